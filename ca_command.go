@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/proxy"
+)
+
+const caUsage = `Usage: mitmcdn [-config config.toml] ca <action> [flags]
+
+Actions:
+  generate [-key-type rsa|ecdsa] [-force]   Create a new root CA at the configured paths
+  show                                      Print CA subject, fingerprint and validity
+  export [--der|--p12] [-o file] [-password pw]
+                                            Write the CA certificate (PEM by default)
+  rotate [-key-type rsa|ecdsa]              Back up the current CA and generate a new one
+`
+
+// runCACommand implements the "mitmcdn ca" subcommand
+func runCACommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(caUsage)
+	}
+
+	certPath, keyPath, err := caPathsFromConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	action, args := args[0], args[1:]
+	switch action {
+	case "generate":
+		return caGenerate(args, stdout, certPath, keyPath)
+	case "show":
+		return caShow(stdout, certPath, keyPath)
+	case "export":
+		return caExport(args, stdout, certPath, keyPath)
+	case "rotate":
+		return caRotate(args, stdout, certPath, keyPath)
+	default:
+		return fmt.Errorf("unknown ca action %q\n\n%s", action, caUsage)
+	}
+}
+
+// caPathsFromConfig resolves the CA paths, falling back to defaults when no config file exists
+func caPathsFromConfig(path string) (string, string, error) {
+	var caCfg config.CAConfig
+	cfg, err := config.LoadConfig(path)
+	if err == nil {
+		caCfg = cfg.CA
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", "", err
+	}
+
+	defaultCert, defaultKey, err := proxy.DefaultCAPaths()
+	if err != nil {
+		return "", "", err
+	}
+	if caCfg.CertPath == "" {
+		caCfg.CertPath = defaultCert
+	}
+	if caCfg.KeyPath == "" {
+		caCfg.KeyPath = defaultKey
+	}
+	return caCfg.CertPath, caCfg.KeyPath, nil
+}
+
+func caGenerate(args []string, stdout io.Writer, certPath, keyPath string) error {
+	flags := flag.NewFlagSet("ca generate", flag.ContinueOnError)
+	keyType := flags.String("key-type", "rsa", "Key algorithm: rsa or ecdsa")
+	force := flags.Bool("force", false, "Overwrite an existing CA")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if !*force {
+		if _, err := os.Stat(certPath); err == nil {
+			return fmt.Errorf("CA certificate already exists at %s (use -force or rotate)", certPath)
+		}
+	}
+
+	ca, err := proxy.CreateCA(certPath, keyPath, *keyType)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA: %w", err)
+	}
+
+	fmt.Fprintf(stdout, "Root CA certificate generated at: %s\n", certPath)
+	fmt.Fprintf(stdout, "SHA-256 fingerprint: %s\n", ca.Fingerprint())
+	return nil
+}
+
+func caShow(stdout io.Writer, certPath, keyPath string) error {
+	ca, err := proxy.LoadCA(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load CA: %w", err)
+	}
+
+	kind := "root"
+	if !ca.IsRoot() {
+		kind = "intermediate"
+	}
+
+	fmt.Fprintf(stdout, "Certificate: %s\n", ca.CertPath)
+	fmt.Fprintf(stdout, "Key:         %s\n", ca.KeyPath)
+	fmt.Fprintf(stdout, "Type:        %s (%s key)\n", kind, ca.Cert.PublicKeyAlgorithm)
+	fmt.Fprintf(stdout, "Subject:     %s\n", ca.Cert.Subject)
+	fmt.Fprintf(stdout, "Issuer:      %s\n", ca.Cert.Issuer)
+	fmt.Fprintf(stdout, "Serial:      %s\n", ca.Cert.SerialNumber.Text(16))
+	fmt.Fprintf(stdout, "Not before:  %s\n", ca.Cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(stdout, "Not after:   %s\n", ca.Cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(stdout, "SHA-256:     %s\n", ca.Fingerprint())
+	if len(ca.Chain) > 1 {
+		fmt.Fprintf(stdout, "Chain:       %d certificates served after each leaf\n", len(ca.Chain))
+	}
+	return nil
+}
+
+func caExport(args []string, stdout io.Writer, certPath, keyPath string) error {
+	flags := flag.NewFlagSet("ca export", flag.ContinueOnError)
+	der := flags.Bool("der", false, "Export the certificate in DER format")
+	p12 := flags.Bool("p12", false, "Export certificate, chain and private key as PKCS#12")
+	password := flags.String("password", "", "Password for the PKCS#12 bundle")
+	output := flags.String("o", "", "Output file (default: stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *der && *p12 {
+		return errors.New("--der and --p12 are mutually exclusive")
+	}
+
+	ca, err := proxy.LoadCA(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load CA: %w", err)
+	}
+
+	var data []byte
+	mode := os.FileMode(0644)
+	switch {
+	case *der:
+		data = ca.CertDER()
+	case *p12:
+		data, err = ca.PKCS12(*password)
+		if err != nil {
+			return fmt.Errorf("failed to encode PKCS#12: %w", err)
+		}
+		mode = 0600
+	default:
+		data = ca.CertPEM()
+	}
+
+	if *output == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, mode)
+}
+
+func caRotate(args []string, stdout io.Writer, certPath, keyPath string) error {
+	flags := flag.NewFlagSet("ca rotate", flag.ContinueOnError)
+	keyType := flags.String("key-type", "rsa", "Key algorithm: rsa or ecdsa")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	suffix := "." + time.Now().Format("20060102-150405") + ".bak"
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, path+suffix); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+		fmt.Fprintf(stdout, "Backed up %s to %s\n", path, path+suffix)
+	}
+
+	return caGenerate([]string{"-key-type", *keyType, "-force"}, stdout, certPath, keyPath)
+}
@@ -3,15 +3,25 @@ module mitmcdn
 go 1.24.0
 
 require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
+	github.com/evanw/esbuild v0.28.1
 	github.com/pelletier/go-toml/v2 v2.1.1
 	github.com/things-go/go-socks5 v0.1.0
+	golang.org/x/crypto v0.47.0
 	golang.org/x/net v0.49.0
 	gorm.io/driver/sqlite v1.5.4
 	gorm.io/gorm v1.25.5
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/mattn/go-sqlite3 v1.14.17 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/text v0.33.0 // indirect
 )
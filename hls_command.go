@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mitmcdn/src/database"
+	"mitmcdn/src/download"
+)
+
+const hlsUsage = `Usage: mitmcdn [-db mitmcdn.db] hls <action> [flags]
+
+Actions:
+  list                                      List cached HLS playlists
+  playlist [-base URL] [-o file] <hash|url> Write the playlist rewritten to the /cache/hls/ URLs
+                                            mitmcdn serves; -base prefixes them, e.g. http://host:8081
+  ts [-o file] <hash|url>                   Join the cached rendition into one MPEG-TS file
+`
+
+// runHLSCommand implements the "mitmcdn hls" subcommand
+func runHLSCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(hlsUsage)
+	}
+
+	db, err := database.InitDB(*dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	packager := download.NewHLSPackager(db)
+
+	action, args := args[0], args[1:]
+	switch action {
+	case "list":
+		var files []database.File
+		if err := db.Where("kind = ? AND (parent_hash = '' OR parent_hash IS NULL)", "hls").
+			Order("last_accessed_at DESC").Find(&files).Error; err != nil {
+			return err
+		}
+		for _, file := range files {
+			fmt.Fprintf(stdout, "%s  %s\n", file.FileHash, file.OriginalURL)
+		}
+		return nil
+	case "playlist":
+		return hlsPlaylist(args, stdout, packager)
+	case "ts":
+		return hlsTS(args, stdout, packager)
+	default:
+		return fmt.Errorf("unknown hls action %q\n\n%s", action, hlsUsage)
+	}
+}
+
+func hlsPlaylist(args []string, stdout io.Writer, packager *download.HLSPackager) error {
+	flags := flag.NewFlagSet("hls playlist", flag.ContinueOnError)
+	base := flags.String("base", "", "URL of the mitmcdn server to prefix /cache/hls/ with")
+	output := flags.String("o", "", "Output file (default: stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(hlsUsage)
+	}
+
+	file, err := packager.FindPlaylist(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	data, err := packager.LocalPlaylist(file, strings.TrimSuffix(*base, "/")+"/cache/hls")
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0644)
+}
+
+func hlsTS(args []string, stdout io.Writer, packager *download.HLSPackager) error {
+	flags := flag.NewFlagSet("hls ts", flag.ContinueOnError)
+	output := flags.String("o", "", "Output file (default: stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(hlsUsage)
+	}
+
+	file, err := packager.FindPlaylist(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	export, err := packager.PrepareTS(file)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = export.WriteTo(stdout)
+		return err
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if _, err := export.WriteTo(out); err != nil {
+		out.Close()
+		os.Remove(*output)
+		return err
+	}
+	return out.Close()
+}
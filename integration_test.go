@@ -907,16 +907,18 @@ func TestCDNRuleMatching(t *testing.T) {
 	defer server.cleanup()
 
 	// Test that httpbin.org matches our CDN rule
+	rules, err := server.config.RuleMatcher()
+	if err != nil {
+		t.Fatalf("RuleMatcher() error = %v", err)
+	}
 	testURL := "https://httpbin.org/get?a=1"
-	rule := server.config.CDNRules[0]
-
-	if !cache.MatchCDNRule(testURL, rule.Domain, rule.MatchPattern) {
+	if rules.MatchURL(testURL, nil) == nil {
 		t.Error("httpbin.org should match CDN rule")
 	}
 
 	// Test that other domain doesn't match
 	testURL2 := "https://other.com/test.html"
-	if cache.MatchCDNRule(testURL2, rule.Domain, rule.MatchPattern) {
+	if rules.MatchURL(testURL2, nil) != nil {
 		t.Error("other.com should not match CDN rule")
 	}
 
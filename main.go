@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -28,6 +29,22 @@ func main() {
 	// Configure log format to include filename and line number
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// Handle subcommands
+	if flag.Arg(0) == "ca" {
+		if err := runCACommand(flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "hls" {
+		if err := runHLSCommand(flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Load configuration
 	cfg, err := config.LoadConfig(*configPath)
 	if err != nil {
@@ -73,6 +90,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize HTML plugins: %v", err)
 	}
+	pluginMaxBodySize, err := config.ParseSize(cfg.Plugins.MaxBodySize)
+	if err != nil {
+		log.Fatalf("Invalid plugins max_body_size: %v", err)
+	}
+	htmlPluginManager.ConfigureMaxBodySize(pluginMaxBodySize)
 
 	// Start servers based on proxy mode
 	ctx, cancel := context.WithCancel(context.Background())
@@ -95,6 +117,7 @@ func main() {
 		log.Printf("  - HTTPS Server: https://%s", cfg.ListenAddress)
 		log.Printf("  - Status API: http://%s/api/status", cfg.ListenAddress)
 		log.Printf("  - Status Page: http://%s/status", cfg.ListenAddress)
+		log.Printf("  - Client Setup: http://%s/mitmcdn/ (or http://mitm.cdn/ via the proxy)", cfg.ListenAddress)
 		if err := unifiedServer.ListenAndServe(cfg.ListenAddress); err != nil {
 			log.Fatalf("Unified server error: %v", err)
 		}
@@ -0,0 +1,208 @@
+/// <reference path="./mitmcdn.d.ts" />
+
+// Rewrites video embeds on matching pages to play from the cache, and starts
+// caching the videos it has not cached yet. Each provider says which elements
+// to look at, how to recognise its videos and how to download them; YouTube,
+// Vimeo and Bilibili iframes and plain <video>/<source> files are built in.
+// A cached video is served on /cache/<provider>/<id>/player (or /video).
+//
+// configs/embed_cache/config.toml:
+//
+//   url_patterns = ["^https://docs\\.example\\.com/"]   # pages to rewrite
+//   yt_dlp_command = ["yt-dlp"]                         # read by mitmcdn itself
+//   download_priority = 90
+//   enabled = ["yt", "vimeo", "bilibili", "video"]      # built-in providers (default: all)
+//
+//   [[formats]]                     # yt-dlp -f for YouTube videos per page, first match wins
+//   pattern = "^https://lectures\\.example/"
+//   format = "bv*[height<=720]+ba/b"
+//
+//   [[providers]]                   # more providers, or replacements for built-in ones
+//   name = "dailymotion"            # the <provider> in /cache/<provider>/<id>/
+//   elements = ["iframe"]           # tags to look at (default: iframe)
+//   attribute = "src"               # attribute holding the video URL (default: src)
+//   pattern = "^https://www\\.dailymotion\\.com/embed/video/(\\w+)"
+//                                   # matched against the absolute URL; the first group is
+//                                   # the video ID, or without one a hash of the URL
+//   fetch_url = "https://www.dailymotion.com/video/{id}"
+//                                   # URL downloaded, with {id} and {url} (default: {url})
+//   downloader = "yt-dlp"           # "http", "yt-dlp" or a [[downloaders]] name (default: http)
+//   target = "player"               # what the URL is pointed at: the "player" page or
+//                                   # the "video" file (default: player)
+
+interface FormatConfig {
+  pattern: string;
+  format: string;
+}
+
+interface ProviderConfig {
+  name: string;
+  elements?: string[];
+  attribute?: string;
+  pattern: string;
+  fetch_url?: string;
+  downloader?: string;
+  target?: string;
+}
+
+interface Config {
+  url_patterns?: string[];
+  download_priority?: number;
+  enabled?: string[];
+  formats?: FormatConfig[];
+  providers?: ProviderConfig[];
+}
+
+interface Provider {
+  name: string;
+  elements: string[];
+  attribute: string;
+  pattern: RegExp;
+  fetchURL: string;
+  downloader: string;
+  target: string;
+}
+
+const BUILT_IN_PROVIDERS: ProviderConfig[] = [
+  {
+    name: "yt",
+    pattern: "^https?://(?:www\\.)?youtube(?:-nocookie)?\\.com/embed/([A-Za-z0-9_-]{6,})",
+    fetch_url: "yt-dlp://{id}",
+    downloader: "yt-dlp",
+  },
+  {
+    name: "vimeo",
+    pattern: "^https?://player\\.vimeo\\.com/video/(\\d+)",
+    fetch_url: "https://vimeo.com/{id}",
+    downloader: "yt-dlp",
+  },
+  {
+    name: "bilibili",
+    pattern: "^https?://player\\.bilibili\\.com/player\\.html\\?(?:.*&)?bvid=(BV[A-Za-z0-9]+)",
+    fetch_url: "https://www.bilibili.com/video/{id}",
+    downloader: "yt-dlp",
+  },
+  {
+    name: "video",
+    elements: ["video", "source"],
+    pattern: "^https?://[^?#]+\\.(?:mp4|m4v|webm|mov)(?:[?#]|$)",
+    target: "video",
+  },
+];
+
+const PROVIDER_NAME_REGEX = /^[a-z0-9_-]+$/;
+const ID_REGEX = /^[A-Za-z0-9_-]+$/;
+
+const config = mitmcdn.config as Config;
+
+if (!config.url_patterns || config.url_patterns.length === 0) {
+  throw new Error("url_patterns cannot be empty");
+}
+const urlPatterns = config.url_patterns.map((pattern) => new RegExp(pattern));
+
+const formats = (config.formats || []).map((f) => {
+  if (!f.format || f.format.trim() === "") {
+    throw new Error(`format for pattern "${f.pattern}" cannot be empty`);
+  }
+  return { pattern: new RegExp(f.pattern), format: f.format };
+});
+
+const downloadPriority = config.download_priority || 90;
+
+function provider(p: ProviderConfig): Provider {
+  if (!p.name || !PROVIDER_NAME_REGEX.test(p.name) || p.name === "hls") {
+    throw new Error(`invalid provider name "${p.name}": use lower-case letters, digits, - and _, other than hls`);
+  }
+  if (!p.pattern) {
+    throw new Error(`provider ${p.name} needs a pattern`);
+  }
+  const target = p.target || "player";
+  if (target !== "player" && target !== "video") {
+    throw new Error(`provider ${p.name}: target must be "player" or "video"`);
+  }
+  return {
+    name: p.name,
+    elements: (p.elements || ["iframe"]).map((tag) => tag.toLowerCase()),
+    attribute: (p.attribute || "src").toLowerCase(),
+    pattern: new RegExp(p.pattern, "i"),
+    fetchURL: p.fetch_url || "{url}",
+    downloader: p.downloader || "http",
+    target,
+  };
+}
+
+const enabled = config.enabled || BUILT_IN_PROVIDERS.map((p) => p.name);
+const definitions = new Map<string, ProviderConfig>();
+for (const name of enabled) {
+  const builtIn = BUILT_IN_PROVIDERS.find((p) => p.name === name);
+  if (!builtIn) {
+    throw new Error(`unknown built-in provider "${name}"`);
+  }
+  definitions.set(name, builtIn);
+}
+for (const p of config.providers || []) {
+  definitions.set(p.name, p);
+}
+const providers = Array.from(definitions.values()).map(provider);
+if (providers.length === 0) {
+  throw new Error("no providers enabled");
+}
+
+export const elements = Array.from(new Set(providers.flatMap((p) => p.elements)));
+
+// The /cache/<provider>/ paths mitmcdn answers itself rather than forwarding
+export const embedProviders = providers.map((p) => p.name);
+
+// formatFor returns the yt-dlp format selector for videos on pageURL, or "" for yt-dlp's default
+function formatFor(pageURL: string): string {
+  for (const f of formats) {
+    if (f.pattern.test(pageURL)) {
+      return f.format;
+    }
+  }
+  return "";
+}
+
+// filenameFor names the cache file after the downloaded file when it has an extension
+function filenameFor(fetchURL: string, id: string): string {
+  const name = fetchURL.replace(/[?#].*$/, "").split("/").pop() || "";
+  return /\.[A-Za-z0-9]+$/.test(name) ? name : `${id}.mp4`;
+}
+
+export function transformElement(element: PageElement, page: Page): ElementChanges | undefined {
+  if (!urlPatterns.some((pattern) => pattern.test(page.url))) {
+    return undefined;
+  }
+
+  for (const p of providers) {
+    const value = element.attributes[p.attribute];
+    if (!p.elements.includes(element.tag) || !value) {
+      continue;
+    }
+    const src = mitmcdn.resolveURL(value.trim(), page.url) || value;
+    const match = p.pattern.exec(src);
+    if (!match) {
+      continue;
+    }
+    const id = match[1] !== undefined && ID_REGEX.test(match[1]) ? match[1] : mitmcdn.hash(src);
+
+    let fetchURL = p.fetchURL.replace(/\{id\}/g, id).replace(/\{url\}/g, src);
+    // The entry stays keyed on the provider and ID; a yt-dlp:// URL carries
+    // the format selector along to the scheduler
+    const format = formatFor(page.url);
+    if (format && fetchURL.startsWith("yt-dlp://")) {
+      fetchURL += `?format=${encodeURIComponent(format)}`;
+    }
+    const status = mitmcdn.download(mitmcdn.embedURL(p.name, id), {
+      filename: filenameFor(fetchURL, id),
+      priority: downloadPriority,
+      fetchURL,
+      downloader: p.downloader,
+    });
+    if (status !== "complete") {
+      return undefined;
+    }
+    return { attributes: { [p.attribute]: `/cache/${p.name}/${id}/${p.target}` } };
+  }
+  return undefined;
+}
@@ -0,0 +1,148 @@
+/// <reference path="./mitmcdn.d.ts" />
+
+// Points the links of pages browsed through the URL-path reverse proxy
+// (/https://host/...) back at the proxy, so clicks, subresources and
+// redirects stay on it and get cached by its rules. href, src, srcset and
+// similar attributes, CSS url() and @import in stylesheets, <style> and style
+// attributes, <base>, <meta http-equiv="refresh"> and Location headers are
+// rewritten to /<scheme>://host/... form. Relative paths already resolve
+// against the proxied page and are left alone. Pages served any other way
+// are not touched.
+//
+// configs/link_rewrite/config.toml (optional):
+//
+//   hosts = ["(^|\\.)example\\.com$"]   # only rewrite links to matching hosts (default: all)
+
+interface Config {
+  hosts?: string[];
+}
+
+// Attributes holding a single URL, on whatever element they appear
+const URL_ATTRIBUTES = ["href", "src", "action", "formaction", "poster", "background", "manifest"];
+
+// Attributes holding comma-separated "url descriptor" candidates
+const SRCSET_ATTRIBUTES = ["srcset", "imagesrcset"];
+
+const CSS_URL_REGEX = /url\(\s*(['"]?)([^'")\s]+)\1\s*\)/gi;
+const CSS_IMPORT_REGEX = /@import\s+(['"])([^'"]+)\1/gi;
+const SCHEME_REGEX = /^[a-z][a-z0-9+.-]*:/i;
+const PROXIED_REGEX = /^\/https?:\/\//i;
+const HOST_REGEX = /^https?:\/\/(?:[^@/?#]*@)?(\[[^\]]*\]|[^:/?#]*)/i;
+
+const config = mitmcdn.config as Config;
+const hosts = (config.hosts || []).map((pattern) => new RegExp(pattern, "i"));
+
+export const urlPathOnly = true;
+
+export const elements = ["*"];
+
+export const contentTypes = ["text/css"];
+
+// proxied returns ref, found in a document at base, in /<scheme>://host/...
+// form, or undefined when it should stay as it is
+function proxied(ref: string, base: string): string | undefined {
+  const value = ref.trim();
+  if (value === "" || value.startsWith("#") || PROXIED_REGEX.test(value)) {
+    return undefined;
+  }
+  if (SCHEME_REGEX.test(value) ? !/^https?:/i.test(value) : !value.startsWith("/")) {
+    // data:, javascript:, mailto: and the like, or a relative path
+    return undefined;
+  }
+  const absolute = mitmcdn.resolveURL(value, base);
+  const host = HOST_REGEX.exec(absolute);
+  if (!host || host[1] === "") {
+    return undefined;
+  }
+  if (hosts.length > 0 && !hosts.some((pattern) => pattern.test(host[1]))) {
+    return undefined;
+  }
+  return "/" + absolute;
+}
+
+function rewriteSrcset(srcset: string, base: string): string {
+  return srcset
+    .split(",")
+    .map((candidate) => {
+      const match = /^(\s*)(\S+)([\s\S]*)$/.exec(candidate);
+      const rewritten = match ? proxied(match[2], base) : undefined;
+      return rewritten === undefined ? candidate : match![1] + rewritten + match![3];
+    })
+    .join(",");
+}
+
+function rewriteCSS(css: string, base: string): string {
+  return css
+    .replace(CSS_URL_REGEX, (match, quote: string, ref: string) => {
+      const rewritten = proxied(ref, base);
+      return rewritten === undefined ? match : `url(${quote}${rewritten}${quote})`;
+    })
+    .replace(CSS_IMPORT_REGEX, (match, quote: string, ref: string) => {
+      const rewritten = proxied(ref, base);
+      return rewritten === undefined ? match : `@import ${quote}${rewritten}${quote}`;
+    });
+}
+
+// rewriteRefresh rewrites the URL of a <meta http-equiv="refresh"> content, "5; url=/next"
+function rewriteRefresh(content: string, base: string): string {
+  return content.replace(/^(\s*\d*\.?\d*\s*[;,]\s*(?:url\s*=\s*)?)(['"]?)(.+?)\2(\s*)$/i, (match, prefix: string, quote: string, ref: string, rest: string) => {
+    const rewritten = proxied(ref, base);
+    return rewritten === undefined ? match : prefix + quote + rewritten + quote + rest;
+  });
+}
+
+export function transformElement(element: PageElement): ElementChanges | undefined {
+  const base = element.baseURI;
+  const changes: Record<string, string> = {};
+  let changed = false;
+  const set = (name: string, value: string) => {
+    if (value !== element.attributes[name]) {
+      changes[name] = value;
+      changed = true;
+    }
+  };
+
+  for (const name of URL_ATTRIBUTES) {
+    const value = element.attributes[name];
+    if (value !== undefined) {
+      const rewritten = proxied(value, base);
+      if (rewritten !== undefined) {
+        set(name, rewritten);
+      }
+    }
+  }
+  if (element.tag === "object" && element.attributes.data !== undefined) {
+    const rewritten = proxied(element.attributes.data, base);
+    if (rewritten !== undefined) {
+      set("data", rewritten);
+    }
+  }
+  for (const name of SRCSET_ATTRIBUTES) {
+    if (element.attributes[name] !== undefined) {
+      set(name, rewriteSrcset(element.attributes[name], base));
+    }
+  }
+  if (element.attributes.style !== undefined) {
+    set("style", rewriteCSS(element.attributes.style, base));
+  }
+  if (element.tag === "meta" && (element.attributes["http-equiv"] || "").toLowerCase() === "refresh" && element.attributes.content) {
+    set("content", rewriteRefresh(element.attributes.content, base));
+  }
+
+  return changed ? { attributes: changes } : undefined;
+}
+
+// transformBody rewrites stylesheets and the contents of <style> elements
+export function transformBody(body: string, response: BodyInfo): string | undefined {
+  const rewritten = rewriteCSS(body, response.url);
+  return rewritten === body ? undefined : rewritten;
+}
+
+export function onResponse(response: PluginResponse): HeaderChanges | undefined {
+  const location = response.headers["Location"];
+  if (response.status < 300 || response.status >= 400 || !location) {
+    return undefined;
+  }
+  const rewritten = proxied(location, response.url);
+  return rewritten === undefined ? undefined : { headers: { Location: rewritten } };
+}
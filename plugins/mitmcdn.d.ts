@@ -0,0 +1,114 @@
+// Host API mitmcdn exposes to plugins as the global `mitmcdn`.
+//
+// A plugin is a module in plugins/<name>.ts exporting any of these hooks:
+//
+//   transformElement(element: PageElement, page: Page): string | ElementChanges | void
+//     rewrites start tags of the elements listed in the exported
+//     `elements: string[]` ("iframe", "video", "*" for all) as HTML pages
+//     stream through; a string replaces the tag
+//   transform(html: string, page: Page): string | { html: string } | void
+//     rewrites whole HTML pages; prefer transformElement, as pages are held
+//     in memory for this hook
+//   onRequest(request: PluginRequest): RequestChanges | void
+//     rewrites requests sent upstream, forwarded or downloaded
+//   onResponse(response: PluginResponse): HeaderChanges | void
+//     sees, and may edit, the header of every response sent to a client
+//   transformBody(body: string, response: BodyInfo): string | { body: string } | void
+//     rewrites bodies of the content types listed in the exported
+//     `contentTypes: string[]` ("application/json", "text/*", ...)
+//   shouldCache(request: PluginRequest): boolean | void
+//     overrides the CDN rules' decision to cache a request
+//
+// A CSS transformBody also rewrites the contents of <style> elements. With
+// `export const urlPathOnly = true` the hooks only run for requests made
+// through the URL-path reverse proxy (/https://host/...). Plugins caching
+// videos under mitmcdn.embedURL(provider, id) export the provider names as
+// `embedProviders`, so that mitmcdn serves /cache/<provider>/<id>/ for them.
+//
+// Returning nothing leaves things as they are. The module runs without file
+// or network access; configs/<name>/config.toml is available as
+// mitmcdn.config.
+
+interface Page {
+  /** URL of the page being rewritten */
+  url: string;
+}
+
+interface PageElement {
+  /** Lower-case tag name */
+  tag: string;
+  /** Attributes in document order, values unescaped */
+  attributes: Record<string, string>;
+  /** URL the element's relative URLs resolve against: the page URL, or its <base href> once seen */
+  baseURI: string;
+}
+
+interface ElementChanges {
+  /** Tag name to use instead */
+  tag?: string;
+  /** Attributes to set; null removes one */
+  attributes?: Record<string, string | null>;
+}
+
+interface PluginRequest {
+  method: string;
+  url: string;
+  /** Request headers by canonical name ("Content-Type"), repeated ones joined by ", " */
+  headers: Record<string, string>;
+}
+
+interface PluginResponse {
+  url: string;
+  status: number;
+  /** Response headers by canonical name, repeated ones joined by ", " */
+  headers: Record<string, string>;
+}
+
+interface BodyInfo {
+  url: string;
+  contentType: string;
+}
+
+interface HeaderChanges {
+  /** Headers to set; null removes one */
+  headers?: Record<string, string | null>;
+}
+
+interface RequestChanges extends HeaderChanges {
+  /** URL to send the request to instead */
+  url?: string;
+}
+
+interface DownloadOptions {
+  /** File name recorded for the cache entry; defaults to the last path segment of the URL */
+  filename?: string;
+  /** Scheduler priority; defaults to 90 */
+  priority?: number;
+  /** URL actually downloaded, when it differs from the URL the entry is cached under */
+  fetchURL?: string;
+  /** Downloader to use ("http", "yt-dlp" or a configured one) instead of the one fetchURL routes to */
+  downloader?: string;
+}
+
+declare namespace mitmcdn {
+  /** The plugin's config.toml, or an empty object when it has none */
+  const config: Record<string, any>;
+
+  /** Cache status of url: "complete", "downloading", "pending", "failed", or "" when not cached */
+  function cacheStatus(url: string): string;
+
+  /** Starts caching url unless it is already cached or downloading, and returns its status */
+  function download(url: string, options?: DownloadOptions): string;
+
+  /** URL a video served on /cache/<provider>/<id>/ is cached under, for cacheStatus and download */
+  function embedURL(provider: string, id: string): string;
+
+  /** ref resolved against the absolute URL base, or "" when either is invalid */
+  function resolveURL(ref: string, base: string): string;
+
+  /** Short hex digest of text, for building IDs out of URLs */
+  function hash(text: string): string;
+
+  /** Writes a line to the server log */
+  function log(...args: unknown[]): void;
+}
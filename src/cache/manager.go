@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -93,56 +92,39 @@ func (m *Manager) ComputeFileHash(url, cookie, strategy string) string {
 
 // GetOrCreateFile gets existing file or creates a new entry
 func (m *Manager) GetOrCreateFile(url, cookie, filename, strategy string) (*database.File, error) {
-	fileHash := m.ComputeFileHash(url, cookie, strategy)
-
-	var file database.File
-	err := m.db.Where("file_hash = ?", fileHash).First(&file).Error
-	if err == nil {
-		// Update last accessed time
-		file.LastAccessedAt = time.Now()
-		m.db.Save(&file)
-		return &file, nil
-	}
-
-	if err != gorm.ErrRecordNotFound {
-		return nil, err
-	}
-
-	// Create new file entry
-	file = database.File{
-		FileHash:       fileHash,
-		OriginalURL:    url,
-		RequestCookie:  cookie,
-		Filename:       filename,
-		FileSize:       0, // Unknown initially
-		SavedPath:      filepath.Join(m.cacheDir, fileHash),
-		DownloadStatus: "pending",
-		LastAccessedAt: time.Now(),
-	}
-
-	if err := m.db.Create(&file).Error; err != nil {
-		return nil, err
-	}
-
-	return &file, nil
+	return m.getOrCreate(m.newFile(m.ComputeFileHash(url, cookie, strategy), url, filename, RequestKey{Cookie: cookie}))
 }
 
-// MatchCDNRule checks if URL matches any CDN rule
-func MatchCDNRule(url string, domain, pattern string) bool {
-	// Check domain
-	if !strings.Contains(url, domain) {
-		return false
+// SetRequestedBy attributes a file to the proxy user who first requested it
+func (m *Manager) SetRequestedBy(file *database.File, username string) error {
+	if username == "" || file.RequestedBy != "" {
+		return nil
 	}
+	file.RequestedBy = username
+	return m.db.Model(file).Update("requested_by", username).Error
+}
 
-	// Check pattern if provided
-	if pattern != "" {
-		matched, err := regexp.MatchString(pattern, url)
-		if err != nil || !matched {
-			return false
-		}
-	}
+// PrefetchProgress summarises the segments cached for a playlist entry
+type PrefetchProgress struct {
+	Segments   int64
+	Complete   int64
+	Failed     int64
+	Size       int64
+	Downloaded int64
+}
 
-	return true
+// PrefetchProgress sums up the non-playlist entries linked to a root playlist entry
+func (m *Manager) PrefetchProgress(parentHash string) (PrefetchProgress, error) {
+	var progress PrefetchProgress
+	err := m.db.Model(&database.File{}).
+		Where("parent_hash = ? AND (kind = '' OR kind IS NULL)", parentHash).
+		Select(`COUNT(*) AS segments,
+			COALESCE(SUM(CASE WHEN download_status = 'complete' THEN 1 ELSE 0 END), 0) AS complete,
+			COALESCE(SUM(CASE WHEN download_status = 'failed' THEN 1 ELSE 0 END), 0) AS failed,
+			COALESCE(SUM(file_size), 0) AS size,
+			COALESCE(SUM(downloaded_bytes), 0) AS downloaded`).
+		Scan(&progress).Error
+	return progress, err
 }
 
 // CleanupExpiredFiles removes files older than TTL
@@ -155,13 +137,23 @@ func (m *Manager) CleanupExpiredFiles() error {
 	}
 
 	for _, file := range files {
-		os.Remove(file.SavedPath)
+		removeCachedFiles(&file)
 		m.db.Delete(&file)
 	}
 
 	return nil
 }
 
+// removeCachedFiles deletes a cache entry's file and the files saved beside
+// it, such as a video's thumbnail and subtitles
+func removeCachedFiles(file *database.File) {
+	os.Remove(file.SavedPath)
+	sidecars, _ := filepath.Glob(file.SavedPath + ".*")
+	for _, sidecar := range sidecars {
+		os.Remove(sidecar)
+	}
+}
+
 // LRUEvict removes least recently used files when cache is full
 func (m *Manager) LRUEvict(targetSize int64) error {
 	var totalSize int64
@@ -190,7 +182,7 @@ func (m *Manager) LRUEvict(targetSize int64) error {
 		if file.DownloadStatus == "complete" {
 			info, err := os.Stat(file.SavedPath)
 			if err == nil {
-				os.Remove(file.SavedPath)
+				removeCachedFiles(&file)
 				totalSize -= info.Size()
 				m.db.Delete(&file)
 			}
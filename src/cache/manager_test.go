@@ -89,54 +89,6 @@ func TestComputeFileHash(t *testing.T) {
 	}
 }
 
-func TestMatchCDNRule(t *testing.T) {
-	tests := []struct {
-		name    string
-		url     string
-		domain  string
-		pattern string
-		want    bool
-	}{
-		{
-			name:    "matches domain and pattern",
-			url:     "https://cdn.httpbin.org/video.mp4",
-			domain:  "cdn.httpbin.org",
-			pattern: "\\.mp4$",
-			want:    true,
-		},
-		{
-			name:    "matches domain but not pattern",
-			url:     "https://cdn.httpbin.org/page.html",
-			domain:  "cdn.httpbin.org",
-			pattern: "\\.mp4$",
-			want:    false,
-		},
-		{
-			name:    "does not match domain",
-			url:     "https://other.com/video.mp4",
-			domain:  "cdn.httpbin.org",
-			pattern: "\\.mp4$",
-			want:    false,
-		},
-		{
-			name:    "matches domain without pattern",
-			url:     "https://cdn.httpbin.org/anyfile",
-			domain:  "cdn.httpbin.org",
-			pattern: "",
-			want:    true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := MatchCDNRule(tt.url, tt.domain, tt.pattern)
-			if got != tt.want {
-				t.Errorf("MatchCDNRule() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func TestNewManager(t *testing.T) {
 	db := setupTestDB(t)
 	tmpDir := t.TempDir()
@@ -232,3 +184,25 @@ func TestGetOrCreateFileDifferentStrategies(t *testing.T) {
 		t.Error("full_url strategy should produce different hash for different URLs")
 	}
 }
+
+func TestFindFile(t *testing.T) {
+	db := setupTestDB(t)
+	mgr, err := NewManager(db, t.TempDir(), 1024*1024, 10*1024*1024, 3600)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	url := "https://cdn.com/video.mp4"
+	if file, err := mgr.FindFile(url, "full_url", RequestKey{}); err != nil || file != nil {
+		t.Fatalf("FindFile() before creation = %v, %v; want nil, nil", file, err)
+	}
+
+	created, err := mgr.GetOrCreateFile(url, "", "video.mp4", "full_url")
+	if err != nil {
+		t.Fatalf("GetOrCreateFile() error = %v", err)
+	}
+	found, err := mgr.FindFile(url, "full_url", RequestKey{})
+	if err != nil || found == nil || found.ID != created.ID {
+		t.Fatalf("FindFile() = %v, %v; want the created entry", found, err)
+	}
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"mitmcdn/src/database"
+
+	"gorm.io/gorm"
+)
+
+// ErrVaryAll is returned for URLs whose origin answered with "Vary: *"; such a
+// response cannot be reused, so the request should go upstream
+var ErrVaryAll = errors.New("origin response varies on every request")
+
+// RequestKey is the request-dependent part of a cache lookup
+type RequestKey struct {
+	Cookie  string      // Cookie header sent upstream when downloading
+	Key     string      // material that separates entries, see config.CDNRule.CacheKey
+	Headers http.Header // other request headers sent upstream when downloading
+}
+
+// Header returns the headers a download for this key is made with, Cookie included
+func (k RequestKey) Header() http.Header {
+	header := k.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if k.Cookie != "" {
+		header.Set("Cookie", k.Cookie)
+	}
+	return header
+}
+
+// NormalizeVary returns the header names of a Vary value canonicalised, sorted
+// and de-duplicated, or "*" if any of them is "*"
+func NormalizeVary(values []string) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return "*"
+			}
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// VaryValues returns what header holds for the names in a normalised Vary value
+func VaryValues(vary string, header http.Header) string {
+	if vary == "" {
+		return ""
+	}
+	names := strings.Split(vary, ", ")
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + ": " + strings.Join(header.Values(name), ", ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// GetOrCreateFileForRequest is GetOrCreateFile keyed by a request. Once the
+// origin has answered with a Vary header, a request whose values for those
+// headers differ from the ones the entry was downloaded with gets an entry of
+// its own.
+func (m *Manager) GetOrCreateFileForRequest(url, filename, strategy string, key RequestKey) (*database.File, error) {
+	return m.lookupVariant(url, filename, strategy, key, true)
+}
+
+// FindFile returns the entry a request would be served from without creating one, or nil if there is none
+func (m *Manager) FindFile(url, strategy string, key RequestKey) (*database.File, error) {
+	return m.lookupVariant(url, "", strategy, key, false)
+}
+
+func (m *Manager) lookupVariant(url, filename, strategy string, key RequestKey, create bool) (*database.File, error) {
+	primaryHash := m.ComputeFileHash(url, key.Key, strategy)
+	primary, err := m.findByHash(primaryHash)
+	if err != nil {
+		return nil, err
+	}
+	if primary == nil {
+		if !create {
+			return nil, nil
+		}
+		return m.getOrCreate(m.newFile(primaryHash, url, filename, key))
+	}
+
+	switch primary.Vary {
+	case "":
+		return m.touch(primary, create), nil
+	case "*":
+		return nil, ErrVaryAll
+	}
+	values := VaryValues(primary.Vary, key.Header())
+	if values == primary.VaryValues {
+		return m.touch(primary, create), nil
+	}
+
+	hash := sha256.Sum256([]byte(primaryHash + "|" + values))
+	variantHash := hex.EncodeToString(hash[:])
+	if !create {
+		return m.findByHash(variantHash)
+	}
+	variant := m.newFile(variantHash, url, filename, key)
+	variant.Vary, variant.VaryValues = primary.Vary, values
+	return m.getOrCreate(variant)
+}
+
+// findByHash returns the entry with fileHash, or nil if there is none
+func (m *Manager) findByHash(fileHash string) (*database.File, error) {
+	var file database.File
+	err := m.db.Where("file_hash = ?", fileHash).First(&file).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// touch records an access to file when it is about to be served
+func (m *Manager) touch(file *database.File, access bool) *database.File {
+	if access {
+		file.LastAccessedAt = time.Now()
+		m.db.Save(file)
+	}
+	return file
+}
+
+func (m *Manager) newFile(fileHash, url, filename string, key RequestKey) database.File {
+	file := database.File{
+		FileHash:       fileHash,
+		OriginalURL:    url,
+		RequestCookie:  key.Cookie,
+		Filename:       filename,
+		FileSize:       0, // Unknown initially
+		SavedPath:      filepath.Join(m.cacheDir, fileHash),
+		DownloadStatus: "pending",
+		LastAccessedAt: time.Now(),
+	}
+	if len(key.Headers) > 0 {
+		if encoded, err := json.Marshal(key.Headers); err == nil {
+			file.RequestHeaders = string(encoded)
+		}
+	}
+	return file
+}
+
+// getOrCreate returns the entry with file's hash, creating it from file if there is none
+func (m *Manager) getOrCreate(file database.File) (*database.File, error) {
+	existing, err := m.findByHash(file.FileHash)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return m.touch(existing, true), nil
+	}
+	if err := m.db.Create(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeVary(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"accept-encoding"}, "Accept-Encoding"},
+		{[]string{"Accept-Language, accept-encoding", "Accept-Encoding"}, "Accept-Encoding, Accept-Language"},
+		{[]string{"Accept-Encoding, *"}, "*"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeVary(tt.values); got != tt.want {
+			t.Errorf("NormalizeVary(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestGetOrCreateFileForRequestVariants(t *testing.T) {
+	db := setupTestDB(t)
+	mgr, err := NewManager(db, t.TempDir(), 1024*1024, 10*1024*1024, 3600)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	url := "https://cdn.com/page.json"
+	english := RequestKey{Headers: http.Header{"Accept-Language": {"en"}}}
+	german := RequestKey{Headers: http.Header{"Accept-Language": {"de"}}}
+
+	primary, err := mgr.GetOrCreateFileForRequest(url, "page.json", "full_url", english)
+	if err != nil {
+		t.Fatalf("GetOrCreateFileForRequest() error = %v", err)
+	}
+	if primary.RequestHeaders == "" {
+		t.Error("request headers should be stored for the download")
+	}
+
+	// Until the origin's Vary is known every request shares the entry
+	if same, _ := mgr.GetOrCreateFileForRequest(url, "page.json", "full_url", german); same.ID != primary.ID {
+		t.Fatal("requests should share the entry before Vary is known")
+	}
+
+	// The download recorded the origin's Vary for the English request
+	db.Model(primary).Updates(map[string]interface{}{
+		"vary":        "Accept-Language",
+		"vary_values": VaryValues("Accept-Language", english.Header()),
+	})
+
+	if same, _ := mgr.GetOrCreateFileForRequest(url, "page.json", "full_url", english); same.ID != primary.ID {
+		t.Error("a matching request should use the primary entry")
+	}
+	if found, _ := mgr.FindFile(url, "full_url", german); found != nil {
+		t.Error("FindFile() should not find a variant that was never created")
+	}
+	variant, err := mgr.GetOrCreateFileForRequest(url, "page.json", "full_url", german)
+	if err != nil {
+		t.Fatalf("GetOrCreateFileForRequest() error = %v", err)
+	}
+	if variant.ID == primary.ID || variant.Vary != "Accept-Language" || variant.SavedPath == primary.SavedPath {
+		t.Fatalf("German request should get its own entry: %+v", variant)
+	}
+	if found, _ := mgr.FindFile(url, "full_url", german); found == nil || found.ID != variant.ID {
+		t.Error("FindFile() should find the German variant")
+	}
+
+	db.Model(primary).Update("vary", "*")
+	if _, err := mgr.GetOrCreateFileForRequest(url, "page.json", "full_url", english); !errors.Is(err, ErrVaryAll) {
+		t.Errorf("Vary: * error = %v, want ErrVaryAll", err)
+	}
+}
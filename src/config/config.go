@@ -3,18 +3,48 @@ package config
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
 type Config struct {
-	ListenAddress string      `toml:"listen_address"`
-	ProxyMode     string      `toml:"proxy_mode"` // http, socks5, url_path, or all
-	UpstreamProxy string      `toml:"upstream_proxy"`
-	AssetsDir     string      `toml:"assets_dir"` // Fallback assets directory
-	Cache         CacheConfig `toml:"cache"`
-	CDNRules      []CDNRule   `toml:"cdn_rules"`
+	ListenAddress string             `toml:"listen_address"`
+	ProxyMode     string             `toml:"proxy_mode"` // http, socks5, url_path, all, or transparent
+	UpstreamProxy string             `toml:"upstream_proxy"`
+	AssetsDir     string             `toml:"assets_dir"` // Fallback assets directory
+	Cache         CacheConfig        `toml:"cache"`
+	CA            CAConfig           `toml:"ca"`
+	PAC           PACConfig          `toml:"pac"`
+	Tunnel        TunnelConfig       `toml:"tunnel"`
+	Resolver      ResolverConfig     `toml:"resolver"`
+	SNIRouting    SNIRoutingConfig   `toml:"sni_routing"`
+	DNS           DNSConfig          `toml:"dns"`
+	Streaming     StreamingConfig    `toml:"streaming"`
+	Plugins       PluginsConfig      `toml:"plugins"`
+	Users         []UserConfig       `toml:"users"`
+	Downloaders   []DownloaderConfig `toml:"downloaders"`
+	CDNRules      []CDNRule          `toml:"cdn_rules"`
+
+	ruleMatcher *RuleMatcher // compiled CDNRules, set by LoadConfig
+}
+
+// RuleMatcher returns the compiled CDN rules. A config loaded from a file
+// returns the matcher compiled at load; one built in code compiles it now.
+func (c *Config) RuleMatcher() (*RuleMatcher, error) {
+	if c.ruleMatcher != nil {
+		return c.ruleMatcher, nil
+	}
+	return NewRuleMatcher(c.CDNRules)
+}
+
+// CAConfig locates the CA used to sign MITM certificates.
+// Empty paths fall back to ~/.mitmproxy/mitmproxy-ca-{cert,key}.pem.
+type CAConfig struct {
+	CertPath string `toml:"cert_path"` // PEM certificate, optionally followed by its issuer chain
+	KeyPath  string `toml:"key_path"`  // PEM private key (PKCS#1, PKCS#8 or EC)
 }
 
 type CacheConfig struct {
@@ -24,11 +54,120 @@ type CacheConfig struct {
 	TTL          string `toml:"ttl"`
 }
 
+// PACConfig controls the generated /proxy.pac and /wpad.dat files.
+// Hosts matching a CDN rule domain or ExtraDomains are sent to the proxy,
+// ExcludeDomains and everything else go DIRECT.
+type PACConfig struct {
+	ProxyAddress   string   `toml:"proxy_address"`   // host:port advertised to clients; defaults to the address the PAC was fetched from
+	ProxyTypes     []string `toml:"proxy_types"`     // PROXY, HTTPS, SOCKS5 or SOCKS, tried in order; defaults to PROXY
+	ExtraDomains   []string `toml:"extra_domains"`   // additional domains to route through the proxy
+	ExcludeDomains []string `toml:"exclude_domains"` // domains that always go DIRECT
+	FallbackDirect bool     `toml:"fallback_direct"` // append DIRECT so clients bypass the proxy when it is down
+}
+
+// TunnelConfig controls connections that are passed through without interception.
+// Allow and Deny entries are hostnames ("example.com" also matches subdomains,
+// "*.example.com" only subdomains), IPs or CIDRs, optionally suffixed with ":port".
+// Deny wins over Allow; an empty Allow list permits every destination not denied.
+type TunnelConfig struct {
+	ConnectTimeout  string   `toml:"connect_timeout"`   // dial timeout for direct tunnels, e.g. "10s"
+	UDPIdleTimeout  string   `toml:"udp_idle_timeout"`  // SOCKS5 UDP ASSOCIATE ends after this long without datagrams
+	BindIdleTimeout string   `toml:"bind_idle_timeout"` // SOCKS5 BIND wait for the inbound connection and idle limit once relayed
+	Allow           []string `toml:"allow"`
+	Deny            []string `toml:"deny"`
+}
+
+// ResolverConfig controls how origin hostnames are resolved. It is needed when
+// DNS for a CDN hostname points at mitmcdn itself, so the real origin is reached.
+type ResolverConfig struct {
+	Upstream      string            `toml:"upstream"`       // "1.1.1.1[:53]", "tcp://1.1.1.1", "tls://1.1.1.1" (DoT) or "https://1.1.1.1/dns-query" (DoH); empty uses the system resolver
+	ServerName    string            `toml:"server_name"`    // TLS name verified for DoT/DoH; defaults to the upstream host
+	CACertPath    string            `toml:"ca_cert_path"`   // extra PEM roots trusted for DoT/DoH
+	Timeout       string            `toml:"timeout"`        // per-query timeout
+	FallbackDelay string            `toml:"fallback_delay"` // happy eyeballs delay before dialing the next address
+	Hosts         map[string]string `toml:"hosts"`          // static hostname -> IP overrides, checked first
+}
+
+// SNIRoutingConfig controls TLS connections made directly to the listener.
+// A CDN rule SNI is served as a MITM'd request for that origin, LocalNames are
+// handled by mitmcdn itself and any other SNI is tunnelled to its origin.
+type SNIRoutingConfig struct {
+	Enabled    bool     `toml:"enabled"`
+	LocalNames []string `toml:"local_names"` // names (and their subdomains) served locally, e.g. status page and URL-path mode
+	OriginPort int      `toml:"origin_port"` // port used to reach origins; defaults to 443
+}
+
+// DNSConfig controls the optional built-in DNS server. Names matching a CDN rule
+// domain are answered with AnswerAddresses; every other query is forwarded upstream.
+type DNSConfig struct {
+	Enabled         bool     `toml:"enabled"`
+	ListenAddress   string   `toml:"listen_address"`   // UDP and TCP; defaults to 0.0.0.0:53
+	AnswerAddresses []string `toml:"answer_addresses"` // IPv4/IPv6 addresses of mitmcdn; defaults to the listen_address host
+	Upstream        string   `toml:"upstream"`         // defaults to resolver.upstream
+	TTL             int      `toml:"ttl"`              // TTL of local answers in seconds; defaults to 60
+	CacheSize       int      `toml:"cache_size"`       // forwarded responses kept in memory; defaults to 1000
+	QueryLogSize    int      `toml:"query_log_size"`   // recent queries shown on the status page; defaults to 100
+	LogQueries      bool     `toml:"log_queries"`      // also write every query to the log
+}
+
+// StreamingConfig controls HLS playlists and DASH manifests passing through a CDN rule. Playlists
+// are cached briefly and revalidated; the segments they list are queued as
+// low-priority downloads so the whole rendition ends up in the cache.
+type StreamingConfig struct {
+	DisablePrefetch bool   `toml:"disable_prefetch"` // only cache segments clients request
+	TopBitrateOnly  bool   `toml:"top_bitrate_only"` // prefetch only the highest-bandwidth HLS variant or DASH representation
+	PlaylistTTL     string `toml:"playlist_ttl"`     // how long a cached playlist is served before revalidating; defaults to 2s
+	Concurrency     int    `toml:"concurrency"`      // prefetched segments downloaded at once; defaults to 2
+	Priority        int    `toml:"priority"`         // download priority of prefetched segments; defaults to 10
+}
+
+// PluginsConfig tunes how plugins rewrite responses
+type PluginsConfig struct {
+	MaxBodySize string `toml:"max_body_size"` // larger responses pass through untouched; defaults to 8M
+}
+
+// UserConfig is a proxy account. When any users are configured, HTTP proxy
+// (Proxy-Authorization: Basic) and SOCKS5 (RFC 1929) clients must authenticate.
+type UserConfig struct {
+	Username       string   `toml:"username"`
+	PasswordHash   string   `toml:"password_hash"`   // bcrypt hash, e.g. from htpasswd -nbB
+	AllowedRules   []string `toml:"allowed_rules"`   // CDN rule domains cached for this user; empty allows all
+	BandwidthLimit string   `toml:"bandwidth_limit"` // bytes per second sent to the user, e.g. "2M"; empty is unlimited
+	Priority       int      `toml:"priority"`        // download priority for this user's cache misses; defaults to 100
+}
+
+// DownloaderConfig declares an external downloader backend. Cache entries
+// whose URL scheme is listed in Schemes, or that match a CDN rule naming the
+// downloader, are fetched by running Command instead of the built-in HTTP
+// client. The built-in backends are "http" and "yt-dlp".
+type DownloaderConfig struct {
+	Name        string   `toml:"name"`
+	Schemes     []string `toml:"schemes"`      // URL schemes routed to this downloader, e.g. "magnet"
+	Command     []string `toml:"command"`      // argv; {url}, {output}, {dir} and {name} are substituted in each argument
+	Output      string   `toml:"output"`       // "file" (default): the command writes {output}; "dir": the largest file it writes under {dir}; "stdout": its standard output
+	Progress    string   `toml:"progress"`     // regex over output lines with named groups "downloaded" and optionally "total", e.g. sizes like 1.5MiB
+	ContentType string   `toml:"content_type"` // MIME type of the result; sniffed from its content when empty
+}
+
+// CDNRule selects requests to cache. Domain is a name matching the host and
+// its subdomains ("example.com" or ".example.com"), an exact host prefixed with
+// "=" ("=cdn.example.com"), subdomains only ("*.example.com"), a glob within
+// labels ("img-*.example.com") or a host regex prefixed with "~"; any but a
+// regex may end in ":port". See RuleMatcher for the precedence between rules.
 type CDNRule struct {
-	Domain         string `toml:"domain"`
-	MatchPattern   string `toml:"match_pattern"`   // URL regex pattern
-	DedupStrategy  string `toml:"dedup_strategy"`  // full_url or filename_only
-	RequestCookie  string `toml:"request_cookie,omitempty"` // optional cookie for dedup
+	Domain        string `toml:"domain"`
+	MatchPattern  string `toml:"match_pattern"`            // regex on the URL path and query
+	DedupStrategy string `toml:"dedup_strategy"`           // full_url or filename_only
+	RequestCookie string `toml:"request_cookie,omitempty"` // optional cookie for dedup
+
+	RequestHeaders  HeaderRules `toml:"request_headers,omitempty"`  // applied to upstream download requests
+	ResponseHeaders HeaderRules `toml:"response_headers,omitempty"` // applied to responses sent to clients
+	StoreHeaders    []string    `toml:"store_headers,omitempty"`    // origin response headers replayed on cache hits; empty keeps all but hop-by-hop ones
+
+	CacheKeyCookies []string `toml:"cache_key_cookies,omitempty"` // cookies that separate cache entries instead of the whole Cookie header
+	CacheKeyHeaders []string `toml:"cache_key_headers,omitempty"` // request headers that separate cache entries and are sent upstream
+
+	Downloader string `toml:"downloader,omitempty"` // backend fetching this rule's files; defaults to "http"
 }
 
 // LoadConfig loads configuration from a TOML file
@@ -65,6 +204,137 @@ func LoadConfig(path string) (*Config, error) {
 	if config.AssetsDir == "" {
 		config.AssetsDir = "./assets"
 	}
+	if config.Tunnel.ConnectTimeout == "" {
+		config.Tunnel.ConnectTimeout = "10s"
+	}
+	if _, err := time.ParseDuration(config.Tunnel.ConnectTimeout); err != nil {
+		return nil, fmt.Errorf("invalid tunnel connect_timeout: %w", err)
+	}
+	if config.Tunnel.UDPIdleTimeout == "" {
+		config.Tunnel.UDPIdleTimeout = "2m"
+	}
+	if _, err := time.ParseDuration(config.Tunnel.UDPIdleTimeout); err != nil {
+		return nil, fmt.Errorf("invalid tunnel udp_idle_timeout: %w", err)
+	}
+	if config.Tunnel.BindIdleTimeout == "" {
+		config.Tunnel.BindIdleTimeout = "2m"
+	}
+	if _, err := time.ParseDuration(config.Tunnel.BindIdleTimeout); err != nil {
+		return nil, fmt.Errorf("invalid tunnel bind_idle_timeout: %w", err)
+	}
+	if config.Resolver.Timeout == "" {
+		config.Resolver.Timeout = "5s"
+	}
+	if _, err := time.ParseDuration(config.Resolver.Timeout); err != nil {
+		return nil, fmt.Errorf("invalid resolver timeout: %w", err)
+	}
+	if config.Resolver.FallbackDelay == "" {
+		config.Resolver.FallbackDelay = "300ms"
+	}
+	if _, err := time.ParseDuration(config.Resolver.FallbackDelay); err != nil {
+		return nil, fmt.Errorf("invalid resolver fallback_delay: %w", err)
+	}
+	if config.SNIRouting.OriginPort == 0 {
+		config.SNIRouting.OriginPort = 443
+	}
+	if config.DNS.ListenAddress == "" {
+		config.DNS.ListenAddress = "0.0.0.0:53"
+	}
+	if config.DNS.TTL == 0 {
+		config.DNS.TTL = 60
+	}
+	if config.DNS.CacheSize == 0 {
+		config.DNS.CacheSize = 1000
+	}
+	if config.DNS.QueryLogSize == 0 {
+		config.DNS.QueryLogSize = 100
+	}
+	if config.Streaming.PlaylistTTL == "" {
+		config.Streaming.PlaylistTTL = "2s"
+	}
+	if _, err := time.ParseDuration(config.Streaming.PlaylistTTL); err != nil {
+		return nil, fmt.Errorf("invalid streaming playlist_ttl: %w", err)
+	}
+	if config.Streaming.Concurrency == 0 {
+		config.Streaming.Concurrency = 2
+	}
+	if config.Streaming.Priority == 0 {
+		config.Streaming.Priority = 10
+	}
+	if config.Plugins.MaxBodySize == "" {
+		config.Plugins.MaxBodySize = "8M"
+	}
+	if _, err := ParseSize(config.Plugins.MaxBodySize); err != nil {
+		return nil, fmt.Errorf("invalid plugins max_body_size: %w", err)
+	}
+	seenUsers := make(map[string]bool)
+	for i := range config.Users {
+		user := &config.Users[i]
+		if user.Username == "" || user.PasswordHash == "" {
+			return nil, fmt.Errorf("user %d: username and password_hash are required", i+1)
+		}
+		if seenUsers[user.Username] {
+			return nil, fmt.Errorf("duplicate user: %s", user.Username)
+		}
+		seenUsers[user.Username] = true
+		if user.BandwidthLimit != "" {
+			if _, err := ParseSize(user.BandwidthLimit); err != nil {
+				return nil, fmt.Errorf("user %s: invalid bandwidth_limit: %w", user.Username, err)
+			}
+		}
+		if user.Priority == 0 {
+			user.Priority = 100
+		}
+	}
+	downloaders := map[string]bool{"http": true, "yt-dlp": true}
+	for i := range config.Downloaders {
+		downloader := &config.Downloaders[i]
+		if downloader.Name == "" || len(downloader.Command) == 0 {
+			return nil, fmt.Errorf("downloader %d: name and command are required", i+1)
+		}
+		if downloaders[downloader.Name] {
+			return nil, fmt.Errorf("duplicate downloader: %s", downloader.Name)
+		}
+		downloaders[downloader.Name] = true
+		switch downloader.Output {
+		case "":
+			downloader.Output = "file"
+		case "file", "dir", "stdout":
+		default:
+			return nil, fmt.Errorf("downloader %s: invalid output: %s", downloader.Name, downloader.Output)
+		}
+		if downloader.Progress != "" {
+			re, err := regexp.Compile(downloader.Progress)
+			if err != nil {
+				return nil, fmt.Errorf("downloader %s: invalid progress pattern: %w", downloader.Name, err)
+			}
+			if re.SubexpIndex("downloaded") < 0 {
+				return nil, fmt.Errorf("downloader %s: progress pattern needs a (?P<downloaded>...) group", downloader.Name)
+			}
+		}
+	}
+	for _, rule := range config.CDNRules {
+		if rule.Downloader != "" && !downloaders[rule.Downloader] {
+			return nil, fmt.Errorf("cdn rule %s: unknown downloader: %s", rule.Domain, rule.Downloader)
+		}
+	}
+	matcher, err := NewRuleMatcher(config.CDNRules)
+	if err != nil {
+		return nil, err
+	}
+	config.ruleMatcher = matcher
+	if len(config.PAC.ProxyTypes) == 0 {
+		config.PAC.ProxyTypes = []string{"PROXY"}
+	}
+	for i, proxyType := range config.PAC.ProxyTypes {
+		proxyType = strings.ToUpper(strings.TrimSpace(proxyType))
+		switch proxyType {
+		case "PROXY", "HTTPS", "SOCKS", "SOCKS5":
+			config.PAC.ProxyTypes[i] = proxyType
+		default:
+			return nil, fmt.Errorf("invalid pac proxy_types entry: %s", proxyType)
+		}
+	}
 
 	return &config, nil
 }
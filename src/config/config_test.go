@@ -144,6 +144,18 @@ func TestLoadConfigDefaults(t *testing.T) {
 	if cfg.Cache.MaxFileSize != "5G" {
 		t.Errorf("MaxFileSize default = %q, want %q", cfg.Cache.MaxFileSize, "5G")
 	}
+
+	if cfg.Tunnel.UDPIdleTimeout != "2m" || cfg.Tunnel.BindIdleTimeout != "2m" {
+		t.Errorf("SOCKS5 idle timeouts default = %q/%q, want 2m/2m", cfg.Tunnel.UDPIdleTimeout, cfg.Tunnel.BindIdleTimeout)
+	}
+
+	if cfg.Resolver.Timeout != "5s" || cfg.Resolver.FallbackDelay != "300ms" {
+		t.Errorf("resolver timeouts default = %q/%q, want 5s/300ms", cfg.Resolver.Timeout, cfg.Resolver.FallbackDelay)
+	}
+
+	if cfg.Plugins.MaxBodySize != "8M" {
+		t.Errorf("plugins max_body_size default = %q, want %q", cfg.Plugins.MaxBodySize, "8M")
+	}
 }
 
 func TestLoadConfigNotFound(t *testing.T) {
@@ -152,3 +164,136 @@ func TestLoadConfigNotFound(t *testing.T) {
 		t.Error("LoadConfig() should return error for nonexistent file")
 	}
 }
+
+func TestLoadConfigPAC(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-config-pac-*.toml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	configContent := `
+[pac]
+proxy_types = ["proxy", "socks5"]
+extra_domains = ["static.example.com"]
+exclude_domains = ["auth.example.com"]
+fallback_direct = true
+`
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	tmpFile.Close()
+
+	cfg, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if len(cfg.PAC.ProxyTypes) != 2 || cfg.PAC.ProxyTypes[0] != "PROXY" || cfg.PAC.ProxyTypes[1] != "SOCKS5" {
+		t.Errorf("PAC.ProxyTypes = %v, want [PROXY SOCKS5]", cfg.PAC.ProxyTypes)
+	}
+	if !cfg.PAC.FallbackDirect {
+		t.Error("PAC.FallbackDirect should be true")
+	}
+
+	// Invalid proxy type
+	if err := os.WriteFile(tmpFile.Name(), []byte("[pac]\nproxy_types = [\"FTP\"]\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("LoadConfig() should reject unknown PAC proxy types")
+	}
+}
+
+func TestLoadConfigUsers(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-config-users-*.toml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	configContent := `
+[[users]]
+username = "alice"
+password_hash = "$2y$05$abcdefghijklmnopqrstuu5Ah0E2Yf8bXcWZm1c2ZkC1m4bqQ3Ety"
+allowed_rules = ["cdn.example.com"]
+bandwidth_limit = "2M"
+`
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	tmpFile.Close()
+
+	cfg, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(cfg.Users) != 1 || cfg.Users[0].Priority != 100 || cfg.Users[0].AllowedRules[0] != "cdn.example.com" {
+		t.Errorf("Users = %+v", cfg.Users)
+	}
+
+	// Duplicate usernames
+	duplicate := "[[users]]\nusername = \"a\"\npassword_hash = \"x\"\n[[users]]\nusername = \"a\"\npassword_hash = \"y\"\n"
+	if err := os.WriteFile(tmpFile.Name(), []byte(duplicate), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("LoadConfig() should reject duplicate users")
+	}
+
+	// Missing password hash
+	if err := os.WriteFile(tmpFile.Name(), []byte("[[users]]\nusername = \"a\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("LoadConfig() should require password_hash")
+	}
+}
+
+func TestLoadConfigDownloaders(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-config-downloaders-*.toml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	configContent := `
+[[downloaders]]
+name = "aria2c"
+schemes = ["magnet"]
+command = ["aria2c", "-d", "{dir}", "{url}"]
+output = "dir"
+progress = '(?P<downloaded>[0-9.]+[KMG]?i?B)/(?P<total>[0-9.]+[KMG]?i?B)'
+
+[[cdn_rules]]
+domain = "files.example.com"
+dedup_strategy = "full_url"
+downloader = "aria2c"
+`
+	if err := os.WriteFile(tmpFile.Name(), []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(cfg.Downloaders) != 1 || cfg.Downloaders[0].Output != "dir" || cfg.CDNRules[0].Downloader != "aria2c" {
+		t.Errorf("Downloaders = %+v, rules = %+v", cfg.Downloaders, cfg.CDNRules)
+	}
+
+	invalid := map[string]string{
+		"missing command": "[[downloaders]]\nname = \"x\"\n",
+		"builtin name":    "[[downloaders]]\nname = \"http\"\ncommand = [\"x\"]\n",
+		"unknown output":  "[[downloaders]]\nname = \"x\"\ncommand = [\"x\"]\noutput = \"pipe\"\n",
+		"progress group":  "[[downloaders]]\nname = \"x\"\ncommand = [\"x\"]\nprogress = \"([0-9]+)\"\n",
+		"unknown in rule": "[[cdn_rules]]\ndomain = \"a.example\"\ndownloader = \"missing\"\n",
+	}
+	for name, content := range invalid {
+		if err := os.WriteFile(tmpFile.Name(), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("LoadConfig() accepted %s", name)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HeaderRules rewrites a set of HTTP headers. Remove runs first, then Set
+// replaces any existing values and Add appends to them.
+type HeaderRules struct {
+	Set    map[string]string `toml:"set,omitempty"`
+	Add    map[string]string `toml:"add,omitempty"`
+	Remove []string          `toml:"remove,omitempty"`
+}
+
+// transferHeaders describe a single response on the wire and are never
+// stored or rewritten; the proxy computes them for each response itself
+var transferHeaders = map[string]bool{
+	"Connection":          true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// volatileHeaders are left out of the default stored copy of an origin
+// response: they are per-connection, per-client or recomputed on every hit
+var volatileHeaders = map[string]bool{
+	"Accept-Ranges": true,
+	"Age":           true,
+	"Alt-Svc":       true,
+	"Date":          true,
+	"Set-Cookie":    true,
+}
+
+// negotiationHeaders are sent upstream with cached downloads so the origin can
+// pick the variant its Vary header describes
+var negotiationHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// Apply rewrites header in place
+func (h HeaderRules) Apply(header http.Header) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
+
+// validate rejects empty names and headers the proxy manages itself
+func (h HeaderRules) validate() error {
+	names := append([]string(nil), h.Remove...)
+	for name := range h.Set {
+		names = append(names, name)
+	}
+	for name := range h.Add {
+		names = append(names, name)
+	}
+	return validateHeaderNames(names)
+}
+
+func validateHeaderNames(names []string) error {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if canonical == "" {
+			return fmt.Errorf("empty header name")
+		}
+		if transferHeaders[canonical] {
+			return fmt.Errorf("header %s cannot be rewritten or stored", canonical)
+		}
+	}
+	return nil
+}
+
+// StoredHeaders returns the origin response headers to keep with a cached file:
+// those listed in StoreHeaders, or by default every header except the
+// transfer and volatile ones. A nil rule uses the default.
+func (r *CDNRule) StoredHeaders(header http.Header) http.Header {
+	stored := make(http.Header)
+	if r != nil && len(r.StoreHeaders) > 0 {
+		for _, name := range r.StoreHeaders {
+			canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values := header.Values(canonical); len(values) > 0 && !transferHeaders[canonical] {
+				stored[canonical] = append([]string(nil), values...)
+			}
+		}
+		return stored
+	}
+	for name, values := range header {
+		canonical := http.CanonicalHeaderKey(name)
+		if !transferHeaders[canonical] && !volatileHeaders[canonical] {
+			stored[canonical] = append([]string(nil), values...)
+		}
+	}
+	return stored
+}
+
+// CacheKey returns the request material that separates cache entries for
+// this rule: the whole Cookie header, or only the cookies and headers named
+// in CacheKeyCookies and CacheKeyHeaders when either is set
+func (r *CDNRule) CacheKey(header http.Header) string {
+	if r == nil || (len(r.CacheKeyCookies) == 0 && len(r.CacheKeyHeaders) == 0) {
+		return header.Get("Cookie")
+	}
+
+	req := &http.Request{Header: header}
+	var parts []string
+	for _, name := range r.CacheKeyCookies {
+		if cookie, err := req.Cookie(name); err == nil {
+			parts = append(parts, "cookie "+name+"="+cookie.Value)
+		}
+	}
+	for _, name := range r.CacheKeyHeaders {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if values := header.Values(canonical); len(values) > 0 {
+			parts = append(parts, canonical+": "+strings.Join(values, ", "))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// UpstreamHeaders returns the client request headers a download for this rule
+// is made with: the content negotiation headers and those in CacheKeyHeaders.
+// Cookie is left out; it travels separately.
+func (r *CDNRule) UpstreamHeaders(header http.Header) http.Header {
+	names := negotiationHeaders
+	if r != nil {
+		names = append(append([]string(nil), names...), r.CacheKeyHeaders...)
+	}
+	upstream := make(http.Header)
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if values := header.Values(canonical); len(values) > 0 && canonical != "Cookie" {
+			upstream[canonical] = append([]string(nil), values...)
+		}
+	}
+	return upstream
+}
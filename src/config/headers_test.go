@@ -0,0 +1,80 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderRulesApply(t *testing.T) {
+	header := http.Header{}
+	header.Set("User-Agent", "curl/8.0")
+	header.Set("X-Debug", "1")
+	header.Set("Accept", "*/*")
+
+	HeaderRules{
+		Set:    map[string]string{"user-agent": "mitmcdn"},
+		Add:    map[string]string{"Accept": "video/mp4"},
+		Remove: []string{"x-debug"},
+	}.Apply(header)
+
+	if got := header.Values("User-Agent"); len(got) != 1 || got[0] != "mitmcdn" {
+		t.Errorf("User-Agent = %q, want [mitmcdn]", got)
+	}
+	if got := header.Values("Accept"); len(got) != 2 {
+		t.Errorf("Accept = %q, want both values", got)
+	}
+	if header.Get("X-Debug") != "" {
+		t.Error("X-Debug should be removed")
+	}
+}
+
+func TestCDNRuleStoredHeaders(t *testing.T) {
+	origin := http.Header{}
+	origin.Set("Content-Disposition", "attachment")
+	origin.Add("Link", "<a>")
+	origin.Add("Link", "<b>")
+	origin.Set("Set-Cookie", "session=1")
+
+	rule := &CDNRule{StoreHeaders: []string{"content-disposition", "Link", "ETag"}}
+	stored := rule.StoredHeaders(origin)
+	if len(stored) != 2 || stored.Get("Content-Disposition") != "attachment" || len(stored.Values("Link")) != 2 {
+		t.Errorf("StoredHeaders() = %v", stored)
+	}
+
+	origin.Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+	origin.Set("Content-Length", "10")
+	var none *CDNRule
+	if stored := none.StoredHeaders(origin); len(stored) != 2 || stored.Get("Content-Disposition") != "attachment" || len(stored.Values("Link")) != 2 {
+		t.Errorf("default StoredHeaders() = %v, want all but transfer and volatile headers", stored)
+	}
+}
+
+func TestCDNRuleCacheKey(t *testing.T) {
+	header := http.Header{}
+	header.Set("Cookie", "session=abc; theme=dark; tracking=123")
+	header.Set("Authorization", "Bearer t1")
+	header.Set("Accept-Language", "de")
+	header.Set("User-Agent", "curl/8.0")
+
+	var legacy *CDNRule
+	if got := legacy.CacheKey(header); got != header.Get("Cookie") {
+		t.Errorf("default CacheKey() = %q, want the whole Cookie header", got)
+	}
+
+	rule := &CDNRule{CacheKeyCookies: []string{"session"}, CacheKeyHeaders: []string{"authorization"}}
+	want := "cookie session=abc\nAuthorization: Bearer t1"
+	if got := rule.CacheKey(header); got != want {
+		t.Errorf("CacheKey() = %q, want %q", got, want)
+	}
+
+	other := header.Clone()
+	other.Set("Cookie", "tracking=999; session=abc")
+	if rule.CacheKey(other) != rule.CacheKey(header) {
+		t.Error("cookies outside cache_key_cookies should not change the key")
+	}
+
+	upstream := rule.UpstreamHeaders(header)
+	if len(upstream) != 2 || upstream.Get("Accept-Language") != "de" || upstream.Get("Authorization") != "Bearer t1" {
+		t.Errorf("UpstreamHeaders() = %v", upstream)
+	}
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Host pattern kinds, from most to least specific
+const (
+	hostRegex  = iota + 1 // "~^img[0-9]+\.example\.com$"
+	hostGlob              // "img-*.example.com", * stays within one label
+	hostSuffix            // "example.com" or ".example.com" (apex and subdomains), "*.example.com" (subdomains only)
+	hostExact             // "=cdn.example.com"
+)
+
+// RuleMatcher matches hosts and URLs against the CDN rules. It is compiled once
+// when the config is loaded and shared by the MITM, SOCKS5, reverse proxy and
+// DNS paths. Rules are tried in a fixed order: exact hosts, then suffixes
+// (longest first), then globs, then regexes; a rule with a port comes before
+// the same host without one, and config order breaks any remaining tie.
+type RuleMatcher struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	rule    CDNRule
+	index   int
+	kind    int
+	host    string         // exact host, or the suffix without its leading "." / "*."
+	apex    bool           // suffix rule also matches the bare domain
+	hostRe  *regexp.Regexp // glob and regex rules
+	port    int            // 0 matches any port
+	pattern *regexp.Regexp // match_pattern, applied to path and query; nil matches all
+}
+
+// NewRuleMatcher compiles rules, rejecting invalid domains and patterns
+func NewRuleMatcher(rules []CDNRule) (*RuleMatcher, error) {
+	m := &RuleMatcher{rules: make([]compiledRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("cdn rule %d (%s): %w", i+1, rule.Domain, err)
+		}
+		compiled.index = i
+		m.rules = append(m.rules, compiled)
+	}
+
+	sort.SliceStable(m.rules, func(i, j int) bool {
+		a, b := m.rules[i], m.rules[j]
+		if a.kind != b.kind {
+			return a.kind > b.kind
+		}
+		if (a.port != 0) != (b.port != 0) {
+			return a.port != 0
+		}
+		if a.kind == hostSuffix && len(a.host) != len(b.host) {
+			return len(a.host) > len(b.host)
+		}
+		return a.index < b.index
+	})
+	return m, nil
+}
+
+func compileRule(rule CDNRule) (compiledRule, error) {
+	compiled := compiledRule{rule: rule}
+	if err := rule.RequestHeaders.validate(); err != nil {
+		return compiled, fmt.Errorf("invalid request_headers: %w", err)
+	}
+	if err := rule.ResponseHeaders.validate(); err != nil {
+		return compiled, fmt.Errorf("invalid response_headers: %w", err)
+	}
+	if err := validateHeaderNames(rule.StoreHeaders); err != nil {
+		return compiled, fmt.Errorf("invalid store_headers: %w", err)
+	}
+	if err := validateHeaderNames(rule.CacheKeyHeaders); err != nil {
+		return compiled, fmt.Errorf("invalid cache_key_headers: %w", err)
+	}
+	if rule.MatchPattern != "" {
+		pattern, err := regexp.Compile(rule.MatchPattern)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid match_pattern: %w", err)
+		}
+		compiled.pattern = pattern
+	}
+
+	domain := strings.TrimSpace(rule.Domain)
+	if expr, ok := strings.CutPrefix(domain, "~"); ok {
+		hostRe, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid host regex: %w", err)
+		}
+		compiled.kind, compiled.hostRe = hostRegex, hostRe
+		return compiled, nil
+	}
+
+	domain = strings.ToLower(domain)
+	domain, exact := strings.CutPrefix(domain, "=")
+	if host, portStr, err := net.SplitHostPort(domain); err == nil {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return compiled, fmt.Errorf("invalid port %q", portStr)
+		}
+		domain, compiled.port = host, port
+	}
+	domain = strings.TrimSuffix(strings.Trim(domain, "[]"), ".")
+
+	switch {
+	case domain == "" || domain == "*" || domain == "*." || domain == ".":
+		return compiled, fmt.Errorf("domain is required")
+	case exact:
+		if strings.Contains(domain, "*") || strings.HasPrefix(domain, ".") {
+			return compiled, fmt.Errorf("exact host %q cannot hold a wildcard", domain)
+		}
+		compiled.kind, compiled.host = hostExact, domain
+	case strings.HasPrefix(domain, "*.") && !strings.Contains(domain[2:], "*"):
+		compiled.kind, compiled.host = hostSuffix, domain[2:]
+	case strings.Contains(domain, "*"):
+		expr := strings.ReplaceAll(regexp.QuoteMeta(domain), `\*`, `[^.]*`)
+		compiled.kind, compiled.hostRe = hostGlob, regexp.MustCompile("^"+expr+"$")
+	default:
+		// A bare name covers its subdomains too, as the PAC file and the
+		// tunnel ACL read it
+		compiled.kind, compiled.host, compiled.apex = hostSuffix, strings.TrimPrefix(domain, "."), true
+	}
+	return compiled, nil
+}
+
+// matchHost checks a normalised host; port 0 means unknown and matches any rule port
+func (c *compiledRule) matchHost(host string, port int) bool {
+	if c.port != 0 && port != 0 && c.port != port {
+		return false
+	}
+	switch c.kind {
+	case hostExact:
+		return host == c.host
+	case hostSuffix:
+		return strings.HasSuffix(host, "."+c.host) || (c.apex && host == c.host)
+	default:
+		return c.hostRe.MatchString(host)
+	}
+}
+
+// MatchHost returns the first rule, among those allow accepts (nil allows all),
+// whose host pattern matches hostport ("host" or "host:port"), or nil
+func (m *RuleMatcher) MatchHost(hostport string, allow func(*CDNRule) bool) *CDNRule {
+	if m == nil {
+		return nil
+	}
+	host, port := splitHostPort(hostport)
+	for i := range m.rules {
+		c := &m.rules[i]
+		if c.matchHost(host, port) && (allow == nil || allow(&c.rule)) {
+			return &c.rule
+		}
+	}
+	return nil
+}
+
+// MatchURL returns the first rule, among those allow accepts (nil allows all),
+// whose host pattern matches the URL host and whose match_pattern matches its
+// path and query, or nil
+func (m *RuleMatcher) MatchURL(rawURL string, allow func(*CDNRule) bool) *CDNRule {
+	if m == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	host, port := splitHostPort(u.Host)
+	if port == 0 {
+		switch u.Scheme {
+		case "http":
+			port = 80
+		case "https":
+			port = 443
+		}
+	}
+	requestURI := u.RequestURI()
+
+	for i := range m.rules {
+		c := &m.rules[i]
+		if !c.matchHost(host, port) || (allow != nil && !allow(&c.rule)) {
+			continue
+		}
+		if c.pattern == nil || c.pattern.MatchString(requestURI) {
+			return &c.rule
+		}
+	}
+	return nil
+}
+
+// Len returns the number of rules
+func (m *RuleMatcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.rules)
+}
+
+// splitHostPort normalises "host[:port]", returning port 0 when absent
+func splitHostPort(hostport string) (string, int) {
+	host, port := hostport, 0
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), "."), port
+}
@@ -0,0 +1,196 @@
+package config
+
+import "testing"
+
+func TestRuleMatcherHosts(t *testing.T) {
+	m, err := NewRuleMatcher([]CDNRule{
+		{Domain: "cdn.example.com"},
+		{Domain: "=origin.example.com"},
+		{Domain: ".static.example.net"},
+		{Domain: "*.media.example.org"},
+		{Domain: "img-*.example.io"},
+		{Domain: "video.example.tv:8443"},
+		{Domain: `~^edge[0-9]+\.example\.dev$`},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"cdn.example.com", "cdn.example.com"},
+		{"CDN.Example.com.", "cdn.example.com"},
+		{"cdn.example.com:443", "cdn.example.com"},
+		{"evilcdn.example.com", ""},
+		{"cdn.example.com.attacker.net", ""},
+		{"img.cdn.example.com", "cdn.example.com"},
+		{"origin.example.com", "=origin.example.com"},
+		{"img.origin.example.com", ""},
+		{"static.example.net", ".static.example.net"},
+		{"a.b.static.example.net", ".static.example.net"},
+		{"media.example.org", ""},
+		{"a.media.example.org", "*.media.example.org"},
+		{"img-1.example.io", "img-*.example.io"},
+		{"img-1.x.example.io", ""},
+		{"video.example.tv:8443", "video.example.tv:8443"},
+		{"video.example.tv:443", ""},
+		{"video.example.tv", "video.example.tv:8443"}, // port unknown, e.g. DNS
+		{"edge12.example.dev", `~^edge[0-9]+\.example\.dev$`},
+		{"edge.example.dev", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := m.MatchHost(tt.host, nil); rule != nil {
+			got = rule.Domain
+		}
+		if got != tt.want {
+			t.Errorf("MatchHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRuleMatcherURLs(t *testing.T) {
+	m, err := NewRuleMatcher([]CDNRule{
+		{Domain: "cdn.httpbin.org", MatchPattern: `\.mp4$`},
+		{Domain: "files.httpbin.org"},
+		{Domain: "vod.httpbin.org", MatchPattern: `^/hls/`},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{"matches domain and pattern", "https://cdn.httpbin.org/video.mp4", true},
+		{"matches domain but not pattern", "https://cdn.httpbin.org/page.html", false},
+		{"does not match domain", "https://other.com/video.mp4", false},
+		{"matches domain without pattern", "https://files.httpbin.org/anyfile", true},
+		{"domain in query does not match", "https://other.com/get?u=cdn.httpbin.org/video.mp4", false},
+		{"pattern sees path and query", "https://vod.httpbin.org/hls/a.ts?sig=1", true},
+		{"pattern is anchored at the path", "https://vod.httpbin.org/live/hls/a.ts", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.MatchURL(tt.url, nil) != nil; got != tt.want {
+				t.Errorf("MatchURL(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatcherSingleRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		domain  string
+		pattern string
+		want    bool
+	}{
+		{
+			name:    "matches domain and pattern",
+			url:     "https://cdn.httpbin.org/video.mp4",
+			domain:  "cdn.httpbin.org",
+			pattern: `\.mp4$`,
+			want:    true,
+		},
+		{
+			name:    "matches domain but not pattern",
+			url:     "https://cdn.httpbin.org/page.html",
+			domain:  "cdn.httpbin.org",
+			pattern: `\.mp4$`,
+			want:    false,
+		},
+		{
+			name:    "matches pattern on another domain",
+			url:     "https://other.com/video.mp4",
+			domain:  "cdn.httpbin.org",
+			pattern: `\.mp4$`,
+			want:    false,
+		},
+		{
+			name:    "matches domain without pattern",
+			url:     "https://cdn.httpbin.org/anyfile",
+			domain:  "cdn.httpbin.org",
+			pattern: "",
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewRuleMatcher([]CDNRule{{Domain: tt.domain, MatchPattern: tt.pattern}})
+			if err != nil {
+				t.Fatalf("NewRuleMatcher() error = %v", err)
+			}
+			if got := m.MatchURL(tt.url, nil) != nil; got != tt.want {
+				t.Errorf("MatchURL(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatcherPrecedence(t *testing.T) {
+	m, err := NewRuleMatcher([]CDNRule{
+		{Domain: `~example\.com$`, DedupStrategy: "regex"},
+		{Domain: ".example.com", DedupStrategy: "suffix"},
+		{Domain: "*.cdn.example.com", DedupStrategy: "longer-suffix"},
+		{Domain: "=cdn.example.com", DedupStrategy: "exact"},
+		{Domain: "=cdn.example.com:8443", DedupStrategy: "exact-port"},
+		{Domain: "img.example.com", MatchPattern: `\.jpg$`, DedupStrategy: "images"},
+		{Domain: "img.example.com", DedupStrategy: "bare"},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://cdn.example.com:8443/a", "exact-port"},
+		{"https://cdn.example.com/a", "exact"},
+		{"https://a.cdn.example.com/a", "longer-suffix"},
+		{"https://www.example.com/a", "suffix"},
+		{"https://img.example.com/a.jpg", "images"},
+		{"https://img.example.com/a.png", "bare"}, // falls through when the pattern fails
+		{"https://a.img.example.com/a.png", "bare"},
+		{"https://notexample.com/a", "regex"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := m.MatchURL(tt.url, nil); rule != nil {
+			got = rule.DedupStrategy
+		}
+		if got != tt.want {
+			t.Errorf("MatchURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	onlySuffix := func(rule *CDNRule) bool { return rule.DedupStrategy == "suffix" }
+	if rule := m.MatchURL("https://cdn.example.com/a", onlySuffix); rule == nil || rule.DedupStrategy != "suffix" {
+		t.Errorf("MatchURL() with filter = %v, want the suffix rule", rule)
+	}
+}
+
+func TestNewRuleMatcherRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []CDNRule{
+		{Domain: ""},
+		{Domain: "*."},
+		{Domain: "=*.example.com"},
+		{Domain: "cdn.example.com:99999"},
+		{Domain: "~(unclosed"},
+		{Domain: "cdn.example.com", MatchPattern: "(unclosed"},
+		{Domain: "cdn.example.com", RequestHeaders: HeaderRules{Set: map[string]string{"Content-Length": "1"}}},
+		{Domain: "cdn.example.com", ResponseHeaders: HeaderRules{Remove: []string{" "}}},
+		{Domain: "cdn.example.com", StoreHeaders: []string{"transfer-encoding"}},
+	} {
+		if _, err := NewRuleMatcher([]CDNRule{rule}); err == nil {
+			t.Errorf("NewRuleMatcher(%+v) should fail", rule)
+		}
+	}
+}
@@ -20,11 +20,20 @@ type File struct {
 	FileSize       int64     `gorm:"not null"`
 	SavedPath      string    `gorm:"not null"`
 	ContentType    string    `gorm:"type:text"` // MIME type from upstream
+	ResponseHeaders string   `gorm:"type:text"` // JSON-encoded origin headers replayed on cache hits
+	RequestHeaders  string   `gorm:"type:text"` // JSON-encoded client headers sent upstream when downloading
+	Vary            string    // normalised origin Vary header, "*" when the response cannot be reused
+	VaryValues      string    `gorm:"type:text"` // request values of the Vary headers this entry was fetched with
 	DownloadStatus string    `gorm:"not null;default:'pending'"` // pending, downloading, complete, failed
 	CreatedAt      time.Time `gorm:"autoCreateTime"`
 	LastAccessedAt time.Time `gorm:"autoUpdateTime"`
 	CompletedAt    *time.Time // nil if not completed
 	DownloadedBytes int64     `gorm:"default:0"` // For resume support
+	RequestedBy    string    `gorm:"index"`     // proxy user who first requested the file
+	Kind           string    // "" for a plain file, "hls" or "dash" for a playlist whose segments are cached with it
+	ParentHash     string    `gorm:"index"` // playlist entry a segment or child playlist was prefetched for
+	Ranges         string    `gorm:"type:text"` // JSON byte ranges cached so far when filled piecewise by Range requests
+	Metadata       string    `gorm:"type:text"` // JSON title, duration, thumbnail and subtitles of a video fetched with yt-dlp
 }
 
 // Log represents system logs
@@ -0,0 +1,408 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/database"
+)
+
+// progressInterval bounds how often an external downloader's progress is written to the database
+const progressInterval = 500 * time.Millisecond
+
+// backend fetches the cache entries routed to it into their SavedPath. It
+// records the outcome itself, through completeDownload or handleDownloadError.
+type backend interface {
+	download(s *Scheduler, task *Task)
+	// streams reports whether the backend feeds task.dataChan as data
+	// arrives; clients of other backends wait for the download to finish
+	streams() bool
+}
+
+// httpBackend is the built-in HTTP client, with resume and streaming to clients
+type httpBackend struct{}
+
+func (httpBackend) download(s *Scheduler, task *Task) { s.downloadHTTPTask(task) }
+func (httpBackend) streams() bool                     { return true }
+
+// ytdlpBackend runs the yt-dlp command set with ConfigureYTDLPCommand
+type ytdlpBackend struct{}
+
+func (ytdlpBackend) download(s *Scheduler, task *Task) { s.downloadYTDLPTask(task) }
+func (ytdlpBackend) streams() bool                     { return false }
+
+// defaultBackends returns the built-in backends and the URL schemes routed to them
+func defaultBackends() (map[string]backend, map[string]string) {
+	backends := map[string]backend{
+		"http":   httpBackend{},
+		"yt-dlp": ytdlpBackend{},
+	}
+	schemes := map[string]string{"yt-dlp": "yt-dlp"}
+	return backends, schemes
+}
+
+// ConfigureDownloaders registers the external downloaders declared in the
+// config next to the built-in ones. A downloader listing a scheme takes it
+// over from a built-in backend.
+func (s *Scheduler) ConfigureDownloaders(downloaders []config.DownloaderConfig) error {
+	backends, schemes := defaultBackends()
+	for _, cfg := range downloaders {
+		if _, ok := backends[cfg.Name]; ok {
+			return fmt.Errorf("duplicate downloader: %s", cfg.Name)
+		}
+		b := &commandBackend{
+			name:        cfg.Name,
+			command:     append([]string(nil), cfg.Command...),
+			output:      cfg.Output,
+			contentType: cfg.ContentType,
+		}
+		if b.output == "" {
+			b.output = "file"
+		}
+		if cfg.Progress != "" {
+			re, err := regexp.Compile(cfg.Progress)
+			if err != nil {
+				return fmt.Errorf("downloader %s: invalid progress pattern: %w", cfg.Name, err)
+			}
+			b.progress = re
+		}
+		backends[cfg.Name] = b
+		for _, scheme := range cfg.Schemes {
+			schemes[strings.ToLower(scheme)] = cfg.Name
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backends, s.backendSchemes = backends, schemes
+	return nil
+}
+
+// backendFor picks the backend for a download URL: by its scheme first, then
+// by the downloader of the CDN rule it matches, falling back to HTTP
+func (s *Scheduler) backendFor(rawURL string) backend {
+	var scheme string
+	if u, err := url.Parse(rawURL); err == nil {
+		scheme = strings.ToLower(u.Scheme)
+	}
+	name := ""
+	if scheme != "http" && scheme != "https" {
+		s.mu.RLock()
+		name = s.backendSchemes[scheme]
+		s.mu.RUnlock()
+	}
+	if name == "" {
+		if rule := s.matchRule(rawURL); rule != nil {
+			name = rule.Downloader
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if b, ok := s.backends[name]; ok {
+		return b
+	}
+	if name != "" {
+		log.Printf("Unknown downloader %q for %s, using http", name, rawURL)
+	}
+	return s.backends["http"]
+}
+
+// StartDownloadWith starts or resumes downloading a file like StartDownload,
+// but with the named downloader instead of the one url routes to
+func (s *Scheduler) StartDownloadWith(file *database.File, url, downloader string, priority int) error {
+	s.mu.RLock()
+	b, ok := s.backends[downloader]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown downloader: %s", downloader)
+	}
+	return s.startDownload(file, url, "", priority, b)
+}
+
+// completeDownload marks a task finished once its backend has moved the
+// result to SavedPath, together with any extra columns the backend recorded
+func (s *Scheduler) completeDownload(task *Task, contentType string, extra map[string]interface{}) {
+	info, err := os.Stat(task.file.SavedPath)
+	if err != nil {
+		s.handleDownloadError(task, err)
+		return
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"download_status":  "complete",
+		"downloaded_bytes": info.Size(),
+		"file_size":        info.Size(),
+		"content_type":     contentType,
+		"completed_at":     &now,
+	}
+	for column, value := range extra {
+		updates[column] = value
+	}
+	s.db.Model(&database.File{}).Where("file_hash = ?", task.FileHash).Updates(updates)
+
+	task.mu.Lock()
+	task.Status = "complete"
+	task.file.ContentType = contentType
+	task.file.FileSize = info.Size()
+	task.file.DownloadedBytes = info.Size()
+	task.mu.Unlock()
+
+	s.closeTaskDataChan(task)
+}
+
+// recordProgress stores the progress an external downloader reported
+func (s *Scheduler) recordProgress(task *Task, downloaded, total int64) {
+	total = max(total, downloaded)
+	s.db.Model(&database.File{}).Where("file_hash = ?", task.FileHash).Updates(map[string]interface{}{
+		"downloaded_bytes": downloaded,
+		"file_size":        total,
+	})
+	task.mu.Lock()
+	task.file.DownloadedBytes, task.file.FileSize = downloaded, total
+	task.mu.Unlock()
+}
+
+// commandBackend runs a downloader declared in [[downloaders]]
+type commandBackend struct {
+	name        string
+	command     []string
+	output      string // file, dir or stdout
+	progress    *regexp.Regexp
+	contentType string
+}
+
+func (b *commandBackend) streams() bool { return false }
+
+func (b *commandBackend) download(s *Scheduler, task *Task) {
+	savedPath := task.file.SavedPath
+	tempPath := savedPath + ".part"
+	tempDir := savedPath + ".dl"
+	_ = os.Remove(tempPath)
+	_ = os.RemoveAll(tempDir)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		s.handleDownloadError(task, err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	replacer := strings.NewReplacer(
+		"{url}", task.URL,
+		"{output}", tempPath,
+		"{dir}", tempDir,
+		"{name}", task.file.Filename,
+	)
+	args := make([]string, len(b.command))
+	for i, arg := range b.command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	cmd := exec.CommandContext(task.ctx, args[0], args[1:]...)
+	cmd.Dir = tempDir
+	output := &tailBuffer{}
+	lines, writer := io.Pipe()
+	cmd.Stderr = writer
+	var out *os.File
+	if b.output == "stdout" {
+		var err error
+		if out, err = os.Create(tempPath); err != nil {
+			s.handleDownloadError(task, err)
+			return
+		}
+		cmd.Stdout = out
+	} else {
+		cmd.Stdout = writer
+	}
+	if err := cmd.Start(); err != nil {
+		if out != nil {
+			out.Close()
+		}
+		s.handleDownloadError(task, fmt.Errorf("%s failed: %w", b.name, err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.readOutput(s, task, lines, output)
+	}()
+	err := cmd.Wait()
+	writer.Close()
+	wg.Wait()
+	if out != nil {
+		out.Close()
+	}
+	if err != nil {
+		s.handleDownloadError(task, fmt.Errorf("%s failed: %w: %s", b.name, err, output.String()))
+		return
+	}
+
+	resultPath := tempPath
+	if b.output == "dir" {
+		resultPath = largestFile(tempDir)
+		if resultPath == "" {
+			s.handleDownloadError(task, fmt.Errorf("%s wrote no file to %s", b.name, tempDir))
+			return
+		}
+	}
+	if err := os.Rename(resultPath, savedPath); err != nil {
+		s.handleDownloadError(task, fmt.Errorf("failed to finalize %s output: %w", b.name, err))
+		return
+	}
+
+	contentType := b.contentType
+	if contentType == "" {
+		contentType = sniffContentType(savedPath)
+	}
+	s.completeDownload(task, contentType, nil)
+}
+
+// readOutput follows the command's output, recording the progress lines it
+// matches and keeping the rest for error messages
+func (b *commandBackend) readOutput(s *Scheduler, task *Task, r io.Reader, tail *tailBuffer) {
+	var lastUpdate time.Time
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		downloaded, total, ok := b.parseProgress(line)
+		if !ok {
+			tail.Write([]byte(line + "\n"))
+			continue
+		}
+		if time.Since(lastUpdate) >= progressInterval || (total > 0 && downloaded >= total) {
+			lastUpdate = time.Now()
+			s.recordProgress(task, downloaded, total)
+		}
+	}
+	io.Copy(io.Discard, r) // a line longer than the scanner buffer stops it
+}
+
+// parseProgress extracts the downloaded and total sizes from a progress line
+func (b *commandBackend) parseProgress(line string) (downloaded, total int64, ok bool) {
+	if b.progress == nil {
+		return 0, 0, false
+	}
+	m := b.progress.FindStringSubmatch(line)
+	if m == nil {
+		return 0, 0, false
+	}
+	downloaded, err := parseByteCount(m[b.progress.SubexpIndex("downloaded")])
+	if err != nil {
+		return 0, 0, false
+	}
+	if i := b.progress.SubexpIndex("total"); i >= 0 {
+		total, _ = parseByteCount(m[i])
+	}
+	return downloaded, total, true
+}
+
+// scanProgressLines splits output on "\n" and on the bare "\r" progress bars redraw with
+func scanProgressLines(data []byte, atEOF bool) (int, []byte, error) {
+	for i, c := range data {
+		if c == '\n' || c == '\r' {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+var byteCountRegex = regexp.MustCompile(`^\s*([0-9]+(?:\.[0-9]+)?)\s*([KMGT]?)I?B?\s*$`)
+
+// parseByteCount parses sizes as downloaders print them: "1234", "1.5MiB", "700KB", "2G"
+func parseByteCount(text string) (int64, error) {
+	m := byteCountRegex.FindStringSubmatch(strings.ToUpper(text))
+	if m == nil {
+		return 0, fmt.Errorf("invalid byte count: %q", text)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	// Downloaders mean binary units whether or not they print the "i"
+	switch m[2] {
+	case "K":
+		value *= 1 << 10
+	case "M":
+		value *= 1 << 20
+	case "G":
+		value *= 1 << 30
+	case "T":
+		value *= 1 << 40
+	}
+	return int64(value), nil
+}
+
+// largestFile returns the biggest regular file under dir, or ""
+func largestFile(dir string) string {
+	var best string
+	var bestSize int64 = -1
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Size() > bestSize {
+			best, bestSize = path, info.Size()
+		}
+		return nil
+	})
+	return best
+}
+
+// sniffContentType guesses the MIME type of a downloaded file from its first bytes
+func sniffContentType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
+
+// tailBuffer keeps the last bytes written to it, for error messages
+type tailBuffer struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = append(b.data, p...)
+	if len(b.data) > 4096 {
+		b.data = b.data[len(b.data)-4096:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return strings.TrimSpace(string(b.data))
+}
@@ -0,0 +1,207 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/database"
+)
+
+func TestParseByteCount(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{"1234", 1234},
+		{"512B", 512},
+		{"1.5KiB", 1536},
+		{"2MiB", 2 << 20},
+		{"700KB", 700 << 10},
+		{"1G", 1 << 30},
+		{" 3.0 MiB ", 3 << 20},
+	}
+	for _, tt := range tests {
+		got, err := parseByteCount(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteCount(%q) = %d, %v; want %d", tt.input, got, err, tt.want)
+		}
+	}
+	for _, input := range []string{"", "NA", "12 parsecs", "-1"} {
+		if _, err := parseByteCount(input); err == nil {
+			t.Errorf("parseByteCount(%q) should fail", input)
+		}
+	}
+}
+
+func TestBackendFor(t *testing.T) {
+	sched, _, _ := setupTestScheduler(t)
+
+	rules, err := config.NewRuleMatcher([]config.CDNRule{
+		{Domain: "files.example.com", DedupStrategy: "full_url", Downloader: "fetcher"},
+		{Domain: "cdn.example.com", DedupStrategy: "full_url"},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+	sched.ConfigureRules(rules)
+	if err := sched.ConfigureDownloaders([]config.DownloaderConfig{
+		{Name: "fetcher", Schemes: []string{"Magnet"}, Command: []string{"fetch", "{url}"}},
+	}); err != nil {
+		t.Fatalf("ConfigureDownloaders() error = %v", err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://cdn.example.com/a.bin", "http"},
+		{"https://files.example.com/a.iso", "fetcher"},
+		{"magnet:?xt=urn:btih:abc", "fetcher"},
+		{"yt-dlp://XZnZkASrArc", "yt-dlp"},
+		{"ftp://other.example/a", "http"},
+	}
+	for _, tt := range tests {
+		got := "http"
+		switch b := sched.backendFor(tt.url).(type) {
+		case ytdlpBackend:
+			got = "yt-dlp"
+		case *commandBackend:
+			got = b.name
+		}
+		if got != tt.want {
+			t.Errorf("backendFor(%q) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+
+	if err := sched.ConfigureDownloaders([]config.DownloaderConfig{{Name: "yt-dlp", Command: []string{"x"}}}); err == nil {
+		t.Error("ConfigureDownloaders() accepted a built-in name")
+	}
+	if err := sched.StartDownloadWith(&database.File{FileHash: "unknown"}, "https://cdn.example.com/a.bin", "missing", 50); err == nil {
+		t.Error("StartDownloadWith() accepted an unknown downloader")
+	}
+}
+
+func TestCommandBackendDownload(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	script := createFakeYTDLPScript(t, `mode="$1"
+out="$2"
+printf 'progress 1.5KiB/3KiB\r' >&2
+while [ ! -e "`+release+`" ]; do sleep 0.02; done
+case "$mode" in
+  file) printf '%s' "$3" > "$out" ;;
+  dir) mkdir -p "$out/sub"; printf 'x' > "$out/small.txt"; printf '%s' "$3" > "$out/sub/payload.bin" ;;
+  stdout) printf '%s' "$3" ;;
+esac
+echo 'progress 3KiB/3KiB' >&2`)
+
+	var downloaders []config.DownloaderConfig
+	for _, mode := range []string{"file", "dir", "stdout"} {
+		out := "{output}"
+		if mode == "dir" {
+			out = "{dir}"
+		}
+		downloaders = append(downloaders, config.DownloaderConfig{
+			Name:     "fake-" + mode,
+			Schemes:  []string{"fake" + mode},
+			Command:  []string{script, mode, out, "<html><body>" + mode + " {name}</body></html>"},
+			Output:   mode,
+			Progress: `progress (?P<downloaded>\S+)/(?P<total>\S+)`,
+		})
+	}
+	if err := sched.ConfigureDownloaders(downloaders); err != nil {
+		t.Fatalf("ConfigureDownloaders() error = %v", err)
+	}
+
+	for _, mode := range []string{"file", "dir", "stdout"} {
+		t.Run(mode, func(t *testing.T) {
+			os.Remove(release)
+			file, err := cacheMgr.GetOrCreateFile("fake"+mode+"://example/item", "", "item.html", "full_url")
+			if err != nil {
+				t.Fatalf("GetOrCreateFile() error = %v", err)
+			}
+			if err := sched.StartDownload(file, file.OriginalURL, "", 100); err != nil {
+				t.Fatalf("StartDownload() error = %v", err)
+			}
+
+			deadline := time.Now().Add(3 * time.Second)
+			var running database.File
+			for time.Now().Before(deadline) {
+				db.Where("file_hash = ?", file.FileHash).First(&running)
+				if running.DownloadedBytes > 0 {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if running.DownloadedBytes != 1536 || running.FileSize != 3072 {
+				t.Fatalf("progress = %d/%d, want 1536/3072", running.DownloadedBytes, running.FileSize)
+			}
+			if err := os.WriteFile(release, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			updated := waitForFileStatus(t, db, file.FileHash, "complete", 3*time.Second)
+			want := "<html><body>" + mode + " item.html</body></html>"
+			data, err := os.ReadFile(updated.SavedPath)
+			if err != nil || string(data) != want {
+				t.Fatalf("saved content = %q, %v; want %q", data, err, want)
+			}
+			if updated.FileSize != int64(len(want)) || !strings.HasPrefix(updated.ContentType, "text/html") {
+				t.Errorf("size = %d, content type = %q", updated.FileSize, updated.ContentType)
+			}
+			if _, err := os.Stat(updated.SavedPath + ".dl"); !os.IsNotExist(err) {
+				t.Errorf("working directory left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestCommandBackendFailureAndWaitingClient(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	script := createFakeYTDLPScript(t, `case "$1" in
+  *fail*) echo 'no seeders' >&2; exit 3 ;;
+esac
+sleep 0.2
+printf 'payload' > "$2"`)
+	if err := sched.ConfigureDownloaders([]config.DownloaderConfig{
+		{Name: "fake", Schemes: []string{"fake"}, Command: []string{script, "{url}", "{output}"}, ContentType: "application/x-test"},
+	}); err != nil {
+		t.Fatalf("ConfigureDownloaders() error = %v", err)
+	}
+
+	failing, _ := cacheMgr.GetOrCreateFile("fake://example/fail", "", "fail", "full_url")
+	if err := sched.StartDownload(failing, failing.OriginalURL, "", 100); err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	waitForFileStatus(t, db, failing.FileHash, "failed", 3*time.Second)
+	var logEntry database.Log
+	if err := db.Where("file_hash = ?", failing.FileHash).First(&logEntry).Error; err != nil {
+		t.Fatalf("failed to load log entry: %v", err)
+	}
+	if !strings.Contains(logEntry.Message, "fake failed") || !strings.Contains(logEntry.Message, "no seeders") {
+		t.Errorf("log message = %q", logEntry.Message)
+	}
+
+	// A client of a backend that cannot stream gets the whole file once it is done
+	file, _ := cacheMgr.GetOrCreateFile("fake://example/ok", "", "ok", "full_url")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://proxy/ok", nil)
+	if err := sched.StreamFile(file, rec, req); err != nil {
+		t.Fatalf("StreamFile() error = %v", err)
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Errorf("response = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "application/x-test" || rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("headers = %v", rec.Header())
+	}
+}
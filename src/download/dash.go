@@ -0,0 +1,428 @@
+package download
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Manifest is a DASH MPD reduced to what caching needs. All URIs are
+// resolved against the manifest URL and the BaseURL elements in effect.
+type Manifest struct {
+	Dynamic        bool // type="dynamic": a live manifest that will change
+	AdaptationSets []AdaptationSet
+}
+
+// AdaptationSet groups the interchangeable representations of one stream
+type AdaptationSet struct {
+	ContentType     string
+	Representations []Representation
+}
+
+// Representation is one encoding of a stream and the URIs that make it up
+type Representation struct {
+	ID        string
+	Bandwidth int64
+	// Resources lists the initialization segment and media segments in
+	// playback order. A representation addressed by byte ranges into a
+	// single file (SegmentBase, or a SegmentList with mediaRange) lists
+	// that file once.
+	Resources []string
+}
+
+type mpdDocument struct {
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   []string    `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration        string              `xml:"duration,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	AdaptationSets  []mpdAdaptationSet  `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType     string              `xml:"contentType,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *mpdURL `xml:"Initialization"`
+	SegmentURLs    []struct {
+		Media string `xml:"media,attr"`
+	} `xml:"SegmentURL"`
+}
+
+type mpdSegmentTemplate struct {
+	Media          string              `xml:"media,attr"`
+	Initialization string              `xml:"initialization,attr"`
+	StartNumber    *int64              `xml:"startNumber,attr"`
+	Timescale      *int64              `xml:"timescale,attr"`
+	Duration       *int64              `xml:"duration,attr"`
+	Timeline       *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+// maxTemplateSegments bounds how many segments one SegmentTemplate expands to
+const maxTemplateSegments = 100000
+
+// IsManifestPath reports whether a URL path names a DASH manifest
+func IsManifestPath(urlPath string) bool {
+	return strings.EqualFold(path.Ext(urlPath), ".mpd")
+}
+
+// ParseManifest parses a DASH MPD fetched from manifestURL
+func ParseManifest(manifestURL string, data []byte) (*Manifest, error) {
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	var doc mpdDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("not a DASH manifest: %w", err)
+	}
+	if base, err = resolveBaseURL(base, doc.BaseURL); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Dynamic: doc.Type == "dynamic"}
+	for _, period := range doc.Periods {
+		periodBase, err := resolveBaseURL(base, period.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		// Without its own duration only a single period can borrow the presentation's
+		var duration time.Duration
+		if period.Duration != "" {
+			duration, _ = parseISODuration(period.Duration)
+		} else if len(doc.Periods) == 1 {
+			duration, _ = parseISODuration(doc.MediaPresentationDuration)
+		}
+
+		for _, set := range period.AdaptationSets {
+			setBase, err := resolveBaseURL(periodBase, set.BaseURL)
+			if err != nil {
+				return nil, err
+			}
+			adaptationSet := AdaptationSet{ContentType: set.ContentType}
+			if adaptationSet.ContentType == "" {
+				adaptationSet.ContentType, _, _ = strings.Cut(set.MimeType, "/")
+			}
+			for _, rep := range set.Representations {
+				repBase, err := resolveBaseURL(setBase, rep.BaseURL)
+				if err != nil {
+					return nil, err
+				}
+				if adaptationSet.ContentType == "" {
+					adaptationSet.ContentType, _, _ = strings.Cut(rep.MimeType, "/")
+				}
+				representation := Representation{ID: rep.ID, Bandwidth: rep.Bandwidth}
+
+				template := mergeTemplates(period.SegmentTemplate, set.SegmentTemplate, rep.SegmentTemplate)
+				list := firstNonNil(rep.SegmentList, set.SegmentList, period.SegmentList)
+				switch {
+				case template != nil && template.Media != "":
+					representation.Resources, err = expandSegmentTemplate(repBase, template, rep, duration)
+				case list != nil:
+					representation.Resources, err = segmentListResources(repBase, list)
+				default:
+					// SegmentBase or a bare BaseURL: the whole representation is one file
+					representation.Resources = []string{repBase.String()}
+				}
+				if err != nil {
+					return nil, err
+				}
+				representation.Resources = uniqueStrings(representation.Resources)
+				adaptationSet.Representations = append(adaptationSet.Representations, representation)
+			}
+			manifest.AdaptationSets = append(manifest.AdaptationSets, adaptationSet)
+		}
+	}
+	return manifest, nil
+}
+
+// Resources returns every URI needed to play the manifest, each once: all
+// representations, or only the highest-bandwidth one of each adaptation set
+// when topOnly is set
+func (m *Manifest) Resources(topOnly bool) []string {
+	var uris []string
+	for _, set := range m.AdaptationSets {
+		representations := set.Representations
+		if topOnly && len(representations) > 1 {
+			best := representations[0]
+			for _, rep := range representations[1:] {
+				if rep.Bandwidth > best.Bandwidth {
+					best = rep
+				}
+			}
+			representations = []Representation{best}
+		}
+		for _, rep := range representations {
+			uris = append(uris, rep.Resources...)
+		}
+	}
+	return uniqueStrings(uris)
+}
+
+// resolveBaseURL applies the first BaseURL element, if any, to base
+func resolveBaseURL(base *url.URL, baseURLs []string) (*url.URL, error) {
+	if len(baseURLs) == 0 || strings.TrimSpace(baseURLs[0]) == "" {
+		return base, nil
+	}
+	resolved, err := base.Parse(strings.TrimSpace(baseURLs[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BaseURL %q: %w", baseURLs[0], err)
+	}
+	return resolved, nil
+}
+
+func resolveReference(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %q: %w", ref, err)
+	}
+	return u.String(), nil
+}
+
+// mergeTemplates combines the SegmentTemplate elements of a period,
+// adaptation set and representation, the more specific ones overriding
+// attributes of the others
+func mergeTemplates(templates ...*mpdSegmentTemplate) *mpdSegmentTemplate {
+	var merged *mpdSegmentTemplate
+	for _, t := range templates {
+		if t == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &mpdSegmentTemplate{}
+		}
+		if t.Media != "" {
+			merged.Media = t.Media
+		}
+		if t.Initialization != "" {
+			merged.Initialization = t.Initialization
+		}
+		if t.StartNumber != nil {
+			merged.StartNumber = t.StartNumber
+		}
+		if t.Timescale != nil {
+			merged.Timescale = t.Timescale
+		}
+		if t.Duration != nil {
+			merged.Duration = t.Duration
+		}
+		if t.Timeline != nil {
+			merged.Timeline = t.Timeline
+		}
+	}
+	return merged
+}
+
+func firstNonNil(lists ...*mpdSegmentList) *mpdSegmentList {
+	for _, list := range lists {
+		if list != nil {
+			return list
+		}
+	}
+	return nil
+}
+
+// expandSegmentTemplate lists the initialization segment and every media
+// segment a SegmentTemplate describes. Segments of a template without a
+// timeline are counted from the period duration; when that is unknown, as in
+// most live manifests, only the initialization segment is listed.
+func expandSegmentTemplate(base *url.URL, t *mpdSegmentTemplate, rep mpdRepresentation, periodDuration time.Duration) ([]string, error) {
+	startNumber, timescale := int64(1), int64(1)
+	if t.StartNumber != nil {
+		startNumber = *t.StartNumber
+	}
+	if t.Timescale != nil && *t.Timescale > 0 {
+		timescale = *t.Timescale
+	}
+	periodEnd := int64(periodDuration.Seconds() * float64(timescale))
+
+	var uris []string
+	add := func(template string, number, at int64) error {
+		uri, err := resolveReference(base, expandTemplate(template, rep.ID, rep.Bandwidth, number, at))
+		if err == nil {
+			uris = append(uris, uri)
+		}
+		return err
+	}
+	if t.Initialization != "" {
+		if err := add(t.Initialization, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	number := startNumber
+	switch {
+	case t.Timeline != nil:
+		var at int64
+		for i, s := range t.Timeline.S {
+			if s.T != nil {
+				at = *s.T
+			}
+			if s.D <= 0 {
+				continue
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Repeat until the next S element or the end of the period
+				end := periodEnd
+				if i+1 < len(t.Timeline.S) && t.Timeline.S[i+1].T != nil {
+					end = *t.Timeline.S[i+1].T
+				}
+				repeat = max(int64(math.Ceil(float64(end-at)/float64(s.D)))-1, 0)
+			}
+			for r := int64(0); r <= repeat && len(uris) < maxTemplateSegments; r++ {
+				if err := add(t.Media, number, at); err != nil {
+					return nil, err
+				}
+				number++
+				at += s.D
+			}
+		}
+	case t.Duration != nil && *t.Duration > 0 && periodEnd > 0:
+		count := int64(math.Ceil(float64(periodEnd) / float64(*t.Duration)))
+		for i := int64(0); i < count && len(uris) < maxTemplateSegments; i++ {
+			if err := add(t.Media, number, i**t.Duration); err != nil {
+				return nil, err
+			}
+			number++
+		}
+	}
+	return uris, nil
+}
+
+// segmentListResources lists the URIs of a SegmentList. Entries without a
+// media attribute are byte ranges of the BaseURL file.
+func segmentListResources(base *url.URL, list *mpdSegmentList) ([]string, error) {
+	var uris []string
+	add := func(ref string) error {
+		if ref == "" {
+			uris = append(uris, base.String())
+			return nil
+		}
+		uri, err := resolveReference(base, ref)
+		if err == nil {
+			uris = append(uris, uri)
+		}
+		return err
+	}
+	if list.Initialization != nil {
+		if err := add(list.Initialization.SourceURL); err != nil {
+			return nil, err
+		}
+	}
+	for _, segment := range list.SegmentURLs {
+		if err := add(segment.Media); err != nil {
+			return nil, err
+		}
+	}
+	return uris, nil
+}
+
+var templateFormat = regexp.MustCompile(`^%0?[0-9]*d$`)
+
+// expandTemplate substitutes the $RepresentationID$, $Number$, $Time$ and
+// $Bandwidth$ identifiers of a SegmentTemplate attribute, honouring width
+// formats such as $Number%05d$
+func expandTemplate(template, id string, bandwidth, number, at int64) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(template, '$')
+		if start < 0 {
+			b.WriteString(template)
+			return b.String()
+		}
+		end := strings.IndexByte(template[start+1:], '$')
+		if end < 0 {
+			b.WriteString(template)
+			return b.String()
+		}
+		b.WriteString(template[:start])
+		identifier := template[start+1 : start+1+end]
+		template = template[start+end+2:]
+
+		name, format, hasFormat := strings.Cut(identifier, "%")
+		format = "%" + format
+		var value int64
+		switch name {
+		case "":
+			b.WriteByte('$')
+			continue
+		case "RepresentationID":
+			b.WriteString(id)
+			continue
+		case "Number":
+			value = number
+		case "Time":
+			value = at
+		case "Bandwidth":
+			value = bandwidth
+		default:
+			b.WriteString("$" + identifier + "$")
+			continue
+		}
+		if hasFormat && templateFormat.MatchString(format) {
+			b.WriteString(fmt.Sprintf(format, value))
+		} else {
+			b.WriteString(strconv.FormatInt(value, 10))
+		}
+	}
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)Y)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an xs:duration such as "PT1H2M3.5S"; years and
+// months count as 365 and 30 days
+func parseISODuration(value string) (time.Duration, error) {
+	match := isoDuration.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	units := []float64{365 * 86400, 30 * 86400, 86400, 3600, 60, 1}
+	var seconds float64
+	for i, unit := range units {
+		if match[i+1] != "" {
+			n, _ := strconv.ParseFloat(match[i+1], 64)
+			seconds += n * unit
+		}
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,171 @@
+package download
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseManifestSegmentTemplate(t *testing.T) {
+	data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet contentType="video">
+      <SegmentTemplate initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/seg-$Number%03d$.m4s" startNumber="5" timescale="1000" duration="4000"/>
+      <Representation id="v1" bandwidth="500000"/>
+      <Representation id="v2" bandwidth="3000000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <Representation id="a1" bandwidth="128000">
+        <SegmentTemplate initialization="audio/init-$Bandwidth$.mp4" media="audio/$Time$.m4s" timescale="10">
+          <SegmentTimeline>
+            <S t="0" d="20" r="1"/>
+            <S d="15"/>
+            <S t="100" d="30" r="-1"/>
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`)
+
+	manifest, err := ParseManifest("https://cdn.example/show/manifest.mpd", data)
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	if manifest.Dynamic || len(manifest.AdaptationSets) != 2 {
+		t.Fatalf("ParseManifest() = %+v", manifest)
+	}
+
+	video := manifest.AdaptationSets[0]
+	if video.ContentType != "video" || len(video.Representations) != 2 {
+		t.Fatalf("video adaptation set = %+v", video)
+	}
+	wantVideo := []string{
+		"https://cdn.example/show/media/v2/init.mp4",
+		"https://cdn.example/show/media/v2/seg-005.m4s",
+		"https://cdn.example/show/media/v2/seg-006.m4s",
+		"https://cdn.example/show/media/v2/seg-007.m4s",
+	}
+	if got := video.Representations[1].Resources; !reflect.DeepEqual(got, wantVideo) {
+		t.Errorf("v2 resources = %q", got)
+	}
+
+	audio := manifest.AdaptationSets[1]
+	if audio.ContentType != "audio" {
+		t.Errorf("audio content type = %q", audio.ContentType)
+	}
+	// 10s at timescale 10 ends the period at 100; the r="-1" entry repeats to the end
+	wantAudio := []string{
+		"https://cdn.example/show/media/audio/init-128000.mp4",
+		"https://cdn.example/show/media/audio/0.m4s",
+		"https://cdn.example/show/media/audio/20.m4s",
+		"https://cdn.example/show/media/audio/40.m4s",
+		"https://cdn.example/show/media/audio/100.m4s",
+	}
+	if got := audio.Representations[0].Resources; !reflect.DeepEqual(got, wantAudio) {
+		t.Errorf("a1 resources = %q", got)
+	}
+
+	top := manifest.Resources(true)
+	if len(top) != len(wantVideo)+len(wantAudio) || top[0] != wantVideo[0] {
+		t.Errorf("Resources(true) = %q", top)
+	}
+	if all := manifest.Resources(false); len(all) != 2*len(wantVideo)+len(wantAudio) {
+		t.Errorf("Resources(false) has %d URIs", len(all))
+	}
+}
+
+func TestParseManifestByteRanges(t *testing.T) {
+	data := []byte(`<MPD type="dynamic">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <Representation id="1" bandwidth="1000">
+        <BaseURL>https://files.example/video-1000.mp4</BaseURL>
+        <SegmentBase indexRange="800-1199"><Initialization range="0-799"/></SegmentBase>
+      </Representation>
+      <Representation id="2" bandwidth="2000">
+        <BaseURL>video-2000.mp4</BaseURL>
+        <SegmentList>
+          <Initialization range="0-499"/>
+          <SegmentURL mediaRange="500-999"/>
+          <SegmentURL mediaRange="1000-1499"/>
+        </SegmentList>
+      </Representation>
+      <Representation id="3" bandwidth="3000">
+        <SegmentList>
+          <Initialization sourceURL="three/init.mp4"/>
+          <SegmentURL media="three/1.m4s"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`)
+
+	manifest, err := ParseManifest("https://cdn.example/live/stream.mpd", data)
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	if !manifest.Dynamic {
+		t.Error("type=dynamic should mark the manifest dynamic")
+	}
+	reps := manifest.AdaptationSets[0].Representations
+	want := [][]string{
+		{"https://files.example/video-1000.mp4"},
+		{"https://cdn.example/live/video-2000.mp4"},
+		{"https://cdn.example/live/three/init.mp4", "https://cdn.example/live/three/1.m4s"},
+	}
+	for i, rep := range reps {
+		if !reflect.DeepEqual(rep.Resources, want[i]) {
+			t.Errorf("representation %s resources = %q, want %q", rep.ID, rep.Resources, want[i])
+		}
+	}
+}
+
+func TestParseManifestLiveTemplateWithoutDuration(t *testing.T) {
+	data := []byte(`<MPD type="dynamic"><Period><AdaptationSet>
+  <Representation id="v" bandwidth="1"><SegmentTemplate initialization="init.mp4" media="$Number$.m4s" duration="2"/></Representation>
+</AdaptationSet></Period></MPD>`)
+	manifest, err := ParseManifest("https://cdn.example/live.mpd", data)
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	if got := manifest.Resources(false); !reflect.DeepEqual(got, []string{"https://cdn.example/init.mp4"}) {
+		t.Errorf("Resources() = %q, want only the initialization segment", got)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"$RepresentationID$_$Number$.m4s", "720p_42.m4s"},
+		{"seg$Number%05d$-$Time$.m4s", "seg00042-9000.m4s"},
+		{"b$Bandwidth$/$$x$Unknown$", "b800000/$x$Unknown$"},
+	}
+	for _, tt := range tests {
+		if got := expandTemplate(tt.template, "720p", 800000, 42, 9000); got != tt.want {
+			t.Errorf("expandTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"PT10S":      10 * time.Second,
+		"PT1H2M3.5S": time.Hour + 2*time.Minute + 3500*time.Millisecond,
+		"P1DT1S":     24*time.Hour + time.Second,
+	}
+	for value, want := range tests {
+		if got, err := parseISODuration(value); err != nil || got != want {
+			t.Errorf("parseISODuration(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "P", "PT", "10S"} {
+		if _, err := parseISODuration(value); err == nil {
+			t.Errorf("parseISODuration(%q) should fail", value)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Playlist is an HLS master or media playlist, reduced to what caching needs.
+// All URIs are resolved against the playlist URL.
+type Playlist struct {
+	Master     bool
+	Variants   []Variant   // master: one per EXT-X-STREAM-INF
+	Renditions []Rendition // master: EXT-X-MEDIA entries that have a URI
+	Segments   []Segment   // media: in playback order
+	Ended      bool        // media: EXT-X-ENDLIST seen, so the playlist will not change
+}
+
+// Variant is a rendition listed in a master playlist
+type Variant struct {
+	URI       string
+	Bandwidth int64
+	Audio     string // EXT-X-MEDIA group IDs the variant plays with
+	Subtitles string
+}
+
+// Rendition is an alternative audio, subtitle or video playlist from EXT-X-MEDIA
+type Rendition struct {
+	URI     string
+	Type    string
+	GroupID string
+}
+
+// Segment is a media segment together with the init section and key in effect for it
+type Segment struct {
+	URI       string
+	Duration  float64
+	Sequence  int64  // media sequence number
+	Map       string // EXT-X-MAP URI, if any
+	Key       string // EXT-X-KEY URI, if any
+	KeyMethod string // EXT-X-KEY METHOD, such as AES-128, when Key is set
+	KeyIV     string // EXT-X-KEY IV as written, empty to derive it from Sequence
+}
+
+// IsPlaylistPath reports whether a URL path names an HLS playlist or a DASH manifest
+func IsPlaylistPath(urlPath string) bool {
+	return strings.EqualFold(path.Ext(urlPath), ".m3u8") || IsManifestPath(urlPath)
+}
+
+// ParsePlaylist parses an HLS playlist fetched from playlistURL
+func ParsePlaylist(playlistURL string, data []byte) (*Playlist, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q: %w", ref, err)
+		}
+		return u.String(), nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() || strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")) != "#EXTM3U" {
+		return nil, fmt.Errorf("not an HLS playlist: missing #EXTM3U")
+	}
+
+	playlist := &Playlist{}
+	var pendingVariant *Variant
+	var duration float64
+	var mapURI, keyURI, keyMethod, keyIV string
+	var sequence int64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseAttributes(value)
+			bandwidth, _ := strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			pendingVariant = &Variant{Bandwidth: bandwidth, Audio: attrs["AUDIO"], Subtitles: attrs["SUBTITLES"]}
+			playlist.Master = true
+		case tag == "#EXT-X-MEDIA":
+			attrs := parseAttributes(value)
+			if attrs["URI"] == "" {
+				continue
+			}
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			playlist.Renditions = append(playlist.Renditions, Rendition{URI: uri, Type: attrs["TYPE"], GroupID: attrs["GROUP-ID"]})
+			playlist.Master = true
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			sequence, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		case tag == "#EXTINF":
+			duration, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(value, ",")[0]), 64)
+		case tag == "#EXT-X-MAP":
+			if mapURI = parseAttributes(value)["URI"]; mapURI != "" {
+				if mapURI, err = resolve(mapURI); err != nil {
+					return nil, err
+				}
+			}
+		case tag == "#EXT-X-KEY":
+			attrs := parseAttributes(value)
+			keyURI, keyMethod, keyIV = "", "", ""
+			if attrs["METHOD"] != "NONE" && attrs["URI"] != "" {
+				if keyURI, err = resolve(attrs["URI"]); err != nil {
+					return nil, err
+				}
+				keyMethod, keyIV = attrs["METHOD"], attrs["IV"]
+			}
+		case tag == "#EXT-X-ENDLIST":
+			playlist.Ended = true
+		case strings.HasPrefix(line, "#"):
+			// Other tags and comments do not affect what gets cached
+		default:
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if pendingVariant != nil {
+				pendingVariant.URI = uri
+				playlist.Variants = append(playlist.Variants, *pendingVariant)
+				pendingVariant = nil
+				continue
+			}
+			playlist.Segments = append(playlist.Segments, Segment{
+				URI:       uri,
+				Duration:  duration,
+				Sequence:  sequence,
+				Map:       mapURI,
+				Key:       keyURI,
+				KeyMethod: keyMethod,
+				KeyIV:     keyIV,
+			})
+			duration = 0
+			sequence++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return playlist, nil
+}
+
+// parseAttributes parses an HLS attribute list such as
+// `BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"`
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.ToUpper(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		list = strings.TrimSpace(rest)
+	}
+	return attrs
+}
+
+// ChildPlaylists returns the media playlists of a master playlist to cache:
+// every variant and rendition, or only the highest-bandwidth variant and the
+// renditions in its audio and subtitle groups when topOnly is set
+func (p *Playlist) ChildPlaylists(topOnly bool) []string {
+	variants := p.Variants
+	if topOnly && len(variants) > 1 {
+		best := variants[0]
+		for _, variant := range variants[1:] {
+			if variant.Bandwidth > best.Bandwidth {
+				best = variant
+			}
+		}
+		variants = []Variant{best}
+	}
+
+	groups := make(map[string]bool)
+	var uris []string
+	for _, variant := range variants {
+		uris = append(uris, variant.URI)
+		groups[variant.Audio] = true
+		groups[variant.Subtitles] = true
+	}
+	for _, rendition := range p.Renditions {
+		if !topOnly || groups[rendition.GroupID] {
+			uris = append(uris, rendition.URI)
+		}
+	}
+	return uniqueStrings(uris)
+}
+
+// Resources returns every URI a media playlist needs for playback, each once:
+// init sections and keys before the first segment that uses them
+func (p *Playlist) Resources() []string {
+	var uris []string
+	for _, segment := range p.Segments {
+		if segment.Map != "" {
+			uris = append(uris, segment.Map)
+		}
+		if segment.Key != "" {
+			uris = append(uris, segment.Key)
+		}
+		uris = append(uris, segment.URI)
+	}
+	return uniqueStrings(uris)
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := values[:0:0]
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,106 @@
+package download
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMasterPlaylist(t *testing.T) {
+	data := []byte("\ufeff#EXTM3U\n" +
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="audio/en.m3u8"` + "\n" +
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="ac3",NAME="Surround",URI="audio/ac3.m3u8"` + "\n" +
+		`#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",INSTREAM-ID="CC1"` + "\n" +
+		`#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac"` + "\n" +
+		"low/index.m3u8\n" +
+		`#EXT-X-STREAM-INF:BANDWIDTH=5000000,AUDIO="aac"` + "\n" +
+		"https://other.example/high/index.m3u8\n" +
+		`#EXT-X-STREAM-INF:BANDWIDTH=2000000,AUDIO="ac3"` + "\n" +
+		"/mid/index.m3u8\n")
+
+	playlist, err := ParsePlaylist("https://cdn.example/video/master.m3u8?token=1", data)
+	if err != nil {
+		t.Fatalf("ParsePlaylist() error = %v", err)
+	}
+	if !playlist.Master || len(playlist.Variants) != 3 || len(playlist.Renditions) != 2 {
+		t.Fatalf("ParsePlaylist() = %+v", playlist)
+	}
+	if v := playlist.Variants[0]; v.URI != "https://cdn.example/video/low/index.m3u8" || v.Bandwidth != 800000 || v.Audio != "aac" {
+		t.Errorf("first variant = %+v", v)
+	}
+
+	all := []string{
+		"https://cdn.example/video/low/index.m3u8",
+		"https://other.example/high/index.m3u8",
+		"https://cdn.example/mid/index.m3u8",
+		"https://cdn.example/video/audio/en.m3u8",
+		"https://cdn.example/video/audio/ac3.m3u8",
+	}
+	if got := playlist.ChildPlaylists(false); !reflect.DeepEqual(got, all) {
+		t.Errorf("ChildPlaylists(false) = %q", got)
+	}
+	top := []string{"https://other.example/high/index.m3u8", "https://cdn.example/video/audio/en.m3u8"}
+	if got := playlist.ChildPlaylists(true); !reflect.DeepEqual(got, top) {
+		t.Errorf("ChildPlaylists(true) = %q", got)
+	}
+}
+
+func TestParseMediaPlaylist(t *testing.T) {
+	data := []byte(`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example/k1",IV=0x1
+#EXTINF:6.006,
+seg0.m4s
+#EXTINF:5.5,title
+seg1.m4s
+#EXT-X-KEY:METHOD=NONE
+
+#EXTINF:4,
+seg2.m4s
+#EXT-X-ENDLIST
+`)
+	playlist, err := ParsePlaylist("https://cdn.example/v/index.m3u8", data)
+	if err != nil {
+		t.Fatalf("ParsePlaylist() error = %v", err)
+	}
+	if playlist.Master || !playlist.Ended || len(playlist.Segments) != 3 {
+		t.Fatalf("ParsePlaylist() = %+v", playlist)
+	}
+	if s := playlist.Segments[1]; s.URI != "https://cdn.example/v/seg1.m4s" || s.Duration != 5.5 || s.Key != "https://keys.example/k1" {
+		t.Errorf("second segment = %+v", s)
+	}
+	if s := playlist.Segments[2]; s.Key != "" || s.Map != "https://cdn.example/v/init.mp4" {
+		t.Errorf("third segment = %+v", s)
+	}
+
+	want := []string{
+		"https://cdn.example/v/init.mp4",
+		"https://keys.example/k1",
+		"https://cdn.example/v/seg0.m4s",
+		"https://cdn.example/v/seg1.m4s",
+		"https://cdn.example/v/seg2.m4s",
+	}
+	if got := playlist.Resources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Resources() = %q", got)
+	}
+}
+
+func TestParsePlaylistRejectsOtherContent(t *testing.T) {
+	if _, err := ParsePlaylist("https://cdn.example/a.m3u8", []byte("<html></html>")); err == nil {
+		t.Error("ParsePlaylist() should reject a document without #EXTM3U")
+	}
+}
+
+func TestIsPlaylistPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/live/index.m3u8": true,
+		"/live/INDEX.M3U8": true,
+		"/live/seg1.ts":    false,
+		"/m3u8/file.mp4":   false,
+	} {
+		if got := IsPlaylistPath(path); got != want {
+			t.Errorf("IsPlaylistPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
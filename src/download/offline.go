@@ -0,0 +1,408 @@
+package download
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"mitmcdn/src/database"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotPlaylist is returned for references that name no cached HLS playlist
+	ErrNotPlaylist = errors.New("not a cached HLS playlist")
+	// ErrIncomplete is returned while some segments of a rendition are not cached yet
+	ErrIncomplete = errors.New("rendition is not fully cached")
+	// ErrNotTransportStream is returned when a rendition cannot be joined into one MPEG-TS file
+	ErrNotTransportStream = errors.New("rendition is not made of MPEG-TS segments")
+)
+
+// HLSPackager turns cached HLS playlists into offline copies: playlists
+// rewritten to the /cache/hls/ URLs UnifiedServer serves, and single MPEG-TS
+// files joining every segment of a rendition.
+type HLSPackager struct {
+	db *gorm.DB
+}
+
+// NewHLSPackager creates a packager reading cache entries from db
+func NewHLSPackager(db *gorm.DB) *HLSPackager {
+	return &HLSPackager{db: db}
+}
+
+// FindPlaylist returns the cached HLS playlist with the given hash or original URL
+func (p *HLSPackager) FindPlaylist(ref string) (*database.File, error) {
+	var file database.File
+	err := p.db.Where("(file_hash = ? OR original_url = ?) AND kind = ? AND download_status = ?", ref, ref, "hls", "complete").
+		Order("parent_hash").First(&file).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotPlaylist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// FindSegment returns a cached file a packaged playlist refers to
+func (p *HLSPackager) FindSegment(fileHash string) (*database.File, error) {
+	var file database.File
+	err := p.db.Where("file_hash = ? AND download_status = ?", fileHash, "complete").First(&file).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrIncomplete
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// readPlaylist parses the cached copy of a playlist entry
+func (p *HLSPackager) readPlaylist(file *database.File) (*Playlist, []byte, error) {
+	data, err := os.ReadFile(file.SavedPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	playlist, err := ParsePlaylist(file.OriginalURL, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return playlist, data, nil
+}
+
+// cachedEntry returns the complete cache entry for uri, preferring the one
+// prefetched for the root playlist, or nil if uri is not cached
+func (p *HLSPackager) cachedEntry(root, uri string, playlist bool) *database.File {
+	query := p.db.Where("original_url = ? AND download_status = ?", uri, "complete")
+	if playlist {
+		query = query.Where("kind = ?", "hls")
+	} else {
+		query = query.Where("kind = '' OR kind IS NULL")
+	}
+	var file database.File
+	if err := query.Order(gorm.Expr("parent_hash = ? DESC", root)).First(&file).Error; err != nil {
+		return nil
+	}
+	return &file
+}
+
+func rootHash(file *database.File) string {
+	if file.ParentHash != "" {
+		return file.ParentHash
+	}
+	return file.FileHash
+}
+
+// missingResources counts the files of a media playlist that are not cached
+func (p *HLSPackager) missingResources(root string, playlist *Playlist) int {
+	missing := 0
+	for _, uri := range playlist.Resources() {
+		if p.cachedEntry(root, uri, false) == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
+// completeMedia returns the media playlist entry for uri if it and all of its segments are cached
+func (p *HLSPackager) completeMedia(root, uri string) (*database.File, *Playlist) {
+	child := p.cachedEntry(root, uri, true)
+	if child == nil {
+		return nil, nil
+	}
+	playlist, _, err := p.readPlaylist(child)
+	if err != nil || playlist.Master || p.missingResources(root, playlist) > 0 {
+		return nil, nil
+	}
+	return child, playlist
+}
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// LocalPlaylist rewrites a cached playlist so every URI points at prefix, the
+// URL /cache/hls is served at. A master playlist keeps the variants and
+// renditions whose segments are all cached; a media playlist must be cached
+// completely and is closed with EXT-X-ENDLIST.
+func (p *HLSPackager) LocalPlaylist(file *database.File, prefix string) ([]byte, error) {
+	playlist, data, err := p.readPlaylist(file)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(file.OriginalURL)
+	if err != nil {
+		return nil, err
+	}
+	root := rootHash(file)
+	resolve := func(ref string) string {
+		if u, err := base.Parse(strings.TrimSpace(ref)); err == nil {
+			return u.String()
+		}
+		return ref
+	}
+	local := func(uri string) (string, bool) {
+		if playlist.Master {
+			if child, _ := p.completeMedia(root, resolve(uri)); child != nil {
+				return fmt.Sprintf("%s/%s/index.m3u8", prefix, child.FileHash), true
+			}
+			return "", false
+		}
+		if entry := p.cachedEntry(root, resolve(uri), false); entry != nil {
+			return fmt.Sprintf("%s/%s/seg/%s%s", prefix, file.FileHash, entry.FileHash, segmentExt(entry.OriginalURL)), true
+		}
+		return "", false
+	}
+
+	var out bytes.Buffer
+	var pendingVariant string
+	variants, missing := 0, 0
+	for _, line := range strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#EXT-X-STREAM-INF"):
+			pendingVariant = line
+			continue
+		case strings.HasPrefix(trimmed, "#EXT-X-I-FRAME-STREAM-INF"), strings.HasPrefix(trimmed, "#EXT-X-ENDLIST"):
+			continue // I-frame playlists are not prefetched; ENDLIST is added below
+		case strings.HasPrefix(trimmed, "#"):
+			if m := uriAttribute.FindStringSubmatch(line); m != nil {
+				target, ok := local(m[1])
+				if !ok {
+					if playlist.Master {
+						continue // drop a rendition that is not cached
+					}
+					missing++
+				}
+				line = strings.Replace(line, m[0], `URI="`+target+`"`, 1)
+			}
+		default:
+			target, ok := local(trimmed)
+			if playlist.Master {
+				if ok {
+					out.WriteString(pendingVariant + "\n")
+					variants++
+				}
+				pendingVariant = ""
+				if !ok {
+					continue
+				}
+			} else if !ok {
+				missing++
+			}
+			line = target
+		}
+		out.WriteString(line + "\n")
+	}
+
+	switch {
+	case playlist.Master && variants == 0:
+		return nil, fmt.Errorf("%w: no variant has all of its segments cached", ErrIncomplete)
+	case !playlist.Master && missing > 0:
+		return nil, fmt.Errorf("%w: %d of %d files missing", ErrIncomplete, missing, len(playlist.Resources()))
+	case !playlist.Master:
+		out.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return out.Bytes(), nil
+}
+
+// segmentExt returns the extension of a segment URL, so local URLs keep
+// hinting at the format
+func segmentExt(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		if ext := path.Ext(u.Path); len(ext) <= 5 {
+			return ext
+		}
+	}
+	return ""
+}
+
+// TSExport is a cached rendition ready to be written out as one MPEG-TS file
+type TSExport struct {
+	packager *HLSPackager
+	root     string
+	segments []Segment
+}
+
+// PrepareTS checks that a rendition of a cached playlist can be joined into
+// one MPEG-TS file. For a master playlist the highest-bandwidth variant whose
+// segments are all cached is used; renditions in separate audio or subtitle
+// playlists are not included.
+func (p *HLSPackager) PrepareTS(file *database.File) (*TSExport, error) {
+	playlist, _, err := p.readPlaylist(file)
+	if err != nil {
+		return nil, err
+	}
+	root := rootHash(file)
+
+	if playlist.Master {
+		var best *Playlist
+		var bestBandwidth int64 = -1
+		for _, variant := range playlist.Variants {
+			if _, media := p.completeMedia(root, variant.URI); media != nil && variant.Bandwidth > bestBandwidth {
+				best, bestBandwidth = media, variant.Bandwidth
+			}
+		}
+		if best == nil {
+			return nil, fmt.Errorf("%w: no variant has all of its segments cached", ErrIncomplete)
+		}
+		playlist = best
+	} else if missing := p.missingResources(root, playlist); missing > 0 {
+		return nil, fmt.Errorf("%w: %d of %d files missing", ErrIncomplete, missing, len(playlist.Resources()))
+	}
+
+	for _, segment := range playlist.Segments {
+		if segment.Map != "" {
+			return nil, fmt.Errorf("%w: segments are fragmented MP4", ErrNotTransportStream)
+		}
+		if segment.Key != "" && segment.KeyMethod != "AES-128" {
+			return nil, fmt.Errorf("%w: %s encryption is not supported", ErrNotTransportStream, segment.KeyMethod)
+		}
+	}
+	if len(playlist.Segments) == 0 {
+		return nil, fmt.Errorf("%w: playlist has no segments", ErrIncomplete)
+	}
+	return &TSExport{packager: p, root: root, segments: playlist.Segments}, nil
+}
+
+// WriteTo writes the segments, decrypted and joined, to w
+func (e *TSExport) WriteTo(w io.Writer) (int64, error) {
+	joiner := &tsJoiner{w: w, counters: make(map[uint16]byte)}
+	keys := make(map[string][]byte)
+	for _, segment := range e.segments {
+		entry := e.packager.cachedEntry(e.root, segment.URI, false)
+		if entry == nil {
+			return joiner.written, fmt.Errorf("%w: %s", ErrIncomplete, segment.URI)
+		}
+		data, err := os.ReadFile(entry.SavedPath)
+		if err != nil {
+			return joiner.written, err
+		}
+		if segment.Key != "" {
+			key, ok := keys[segment.Key]
+			if !ok {
+				keyEntry := e.packager.cachedEntry(e.root, segment.Key, false)
+				if keyEntry == nil {
+					return joiner.written, fmt.Errorf("%w: %s", ErrIncomplete, segment.Key)
+				}
+				if key, err = os.ReadFile(keyEntry.SavedPath); err != nil {
+					return joiner.written, err
+				}
+				keys[segment.Key] = key
+			}
+			if data, err = decryptSegment(data, key, segment); err != nil {
+				return joiner.written, fmt.Errorf("segment %s: %w", segment.URI, err)
+			}
+		}
+		if err := joiner.writeSegment(data); err != nil {
+			return joiner.written, fmt.Errorf("segment %s: %w", segment.URI, err)
+		}
+	}
+	return joiner.written, nil
+}
+
+// decryptSegment reverses AES-128 segment encryption: CBC with PKCS#7
+// padding, the IV taken from the key tag or else the media sequence number
+func decryptSegment(data, key []byte, segment Segment) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if segment.KeyIV != "" {
+		hexIV := strings.TrimPrefix(strings.TrimPrefix(segment.KeyIV, "0x"), "0X")
+		decoded, err := hex.DecodeString(fmt.Sprintf("%032s", hexIV))
+		if err != nil || len(decoded) != aes.BlockSize {
+			return nil, fmt.Errorf("invalid IV %q", segment.KeyIV)
+		}
+		iv = decoded
+	} else {
+		for i, n := aes.BlockSize-1, segment.Sequence; i >= 0 && n > 0; i, n = i-1, n>>8 {
+			iv[i] = byte(n)
+		}
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment is not a whole number of blocks")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid padding after decryption")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsNullPID    = 0x1fff
+)
+
+// tsJoiner concatenates MPEG-TS segments into one stream. Continuity
+// counters are renumbered across segment boundaries so players do not treat
+// the joins as packet loss, and bytes outside whole packets are dropped.
+type tsJoiner struct {
+	w        io.Writer
+	counters map[uint16]byte
+	written  int64
+}
+
+func (j *tsJoiner) writeSegment(data []byte) error {
+	packets := 0
+	for off := 0; off+tsPacketSize <= len(data); {
+		if data[off] != tsSyncByte || (off+tsPacketSize < len(data) && data[off+tsPacketSize] != tsSyncByte) {
+			next := findTSSync(data[off+1:])
+			if next < 0 {
+				break
+			}
+			off += 1 + next
+			continue
+		}
+		packet := data[off : off+tsPacketSize]
+		pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+		if pid != tsNullPID && packet[3]&0x10 != 0 {
+			counter, seen := j.counters[pid]
+			if seen {
+				counter = (counter + 1) & 0x0f
+			} else {
+				counter = packet[3] & 0x0f
+			}
+			j.counters[pid] = counter
+			packet[3] = packet[3]&0xf0 | counter
+		}
+		n, err := j.w.Write(packet)
+		j.written += int64(n)
+		if err != nil {
+			return err
+		}
+		packets++
+		off += tsPacketSize
+	}
+	if packets == 0 {
+		return ErrNotTransportStream
+	}
+	return nil
+}
+
+// findTSSync returns the offset of the first sync byte that is followed by
+// another one a packet later (or by the end of data), or -1
+func findTSSync(data []byte) int {
+	for i := 0; i+tsPacketSize <= len(data); i++ {
+		if data[i] == tsSyncByte && (i+tsPacketSize >= len(data) || data[i+tsPacketSize] == tsSyncByte) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,169 @@
+package download
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mitmcdn/src/database"
+
+	"gorm.io/gorm"
+)
+
+// tsPackets builds MPEG-TS packets on one PID with continuity counters from first
+func tsPackets(pid uint16, first byte, count int, fill byte) []byte {
+	var data []byte
+	for i := 0; i < count; i++ {
+		packet := bytes.Repeat([]byte{fill}, tsPacketSize)
+		packet[0] = tsSyncByte
+		packet[1] = byte(pid >> 8)
+		packet[2] = byte(pid)
+		packet[3] = 0x10 | (first+byte(i))&0x0f
+		data = append(data, packet...)
+	}
+	return data
+}
+
+func encryptAES128(t *testing.T, plain, key, iv []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	padded := append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+	return out
+}
+
+// cacheEntry stores data as a complete cache entry for url
+func cacheEntry(t *testing.T, db *gorm.DB, dir, url, kind, parent string, data []byte) *database.File {
+	t.Helper()
+	sum := sha256.Sum256([]byte(url))
+	file := &database.File{
+		FileHash:       hex.EncodeToString(sum[:]),
+		OriginalURL:    url,
+		Filename:       filepath.Base(url),
+		FileSize:       int64(len(data)),
+		SavedPath:      filepath.Join(dir, hex.EncodeToString(sum[:])),
+		DownloadStatus: "complete",
+		Kind:           kind,
+		ParentHash:     parent,
+	}
+	if err := os.WriteFile(file.SavedPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(file).Error; err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestHLSPackager(t *testing.T) {
+	_, db, _ := setupTestScheduler(t)
+	dir := t.TempDir()
+	packager := NewHLSPackager(db)
+
+	key := []byte("0123456789abcdef")
+	first := tsPackets(0x100, 3, 2, 0xaa)
+	second := tsPackets(0x100, 9, 2, 0xbb)
+	encrypted := encryptAES128(t, second, key, append(make([]byte, 15), 8))
+
+	master := cacheEntry(t, db, dir, "https://cdn.example/v/master.m3u8", "hls", "", []byte(
+		"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900\nhigh.m3u8\n"))
+	high := cacheEntry(t, db, dir, "https://cdn.example/v/high.m3u8", "hls", master.FileHash, []byte(
+		"#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:4,\nhigh-0.ts\n"+
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:4,\nhigh-1.ts\n"))
+	cacheEntry(t, db, dir, "https://cdn.example/v/low.m3u8", "hls", master.FileHash, []byte(
+		"#EXTM3U\n#EXTINF:4,\nlow-0.ts\n#EXT-X-ENDLIST\n"))
+	seg0 := cacheEntry(t, db, dir, "https://cdn.example/v/high-0.ts", "", master.FileHash, first)
+	cacheEntry(t, db, dir, "https://cdn.example/v/high-1.ts", "", master.FileHash, encrypted)
+	keyEntry := cacheEntry(t, db, dir, "https://cdn.example/v/key.bin", "", master.FileHash, key)
+
+	if found, err := packager.FindPlaylist(master.OriginalURL); err != nil || found.FileHash != master.FileHash {
+		t.Fatalf("FindPlaylist(url) = %v, %v", found, err)
+	}
+	if _, err := packager.FindPlaylist(seg0.FileHash); !errors.Is(err, ErrNotPlaylist) {
+		t.Errorf("FindPlaylist(segment) error = %v, want ErrNotPlaylist", err)
+	}
+
+	// The low variant's segment was never cached, so only high is offered
+	local, err := packager.LocalPlaylist(master, "/cache/hls")
+	if err != nil {
+		t.Fatalf("LocalPlaylist(master) error = %v", err)
+	}
+	wantMaster := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=900\n/cache/hls/" + high.FileHash + "/index.m3u8\n"
+	if string(local) != wantMaster {
+		t.Errorf("LocalPlaylist(master) =\n%s\nwant\n%s", local, wantMaster)
+	}
+
+	media, err := packager.LocalPlaylist(high, "http://proxy:8081/cache/hls")
+	if err != nil {
+		t.Fatalf("LocalPlaylist(media) error = %v", err)
+	}
+	prefix := "http://proxy:8081/cache/hls/" + high.FileHash + "/seg/"
+	for _, want := range []string{
+		"\n" + prefix + seg0.FileHash + ".ts\n",
+		`URI="` + prefix + keyEntry.FileHash + `.bin"`,
+	} {
+		if !strings.Contains(string(media), want) {
+			t.Errorf("LocalPlaylist(media) lacks %q:\n%s", want, media)
+		}
+	}
+	if !strings.HasSuffix(string(media), "#EXT-X-ENDLIST\n") || strings.Contains(string(media), "cdn.example") {
+		t.Errorf("LocalPlaylist(media) =\n%s", media)
+	}
+
+	export, err := packager.PrepareTS(master)
+	if err != nil {
+		t.Fatalf("PrepareTS() error = %v", err)
+	}
+	var out bytes.Buffer
+	if n, err := export.WriteTo(&out); err != nil || n != int64(4*tsPacketSize) {
+		t.Fatalf("WriteTo() = %d, %v", n, err)
+	}
+	joined := out.Bytes()
+	for i, want := range []byte{3, 4, 5, 6} {
+		if got := joined[i*tsPacketSize+3] & 0x0f; got != want {
+			t.Errorf("packet %d continuity counter = %d, want %d", i, got, want)
+		}
+	}
+	if joined[3*tsPacketSize+100] != 0xbb {
+		t.Error("encrypted segment was not decrypted with the sequence-number IV")
+	}
+}
+
+func TestHLSPackagerRejectsIncompleteAndFMP4(t *testing.T) {
+	_, db, _ := setupTestScheduler(t)
+	dir := t.TempDir()
+	packager := NewHLSPackager(db)
+
+	partial := cacheEntry(t, db, dir, "https://cdn.example/p/index.m3u8", "hls", "", []byte(
+		"#EXTM3U\n#EXTINF:4,\n0.ts\n#EXTINF:4,\n1.ts\n"))
+	cacheEntry(t, db, dir, "https://cdn.example/p/0.ts", "", partial.FileHash, tsPackets(0x100, 0, 1, 0))
+	if _, err := packager.LocalPlaylist(partial, "/cache/hls"); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("LocalPlaylist() error = %v, want ErrIncomplete", err)
+	}
+	if _, err := packager.PrepareTS(partial); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("PrepareTS() error = %v, want ErrIncomplete", err)
+	}
+
+	fmp4 := cacheEntry(t, db, dir, "https://cdn.example/f/index.m3u8", "hls", "", []byte(
+		"#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4,\n0.m4s\n#EXT-X-ENDLIST\n"))
+	cacheEntry(t, db, dir, "https://cdn.example/f/init.mp4", "", fmp4.FileHash, []byte("init"))
+	cacheEntry(t, db, dir, "https://cdn.example/f/0.m4s", "", fmp4.FileHash, []byte("moof"))
+	if _, err := packager.LocalPlaylist(fmp4, "/cache/hls"); err != nil {
+		t.Errorf("LocalPlaylist(fMP4) error = %v", err)
+	}
+	if _, err := packager.PrepareTS(fmp4); !errors.Is(err, ErrNotTransportStream) {
+		t.Errorf("PrepareTS(fMP4) error = %v, want ErrNotTransportStream", err)
+	}
+}
@@ -0,0 +1,368 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"mitmcdn/src/cache"
+	"mitmcdn/src/config"
+	"mitmcdn/src/database"
+)
+
+// maxPlaylistSize bounds how much of a playlist is read into memory
+const maxPlaylistSize = 8 * 1024 * 1024
+
+// streamingOptions is the scheduler's copy of config.StreamingConfig
+type streamingOptions struct {
+	prefetch       bool
+	topBitrateOnly bool
+	playlistTTL    time.Duration
+	concurrency    int
+	priority       int
+}
+
+func defaultStreamingOptions() streamingOptions {
+	return streamingOptions{
+		prefetch:    true,
+		playlistTTL: 2 * time.Second,
+		concurrency: 2,
+		priority:    10,
+	}
+}
+
+// ConfigureStreaming applies the [streaming] settings for HLS playlists and DASH manifests
+func (s *Scheduler) ConfigureStreaming(cfg config.StreamingConfig) {
+	opts := defaultStreamingOptions()
+	opts.prefetch = !cfg.DisablePrefetch
+	opts.topBitrateOnly = cfg.TopBitrateOnly
+	if ttl, err := time.ParseDuration(cfg.PlaylistTTL); err == nil && ttl >= 0 {
+		opts.playlistTTL = ttl
+	}
+	if cfg.Concurrency > 0 {
+		opts.concurrency = cfg.Concurrency
+	}
+	if cfg.Priority != 0 {
+		opts.priority = cfg.Priority
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streaming = opts
+	if cap(s.prefetchSlots) != opts.concurrency {
+		s.prefetchSlots = make(chan struct{}, opts.concurrency)
+	}
+}
+
+func (s *Scheduler) getStreaming() (streamingOptions, chan struct{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.streaming, s.prefetchSlots
+}
+
+// ServePlaylist serves an HLS playlist or DASH manifest. A cached copy
+// younger than the playlist TTL is served as is; an older one is revalidated
+// with the origin first, and served stale if the origin cannot be reached.
+// Every playlist fetched from the origin has the segments it lists queued for
+// prefetching.
+func (s *Scheduler) ServePlaylist(file *database.File, w http.ResponseWriter, r *http.Request) error {
+	cacheStatus, err := s.refreshPlaylist(file)
+	if err != nil {
+		if file.DownloadStatus != "complete" {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return err
+		}
+		log.Printf("Serving stale playlist %s: %v", file.OriginalURL, err)
+		cacheStatus = "HIT"
+	}
+	s.serveFile(file, w, r, cacheStatus)
+	return nil
+}
+
+// fileLock returns the mutex serialising playlist revalidation and sparse
+// range writes for one cache entry
+func (s *Scheduler) fileLock(fileHash string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, ok := s.fileLocks[fileHash]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.fileLocks[fileHash] = lock
+	}
+	return lock
+}
+
+// refreshPlaylist brings the cached copy of a playlist up to date, returning
+// the X-Cache status to serve it with
+func (s *Scheduler) refreshPlaylist(file *database.File) (string, error) {
+	lock := s.fileLock(file.FileHash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another request may have refreshed it while this one waited
+	var current database.File
+	if err := s.db.Where("file_hash = ?", file.FileHash).First(&current).Error; err == nil {
+		*file = current
+	}
+
+	opts, _ := s.getStreaming()
+	if file.DownloadStatus == "complete" && file.CompletedAt != nil && time.Since(*file.CompletedAt) < opts.playlistTTL {
+		return "HIT", nil
+	}
+
+	body, err := s.fetchPlaylist(file)
+	if err != nil {
+		return "", err
+	}
+	if body == nil {
+		return "HIT", nil // revalidated
+	}
+	s.prefetchPlaylist(file, body)
+	return "MISS", nil
+}
+
+// fetchPlaylist downloads a playlist into the cache, revalidating a cached
+// copy with its ETag and Last-Modified. It returns nil when the origin
+// answers 304 Not Modified.
+func (s *Scheduler) fetchPlaylist(file *database.File) ([]byte, error) {
+	req, rule, err := s.originRequest(file)
+	if err != nil {
+		return nil, err
+	}
+	// Playlists are parsed, so leave compression to the transport, which
+	// decodes what it negotiated itself, rather than to the client's codings
+	req.Header.Del("Accept-Encoding")
+	if file.DownloadStatus == "complete" {
+		stored := storedResponseHeaders(file)
+		if etag := stored.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := stored.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	if resp.StatusCode == http.StatusNotModified && file.DownloadStatus == "complete" {
+		s.db.Model(&database.File{}).Where("file_hash = ?", file.FileHash).Update("completed_at", &now)
+		file.CompletedAt = &now
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxPlaylistSize {
+		return nil, fmt.Errorf("playlist larger than %d bytes", maxPlaylistSize)
+	}
+	tempPath := file.SavedPath + ".tmp"
+	if err := os.WriteFile(tempPath, body, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tempPath, file.SavedPath); err != nil {
+		return nil, err
+	}
+
+	kind, contentType := "hls", "application/vnd.apple.mpegurl"
+	if u, err := url.Parse(file.OriginalURL); err == nil && IsManifestPath(u.Path) {
+		kind, contentType = "dash", "application/dash+xml"
+	}
+	if header := resp.Header.Get("Content-Type"); header != "" {
+		contentType = header
+	}
+	size := int64(len(body))
+	updates := map[string]interface{}{
+		"download_status":  "complete",
+		"file_size":        size,
+		"downloaded_bytes": size,
+		"content_type":     contentType,
+		"completed_at":     &now,
+		"kind":             kind,
+	}
+	if stored := rule.StoredHeaders(resp.Header); len(stored) > 0 {
+		if encoded, err := json.Marshal(stored); err == nil {
+			updates["response_headers"] = string(encoded)
+			file.ResponseHeaders = string(encoded)
+		}
+	}
+	s.db.Model(&database.File{}).Where("file_hash = ?", file.FileHash).Updates(updates)
+
+	file.DownloadStatus = "complete"
+	file.FileSize, file.DownloadedBytes = size, size
+	file.ContentType = contentType
+	file.CompletedAt = &now
+	file.Kind = kind
+	return body, nil
+}
+
+// originRequest builds a GET to the origin for file, with the client headers
+// it was keyed on and the request header rules of its CDN rule
+func (s *Scheduler) originRequest(file *database.File) (*http.Request, *config.CDNRule, error) {
+	req, err := http.NewRequest(http.MethodGet, file.OriginalURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range fileRequestKey(file, file.RequestCookie).Header() {
+		req.Header[name] = values
+	}
+	rule := s.matchRule(file.OriginalURL)
+	if rule != nil {
+		rule.RequestHeaders.Apply(req.Header)
+	}
+	s.rewriteRequest(req)
+	return req, rule, nil
+}
+
+// prefetchPlaylist queues what a freshly fetched playlist lists: the media
+// playlists of an HLS master playlist, or the segments of an HLS media
+// playlist or of the chosen representations of a DASH manifest. It runs in
+// the background, at most one pass per playlist at a time.
+func (s *Scheduler) prefetchPlaylist(file *database.File, body []byte) {
+	opts, slots := s.getStreaming()
+	if !opts.prefetch {
+		return
+	}
+	var children, resources []string
+	if file.Kind == "dash" {
+		manifest, err := ParseManifest(file.OriginalURL, body)
+		if err != nil {
+			log.Printf("Not prefetching %s: %v", file.OriginalURL, err)
+			return
+		}
+		resources = manifest.Resources(opts.topBitrateOnly)
+	} else {
+		playlist, err := ParsePlaylist(file.OriginalURL, body)
+		if err != nil {
+			log.Printf("Not prefetching %s: %v", file.OriginalURL, err)
+			return
+		}
+		if playlist.Master {
+			children = playlist.ChildPlaylists(opts.topBitrateOnly)
+		} else {
+			resources = playlist.Resources()
+		}
+	}
+
+	s.mu.Lock()
+	if s.prefetching[file.FileHash] {
+		s.mu.Unlock()
+		return
+	}
+	s.prefetching[file.FileHash] = true
+	s.mu.Unlock()
+
+	parent := *file
+	root := parent.FileHash
+	if parent.ParentHash != "" {
+		root = parent.ParentHash
+	}
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.prefetching, parent.FileHash)
+			s.mu.Unlock()
+		}()
+
+		for _, uri := range children {
+			if child := s.prefetchEntry(&parent, root, uri); child != nil {
+				if _, err := s.refreshPlaylist(child); err != nil {
+					log.Printf("Failed to fetch playlist %s: %v", uri, err)
+				}
+			}
+		}
+		s.prefetchResources(&parent, root, resources, opts.priority, slots)
+	}()
+}
+
+// prefetchResources downloads the listed segments at low priority, a bounded number at a time
+func (s *Scheduler) prefetchResources(parent *database.File, root string, uris []string, priority int, slots chan struct{}) {
+	var wg sync.WaitGroup
+	for _, uri := range uris {
+		child := s.prefetchEntry(parent, root, uri)
+		if child == nil || child.DownloadStatus == "complete" {
+			continue
+		}
+		s.mu.RLock()
+		_, queued := s.tasks[child.FileHash]
+		s.mu.RUnlock()
+		if queued {
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(child *database.File) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := s.StartDownload(child, child.OriginalURL, child.RequestCookie, priority); err != nil {
+				log.Printf("Failed to prefetch %s: %v", child.OriginalURL, err)
+				return
+			}
+			s.mu.RLock()
+			task := s.tasks[child.FileHash]
+			s.mu.RUnlock()
+			if task != nil {
+				<-task.done
+			}
+		}(child)
+	}
+	wg.Wait()
+}
+
+// prefetchEntry returns the cache entry for a URI listed in parent, keyed as
+// a client request carrying parent's cookies and headers would be, and links
+// it to the root playlist entry. URIs no CDN rule matches are skipped since
+// clients would not fetch them through the proxy.
+func (s *Scheduler) prefetchEntry(parent *database.File, root, uri string) *database.File {
+	rule := s.matchRule(uri)
+	if rule == nil {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+
+	header := fileRequestKey(parent, parent.RequestCookie).Header()
+	key := cache.RequestKey{
+		Cookie:  parent.RequestCookie,
+		Key:     rule.CacheKey(header),
+		Headers: rule.UpstreamHeaders(header),
+	}
+	child, err := s.cacheManager.GetOrCreateFileForRequest(uri, path.Base(u.Path), rule.DedupStrategy, key)
+	if err != nil {
+		if !errors.Is(err, cache.ErrVaryAll) {
+			log.Printf("Failed to create cache entry for %s: %v", uri, err)
+		}
+		return nil
+	}
+	if child.ParentHash == "" && child.FileHash != root {
+		child.ParentHash = root
+		s.db.Model(&database.File{}).Where("file_hash = ?", child.FileHash).Update("parent_hash", root)
+	}
+	return child
+}
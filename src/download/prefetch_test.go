@@ -0,0 +1,224 @@
+package download
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mitmcdn/src/cache"
+	"mitmcdn/src/config"
+	"mitmcdn/src/database"
+)
+
+func TestServePlaylistPrefetchesSegments(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Header().Set("ETag", `"master-1"`)
+			if r.Header.Get("If-None-Match") == `"master-1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900\nhigh.m3u8\n")
+		case "/low.m3u8", "/high.m3u8":
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m3u8")
+			fmt.Fprintf(w, "#EXTM3U\n#EXTINF:4,\n%s-0.ts\n#EXTINF:4,\n%s-1.ts\n#EXT-X-ENDLIST\n", name, name)
+		default:
+			w.Write([]byte("segment" + r.URL.Path))
+		}
+	}))
+	defer origin.Close()
+
+	rules, err := config.NewRuleMatcher([]config.CDNRule{{Domain: "127.0.0.1", DedupStrategy: "full_url"}})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+	sched.ConfigureRules(rules)
+	sched.ConfigureStreaming(config.StreamingConfig{TopBitrateOnly: true, PlaylistTTL: "0s"})
+
+	master, err := cacheMgr.GetOrCreateFile(origin.URL+"/master.m3u8", "", "master.m3u8", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	if err := sched.ServePlaylist(master, recorder, httptest.NewRequest(http.MethodGet, "/master.m3u8", nil)); err != nil {
+		t.Fatalf("ServePlaylist() error = %v", err)
+	}
+	if !strings.Contains(recorder.Body.String(), "high.m3u8") || recorder.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("ServePlaylist() = %q with X-Cache %q", recorder.Body.String(), recorder.Header().Get("X-Cache"))
+	}
+
+	// The top variant's segments end up cached and linked to the master playlist
+	for _, name := range []string{"high-0.ts", "high-1.ts"} {
+		var segment database.File
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if db.Where("original_url = ?", origin.URL+"/"+name).First(&segment).Error == nil && segment.DownloadStatus == "complete" {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if segment.DownloadStatus != "complete" || segment.ParentHash != master.FileHash {
+			t.Errorf("%s = status %q parent %q, want complete under %s", name, segment.DownloadStatus, segment.ParentHash, master.FileHash)
+		}
+	}
+	mu.Lock()
+	if fetched["/low.m3u8"] != 0 || fetched["/low-0.ts"] != 0 {
+		t.Errorf("lower variant was fetched: %v", fetched)
+	}
+	mu.Unlock()
+
+	progress, err := cacheMgr.PrefetchProgress(master.FileHash)
+	if err != nil || progress.Segments != 2 || progress.Complete != 2 {
+		t.Errorf("PrefetchProgress() = %+v, %v", progress, err)
+	}
+
+	// With a zero TTL the next request revalidates and is answered by the 304
+	recorder = httptest.NewRecorder()
+	sched.ServePlaylist(master, recorder, httptest.NewRequest(http.MethodGet, "/master.m3u8", nil))
+	if recorder.Header().Get("X-Cache") != "HIT" || !strings.Contains(recorder.Body.String(), "high.m3u8") {
+		t.Errorf("revalidated playlist = %q with X-Cache %q", recorder.Body.String(), recorder.Header().Get("X-Cache"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetched["/master.m3u8"] != 2 {
+		t.Errorf("master fetched %d times, want 2", fetched["/master.m3u8"])
+	}
+}
+
+func TestServePlaylistPrefetchesDASHSegments(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/show/manifest.mpd" {
+			fmt.Fprint(w, `<MPD mediaPresentationDuration="PT6S"><Period><AdaptationSet>
+  <SegmentTemplate initialization="$RepresentationID$-init.mp4" media="$RepresentationID$-$Number$.m4s" duration="2"/>
+  <Representation id="low" bandwidth="100"/>
+  <Representation id="high" bandwidth="900"/>
+</AdaptationSet></Period></MPD>`)
+			return
+		}
+		w.Write([]byte("segment" + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	rules, err := config.NewRuleMatcher([]config.CDNRule{{Domain: "127.0.0.1", DedupStrategy: "full_url"}})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+	sched.ConfigureRules(rules)
+	sched.ConfigureStreaming(config.StreamingConfig{TopBitrateOnly: true})
+
+	manifest, err := cacheMgr.GetOrCreateFile(origin.URL+"/show/manifest.mpd", "", "manifest.mpd", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	if err := sched.ServePlaylist(manifest, recorder, httptest.NewRequest(http.MethodGet, "/show/manifest.mpd", nil)); err != nil {
+		t.Fatalf("ServePlaylist() error = %v", err)
+	}
+	if manifest.Kind != "dash" {
+		t.Errorf("manifest kind = %q, want dash", manifest.Kind)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var progress cache.PrefetchProgress
+	for time.Now().Before(deadline) {
+		if progress, _ = cacheMgr.PrefetchProgress(manifest.FileHash); progress.Complete == 4 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if progress.Segments != 4 || progress.Complete != 4 {
+		t.Fatalf("PrefetchProgress() = %+v, want the init and 3 segments of the top representation", progress)
+	}
+	var low int64
+	db.Model(&database.File{}).Where("original_url LIKE ?", "%/low-%").Count(&low)
+	if low != 0 {
+		t.Errorf("%d entries for the lower representation", low)
+	}
+}
+
+func TestServePlaylistPrefetchesFromCompressedOrigin(t *testing.T) {
+	sched, _, cacheMgr := setupTestScheduler(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/media.m3u8":
+			body = "#EXTM3U\n#EXTINF:4,\nseg-0.ts\n#EXT-X-ENDLIST\n"
+		case "/manifest.mpd":
+			body = `<MPD mediaPresentationDuration="PT2S"><Period><AdaptationSet>
+  <SegmentTemplate initialization="init.mp4" media="chunk-$Number$.m4s" duration="2"/>
+  <Representation id="only" bandwidth="100"/>
+</AdaptationSet></Period></MPD>`
+		default:
+			body = "segment" + r.URL.Path
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(body))
+		gz.Close()
+	}))
+	defer origin.Close()
+
+	rules, err := config.NewRuleMatcher([]config.CDNRule{{Domain: "127.0.0.1", DedupStrategy: "full_url"}})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+	sched.ConfigureRules(rules)
+	sched.ConfigureStreaming(config.StreamingConfig{})
+
+	// The client's codings travel upstream with downloads of this entry
+	key := cache.RequestKey{Headers: http.Header{"Accept-Encoding": []string{"gzip, deflate, br"}}}
+	for _, tc := range []struct {
+		name     string
+		body     string
+		segments int64
+	}{
+		{name: "media.m3u8", body: "seg-0.ts", segments: 1},
+		{name: "manifest.mpd", body: "chunk-$Number$.m4s", segments: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			playlist, err := cacheMgr.GetOrCreateFileForRequest(origin.URL+"/"+tc.name, tc.name, "full_url", key)
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			recorder := httptest.NewRecorder()
+			if err := sched.ServePlaylist(playlist, recorder, httptest.NewRequest(http.MethodGet, "/"+tc.name, nil)); err != nil {
+				t.Fatalf("ServePlaylist() error = %v", err)
+			}
+			if !strings.Contains(recorder.Body.String(), tc.body) || recorder.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("ServePlaylist() = %q with Content-Encoding %q", recorder.Body.String(), recorder.Header().Get("Content-Encoding"))
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			var progress cache.PrefetchProgress
+			for time.Now().Before(deadline) {
+				if progress, _ = cacheMgr.PrefetchProgress(playlist.FileHash); progress.Complete == tc.segments {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if progress.Segments != tc.segments || progress.Complete != tc.segments {
+				t.Fatalf("PrefetchProgress() = %+v, want %d segments", progress, tc.segments)
+			}
+		})
+	}
+}
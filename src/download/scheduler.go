@@ -2,20 +2,21 @@ package download
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"mitmcdn/src/cache"
+	"mitmcdn/src/config"
 	"mitmcdn/src/database"
 
 	"gorm.io/gorm"
@@ -29,6 +30,16 @@ type Scheduler struct {
 	tasks        map[string]*Task // fileHash -> task
 	priorityChan chan *Task       // Priority queue
 	ytDLPCommand []string
+	rules        *config.RuleMatcher // header rules for upstream requests and cached responses
+	requestHook  func(*http.Request) // plugin rewriting upstream requests, or nil
+
+	backends       map[string]backend // downloaders by name: "http", "yt-dlp" and configured ones
+	backendSchemes map[string]string  // URL scheme -> name of the backend fetching it
+
+	streaming     streamingOptions
+	prefetchSlots chan struct{}          // bounds concurrent prefetched segment downloads
+	prefetching   map[string]bool        // playlist hashes with a prefetch pass running
+	fileLocks     map[string]*sync.Mutex // serialises playlist revalidation and sparse writes per entry
 }
 
 type Task struct {
@@ -43,7 +54,9 @@ type Task struct {
 	pauseChan  chan struct{}
 	resumeChan chan struct{}
 	file       *database.File
-	dataChan   chan []byte // Channel for streaming data to clients
+	backend    backend
+	dataChan   chan []byte   // Channel for streaming data to clients
+	done       chan struct{} // closed once the task completes or fails
 	closeOnce  sync.Once
 	streamMu   sync.RWMutex
 	streamers  []io.Writer // Active streamers (clients receiving data)
@@ -72,13 +85,21 @@ func NewScheduler(cacheManager *cache.Manager, db *gorm.DB, upstreamProxy string
 
 // NewSchedulerWithClient creates a scheduler with a custom HTTP client (useful for testing)
 func NewSchedulerWithClient(cacheManager *cache.Manager, db *gorm.DB, upstreamProxy string, httpClient *http.Client) (*Scheduler, error) {
+	streaming := defaultStreamingOptions()
+	backends, backendSchemes := defaultBackends()
 	return &Scheduler{
-		cacheManager: cacheManager,
-		db:           db,
-		httpClient:   httpClient,
-		tasks:        make(map[string]*Task),
-		priorityChan: make(chan *Task, 100),
-		ytDLPCommand: []string{"yt-dlp"},
+		cacheManager:   cacheManager,
+		db:             db,
+		httpClient:     httpClient,
+		tasks:          make(map[string]*Task),
+		priorityChan:   make(chan *Task, 100),
+		ytDLPCommand:   []string{"yt-dlp"},
+		backends:       backends,
+		backendSchemes: backendSchemes,
+		streaming:      streaming,
+		prefetchSlots:  make(chan struct{}, streaming.concurrency),
+		prefetching:    make(map[string]bool),
+		fileLocks:      make(map[string]*sync.Mutex),
 	}, nil
 }
 
@@ -89,6 +110,59 @@ func (s *Scheduler) ConfigureYTDLPCommand(command []string) {
 	s.ytDLPCommand = append([]string(nil), command...)
 }
 
+// ConfigureDialContext sets how the download client connects to origins
+func (s *Scheduler) ConfigureDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transport, ok := s.httpClient.Transport.(*http.Transport)
+	if !ok {
+		if s.httpClient.Transport != nil {
+			return
+		}
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		s.httpClient.Transport = transport
+	}
+	transport.DialContext = dial
+}
+
+// ConfigureRules sets the CDN rules whose header settings apply to downloads and cached responses
+func (s *Scheduler) ConfigureRules(rules *config.RuleMatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = rules
+}
+
+// ConfigureRequestHook sets a function that rewrites every upstream HTTP
+// request after the CDN rule headers are applied
+func (s *Scheduler) ConfigureRequestHook(hook func(*http.Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requestHook = hook
+}
+
+// rewriteRequest runs the request hook on req
+func (s *Scheduler) rewriteRequest(req *http.Request) {
+	s.mu.RLock()
+	hook := s.requestHook
+	s.mu.RUnlock()
+
+	if hook != nil {
+		hook(req)
+	}
+}
+
+// matchRule returns the CDN rule for url, or nil
+func (s *Scheduler) matchRule(url string) *config.CDNRule {
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+
+	return rules.MatchURL(url, nil)
+}
+
 func (s *Scheduler) getYTDLPCommand() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -115,6 +189,10 @@ func (s *Scheduler) GetActiveTaskCount() int {
 
 // StartDownload starts or resumes downloading a file
 func (s *Scheduler) StartDownload(file *database.File, url, cookie string, priority int) error {
+	return s.startDownload(file, url, cookie, priority, s.backendFor(url))
+}
+
+func (s *Scheduler) startDownload(file *database.File, url, cookie string, priority int, backend backend) error {
 	s.mu.Lock()
 	task, exists := s.tasks[file.FileHash]
 	if exists {
@@ -130,8 +208,11 @@ func (s *Scheduler) StartDownload(file *database.File, url, cookie string, prior
 		}
 
 		if status == "paused" {
-			// Resume paused task
-			task.resumeChan <- struct{}{}
+			// Resume paused task; it may not have reached its pause point yet
+			select {
+			case task.resumeChan <- struct{}{}:
+			default:
+			}
 		}
 		return nil
 	}
@@ -149,12 +230,15 @@ func (s *Scheduler) StartDownload(file *database.File, url, cookie string, prior
 		pauseChan:  make(chan struct{}),
 		resumeChan: make(chan struct{}),
 		file:       file,
+		backend:    backend,
 		dataChan:   make(chan []byte, 10), // Buffered channel for streaming
+		done:       make(chan struct{}),
 		streamers:  make([]io.Writer, 0),
 	}
 
 	s.tasks[file.FileHash] = task
 	s.mu.Unlock()
+	s.resetSparseFile(file)
 
 	// Start download in goroutine
 	go func() {
@@ -164,6 +248,7 @@ func (s *Scheduler) StartDownload(file *database.File, url, cookie string, prior
 			}
 		}()
 		s.downloadTask(task)
+		s.resumePausedTasks()
 	}()
 
 	return nil
@@ -199,6 +284,32 @@ func (s *Scheduler) PauseLowPriorityTasks(minPriority int) {
 	}
 }
 
+// resumePausedTasks resumes paused tasks that no longer yield to a
+// higher-priority download
+func (s *Scheduler) resumePausedTasks() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	highest := -1 << 31
+	for _, task := range s.tasks {
+		task.mu.Lock()
+		if task.Status == "downloading" && task.Priority > highest {
+			highest = task.Priority
+		}
+		task.mu.Unlock()
+	}
+	for _, task := range s.tasks {
+		task.mu.Lock()
+		if task.Status == "paused" && task.Priority >= highest {
+			select {
+			case task.resumeChan <- struct{}{}:
+			default:
+			}
+		}
+		task.mu.Unlock()
+	}
+}
+
 // downloadTask performs the actual download
 func (s *Scheduler) downloadTask(task *Task) {
 	task.mu.Lock()
@@ -210,11 +321,12 @@ func (s *Scheduler) downloadTask(task *Task) {
 		"download_status": "downloading",
 	})
 
-	if videoID, ok := extractYTDLPVideoID(task.URL); ok {
-		s.downloadYTDLPTask(task, videoID)
-		return
-	}
+	task.backend.download(s, task)
+}
 
+// downloadHTTPTask fetches a task's URL with the HTTP client, resuming a
+// partial file and feeding streaming clients as data arrives
+func (s *Scheduler) downloadHTTPTask(task *Task) {
 	// Check if file already exists and get current size
 	fileInfo, err := os.Stat(task.file.SavedPath)
 	var startOffset int64 = 0
@@ -229,10 +341,19 @@ func (s *Scheduler) downloadTask(task *Task) {
 		return
 	}
 
-	if task.Cookie != "" {
-		req.Header.Set("Cookie", task.Cookie)
+	// Send the client headers the entry was keyed on, so the origin picks the
+	// same variant its Vary header will describe
+	clientHeader := requestKeyFor(task).Header()
+	for name, values := range clientHeader {
+		req.Header[name] = values
 	}
 
+	rule := s.matchRule(task.URL)
+	if rule != nil {
+		rule.RequestHeaders.Apply(req.Header)
+	}
+	s.rewriteRequest(req)
+
 	if startOffset > 0 {
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startOffset))
 	}
@@ -286,6 +407,22 @@ func (s *Scheduler) downloadTask(task *Task) {
 		task.file.ContentType = contentType
 		task.mu.Unlock()
 	}
+	if stored := rule.StoredHeaders(resp.Header); len(stored) > 0 {
+		if encoded, err := json.Marshal(stored); err == nil {
+			updates["response_headers"] = string(encoded)
+			task.mu.Lock()
+			task.file.ResponseHeaders = string(encoded)
+			task.mu.Unlock()
+		}
+	}
+	vary := cache.NormalizeVary(resp.Header.Values("Vary"))
+	varyValues := cache.VaryValues(vary, clientHeader)
+	task.mu.Lock()
+	if vary != task.file.Vary || varyValues != task.file.VaryValues {
+		updates["vary"], updates["vary_values"] = vary, varyValues
+		task.file.Vary, task.file.VaryValues = vary, varyValues
+	}
+	task.mu.Unlock()
 	if len(updates) > 0 {
 		s.db.Model(&database.File{}).Where("file_hash = ?", task.FileHash).Updates(updates)
 	}
@@ -358,117 +495,20 @@ func (s *Scheduler) downloadTask(task *Task) {
 	}
 }
 
-func extractYTDLPVideoID(rawURL string) (string, bool) {
-	parsed, err := url.Parse(rawURL)
-	if err != nil || parsed.Scheme != "yt-dlp" {
-		return "", false
-	}
-
-	videoID := parsed.Host
-	if videoID == "" {
-		videoID = strings.TrimPrefix(parsed.Path, "/")
-	}
-	videoID = strings.TrimSpace(videoID)
-	if videoID == "" {
-		return "", false
-	}
-
-	return videoID, true
+// requestKeyFor rebuilds the client request headers stored with a task's file
+func requestKeyFor(task *Task) cache.RequestKey {
+	return fileRequestKey(task.file, task.Cookie)
 }
 
-func (s *Scheduler) downloadYTDLPTask(task *Task, videoID string) {
-	command := s.getYTDLPCommand()
-	if len(command) == 0 {
-		s.handleDownloadError(task, fmt.Errorf("yt-dlp command is empty"))
-		return
-	}
-
-	if err := os.MkdirAll(filepath.Dir(task.file.SavedPath), 0755); err != nil {
-		s.handleDownloadError(task, err)
-		return
-	}
-
-	tempPath := task.file.SavedPath + ".part"
-	_ = os.Remove(tempPath)
-
-	args := append([]string{}, command[1:]...)
-	sourceURL := fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID)
-	args = append(args,
-		"--no-part",
-		"--no-continue",
-		"--no-playlist",
-		"-o", tempPath,
-		sourceURL,
-	)
-
-	cmd := exec.CommandContext(task.ctx, command[0], args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		s.handleDownloadError(task, fmt.Errorf("yt-dlp failed: %w: %s", err, strings.TrimSpace(string(output))))
-		return
-	}
-
-	// yt-dlp may append a different extension after merging formats
-	// (e.g. ".part.webm" instead of ".part"), so glob for the actual output file.
-	actualPath := tempPath
-	if _, statErr := os.Stat(tempPath); os.IsNotExist(statErr) {
-		matches, _ := filepath.Glob(tempPath + ".*")
-		if len(matches) == 1 {
-			actualPath = matches[0]
-		} else if len(matches) > 1 {
-			// Pick the largest file (the merged output)
-			var best string
-			var bestSize int64
-			for _, m := range matches {
-				if fi, e := os.Stat(m); e == nil && fi.Size() > bestSize {
-					best = m
-					bestSize = fi.Size()
-				}
-			}
-			actualPath = best
+// fileRequestKey rebuilds the client request headers stored with file
+func fileRequestKey(file *database.File, cookie string) cache.RequestKey {
+	key := cache.RequestKey{Cookie: cookie}
+	if file.RequestHeaders != "" {
+		if err := json.Unmarshal([]byte(file.RequestHeaders), &key.Headers); err != nil {
+			log.Printf("Ignoring invalid request headers for %s: %v", file.FileHash, err)
 		}
 	}
-
-	if err := os.Rename(actualPath, task.file.SavedPath); err != nil {
-		s.handleDownloadError(task, fmt.Errorf("failed to finalize yt-dlp output: %w", err))
-		return
-	}
-
-	info, err := os.Stat(task.file.SavedPath)
-	if err != nil {
-		s.handleDownloadError(task, err)
-		return
-	}
-
-	// Determine content type from the actual file extension yt-dlp produced.
-	contentType := "video/mp4"
-	if actualPath != tempPath {
-		switch strings.ToLower(filepath.Ext(actualPath)) {
-		case ".webm":
-			contentType = "video/webm"
-		case ".mkv":
-			contentType = "video/x-matroska"
-		case ".mp4":
-			contentType = "video/mp4"
-		}
-	}
-
-	now := time.Now()
-	s.db.Model(&database.File{}).Where("file_hash = ?", task.FileHash).Updates(map[string]interface{}{
-		"download_status":  "complete",
-		"downloaded_bytes": info.Size(),
-		"file_size":        info.Size(),
-		"content_type":     contentType,
-		"completed_at":     &now,
-	})
-
-	task.mu.Lock()
-	task.Status = "complete"
-	task.file.ContentType = contentType
-	task.file.FileSize = info.Size()
-	task.mu.Unlock()
-
-	s.closeTaskDataChan(task)
+	return key
 }
 
 func (s *Scheduler) handleDownloadError(task *Task, err error) {
@@ -495,15 +535,21 @@ func (s *Scheduler) handleDownloadError(task *Task, err error) {
 func (s *Scheduler) closeTaskDataChan(task *Task) {
 	task.closeOnce.Do(func() {
 		close(task.dataChan)
+		close(task.done)
 	})
 }
 
 // StreamFile streams a file to client while downloading (if not complete)
 // Implements "stream tapping" - downloads from upstream while streaming to client
 func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *http.Request) error {
+	return s.StreamFileWithPriority(file, w, r, 100)
+}
+
+// StreamFileWithPriority is StreamFile with the priority used if a download has to be started
+func (s *Scheduler) StreamFileWithPriority(file *database.File, w http.ResponseWriter, r *http.Request, priority int) error {
 	// If file is complete, serve directly
 	if file.DownloadStatus == "complete" {
-		http.ServeFile(w, r, file.SavedPath)
+		s.ServeFile(file, w, r)
 		return nil
 	}
 
@@ -527,9 +573,9 @@ func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *ht
 	}
 
 	if needsStart {
-		// Start download with high priority (don't hold lock to avoid deadlock)
-		s.PauseLowPriorityTasks(100)
-		if err := s.StartDownload(file, file.OriginalURL, file.RequestCookie, 100); err != nil {
+		// Start download with the requested priority (don't hold lock to avoid deadlock)
+		s.PauseLowPriorityTasks(priority)
+		if err := s.StartDownload(file, file.OriginalURL, file.RequestCookie, priority); err != nil {
 			return fmt.Errorf("failed to start download: %w", err)
 		}
 		// Get the task we just created
@@ -541,6 +587,13 @@ func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *ht
 			return fmt.Errorf("task not found after creation")
 		}
 	}
+	if !task.backend.streams() {
+		cacheStatus := "STREAM"
+		if needsStart {
+			cacheStatus = "MISS"
+		}
+		return s.serveWhenDone(task, file, w, r, cacheStatus)
+	}
 
 	// Open file for reading existing content first
 	currentSize := int64(0)
@@ -591,6 +644,7 @@ func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *ht
 		status := task.Status
 		contentType := task.file.ContentType
 		fileSize := task.file.FileSize
+		responseHeaders := task.file.ResponseHeaders
 		task.mu.Unlock()
 
 		if status == "failed" && currentSize == 0 {
@@ -601,6 +655,7 @@ func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *ht
 			// Update the file parameter with values from task
 			file.ContentType = contentType
 			file.FileSize = fileSize
+			file.ResponseHeaders = responseHeaders
 			break
 		}
 		time.Sleep(50 * time.Millisecond)
@@ -613,12 +668,22 @@ func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *ht
 		return s.writeDownloadError(w, file.FileHash)
 	}
 
-	// Set headers for streaming
+	// Set headers for streaming; MISS when this request started the download
 	contentType := file.ContentType
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 	w.Header().Set("Content-Type", contentType)
+	if needsStart {
+		w.Header().Set("X-Cache", "MISS")
+	} else {
+		w.Header().Set("X-Cache", "STREAM")
+	}
+	s.writeOriginHeaders(file, w.Header())
+	if checkNotModified(r, w.Header()) {
+		writeNotModified(w)
+		return nil
+	}
 
 	// Set Content-Length if we know the total size (from upstream Content-Length)
 	// This allows proper connection termination
@@ -667,6 +732,179 @@ func (s *Scheduler) StreamFile(file *database.File, w http.ResponseWriter, r *ht
 	}
 }
 
+// serveWhenDone waits for a download whose backend cannot stream to clients
+// and serves the finished file
+func (s *Scheduler) serveWhenDone(task *Task, file *database.File, w http.ResponseWriter, r *http.Request, cacheStatus string) error {
+	select {
+	case <-task.done:
+	case <-r.Context().Done():
+		return nil
+	}
+
+	var current database.File
+	if err := s.db.Where("file_hash = ?", file.FileHash).First(&current).Error; err != nil {
+		return err
+	}
+	if current.DownloadStatus != "complete" {
+		return s.writeDownloadError(w, file.FileHash)
+	}
+	*file = current
+	s.serveFile(file, w, r, cacheStatus)
+	return nil
+}
+
+// ServeFile serves a completed download as a cache hit, replaying the origin
+// headers stored with it. Range and conditional requests are answered against
+// the origin ETag and Last-Modified.
+func (s *Scheduler) ServeFile(file *database.File, w http.ResponseWriter, r *http.Request) {
+	s.serveFile(file, w, r, "HIT")
+}
+
+// serveFile serves a completed download with the given X-Cache status
+func (s *Scheduler) serveFile(file *database.File, w http.ResponseWriter, r *http.Request, cacheStatus string) {
+	f, err := os.Open(file.SavedPath)
+	if err != nil {
+		http.Error(w, "Cached file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Cached file not readable", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	if file.ContentType != "" {
+		header.Set("Content-Type", file.ContentType)
+	}
+	header.Set("X-Cache", cacheStatus)
+	s.writeOriginHeaders(file, header)
+
+	cachedAt := info.ModTime()
+	if file.CompletedAt != nil {
+		cachedAt = *file.CompletedAt
+	}
+	header.Set("Age", strconv.FormatInt(cacheAge(header.Get("Age"), cachedAt), 10))
+
+	modTime := info.ModTime()
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		modTime = lastModified
+	}
+	http.ServeContent(w, r, file.Filename, modTime, f)
+}
+
+// ServeHead answers a HEAD request from what is known about file without
+// starting a download. It returns false when neither a completed file nor an
+// in-progress download has headers yet, so the caller should ask upstream.
+func (s *Scheduler) ServeHead(file *database.File, w http.ResponseWriter, r *http.Request) bool {
+	if file.DownloadStatus == "complete" {
+		s.ServeFile(file, w, r)
+		return true
+	}
+
+	s.mu.RLock()
+	task := s.tasks[file.FileHash]
+	s.mu.RUnlock()
+	if task == nil {
+		return false
+	}
+
+	task.mu.Lock()
+	status := task.Status
+	known := *task.file
+	task.mu.Unlock()
+	if status == "failed" || known.ContentType == "" {
+		return false
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", known.ContentType)
+	header.Set("X-Cache", "STREAM")
+	s.writeOriginHeaders(&known, header)
+	if checkNotModified(r, header) {
+		writeNotModified(w)
+		return true
+	}
+	if known.FileSize > 0 {
+		header.Set("Content-Length", strconv.FormatInt(known.FileSize, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// checkNotModified evaluates If-None-Match, or failing that If-Modified-Since,
+// against the validators already set on header
+func checkNotModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// writeNotModified sends a 304, dropping the headers that describe a body
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// cacheAge is the Age of a cached response: the Age the origin reported plus
+// the whole seconds since the file was stored
+func cacheAge(originAge string, cachedAt time.Time) int64 {
+	age, _ := strconv.ParseInt(originAge, 10, 64)
+	if age < 0 {
+		age = 0
+	}
+	if elapsed := time.Since(cachedAt); elapsed > 0 {
+		age += int64(elapsed / time.Second)
+	}
+	return age
+}
+
+// writeOriginHeaders copies the stored origin headers of file into header and
+// applies the response header rules of its CDN rule
+func (s *Scheduler) writeOriginHeaders(file *database.File, header http.Header) {
+	for name, values := range storedResponseHeaders(file) {
+		header[name] = values
+	}
+	if rule := s.matchRule(file.OriginalURL); rule != nil {
+		rule.ResponseHeaders.Apply(header)
+	}
+}
+
+// storedResponseHeaders decodes the origin headers stored with file
+func storedResponseHeaders(file *database.File) http.Header {
+	var stored http.Header
+	if file.ResponseHeaders != "" {
+		if err := json.Unmarshal([]byte(file.ResponseHeaders), &stored); err != nil {
+			log.Printf("Ignoring invalid stored headers for %s: %v", file.FileHash, err)
+		}
+	}
+	return stored
+}
+
 func (s *Scheduler) writeDownloadError(w http.ResponseWriter, fileHash string) error {
 	// Get error message from logs
 	var logEntry database.Log
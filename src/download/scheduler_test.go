@@ -4,13 +4,16 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"mitmcdn/src/cache"
+	"mitmcdn/src/config"
 	"mitmcdn/src/database"
 
 	"gorm.io/gorm"
@@ -350,6 +353,119 @@ printf 'fake-video-content' > "$out"`)
 	}
 }
 
+func TestStartDownloadYTDLPProgressAndMetadata(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	release := filepath.Join(t.TempDir(), "release")
+	scriptPath := createFakeYTDLPScript(t, `out=""
+thumb=""
+sub=""
+while [ "$#" -gt 0 ]; do
+  if [ "$1" = "-o" ]; then
+    case "$2" in
+      thumbnail:*) thumb="${2#thumbnail:}" ;;
+      subtitle:*) sub="${2#subtitle:}" ;;
+      *) out="$2" ;;
+    esac
+    shift 2
+    continue
+  fi
+  shift
+done
+echo '{"title": "Fake Video", "duration": 12.5, "thumbnail": "https://i.ytimg.com/vi/x/hq.jpg", "ext": "webm", "filesize_approx": 18, "subtitles": {"en": [{"ext": "vtt", "name": "English"}]}}'
+echo "[mitmcdn-progress] 5 20 $out"
+while [ ! -e "`+release+`" ]; do sleep 0.02; done
+printf '0123456789abcdefghij' > "$out"
+echo "[mitmcdn-progress] 20 20 $out"
+printf 'jpeg' > "${thumb%".%(ext)s"}.jpg"
+printf 'WEBVTT\n' > "${sub%".%(ext)s"}.en.vtt"`)
+	sched.ConfigureYTDLPCommand([]string{scriptPath})
+
+	url := "yt-dlp://ProgressVid"
+	file, err := cacheMgr.GetOrCreateFile(url, "", "ProgressVid.mp4", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := sched.StartDownload(file, file.OriginalURL, "", 100); err != nil {
+		t.Fatalf("StartDownload failed: %v", err)
+	}
+
+	// Progress and metadata are visible before yt-dlp exits
+	deadline := time.Now().Add(3 * time.Second)
+	var running database.File
+	for time.Now().Before(deadline) {
+		db.Where("file_hash = ?", file.FileHash).First(&running)
+		if running.DownloadedBytes == 5 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if running.DownloadStatus != "downloading" || running.DownloadedBytes != 5 || running.FileSize != 20 {
+		t.Fatalf("while downloading: status=%s downloaded=%d size=%d", running.DownloadStatus, running.DownloadedBytes, running.FileSize)
+	}
+	if meta, err := ReadMediaMetadata(&running); err != nil || meta == nil || meta.Title != "Fake Video" {
+		t.Fatalf("metadata while downloading = %+v, %v", meta, err)
+	}
+	if err := os.WriteFile(release, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := waitForFileStatus(t, db, file.FileHash, "complete", 3*time.Second)
+	if updated.ContentType != "video/webm" {
+		t.Errorf("content type = %q, want video/webm from the reported container", updated.ContentType)
+	}
+	if updated.FileSize != 20 || updated.DownloadedBytes != 20 {
+		t.Errorf("size = %d/%d, want 20/20", updated.DownloadedBytes, updated.FileSize)
+	}
+
+	meta, err := ReadMediaMetadata(&updated)
+	if err != nil || meta == nil {
+		t.Fatalf("ReadMediaMetadata() = %v, %v", meta, err)
+	}
+	if meta.Duration != 12.5 || meta.ThumbnailURL != "https://i.ytimg.com/vi/x/hq.jpg" {
+		t.Errorf("metadata = %+v", meta)
+	}
+	if meta.Thumbnail != updated.SavedPath+".thumb.jpg" {
+		t.Errorf("thumbnail = %q", meta.Thumbnail)
+	}
+	if len(meta.Subtitles) != 1 || meta.Subtitles[0].Lang != "en" || meta.Subtitles[0].Name != "English" ||
+		meta.Subtitles[0].Path != updated.SavedPath+".sub.en.vtt" {
+		t.Errorf("subtitles = %+v", meta.Subtitles)
+	}
+}
+
+func TestYTDLPProgress(t *testing.T) {
+	p := &ytdlpProgress{expected: 150, files: make(map[string][2]int64)}
+
+	steps := []struct {
+		line                  string
+		wantDownloaded, total int64
+	}{
+		{"[mitmcdn-progress] 10 100 /tmp/v.f137.mp4", 10, 150},
+		{"[mitmcdn-progress] 100 100 /tmp/v.f137.mp4", 100, 150},
+		{"[mitmcdn-progress] 20 NA /tmp/v.f140.m4a", 120, 150},
+		{"[mitmcdn-progress] 30 80.5 /tmp/v.f140.m4a", 130, 180},
+	}
+	for _, step := range steps {
+		downloaded, total, ok := p.add(step.line)
+		if !ok || downloaded != step.wantDownloaded || total != step.total {
+			t.Errorf("add(%q) = %d, %d, %v; want %d, %d", step.line, downloaded, total, ok, step.wantDownloaded, step.total)
+		}
+	}
+	if _, _, ok := p.add("[mitmcdn-progress] NA NA"); ok {
+		t.Error("add() accepted a line without downloaded bytes")
+	}
+}
+
+func TestYTDLPFormat(t *testing.T) {
+	if got := ytdlpFormat("yt-dlp://XZnZkASrArc?format=bv%2A%2Bba%2Fb"); got != "bv*+ba/b" {
+		t.Errorf("ytdlpFormat() = %q", got)
+	}
+	if id, ok := extractYTDLPVideoID("yt-dlp://XZnZkASrArc?format=best"); !ok || id != "XZnZkASrArc" {
+		t.Errorf("extractYTDLPVideoID() = %q, %v", id, ok)
+	}
+}
+
 func TestStartDownloadYTDLPFailure(t *testing.T) {
 	sched, db, cacheMgr := setupTestScheduler(t)
 
@@ -378,3 +494,134 @@ exit 7`)
 		t.Fatalf("unexpected log message: %q", logEntry.Message)
 	}
 }
+
+func TestDownloadHeaderRules(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	var gotUA, gotReferer, gotDebug string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA, gotReferer, gotDebug = r.Header.Get("User-Agent"), r.Header.Get("Referer"), r.Header.Get("X-Debug")
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Disposition", `attachment; filename="movie.mp4"`)
+		w.Header().Set("Access-Control-Allow-Origin", "https://origin.example")
+		w.Header().Set("X-Internal", "secret")
+		w.Write([]byte("movie-bytes"))
+	}))
+	defer origin.Close()
+
+	rules, err := config.NewRuleMatcher([]config.CDNRule{{
+		Domain: "127.0.0.1",
+		RequestHeaders: config.HeaderRules{
+			Set:    map[string]string{"User-Agent": "mitmcdn-test", "Referer": "https://player.example/"},
+			Remove: []string{"X-Debug"},
+		},
+		ResponseHeaders: config.HeaderRules{
+			Set: map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+		StoreHeaders: []string{"content-disposition", "Access-Control-Allow-Origin"},
+	}})
+	if err != nil {
+		t.Fatalf("NewRuleMatcher() error = %v", err)
+	}
+	sched.ConfigureRules(rules)
+
+	file, err := cacheMgr.GetOrCreateFile(origin.URL+"/movie.mp4", "", "movie.mp4", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := sched.StartDownload(file, file.OriginalURL, "", 100); err != nil {
+		t.Fatalf("StartDownload failed: %v", err)
+	}
+	updated := waitForFileStatus(t, db, file.FileHash, "complete", 3*time.Second)
+
+	if gotUA != "mitmcdn-test" || gotReferer != "https://player.example/" || gotDebug != "" {
+		t.Errorf("origin saw User-Agent=%q Referer=%q X-Debug=%q", gotUA, gotReferer, gotDebug)
+	}
+
+	recorder := httptest.NewRecorder()
+	sched.ServeFile(&updated, recorder, httptest.NewRequest(http.MethodGet, "/movie.mp4", nil))
+	header := recorder.Result().Header
+	if got := header.Get("Content-Disposition"); got != `attachment; filename="movie.mp4"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if got := header.Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the rule override", got)
+	}
+	if got := header.Get("X-Internal"); got != "" {
+		t.Errorf("unlisted header X-Internal was replayed: %q", got)
+	}
+	if recorder.Body.String() != "movie-bytes" {
+		t.Errorf("body = %q", recorder.Body.String())
+	}
+}
+
+func TestServeFileReplaysOriginHeaders(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Header().Set("Set-Cookie", "session=origin")
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	file, err := cacheMgr.GetOrCreateFile(origin.URL+"/clip", "", "clip", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	// The request that starts the download is a MISS
+	miss := httptest.NewRecorder()
+	if err := sched.StreamFile(file, miss, httptest.NewRequest(http.MethodGet, "/clip", nil)); err != nil {
+		t.Fatalf("StreamFile failed: %v", err)
+	}
+	if got := miss.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("first response X-Cache = %q, want MISS", got)
+	}
+	if got := miss.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+		t.Errorf("streamed Cache-Control = %q", got)
+	}
+
+	updated := waitForFileStatus(t, db, file.FileHash, "complete", 3*time.Second)
+	past := time.Now().Add(-90 * time.Second)
+	updated.CompletedAt = &past
+
+	hit := httptest.NewRecorder()
+	sched.ServeFile(&updated, hit, httptest.NewRequest(http.MethodGet, "/clip", nil))
+	header := hit.Result().Header
+	for name, want := range map[string]string{
+		"X-Cache":       "HIT",
+		"Content-Type":  "video/mp4",
+		"Cache-Control": "public, max-age=86400",
+		"ETag":          `"v1"`,
+		"Last-Modified": lastModified.Format(http.TimeFormat),
+		"Set-Cookie":    "",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("hit %s = %q, want %q", name, got, want)
+		}
+	}
+	if age, _ := strconv.Atoi(header.Get("Age")); age < 90 || age > 100 {
+		t.Errorf("hit Age = %q, want about 90", header.Get("Age"))
+	}
+
+	conditional := httptest.NewRequest(http.MethodGet, "/clip", nil)
+	conditional.Header.Set("If-None-Match", `"v1"`)
+	notModified := httptest.NewRecorder()
+	sched.ServeFile(&updated, notModified, conditional)
+	if notModified.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d, want 304", notModified.Code)
+	}
+
+	ranged := httptest.NewRequest(http.MethodGet, "/clip", nil)
+	ranged.Header.Set("Range", "bytes=2-4")
+	partial := httptest.NewRecorder()
+	sched.ServeFile(&updated, partial, ranged)
+	if partial.Code != http.StatusPartialContent || partial.Body.String() != "234" {
+		t.Errorf("Range response = %d %q, want 206 \"234\"", partial.Code, partial.Body.String())
+	}
+}
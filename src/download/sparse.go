@@ -0,0 +1,467 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mitmcdn/src/database"
+)
+
+// byteRange is a half-open interval [Start, End) of a cached file
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// rangeSet is a sorted list of disjoint, non-adjacent byte ranges
+type rangeSet []byteRange
+
+func decodeRanges(encoded string) rangeSet {
+	var ranges rangeSet
+	if encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &ranges); err != nil {
+			log.Printf("Ignoring invalid cached ranges %q: %v", encoded, err)
+			return nil
+		}
+	}
+	return ranges
+}
+
+func (rs rangeSet) encode() string {
+	if rs == nil {
+		rs = rangeSet{}
+	}
+	encoded, _ := json.Marshal(rs)
+	return string(encoded)
+}
+
+// add returns the set with [start, end) included
+func (rs rangeSet) add(start, end int64) rangeSet {
+	if start >= end {
+		return rs
+	}
+	merged := make(rangeSet, 0, len(rs)+1)
+	for _, r := range rs {
+		if r.End < start || r.Start > end {
+			merged = append(merged, r)
+			continue
+		}
+		start, end = min(start, r.Start), max(end, r.End)
+	}
+	merged = append(merged, byteRange{start, end})
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Start < merged[j].Start })
+	return merged
+}
+
+// missing returns the parts of [start, end) the set does not cover
+func (rs rangeSet) missing(start, end int64) rangeSet {
+	var gaps rangeSet
+	for _, r := range rs {
+		if r.End <= start || r.Start >= end {
+			continue
+		}
+		if r.Start > start {
+			gaps = append(gaps, byteRange{start, r.Start})
+		}
+		start = r.End
+		if start >= end {
+			return gaps
+		}
+	}
+	return append(gaps, byteRange{start, end})
+}
+
+// prefix returns how many bytes from the start of the file the set covers
+func (rs rangeSet) prefix() int64 {
+	if len(rs) == 0 || rs[0].Start > 0 {
+		return 0
+	}
+	return rs[0].End
+}
+
+func (rs rangeSet) size() int64 {
+	var total int64
+	for _, r := range rs {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// parseByteRange parses a Range header asking for one bounded range,
+// "bytes=first-last", into a half-open interval
+func parseByteRange(header string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || first == "" || last == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end + 1, true
+}
+
+// parseContentRange parses "bytes first-last/total"; total is -1 when the
+// origin reports it as "*"
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	interval, size, hasSize := strings.Cut(spec, "/")
+	first, last, hasLast := strings.Cut(interval, "-")
+	if !found || !hasSize || !hasLast {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+	return start, end + 1, total, nil
+}
+
+// ServeRange answers a request for one bounded byte range of an entry that is
+// not cached completely. Such entries are cached sparsely: the first time a
+// URL is asked for by range, only the requested bytes are fetched from the
+// origin and written in place, and later ranges add to the same file until it
+// is complete. Segments addressed by byte ranges into one file, as in DASH
+// SegmentBase representations, thus share one cache entry.
+//
+// ServeRange returns false, having written nothing, for requests it does not
+// handle: other Range forms, entries already downloaded from the start, and
+// origins that ignore Range.
+func (s *Scheduler) ServeRange(file *database.File, w http.ResponseWriter, r *http.Request) (bool, error) {
+	start, end, ok := parseByteRange(r.Header.Get("Range"))
+	if !ok || file.DownloadStatus == "complete" {
+		return false, nil
+	}
+
+	end, cacheStatus, err := s.cacheRange(file, start, end)
+	switch {
+	case err == errRangeIgnored:
+		return false, nil
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return true, err
+	case cacheStatus == "":
+		return false, nil
+	case cacheStatus == relayStatus:
+		return s.relayRange(file, w, r, start, end)
+	}
+	s.writeCachedRange(file, w, r, start, end, cacheStatus)
+	return true, nil
+}
+
+// relayStatus is the cacheRange status for ranges to pass through from the origin
+const relayStatus = "RELAY"
+
+var (
+	errRangeIgnored = errors.New("origin does not support range requests")
+	errRangeChanged = errors.New("origin content changed")
+)
+
+// cacheRange makes [start, end) of a sparse entry available in its file,
+// fetching what is missing. It returns the range end clamped to the file
+// size and the X-Cache status to answer with: "" when the entry is not
+// cached sparsely, or relayStatus when a full download of the entry has not
+// reached the range yet.
+func (s *Scheduler) cacheRange(file *database.File, start, end int64) (int64, string, error) {
+	lock := s.fileLock(file.FileHash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var current database.File
+	if err := s.db.Where("file_hash = ?", file.FileHash).First(&current).Error; err == nil {
+		*file = current
+	}
+	requestedEnd := end
+	if file.DownloadStatus == "complete" {
+		return end, "", nil
+	}
+	onDisk := int64(0)
+	if info, err := os.Stat(file.SavedPath); err == nil {
+		onDisk = info.Size()
+	}
+	sequential := s.hasActiveTask(file.FileHash)
+	if file.Ranges == "" && (sequential || onDisk > 0) {
+		return end, "", nil // downloaded from the start, not sparsely
+	}
+	if file.FileSize > 0 {
+		if start >= file.FileSize {
+			return end, "", nil
+		}
+		end = min(end, file.FileSize)
+	}
+
+	cached := decodeRanges(file.Ranges)
+	if sequential {
+		// A full download is filling the file from the start; only read from it
+		if len(cached.add(0, onDisk).missing(start, end)) > 0 {
+			return end, relayStatus, nil
+		}
+		return end, "STREAM", nil
+	}
+
+	gaps := cached.missing(start, end)
+	if len(gaps) == 0 {
+		return end, "HIT", nil
+	}
+	cached, err := s.fetchRange(file, cached, gaps[0].Start, gaps[len(gaps)-1].End)
+	if err == errRangeChanged {
+		// The cached ranges were discarded; fetch the whole range afresh
+		end = requestedEnd
+		cached, err = s.fetchRange(file, nil, start, end)
+	}
+	if err != nil {
+		return end, "", err
+	}
+	if file.FileSize > 0 {
+		end = min(end, file.FileSize)
+	}
+	if len(cached.missing(start, end)) > 0 {
+		return end, "", fmt.Errorf("origin returned a short range for %s", file.OriginalURL)
+	}
+	return end, "MISS", nil
+}
+
+// hasActiveTask reports whether a full download of the entry is queued or running
+func (s *Scheduler) hasActiveTask(fileHash string) bool {
+	s.mu.RLock()
+	task := s.tasks[fileHash]
+	s.mu.RUnlock()
+	if task == nil {
+		return false
+	}
+	task.mu.Lock()
+	defer task.mu.Unlock()
+	return task.Status == "pending" || task.Status == "downloading" || task.Status == "paused"
+}
+
+// fetchRange downloads [start, end) of a sparse entry into its file and
+// records it, returning the updated set of cached ranges. The request carries
+// If-Range with the validator stored with the cached ranges; when the origin
+// answers with the whole content or with other validators, the entry is
+// reset and errRangeIgnored or errRangeChanged returned.
+func (s *Scheduler) fetchRange(file *database.File, cached rangeSet, start, end int64) (rangeSet, error) {
+	req, rule, err := s.originRequest(file)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	var stored http.Header
+	if len(cached) > 0 {
+		stored = storedResponseHeaders(file)
+		if validator := ifRangeValidator(stored); validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if len(cached) > 0 {
+			s.resetSparse(file)
+		}
+		return nil, errRangeIgnored
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	first, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if len(cached) > 0 && (validatorsDiffer(stored, resp.Header) || (total > 0 && file.FileSize > 0 && total != file.FileSize)) {
+		log.Printf("Discarding cached ranges of %s: the origin content changed", file.OriginalURL)
+		s.resetSparse(file)
+		return nil, errRangeChanged
+	}
+
+	f, err := os.OpenFile(file.SavedPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	written, copyErr := io.Copy(io.NewOffsetWriter(f, first), resp.Body)
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	cached = cached.add(first, first+written)
+
+	updates := map[string]interface{}{"ranges": cached.encode()}
+	if total > 0 {
+		updates["file_size"] = total
+		file.FileSize = total
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		updates["content_type"] = contentType
+		file.ContentType = contentType
+	}
+	if stored := rule.StoredHeaders(resp.Header); len(stored) > 0 {
+		if encoded, err := json.Marshal(stored); err == nil {
+			updates["response_headers"] = string(encoded)
+			file.ResponseHeaders = string(encoded)
+		}
+	}
+	downloaded := cached.size()
+	updates["downloaded_bytes"] = downloaded
+	file.DownloadedBytes = downloaded
+	if file.FileSize > 0 && cached.prefix() >= file.FileSize {
+		now := time.Now()
+		updates["download_status"], updates["completed_at"] = "complete", &now
+		file.DownloadStatus, file.CompletedAt = "complete", &now
+	}
+	file.Ranges = updates["ranges"].(string)
+	s.db.Model(&database.File{}).Where("file_hash = ?", file.FileHash).Updates(updates)
+
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	return cached, nil
+}
+
+// resetSparse discards the cached ranges of an entry along with its file
+func (s *Scheduler) resetSparse(file *database.File) {
+	if err := os.Truncate(file.SavedPath, 0); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to truncate %s: %v", file.SavedPath, err)
+	}
+	s.db.Model(&database.File{}).Where("file_hash = ?", file.FileHash).Updates(map[string]interface{}{
+		"ranges":           "",
+		"file_size":        0,
+		"downloaded_bytes": 0,
+		"response_headers": "",
+	})
+	file.Ranges, file.FileSize, file.DownloadedBytes, file.ResponseHeaders = "", 0, 0, ""
+}
+
+// ifRangeValidator returns the stored validator to send as If-Range: a
+// strong ETag, or else Last-Modified
+func ifRangeValidator(stored http.Header) string {
+	if etag := stored.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return stored.Get("Last-Modified")
+}
+
+// validatorsDiffer reports whether a response carries another ETag or
+// Last-Modified than the ones stored with the cached ranges
+func validatorsDiffer(stored, header http.Header) bool {
+	if etag := stored.Get("ETag"); etag != "" && header.Get("ETag") != "" {
+		return etag != header.Get("ETag")
+	}
+	if lastModified := stored.Get("Last-Modified"); lastModified != "" && header.Get("Last-Modified") != "" {
+		return lastModified != header.Get("Last-Modified")
+	}
+	return false
+}
+
+// writeCachedRange answers with [start, end) of the entry's file
+func (s *Scheduler) writeCachedRange(file *database.File, w http.ResponseWriter, r *http.Request, start, end int64, cacheStatus string) {
+	f, err := os.Open(file.SavedPath)
+	if err != nil {
+		http.Error(w, "Cache file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	total := "*"
+	if file.FileSize > 0 {
+		total = strconv.FormatInt(file.FileSize, 10)
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("X-Cache", cacheStatus)
+	s.writeOriginHeaders(file, header)
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end-1, total))
+	header.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method != http.MethodHead {
+		io.Copy(w, io.NewSectionReader(f, start, end-start))
+	}
+}
+
+// relayRange passes a range the running full download has not reached yet
+// straight through from the origin
+func (s *Scheduler) relayRange(file *database.File, w http.ResponseWriter, r *http.Request, start, end int64) (bool, error) {
+	req, _, err := s.originRequest(file)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := s.httpClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return false, nil
+	}
+	for _, name := range []string{"Content-Type", "Content-Range", "Content-Length"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.Header().Set("X-Cache", "MISS")
+	s.writeOriginHeaders(file, w.Header())
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.Copy(w, resp.Body)
+	return true, err
+}
+
+// resetSparseFile prepares a sparse entry for a full download from the
+// start: the file is cut back to its leading cached bytes, which the download
+// then resumes from
+func (s *Scheduler) resetSparseFile(file *database.File) {
+	if file.Ranges == "" {
+		return
+	}
+	lock := s.fileLock(file.FileHash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var current database.File
+	if err := s.db.Where("file_hash = ?", file.FileHash).First(&current).Error; err != nil {
+		return
+	}
+	prefix := decodeRanges(current.Ranges).prefix()
+	if err := os.Truncate(current.SavedPath, prefix); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to truncate sparse file %s: %v", current.SavedPath, err)
+	}
+	ranges := rangeSet{}.add(0, prefix).encode()
+	s.db.Model(&database.File{}).Where("file_hash = ?", file.FileHash).Updates(map[string]interface{}{
+		"ranges":           ranges,
+		"downloaded_bytes": prefix,
+	})
+	file.Ranges, file.DownloadedBytes = ranges, prefix
+}
@@ -0,0 +1,221 @@
+package download
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mitmcdn/src/database"
+)
+
+func TestRangeSet(t *testing.T) {
+	var rs rangeSet
+	rs = rs.add(10, 20).add(30, 40).add(20, 25)
+	if got := rs.encode(); got != `[{"start":10,"end":25},{"start":30,"end":40}]` {
+		t.Fatalf("add() = %s", got)
+	}
+	if gaps := rs.missing(0, 50); len(gaps) != 3 || gaps[0] != (byteRange{0, 10}) || gaps[1] != (byteRange{25, 30}) || gaps[2] != (byteRange{40, 50}) {
+		t.Errorf("missing(0, 50) = %v", gaps)
+	}
+	if gaps := rs.missing(12, 24); len(gaps) != 0 {
+		t.Errorf("missing(12, 24) = %v, want none", gaps)
+	}
+	if rs.prefix() != 0 || rs.size() != 25 {
+		t.Errorf("prefix() = %d, size() = %d", rs.prefix(), rs.size())
+	}
+	if rs = rs.add(0, 10); rs.prefix() != 25 {
+		t.Errorf("prefix() = %d after filling the start", rs.prefix())
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	if start, end, ok := parseByteRange("bytes=100-199"); !ok || start != 100 || end != 200 {
+		t.Errorf("parseByteRange() = %d, %d, %v", start, end, ok)
+	}
+	for _, header := range []string{"", "bytes=100-", "bytes=-100", "bytes=0-1,5-6", "bytes=9-3", "items=0-1"} {
+		if _, _, ok := parseByteRange(header); ok {
+			t.Errorf("parseByteRange(%q) should not be handled", header)
+		}
+	}
+}
+
+func TestServeRangeCachesSparsely(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var mu sync.Mutex
+	var requested []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	file, err := cacheMgr.GetOrCreateFile(origin.URL+"/video.mp4", "", "video.mp4", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+		r.Header.Set("Range", rangeHeader)
+		w := httptest.NewRecorder()
+		served, err := sched.ServeRange(file, w, r)
+		if !served || err != nil {
+			t.Fatalf("ServeRange(%s) = %v, %v", rangeHeader, served, err)
+		}
+		return w
+	}
+
+	w := get("bytes=100-199")
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(content[100:200]) {
+		t.Fatalf("first range = %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 100-199/1000" || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("first range headers = %v", w.Header())
+	}
+
+	// Overlapping ranges only fetch the missing part; covered ones are hits
+	get("bytes=150-299")
+	if w := get("bytes=120-280"); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != string(content[120:281]) {
+		t.Errorf("covered range = %q with X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	mu.Lock()
+	if strings.Join(requested, ",") != "bytes=100-199,bytes=200-299" {
+		t.Errorf("origin saw ranges %q", requested)
+	}
+	mu.Unlock()
+
+	var rows int64
+	db.Model(&database.File{}).Count(&rows)
+	var stored database.File
+	db.Where("file_hash = ?", file.FileHash).First(&stored)
+	if rows != 1 || stored.Ranges != `[{"start":100,"end":300}]` || stored.FileSize != 1000 || stored.DownloadedBytes != 200 {
+		t.Fatalf("%d rows, entry %+v", rows, stored)
+	}
+
+	// A full download resumes from the cached prefix, of which there is none yet
+	if err := sched.StartDownload(&stored, stored.OriginalURL, "", 100); err != nil {
+		t.Fatalf("StartDownload failed: %v", err)
+	}
+	waitForFileStatus(t, db, file.FileHash, "complete", 3*time.Second)
+	data, err := os.ReadFile(stored.SavedPath)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("completed file has %d bytes, want the origin content", len(data))
+	}
+}
+
+func TestServeRangeOriginWithoutRanges(t *testing.T) {
+	sched, _, cacheMgr := setupTestScheduler(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("whole-body"))
+	}))
+	defer origin.Close()
+
+	file, err := cacheMgr.GetOrCreateFile(origin.URL+"/file.bin", "", "file.bin", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	w := httptest.NewRecorder()
+	if served, err := sched.ServeRange(file, w, r); served || err != nil {
+		t.Errorf("ServeRange() = %v, %v, want the request left to the full download", served, err)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("ServeRange() wrote %q", w.Body.String())
+	}
+}
+
+func TestServeRangeDiscardsChangedContent(t *testing.T) {
+	sched, db, cacheMgr := setupTestScheduler(t)
+
+	var mu sync.Mutex
+	content, etag := bytes.Repeat([]byte("a"), 1000), `"v1"`
+	honorIfRange := true
+	var ifRange []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ifRange = append(ifRange, r.Header.Get("If-Range"))
+		if !honorIfRange {
+			r.Header.Del("If-Range")
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	file, err := cacheMgr.GetOrCreateFile(origin.URL+"/video.mp4", "", "video.mp4", "full_url")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	serve := func(rangeHeader string) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+		r.Header.Set("Range", rangeHeader)
+		w := httptest.NewRecorder()
+		served, err := sched.ServeRange(file, w, r)
+		if err != nil {
+			t.Fatalf("ServeRange(%s) failed: %v", rangeHeader, err)
+		}
+		return w, served
+	}
+	entry := func() database.File {
+		var stored database.File
+		db.Where("file_hash = ?", file.FileHash).First(&stored)
+		return stored
+	}
+	change := func(fill string, newETag string) {
+		mu.Lock()
+		content, etag = bytes.Repeat([]byte(fill), 1000), newETag
+		mu.Unlock()
+	}
+
+	if _, served := serve("bytes=0-99"); !served {
+		t.Fatal("first range was not served")
+	}
+
+	// The origin answers If-Range with the whole new content: the cached
+	// ranges are dropped and the request left to the full download
+	change("b", `"v2"`)
+	if _, served := serve("bytes=50-149"); served {
+		t.Fatal("a changed entry should be left to the full download")
+	}
+	mu.Lock()
+	if got := ifRange[len(ifRange)-1]; got != `"v1"` {
+		t.Errorf("If-Range = %q, want the stored ETag", got)
+	}
+	mu.Unlock()
+	if stored := entry(); stored.Ranges != "" || stored.DownloadedBytes != 0 {
+		t.Fatalf("entry after a 200 = %+v", stored)
+	}
+	if info, err := os.Stat(file.SavedPath); err == nil && info.Size() != 0 {
+		t.Errorf("cached file still has %d bytes", info.Size())
+	}
+
+	// An origin ignoring If-Range is caught by its ETag: the old ranges are
+	// discarded and the request refetched as a whole
+	if w, served := serve("bytes=0-99"); !served || w.Body.String() != strings.Repeat("b", 100) {
+		t.Fatalf("range after reset = %v %q", served, w.Body.String())
+	}
+	mu.Lock()
+	honorIfRange = false
+	mu.Unlock()
+	change("c", `"v3"`)
+	w, served := serve("bytes=50-149")
+	if !served || w.Body.String() != strings.Repeat("c", 100) {
+		t.Fatalf("range across changed content = %v %q", served, w.Body.String())
+	}
+	if stored := entry(); stored.Ranges != `[{"start":50,"end":150}]` || stored.DownloadedBytes != 100 {
+		t.Errorf("entry after a changed 206 = %+v", stored)
+	}
+}
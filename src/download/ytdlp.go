@@ -0,0 +1,391 @@
+package download
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mitmcdn/src/database"
+)
+
+// ytdlpProgressPrefix marks the progress lines yt-dlp prints through --progress-template
+const ytdlpProgressPrefix = "[mitmcdn-progress]"
+
+// ytdlpProgressTemplate makes yt-dlp print one parseable line per progress
+// update: downloaded bytes, total (or estimated) bytes and the file being
+// written, which changes when video and audio are fetched separately
+const ytdlpProgressTemplate = "download:" + ytdlpProgressPrefix +
+	" %(progress.downloaded_bytes)s %(progress.total_bytes,progress.total_bytes_estimate)s %(progress.filename)s"
+
+// MediaMetadata describes a video fetched with yt-dlp. It is stored as JSON
+// in the Metadata column of its cache entry; the thumbnail and subtitle files
+// are saved beside the cached video.
+type MediaMetadata struct {
+	Title        string     `json:"title,omitempty"`
+	Duration     float64    `json:"duration,omitempty"` // seconds
+	ThumbnailURL string     `json:"thumbnail_url,omitempty"`
+	Thumbnail    string     `json:"thumbnail,omitempty"` // path of the cached thumbnail
+	Subtitles    []Subtitle `json:"subtitles,omitempty"`
+}
+
+// Subtitle is a cached subtitle track of a video
+type Subtitle struct {
+	Lang string `json:"lang"`
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+}
+
+// ReadMediaMetadata decodes the metadata stored with file, returning nil when there is none
+func ReadMediaMetadata(file *database.File) (*MediaMetadata, error) {
+	if file.Metadata == "" {
+		return nil, nil
+	}
+	var meta MediaMetadata
+	if err := json.Unmarshal([]byte(file.Metadata), &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// ytdlpInfo is the part of yt-dlp's --dump-json output that is kept
+type ytdlpInfo struct {
+	Title            string  `json:"title"`
+	Duration         float64 `json:"duration"`
+	Thumbnail        string  `json:"thumbnail"`
+	Ext              string  `json:"ext"`
+	Filesize         float64 `json:"filesize"`
+	FilesizeApprox   float64 `json:"filesize_approx"`
+	RequestedFormats []struct {
+		Filesize       float64 `json:"filesize"`
+		FilesizeApprox float64 `json:"filesize_approx"`
+	} `json:"requested_formats"`
+	Subtitles map[string][]struct {
+		Name string `json:"name"`
+	} `json:"subtitles"`
+}
+
+// expectedSize estimates the download size before yt-dlp reports progress
+func (info *ytdlpInfo) expectedSize() int64 {
+	if len(info.RequestedFormats) > 0 {
+		var total float64
+		for _, format := range info.RequestedFormats {
+			if format.Filesize > 0 {
+				total += format.Filesize
+			} else {
+				total += format.FilesizeApprox
+			}
+		}
+		return int64(total)
+	}
+	if info.Filesize > 0 {
+		return int64(info.Filesize)
+	}
+	return int64(info.FilesizeApprox)
+}
+
+// ytdlpProgress sums the progress yt-dlp reports for each file it writes
+type ytdlpProgress struct {
+	expected   int64
+	files      map[string][2]int64 // filename -> downloaded, total
+	lastUpdate time.Time
+}
+
+// add records a progress line and returns the downloaded and total bytes so far
+func (p *ytdlpProgress) add(line string) (downloaded, total int64, ok bool) {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, ytdlpProgressPrefix)), " ", 3)
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	done, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size, _ := strconv.ParseFloat(fields[1], 64) // "NA" while unknown
+	name := ""
+	if len(fields) == 3 {
+		name = fields[2]
+	}
+	p.files[name] = [2]int64{int64(done), int64(size)}
+
+	for _, file := range p.files {
+		downloaded += file[0]
+		total += max(file[0], file[1])
+	}
+	return downloaded, max(total, p.expected), true
+}
+
+// EmbedCacheURL returns the URL a video embedded from provider is cached
+// under, as served on /cache/<provider>/<id>/. YouTube videos ("yt") keep the
+// yt-dlp://<id> URL they have always been cached under.
+func EmbedCacheURL(provider, id string) string {
+	if provider == "yt" {
+		return "yt-dlp://" + id
+	}
+	return "embed://" + provider + "/" + id
+}
+
+func extractYTDLPVideoID(rawURL string) (string, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "yt-dlp" {
+		return "", false
+	}
+
+	videoID := parsed.Host
+	if videoID == "" {
+		videoID = strings.TrimPrefix(parsed.Path, "/")
+	}
+	videoID = strings.TrimSpace(videoID)
+	if videoID == "" {
+		return "", false
+	}
+
+	return videoID, true
+}
+
+// ytdlpFormat returns the -f selector carried in a yt-dlp:// download URL's
+// "format" query parameter; the cache entry itself is keyed without it
+func ytdlpFormat(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Query().Get("format")
+}
+
+// ytdlpSourceURL returns the page yt-dlp downloads for a URL: the YouTube
+// watch page of a yt-dlp://<video-id> URL, or any other URL as it is
+func ytdlpSourceURL(rawURL string) string {
+	if videoID, ok := extractYTDLPVideoID(rawURL); ok {
+		return fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID)
+	}
+	return rawURL
+}
+
+func (s *Scheduler) downloadYTDLPTask(task *Task) {
+	command := s.getYTDLPCommand()
+	if len(command) == 0 {
+		s.handleDownloadError(task, fmt.Errorf("yt-dlp command is empty"))
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(task.file.SavedPath), 0755); err != nil {
+		s.handleDownloadError(task, err)
+		return
+	}
+
+	tempPath := task.file.SavedPath + ".part"
+	_ = os.Remove(tempPath)
+
+	args := append([]string{}, command[1:]...)
+	sourceURL := ytdlpSourceURL(task.URL)
+	args = append(args,
+		"--no-part",
+		"--no-continue",
+		"--no-playlist",
+		"--newline",
+		"--progress",
+		"--progress-template", ytdlpProgressTemplate,
+		"--dump-json",
+		"--no-simulate",
+		"--write-thumbnail",
+		"--write-subs",
+		"--sub-format", "vtt/best",
+		"-o", "thumbnail:"+task.file.SavedPath+".thumb.%(ext)s",
+		"-o", "subtitle:"+task.file.SavedPath+".sub.%(ext)s",
+		"-o", tempPath,
+	)
+	if format := ytdlpFormat(task.URL); format != "" {
+		args = append(args, "-f", format)
+	}
+	args = append(args, sourceURL)
+
+	cmd := exec.CommandContext(task.ctx, command[0], args...)
+	stderr := &tailBuffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.handleDownloadError(task, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.handleDownloadError(task, fmt.Errorf("yt-dlp failed: %w", err))
+		return
+	}
+
+	info := s.readYTDLPOutput(task, stdout, stderr)
+	if err := cmd.Wait(); err != nil {
+		s.handleDownloadError(task, fmt.Errorf("yt-dlp failed: %w: %s", err, stderr.String()))
+		return
+	}
+
+	// yt-dlp may append a different extension after merging formats
+	// (e.g. ".part.webm" instead of ".part"), so glob for the actual output file.
+	actualPath := tempPath
+	if _, statErr := os.Stat(tempPath); os.IsNotExist(statErr) {
+		matches, _ := filepath.Glob(tempPath + ".*")
+		if len(matches) == 1 {
+			actualPath = matches[0]
+		} else if len(matches) > 1 {
+			// Pick the largest file (the merged output)
+			var best string
+			var bestSize int64
+			for _, m := range matches {
+				if fi, e := os.Stat(m); e == nil && fi.Size() > bestSize {
+					best = m
+					bestSize = fi.Size()
+				}
+			}
+			actualPath = best
+		}
+	}
+
+	if err := os.Rename(actualPath, task.file.SavedPath); err != nil {
+		s.handleDownloadError(task, fmt.Errorf("failed to finalize yt-dlp output: %w", err))
+		return
+	}
+
+	// Prefer the container yt-dlp reported, then the extension it produced
+	contentType := ""
+	if info != nil {
+		contentType = ytdlpContentType(info.Ext)
+	}
+	if contentType == "" && actualPath != tempPath {
+		contentType = ytdlpContentType(strings.TrimPrefix(filepath.Ext(actualPath), "."))
+	}
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+
+	var extra map[string]interface{}
+	if encoded, err := json.Marshal(ytdlpMetadata(task.file.SavedPath, info)); err == nil {
+		extra = map[string]interface{}{"metadata": string(encoded)}
+		task.mu.Lock()
+		task.file.Metadata = string(encoded)
+		task.mu.Unlock()
+	}
+	s.completeDownload(task, contentType, extra)
+}
+
+// readYTDLPOutput follows yt-dlp's stdout until it exits, recording the video
+// metadata and live progress in the cache entry. It returns the metadata
+// yt-dlp printed, or nil.
+func (s *Scheduler) readYTDLPOutput(task *Task, stdout io.Reader, stderr *tailBuffer) *ytdlpInfo {
+	var info *ytdlpInfo
+	progress := &ytdlpProgress{files: make(map[string][2]int64)}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // the info JSON can be large
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, ytdlpProgressPrefix):
+			downloaded, total, ok := progress.add(line)
+			if !ok || (time.Since(progress.lastUpdate) < progressInterval && downloaded < total) {
+				continue
+			}
+			progress.lastUpdate = time.Now()
+			s.recordProgress(task, downloaded, total)
+		case strings.HasPrefix(line, "{") && info == nil:
+			var parsed ytdlpInfo
+			if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+				stderr.Write([]byte(line + "\n"))
+				continue
+			}
+			info = &parsed
+			progress.expected = parsed.expectedSize()
+			s.recordYTDLPInfo(task, info)
+		default:
+			stderr.Write([]byte(line + "\n"))
+		}
+	}
+	return info
+}
+
+// recordYTDLPInfo stores what yt-dlp reported before downloading, so the
+// status and player pages can show it while the download runs
+func (s *Scheduler) recordYTDLPInfo(task *Task, info *ytdlpInfo) {
+	updates := map[string]interface{}{}
+	if encoded, err := json.Marshal(ytdlpMetadata("", info)); err == nil {
+		updates["metadata"] = string(encoded)
+	}
+	if contentType := ytdlpContentType(info.Ext); contentType != "" {
+		updates["content_type"] = contentType
+	}
+	if size := info.expectedSize(); size > 0 {
+		updates["file_size"] = size
+	}
+	if len(updates) == 0 {
+		return
+	}
+	s.db.Model(&database.File{}).Where("file_hash = ?", task.FileHash).Updates(updates)
+
+	task.mu.Lock()
+	if encoded, ok := updates["metadata"].(string); ok {
+		task.file.Metadata = encoded
+	}
+	if contentType, ok := updates["content_type"].(string); ok {
+		task.file.ContentType = contentType
+	}
+	task.mu.Unlock()
+}
+
+// ytdlpMetadata builds the stored metadata from yt-dlp's info and, once the
+// download has finished, the thumbnail and subtitle files saved beside savedPath
+func ytdlpMetadata(savedPath string, info *ytdlpInfo) *MediaMetadata {
+	meta := &MediaMetadata{}
+	if info != nil {
+		meta.Title = info.Title
+		meta.Duration = info.Duration
+		meta.ThumbnailURL = info.Thumbnail
+	}
+	if savedPath == "" {
+		return meta
+	}
+
+	if matches, _ := filepath.Glob(savedPath + ".thumb.*"); len(matches) > 0 {
+		meta.Thumbnail = matches[0]
+	}
+	subtitles, _ := filepath.Glob(savedPath + ".sub.*.*")
+	sort.Strings(subtitles)
+	for _, path := range subtitles {
+		// <savedPath>.sub.<lang>.<ext>
+		lang := strings.TrimSuffix(strings.TrimPrefix(path, savedPath+".sub."), filepath.Ext(path))
+		subtitle := Subtitle{Lang: lang, Path: path}
+		if info != nil && len(info.Subtitles[lang]) > 0 {
+			subtitle.Name = info.Subtitles[lang][0].Name
+		}
+		meta.Subtitles = append(meta.Subtitles, subtitle)
+	}
+	return meta
+}
+
+// ytdlpContentType maps a container extension reported by yt-dlp to a MIME type
+func ytdlpContentType(ext string) string {
+	switch strings.ToLower(ext) {
+	case "":
+		return ""
+	case "mp4", "m4v":
+		return "video/mp4"
+	case "webm":
+		return "video/webm"
+	case "mkv":
+		return "video/x-matroska"
+	case "m4a":
+		return "audio/mp4"
+	case "mp3":
+		return "audio/mpeg"
+	case "opus", "ogg":
+		return "audio/ogg"
+	}
+	return mime.TypeByExtension("." + ext)
+}
@@ -0,0 +1,549 @@
+package htmlplugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mitmcdn/src/cache"
+	"mitmcdn/src/database"
+	"mitmcdn/src/download"
+
+	"gorm.io/gorm"
+)
+
+// embedPluginSource is the plugin shipped in the repository's plugins directory
+var embedPluginSource = filepath.Join("..", "..", "plugins", "embed_cache.ts")
+
+func installEmbedPlugin(t *testing.T, pluginsDir string) {
+	t.Helper()
+
+	source, err := os.ReadFile(embedPluginSource)
+	if err != nil {
+		t.Fatalf("failed to read plugin: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(pluginsDir, "embed_cache.ts"), source, 0644); err != nil {
+		t.Fatalf("failed to write plugin ts file: %v", err)
+	}
+}
+
+func setupPluginTestEnv(t *testing.T) (*cache.Manager, *download.Scheduler, *gorm.DB) {
+	t.Helper()
+
+	tmpDB, err := os.CreateTemp("", "htmlplugin-*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp DB: %v", err)
+	}
+	_ = tmpDB.Close()
+	t.Cleanup(func() { _ = os.Remove(tmpDB.Name()) })
+
+	db, err := database.InitDB(tmpDB.Name())
+	if err != nil {
+		t.Fatalf("failed to init DB: %v", err)
+	}
+
+	cacheMgr, err := cache.NewManager(db, t.TempDir(), 100*1024*1024, 200*1024*1024, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache manager: %v", err)
+	}
+
+	sched, err := download.NewScheduler(cacheMgr, db, "")
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %v", err)
+	}
+
+	return cacheMgr, sched, db
+}
+
+func createFakeYTDLPScript(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "fake-yt-dlp.sh")
+	content := "#!/bin/sh\nset -eu\n" + body + "\n"
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatalf("failed to write fake yt-dlp script: %v", err)
+	}
+	return path
+}
+
+func writePluginConfig(t *testing.T, path string, patterns []string, command []string, priority int) {
+	t.Helper()
+
+	quotedPatterns := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		quotedPatterns = append(quotedPatterns, fmt.Sprintf("%q", p))
+	}
+
+	quotedCommand := make([]string, 0, len(command))
+	for _, c := range command {
+		quotedCommand = append(quotedCommand, fmt.Sprintf("%q", c))
+	}
+
+	content := fmt.Sprintf("url_patterns = [%s]\nyt_dlp_command = [%s]\ndownload_priority = %d\n", strings.Join(quotedPatterns, ", "), strings.Join(quotedCommand, ", "), priority)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write plugin config: %v", err)
+	}
+}
+
+func appendPluginConfig(t *testing.T, path, content string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open plugin config: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("failed to write plugin config: %v", err)
+	}
+}
+
+func waitForStatusByURL(t *testing.T, db *gorm.DB, originalURL string, status string) database.File {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		var file database.File
+		err := db.Where("original_url = ?", originalURL).First(&file).Error
+		if err == nil && file.DownloadStatus == status {
+			return file
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var file database.File
+	_ = db.Where("original_url = ?", originalURL).First(&file).Error
+	t.Fatalf("timeout waiting for %s to reach %s, last status=%s", originalURL, status, file.DownloadStatus)
+	return database.File{}
+}
+
+// fakeYTDLP writes the video and records the URL each run downloaded
+const fakeYTDLP = `out=""
+source=""
+while [ "$#" -gt 0 ]; do
+  case "$1" in
+    -o) out="$2"; shift 2; continue ;;
+  esac
+  source="$1"
+  shift
+done
+echo "$source" >> "$SOURCES"
+printf 'cached-video' > "$out"`
+
+func TestEmbedCachePlugin_RewritesAndDownloads(t *testing.T) {
+	cacheMgr, sched, db := setupPluginTestEnv(t)
+
+	sources := filepath.Join(t.TempDir(), "sources.log")
+	t.Setenv("SOURCES", sources)
+	script := createFakeYTDLPScript(t, fakeYTDLP)
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	writePluginConfig(t, configPath, []string{`^https://target\.example/.*$`}, []string{script}, 95)
+
+	plugin, err := LoadScriptPlugin(embedPluginSource, configPath, cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	mgr := &Manager{plugins: []HTMLPlugin{plugin}}
+
+	html := `<div><iframe src="https://www.youtube.com/embed/XZnZkASrArc?rel=0" width="560"></iframe></div>` +
+		`<section><iframe src="//www.youtube.com/embed/XZnZkASrArc"></iframe></section>` +
+		`<p><iframe src="https://www.youtube-nocookie.com/embed/AbCdEfGhIjk"></iframe></p>` +
+		`<iframe src="https://player.vimeo.com/video/76979871?h=8272103f6e"></iframe>` +
+		`<iframe src="//player.bilibili.com/player.html?isOutside=true&amp;aid=1&amp;bvid=BV1GJ411x7h7&amp;p=1"></iframe>`
+
+	// Nothing is cached yet: the page is left alone and the videos start caching
+	modified, changed, err := mgr.Apply("https://target.example/page", html)
+	if err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+	if changed || modified != html {
+		t.Fatalf("expected uncached embeds to stay, got: %s", modified)
+	}
+
+	videos := map[string]string{
+		"yt-dlp://XZnZkASrArc":          "https://www.youtube.com/watch?v=XZnZkASrArc",
+		"yt-dlp://AbCdEfGhIjk":          "https://www.youtube.com/watch?v=AbCdEfGhIjk",
+		"embed://vimeo/76979871":        "https://vimeo.com/76979871",
+		"embed://bilibili/BV1GJ411x7h7": "https://www.bilibili.com/video/BV1GJ411x7h7",
+	}
+	for cacheURL := range videos {
+		file := waitForStatusByURL(t, db, cacheURL, "complete")
+		data, err := os.ReadFile(file.SavedPath)
+		if err != nil {
+			t.Fatalf("failed to read cached file %s: %v", file.SavedPath, err)
+		}
+		if string(data) != "cached-video" {
+			t.Fatalf("unexpected cached data for %s: %q", file.OriginalURL, string(data))
+		}
+	}
+	data, err := os.ReadFile(sources)
+	if err != nil {
+		t.Fatalf("failed to read downloaded sources: %v", err)
+	}
+	for _, source := range videos {
+		if !strings.Contains(string(data), source+"\n") {
+			t.Fatalf("yt-dlp did not download %s, got:\n%s", source, data)
+		}
+	}
+
+	var count int64
+	if err := db.Model(&database.File{}).Where("original_url = ?", "yt-dlp://XZnZkASrArc").Count(&count).Error; err != nil {
+		t.Fatalf("failed to count dedup records: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected dedup count=1 for XZnZkASrArc, got %d", count)
+	}
+
+	// Once cached, the embeds play from the cache
+	modified, changed, err = mgr.Apply("https://target.example/page", html)
+	if err != nil || !changed {
+		t.Fatalf("process = %v, %v", changed, err)
+	}
+	for _, want := range []string{
+		`<iframe src="/cache/yt/XZnZkASrArc/player" width="560">`,
+		`<iframe src="/cache/yt/AbCdEfGhIjk/player">`,
+		`<iframe src="/cache/vimeo/76979871/player">`,
+		`<iframe src="/cache/bilibili/BV1GJ411x7h7/player">`,
+	} {
+		if !strings.Contains(modified, want) {
+			t.Fatalf("expected %s in: %s", want, modified)
+		}
+	}
+	if strings.Count(modified, "/cache/yt/XZnZkASrArc/player") != 2 {
+		t.Fatalf("expected both embeds of XZnZkASrArc rewritten, got: %s", modified)
+	}
+}
+
+func TestEmbedCachePlugin_VideoTagsAndCustomProviders(t *testing.T) {
+	cacheMgr, sched, db := setupPluginTestEnv(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("video:" + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	writePluginConfig(t, configPath, []string{`^http://127\.0\.0\.1`}, []string{"/bin/false"}, 90)
+	appendPluginConfig(t, configPath, fmt.Sprintf(`enabled = ["video"]
+
+[[providers]]
+name = "clips"
+elements = ["iframe", "embed"]
+pattern = "^https://clips\\.example/embed/(\\w+)"
+fetch_url = "%s/clips/{id}.mp4"
+`, origin.URL))
+
+	plugin, err := LoadScriptPlugin(embedPluginSource, configPath, cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	mgr := &Manager{plugins: []HTMLPlugin{plugin}}
+	if !mgr.ServesEmbed("video") || !mgr.ServesEmbed("clips") || mgr.ServesEmbed("yt") {
+		t.Fatalf("embed providers = %v, want the enabled and configured ones", plugin.EmbedProviders())
+	}
+
+	pageURL := origin.URL + "/docs/guide/"
+	absolute := origin.URL + "/media/intro.mp4"
+	html := `<video controls src="` + absolute + `"></video>` +
+		`<video><source src="../../media/clip.webm?v=2" type="video/webm"></video>` +
+		`<iframe src="https://clips.example/embed/abc123"></iframe>` +
+		`<iframe src="https://www.youtube.com/embed/XZnZkASrArc"></iframe>` +
+		`<img src="/media/poster.png">`
+
+	if _, changed, err := mgr.Apply(pageURL, html); err != nil || changed {
+		t.Fatalf("process = %v, %v before anything is cached", changed, err)
+	}
+
+	hashOf := func(rawURL string) string {
+		sum := sha256.Sum256([]byte(rawURL))
+		return hex.EncodeToString(sum[:8])
+	}
+	introID := hashOf(absolute)
+	clipID := hashOf(origin.URL + "/media/clip.webm?v=2")
+	for cacheURL, want := range map[string]string{
+		download.EmbedCacheURL("video", introID):  "video:/media/intro.mp4",
+		download.EmbedCacheURL("video", clipID):   "video:/media/clip.webm",
+		download.EmbedCacheURL("clips", "abc123"): "video:/clips/abc123.mp4",
+	} {
+		file := waitForStatusByURL(t, db, cacheURL, "complete")
+		if data, err := os.ReadFile(file.SavedPath); err != nil || string(data) != want {
+			t.Fatalf("cached %s = %q, %v", cacheURL, data, err)
+		}
+	}
+
+	modified, changed, err := mgr.Apply(pageURL, html)
+	if err != nil || !changed {
+		t.Fatalf("process = %v, %v", changed, err)
+	}
+	want := `<video controls="" src="/cache/video/` + introID + `/video"></video>` +
+		`<video><source src="/cache/video/` + clipID + `/video" type="video/webm"></video>` +
+		`<iframe src="/cache/clips/abc123/player"></iframe>` +
+		`<iframe src="https://www.youtube.com/embed/XZnZkASrArc"></iframe>` +
+		`<img src="/media/poster.png">`
+	if modified != want {
+		t.Fatalf("modified = %s\nwant       %s", modified, want)
+	}
+}
+
+func TestEmbedCachePlugin_FormatSelectors(t *testing.T) {
+	cacheMgr, sched, db := setupPluginTestEnv(t)
+
+	formatLog := filepath.Join(t.TempDir(), "formats.log")
+	script := createFakeYTDLPScript(t, `out=""
+format=""
+while [ "$#" -gt 0 ]; do
+  case "$1" in
+    -o) out="$2"; shift 2; continue ;;
+    -f) format="$2"; shift 2; continue ;;
+  esac
+  shift
+done
+echo "$format" >> "`+formatLog+`"
+printf 'video' > "$out"`)
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	writePluginConfig(t, configPath, []string{`^https://`}, []string{script}, 90)
+	appendPluginConfig(t, configPath, `
+[[formats]]
+pattern = "^https://lectures\\.example/"
+format = "bv*[height<=720]+ba/b"
+
+[[formats]]
+pattern = "^https://"
+format = "worst"
+`)
+
+	plugin, err := LoadScriptPlugin(embedPluginSource, configPath, cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	mgr := &Manager{plugins: []HTMLPlugin{plugin}}
+
+	if _, _, err := mgr.Apply("https://lectures.example/1", `<iframe src="https://www.youtube.com/embed/LectureVid1"></iframe>`); err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+	waitForStatusByURL(t, db, "yt-dlp://LectureVid1", "complete")
+	if _, _, err := mgr.Apply("https://other.example/", `<iframe src="https://www.youtube.com/embed/OtherVideo2"></iframe>`); err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+	waitForStatusByURL(t, db, "yt-dlp://OtherVideo2", "complete")
+
+	data, err := os.ReadFile(formatLog)
+	if err != nil {
+		t.Fatalf("failed to read format log: %v", err)
+	}
+	if got, want := string(data), "bv*[height<=720]+ba/b\nworst\n"; got != want {
+		t.Fatalf("formats passed to yt-dlp = %q, want %q", got, want)
+	}
+}
+
+func TestEmbedCachePlugin_SkipsUnmatchedURL(t *testing.T) {
+	cacheMgr, sched, db := setupPluginTestEnv(t)
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	writePluginConfig(t, configPath, []string{`^https://only\.this\.site/.*$`}, []string{"/bin/true"}, 80)
+
+	plugin, err := LoadScriptPlugin(embedPluginSource, configPath, cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	mgr := &Manager{plugins: []HTMLPlugin{plugin}}
+
+	html := `<iframe src="https://www.youtube.com/embed/XZnZkASrArc"></iframe>`
+	modified, changed, err := mgr.Apply("https://other.site/page", html)
+	if err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+	if changed {
+		t.Fatal("expected no change for unmatched URL")
+	}
+	if modified != html {
+		t.Fatalf("html should remain unchanged")
+	}
+
+	var count int64
+	if err := db.Model(&database.File{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count files: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no download records, got %d", count)
+	}
+}
+
+func TestEmbedCachePlugin_ConfigValidation(t *testing.T) {
+	cacheMgr, sched, _ := setupPluginTestEnv(t)
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "empty patterns", content: "url_patterns=[]\nyt_dlp_command=[\"yt-dlp\"]\n"},
+		{name: "invalid regex", content: "url_patterns=[\"([\"]\nyt_dlp_command=[\"yt-dlp\"]\n"},
+		{name: "empty command", content: "url_patterns=[\"^https://x\"]\nyt_dlp_command=[]\n"},
+		{name: "invalid format pattern", content: "url_patterns=[\"^https://x\"]\nyt_dlp_command=[\"yt-dlp\"]\n[[formats]]\npattern=\"([\"\nformat=\"best\"\n"},
+		{name: "empty format", content: "url_patterns=[\"^https://x\"]\nyt_dlp_command=[\"yt-dlp\"]\n[[formats]]\npattern=\"^https://x\"\nformat=\"\"\n"},
+		{name: "unknown built-in provider", content: "url_patterns=[\"^https://x\"]\nenabled=[\"dailymotion\"]\n"},
+		{name: "no providers", content: "url_patterns=[\"^https://x\"]\nenabled=[]\n"},
+		{name: "invalid provider name", content: "url_patterns=[\"^https://x\"]\n[[providers]]\nname=\"My Videos\"\npattern=\"x\"\n"},
+		{name: "provider named hls", content: "url_patterns=[\"^https://x\"]\n[[providers]]\nname=\"hls\"\npattern=\"x\"\n"},
+		{name: "provider without pattern", content: "url_patterns=[\"^https://x\"]\n[[providers]]\nname=\"clips\"\n"},
+		{name: "invalid target", content: "url_patterns=[\"^https://x\"]\n[[providers]]\nname=\"clips\"\npattern=\"x\"\ntarget=\"page\"\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(cfg, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			if _, err := LoadScriptPlugin(embedPluginSource, cfg, cacheMgr, sched); err == nil {
+				t.Fatalf("expected config validation error")
+			}
+		})
+	}
+}
+
+func TestManager_ModifyResponseHTML(t *testing.T) {
+	cacheMgr, sched, db := setupPluginTestEnv(t)
+
+	script := createFakeYTDLPScript(t, `out=""
+while [ "$#" -gt 0 ]; do
+  if [ "$1" = "-o" ]; then
+    out="$2"
+    shift 2
+    continue
+  fi
+  shift
+done
+printf 'manager-video' > "$out"`)
+
+	pluginsDir := filepath.Join(t.TempDir(), "plugins")
+	configsDir := filepath.Join(t.TempDir(), "configs")
+	if err := os.MkdirAll(pluginsDir, 0755); err != nil {
+		t.Fatalf("failed to create plugins dir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(configsDir, "embed_cache"), 0755); err != nil {
+		t.Fatalf("failed to create configs dir: %v", err)
+	}
+
+	installEmbedPlugin(t, pluginsDir)
+	writePluginConfig(
+		t,
+		filepath.Join(configsDir, "embed_cache", "config.toml"),
+		[]string{`^https://manager\.example/.*$`},
+		[]string{script},
+		90,
+	)
+
+	mgr, err := NewManager(pluginsDir, configsDir, cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+
+	reqURL, _ := url.Parse("https://manager.example/page")
+	html := `<iframe src="https://www.youtube.com/embed/XZnZkASrArc"></iframe>`
+	serve := func() (*http.Response, string) {
+		t.Helper()
+
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write([]byte(html))
+		zw.Close()
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"text/html; charset=utf-8"}, "Content-Encoding": []string{"gzip"}, "Content-Length": []string{fmt.Sprint(compressed.Len())}},
+			Body:          io.NopCloser(&compressed),
+			ContentLength: int64(compressed.Len()),
+			Request:       &http.Request{Method: http.MethodGet, URL: reqURL},
+		}
+		if err := mgr.ModifyResponse(resp); err != nil {
+			t.Fatalf("modify response failed: %v", err)
+		}
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("modified body is not gzip: %v", err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("failed reading modified body: %v", err)
+		}
+		return resp, string(body)
+	}
+
+	// The first visit starts caching the video and leaves the page as it is
+	if _, out := serve(); out != html {
+		t.Fatalf("expected the uncached embed to stay, got: %s", out)
+	}
+	_ = waitForStatusByURL(t, db, "yt-dlp://XZnZkASrArc", "complete")
+
+	// The page streams through, still compressed for the client
+	resp, out := serve()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("content-encoding should be kept")
+	}
+	if resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1 {
+		t.Fatalf("content-length should be dropped from a streamed page")
+	}
+	if out != `<iframe src="/cache/yt/XZnZkASrArc/player"></iframe>` {
+		t.Fatalf("expected rewritten iframe, got: %s", out)
+	}
+}
+
+func TestManager_ModifyResponseSkipsNonHTML(t *testing.T) {
+	mgr := &Manager{plugins: []HTMLPlugin{&ScriptPlugin{}}}
+
+	reqURL, _ := url.Parse("https://manager.example/page")
+	body := `{"ok":true}`
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Body:    io.NopCloser(strings.NewReader(body)),
+		Request: &http.Request{Method: http.MethodGet, URL: reqURL},
+	}
+
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed reading response: %v", err)
+	}
+	if string(out) != body {
+		t.Fatalf("non-html response should not change")
+	}
+}
+
+func TestNewManagerFailsWhenPluginConfigMissing(t *testing.T) {
+	cacheMgr, sched, _ := setupPluginTestEnv(t)
+
+	pluginsDir := filepath.Join(t.TempDir(), "plugins")
+	configsDir := filepath.Join(t.TempDir(), "configs")
+	if err := os.MkdirAll(pluginsDir, 0755); err != nil {
+		t.Fatalf("failed to create plugins dir: %v", err)
+	}
+	if err := os.MkdirAll(configsDir, 0755); err != nil {
+		t.Fatalf("failed to create configs dir: %v", err)
+	}
+	installEmbedPlugin(t, pluginsDir)
+
+	if _, err := NewManager(pluginsDir, configsDir, cacheMgr, sched); err == nil {
+		t.Fatalf("expected error when plugin config is missing")
+	}
+}
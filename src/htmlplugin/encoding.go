@@ -0,0 +1,130 @@
+package htmlplugin
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// contentCodings are the Content-Encoding values plugins can rewrite through
+var contentCodings = map[string]bool{
+	"":         true,
+	"identity": true,
+	"gzip":     true,
+	"x-gzip":   true,
+	"deflate":  true,
+	"br":       true,
+}
+
+// canDecode reports whether a body with the given Content-Encoding can be
+// decoded for the plugins and encoded again for the client
+func canDecode(encoding string) bool {
+	return contentCodings[strings.ToLower(strings.TrimSpace(encoding))]
+}
+
+// RestrictAcceptEncoding limits a forwarded request's Accept-Encoding to the
+// codings plugins can rewrite through, so responses arrive compressed but
+// still decodable. Without plugins the header is left alone.
+func (m *Manager) RestrictAcceptEncoding(header http.Header) {
+	if m == nil || len(m.plugins) == 0 {
+		return
+	}
+	var accepted []string
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.TrimSpace(coding)
+			name, _, _ := strings.Cut(coding, ";")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" && canDecode(name) {
+				accepted = append(accepted, coding)
+			}
+		}
+	}
+	if len(accepted) == 0 {
+		header.Del("Accept-Encoding")
+		return
+	}
+	header.Set("Accept-Encoding", strings.Join(accepted, ", "))
+}
+
+// decodeBody returns a reader of r's content with its Content-Encoding removed
+func decodeBody(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "deflate":
+		// Properly zlib-wrapped, though some servers send raw deflate
+		br := bufio.NewReader(r)
+		if head, err := br.Peek(2); err == nil && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// encodeBody returns a writer applying the Content-Encoding to what is written to w
+func encodeBody(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return nopWriteCloser{w}, nil
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// decodeAll decodes a whole body, failing if it decodes to more than limit bytes
+func decodeAll(encoding string, body []byte, limit int64) ([]byte, error) {
+	r, err := decodeBody(encoding, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", limit)
+	}
+	return decoded, nil
+}
+
+// encodeAll encodes a whole body
+func encodeAll(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := encodeBody(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,209 @@
+package htmlplugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Plugins may implement any of the hooks below next to HTMLPlugin. The
+// proxies run them on every request they see, whether it is served from the
+// cache, downloaded or forwarded.
+
+// RequestHook rewrites requests sent upstream, both forwarded client
+// requests and the scheduler's download requests
+type RequestHook interface {
+	RewriteRequest(req *http.Request) error
+}
+
+// ResponseHook sees, and may edit, the header of every response sent to a client
+type ResponseHook interface {
+	InspectResponse(rawURL string, status int, header http.Header) error
+}
+
+// BodyHook transforms whole response bodies of the content types it accepts
+type BodyHook interface {
+	TransformsBody(contentType string) bool
+	TransformBody(rawURL, contentType string, body []byte) ([]byte, bool, error)
+}
+
+// CacheHook overrides the CDN rules' decision to cache a request. decided is
+// false when the plugin leaves the decision to the rules.
+type CacheHook interface {
+	ShouldCache(req *http.Request, rawURL string) (cache, decided bool, err error)
+}
+
+// URLPathHook is implemented by plugins that may only apply to requests made
+// through the URL-path reverse proxy (/https://host/...), such as plugins
+// rewriting links into that form
+type URLPathHook interface {
+	URLPathOnly() bool
+}
+
+// EmbedHook is implemented by plugins caching videos served on
+// /cache/<provider>/<id>/, naming the providers they cache
+type EmbedHook interface {
+	EmbedProviders() []string
+}
+
+// ServesEmbed reports whether a plugin caches videos of provider, so
+// /cache/<provider>/ paths belong to this server
+func (m *Manager) ServesEmbed(provider string) bool {
+	if m == nil {
+		return false
+	}
+	for _, plugin := range m.plugins {
+		if hook, ok := plugin.(EmbedHook); ok && slices.Contains(hook.EmbedProviders(), provider) {
+			return true
+		}
+	}
+	return false
+}
+
+type urlPathKey struct{}
+
+// WithURLPath marks ctx as belonging to a request made through the URL-path reverse proxy
+func WithURLPath(ctx context.Context) context.Context {
+	return context.WithValue(ctx, urlPathKey{}, true)
+}
+
+// ForRequest returns the plugins that apply to r: those limited to the
+// URL-path reverse proxy are left out of other requests
+func (m *Manager) ForRequest(r *http.Request) *Manager {
+	if m == nil || r == nil {
+		return m
+	}
+	if urlPath, _ := r.Context().Value(urlPathKey{}).(bool); urlPath {
+		return m
+	}
+
+	var plugins []HTMLPlugin
+	for i, plugin := range m.plugins {
+		if hook, ok := plugin.(URLPathHook); ok && hook.URLPathOnly() {
+			if plugins == nil {
+				plugins = append(make([]HTMLPlugin, 0, len(m.plugins)), m.plugins[:i]...)
+			}
+			continue
+		}
+		if plugins != nil {
+			plugins = append(plugins, plugin)
+		}
+	}
+	if plugins == nil {
+		return m
+	}
+	return &Manager{plugins: plugins, maxBodySize: m.maxBodySize}
+}
+
+// RewriteRequest runs the plugins' request hooks on an upstream request
+func (m *Manager) RewriteRequest(req *http.Request) {
+	m = m.ForRequest(req)
+	if m == nil {
+		return
+	}
+	for _, plugin := range m.plugins {
+		if hook, ok := plugin.(RequestHook); ok {
+			if err := hook.RewriteRequest(req); err != nil {
+				log.Printf("Plugin %s failed to rewrite request %s: %v", plugin.Name(), req.URL, err)
+			}
+		}
+	}
+}
+
+// InspectResponse runs the plugins' response hooks on a response header
+// before it is sent
+func (m *Manager) InspectResponse(rawURL string, status int, header http.Header) {
+	if m == nil {
+		return
+	}
+	for _, plugin := range m.plugins {
+		if hook, ok := plugin.(ResponseHook); ok {
+			if err := hook.InspectResponse(rawURL, status, header); err != nil {
+				log.Printf("Plugin %s failed to inspect response %s: %v", plugin.Name(), rawURL, err)
+			}
+		}
+	}
+}
+
+// ShouldCache asks the plugins whether to cache a request; the first plugin
+// that decides wins
+func (m *Manager) ShouldCache(req *http.Request, rawURL string) (cache, decided bool) {
+	m = m.ForRequest(req)
+	if m == nil {
+		return false, false
+	}
+	for _, plugin := range m.plugins {
+		hook, ok := plugin.(CacheHook)
+		if !ok {
+			continue
+		}
+		cache, decided, err := hook.ShouldCache(req, rawURL)
+		if err != nil {
+			log.Printf("Plugin %s failed to decide caching of %s: %v", plugin.Name(), rawURL, err)
+			continue
+		}
+		if decided {
+			return cache, true
+		}
+	}
+	return false, false
+}
+
+// TransformsBody reports whether the plugins may rewrite bodies of contentType
+func (m *Manager) TransformsBody(contentType string) bool {
+	if m == nil || len(m.plugins) == 0 {
+		return false
+	}
+	if isHTML(contentType) {
+		return true
+	}
+	for _, plugin := range m.plugins {
+		if hook, ok := plugin.(BodyHook); ok && hook.TransformsBody(contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransformBody runs the plugins on a response body: HTML through Apply,
+// then every body hook accepting contentType
+func (m *Manager) TransformBody(rawURL, contentType string, body []byte) ([]byte, bool, error) {
+	if m == nil || len(m.plugins) == 0 {
+		return body, false, nil
+	}
+
+	current := body
+	changed := false
+	if isHTML(contentType) {
+		html, htmlChanged, err := m.Apply(rawURL, string(body))
+		if err != nil {
+			return body, false, err
+		}
+		if htmlChanged {
+			current, changed = []byte(html), true
+		}
+	}
+
+	for _, plugin := range m.plugins {
+		hook, ok := plugin.(BodyHook)
+		if !ok || !hook.TransformsBody(contentType) {
+			continue
+		}
+		next, pluginChanged, err := hook.TransformBody(rawURL, contentType, current)
+		if err != nil {
+			return body, false, fmt.Errorf("plugin %s failed: %w", plugin.Name(), err)
+		}
+		if pluginChanged {
+			current, changed = next, true
+		}
+	}
+
+	return current, changed, nil
+}
+
+func isHTML(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "text/html")
+}
@@ -0,0 +1,130 @@
+package htmlplugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// linkRewritePluginSource is the plugin shipped in the repository's plugins directory
+var linkRewritePluginSource = filepath.Join("..", "..", "plugins", "link_rewrite.ts")
+
+func loadLinkRewritePlugin(t *testing.T, config string) *Manager {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	if config != "" {
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("failed to write plugin config: %v", err)
+		}
+	}
+	plugin, err := LoadScriptPlugin(linkRewritePluginSource, configPath, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to load plugin: %v", err)
+	}
+	return &Manager{plugins: []HTMLPlugin{plugin}, maxBodySize: defaultMaxBodySize}
+}
+
+func urlPathRequest(method, rawURL string) *http.Request {
+	u, _ := url.Parse(rawURL)
+	req := &http.Request{Method: method, URL: u, Header: http.Header{}}
+	return req.WithContext(WithURLPath(context.Background()))
+}
+
+func TestLinkRewritePlugin_Page(t *testing.T) {
+	mgr := loadLinkRewritePlugin(t, "")
+
+	page := `<html><head><base href="https://cdn.example/assets/">` +
+		`<link rel="stylesheet" href="/css/site.css"><meta http-equiv="Refresh" content="5; url=/next">` +
+		`<style>body { background: url("/img/bg.png") } @import 'https://fonts.example/f.css';</style></head>` +
+		`<body><a href="https://other.example/a?b=1&amp;c=2#top">x</a><a href="//cdn.example/y">y</a>` +
+		`<a href="relative/page">r</a><a href="#frag">f</a><a href="mailto:me@example.com">m</a><a href="javascript:void(0)">j</a>` +
+		`<a href="/https://already.example/">p</a><img src="data:image/png;base64,AA==" srcset="/s.png 1x, https://cdn.example/l.png 2x">` +
+		`<form action="/search"><button formaction="/go">go</button></form><video poster="/p.jpg"><source src="/v.mp4"></video>` +
+		`<div style="background-image:url(/d.png)"></div><object data="/o.swf"></object><div data="/not-a-url"></div></body></html>`
+	want := `<html><head><base href="/https://cdn.example/assets/">` +
+		`<link rel="stylesheet" href="/https://cdn.example/css/site.css"><meta http-equiv="Refresh" content="5; url=/https://cdn.example/next">` +
+		`<style>body { background: url("/https://cdn.example/img/bg.png") } @import '/https://fonts.example/f.css';</style></head>` +
+		`<body><a href="/https://other.example/a?b=1&amp;c=2#top">x</a><a href="/https://cdn.example/y">y</a>` +
+		`<a href="relative/page">r</a><a href="#frag">f</a><a href="mailto:me@example.com">m</a><a href="javascript:void(0)">j</a>` +
+		`<a href="/https://already.example/">p</a><img src="data:image/png;base64,AA==" srcset="/https://cdn.example/s.png 1x, /https://cdn.example/l.png 2x">` +
+		`<form action="/https://cdn.example/search"><button formaction="/https://cdn.example/go">go</button></form><video poster="/https://cdn.example/p.jpg"><source src="/https://cdn.example/v.mp4"></video>` +
+		`<div style="background-image:url(/https://cdn.example/d.png)"></div><object data="/https://cdn.example/o.swf"></object><div data="/not-a-url"></div></body></html>`
+
+	resp := htmlResponse(t, "gzip", []byte(page))
+	resp.Request = urlPathRequest(http.MethodGet, "https://example.com/docs/page")
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+	if got := readResponse(t, resp); got != want {
+		t.Fatalf("body = %s\nwant   %s", got, want)
+	}
+}
+
+func TestLinkRewritePlugin_StylesheetsAndRedirects(t *testing.T) {
+	mgr := loadLinkRewritePlugin(t, `hosts = ["(^|\\.)example\\.com$"]`)
+
+	css := `@import "/base.css"; .a { background: url( '../img/a.png' ) } .b { background: url(https://static.example.com/b.png) } .c { background: url(https://elsewhere.net/c.png) }`
+	want := `@import "/https://example.com/base.css"; .a { background: url( '../img/a.png' ) } .b { background: url(/https://static.example.com/b.png) } .c { background: url(https://elsewhere.net/c.png) }`
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"text/css; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(css)),
+		ContentLength: int64(len(css)),
+		Request:       urlPathRequest(http.MethodGet, "https://example.com/css/site.css"),
+	}
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+	if got := readResponse(t, resp); got != want {
+		t.Fatalf("stylesheet = %s\nwant         %s", got, want)
+	}
+
+	tests := []struct {
+		status   int
+		location string
+		want     string
+	}{
+		{status: http.StatusFound, location: "https://www.example.com/login?next=%2F", want: "/https://www.example.com/login?next=%2F"},
+		{status: http.StatusMovedPermanently, location: "/moved", want: "/https://example.com/moved"},
+		{status: http.StatusSeeOther, location: "next", want: "next"},
+		{status: http.StatusFound, location: "https://elsewhere.net/", want: "https://elsewhere.net/"},
+		{status: http.StatusCreated, location: "/created", want: "/created"},
+	}
+	for _, tc := range tests {
+		header := http.Header{"Location": []string{tc.location}}
+		mgr.InspectResponse("https://example.com/old", tc.status, header)
+		if got := header.Get("Location"); got != tc.want {
+			t.Errorf("Location %q with status %d = %q, want %q", tc.location, tc.status, got, tc.want)
+		}
+	}
+}
+
+func TestLinkRewritePlugin_OnlyURLPathRequests(t *testing.T) {
+	mgr := loadLinkRewritePlugin(t, "")
+
+	page := `<a href="/next">next</a>`
+	resp := htmlResponse(t, "", []byte(page))
+	resp.Header.Set("Location", "/elsewhere")
+	resp.StatusCode = http.StatusFound
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+	if got := readResponse(t, resp); got != page {
+		t.Fatalf("page served through the proxy was rewritten: %s", got)
+	}
+	if got := resp.Header.Get("Location"); got != "/elsewhere" {
+		t.Fatalf("Location = %q for a request through the proxy", got)
+	}
+	if plugins := mgr.ForRequest(resp.Request); len(plugins.plugins) != 0 {
+		t.Fatalf("ForRequest kept %d plugins for a request through the proxy", len(plugins.plugins))
+	}
+	if plugins := mgr.ForRequest(urlPathRequest(http.MethodGet, "https://example.com/")); plugins != mgr {
+		t.Fatal("ForRequest dropped plugins for a URL-path request")
+	}
+}
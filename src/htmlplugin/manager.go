@@ -1,12 +1,15 @@
 package htmlplugin
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"mitmcdn/src/cache"
@@ -18,12 +21,16 @@ type HTMLPlugin interface {
 	Process(pageURL, html string) (string, bool, error)
 }
 
+// defaultMaxBodySize is the largest response plugins rewrite unless configured otherwise
+const defaultMaxBodySize = 8 * 1024 * 1024
+
 type Manager struct {
-	plugins []HTMLPlugin
+	plugins     []HTMLPlugin
+	maxBodySize int64 // larger responses pass through untouched
 }
 
 func NewManager(pluginsDir, configsDir string, cacheMgr *cache.Manager, sched *download.Scheduler) (*Manager, error) {
-	manager := &Manager{plugins: make([]HTMLPlugin, 0)}
+	manager := &Manager{plugins: make([]HTMLPlugin, 0), maxBodySize: defaultMaxBodySize}
 
 	entries, err := os.ReadDir(pluginsDir)
 	if err != nil {
@@ -38,27 +45,45 @@ func NewManager(pluginsDir, configsDir string, cacheMgr *cache.Manager, sched *d
 		if entry.IsDir() {
 			continue
 		}
-		if strings.HasSuffix(entry.Name(), ".ts") {
+		// .d.ts files only declare types, such as the host API in mitmcdn.d.ts
+		if strings.HasSuffix(entry.Name(), ".ts") && !strings.HasSuffix(entry.Name(), ".d.ts") {
 			pluginNames = append(pluginNames, strings.TrimSuffix(entry.Name(), ".ts"))
 		}
 	}
 	sort.Strings(pluginNames)
 
 	for _, pluginName := range pluginNames {
-		switch pluginName {
-		case "youtube_embed_cache":
-			cfgPath := filepath.Join(configsDir, pluginName, "config.toml")
-			plugin, err := NewYouTubeEmbedCachePlugin(cfgPath, cacheMgr, sched)
-			if err != nil {
-				return nil, fmt.Errorf("failed to load plugin %s: %w", pluginName, err)
-			}
-			manager.plugins = append(manager.plugins, plugin)
+		sourcePath := filepath.Join(pluginsDir, pluginName+".ts")
+		cfgPath := filepath.Join(configsDir, pluginName, "config.toml")
+		plugin, err := LoadScriptPlugin(sourcePath, cfgPath, cacheMgr, sched)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load plugin %s: %w", pluginName, err)
 		}
+		manager.plugins = append(manager.plugins, plugin)
 	}
 
 	return manager, nil
 }
 
+// ConfigureMaxBodySize sets the size above which responses pass through untouched
+func (m *Manager) ConfigureMaxBodySize(size int64) {
+	m.maxBodySize = size
+}
+
+// MaxBodySize returns the size above which responses pass through untouched
+func (m *Manager) MaxBodySize() int64 {
+	if m == nil || m.maxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return m.maxBodySize
+}
+
+// ModifyResponse runs the plugins on a forwarded response: the body hooks
+// on bodies of the content types they accept, then the response hooks.
+// Compressed bodies are decoded for the plugins and encoded again. HTML
+// pages only handled by element hooks are rewritten as they stream; other
+// bodies are read whole, and pass through untouched when larger than
+// MaxBodySize.
 func (m *Manager) ModifyResponse(resp *http.Response) error {
 	if m == nil || len(m.plugins) == 0 {
 		return nil
@@ -66,39 +91,111 @@ func (m *Manager) ModifyResponse(resp *http.Response) error {
 	if resp == nil || resp.Request == nil {
 		return nil
 	}
+	m = m.ForRequest(resp.Request)
+	rawURL := resp.Request.URL.String()
+	defer func() { m.InspectResponse(rawURL, resp.StatusCode, resp.Header) }()
 
-	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
-	if !strings.Contains(contentType, "text/html") {
+	contentType := resp.Header.Get("Content-Type")
+	encoding := resp.Header.Get("Content-Encoding")
+	if !m.TransformsBody(contentType) || !canDecode(encoding) || !hasBody(resp) || resp.ContentLength > m.MaxBodySize() {
 		return nil
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+	if isHTML(contentType) && !m.transformsPages(contentType) {
+		m.streamElements(resp, rawURL, encoding)
+		return nil
+	}
+	return m.transformWhole(resp, rawURL, contentType, encoding)
+}
+
+// streamElements replaces resp.Body with the page rewritten by the element hooks as it is read
+func (m *Manager) streamElements(resp *http.Response, rawURL, encoding string) {
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+
+		decoded, err := decodeBody(encoding, body)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer decoded.Close()
+		encoded, err := encodeBody(encoding, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		err = m.rewriteElements(rawURL, decoded, encoded, m.MaxBodySize())
+		if closeErr := encoded.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
+
+// transformWhole runs the plugins on the whole body of resp
+func (m *Manager) transformWhole(resp *http.Response, rawURL, contentType, encoding string) error {
+	limit := m.MaxBodySize()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
 	if err != nil {
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
+	if int64(len(raw)) > limit {
+		// Too big to rewrite: send what was read and the rest untouched
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		return nil
+	}
 	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+	resp.ContentLength = int64(len(raw))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(raw)))
 
-	originalHTML := string(bodyBytes)
-	modifiedHTML, changed, err := m.Apply(resp.Request.URL.String(), originalHTML)
+	decoded, err := decodeAll(encoding, raw, limit)
 	if err != nil {
-		return err
+		log.Printf("Plugins skipped %s: %v", rawURL, err)
+		return nil
+	}
+	modified, changed, err := m.TransformBody(rawURL, contentType, decoded)
+	if err != nil {
+		// A failing plugin, such as one over its time limit, leaves the page as it was
+		log.Printf("Plugins failed for %s: %v", rawURL, err)
+		return nil
 	}
 	if !changed {
-		resp.Body = io.NopCloser(strings.NewReader(originalHTML))
-		resp.ContentLength = int64(len(originalHTML))
-		resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(originalHTML)))
+		return nil
+	}
+	encoded, err := encodeAll(encoding, modified)
+	if err != nil {
+		log.Printf("Plugins failed to encode %s: %v", rawURL, err)
 		return nil
 	}
 
-	resp.Body = io.NopCloser(strings.NewReader(modifiedHTML))
-	resp.ContentLength = int64(len(modifiedHTML))
-	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(modifiedHTML)))
-	resp.Header.Del("Content-Encoding")
-	resp.Header.Del("Transfer-Encoding")
-
+	resp.Body = io.NopCloser(bytes.NewReader(encoded))
+	resp.ContentLength = int64(len(encoded))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
 	return nil
 }
 
+// hasBody reports whether resp carries a full body plugins could rewrite
+func hasBody(resp *http.Response) bool {
+	if resp.Request.Method == http.MethodHead {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	return true
+}
+
 func (m *Manager) Apply(pageURL, html string) (string, bool, error) {
 	if m == nil || len(m.plugins) == 0 {
 		return html, false, nil
@@ -118,5 +215,15 @@ func (m *Manager) Apply(pageURL, html string) (string, bool, error) {
 		}
 	}
 
+	// Then the element hooks, as on a streamed page
+	var rewritten strings.Builder
+	if err := m.rewriteElements(pageURL, strings.NewReader(current), &rewritten, -1); err != nil {
+		return html, false, err
+	}
+	if rewritten.String() != current {
+		changed = true
+		current = rewritten.String()
+	}
+
 	return current, changed, nil
 }
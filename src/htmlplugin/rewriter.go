@@ -0,0 +1,269 @@
+package htmlplugin
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Element is an HTML start tag handed to element hooks
+type Element struct {
+	Tag         string
+	Attrs       []html.Attribute
+	SelfClosing bool
+	// BaseURI is the URL the element's relative URLs resolve against: the
+	// page URL, or the page's <base href> once one has been seen
+	BaseURI string
+}
+
+// String serializes the start tag
+func (e *Element) String() string {
+	var b strings.Builder
+	b.WriteString("<")
+	b.WriteString(e.Tag)
+	for _, attr := range e.Attrs {
+		b.WriteString(" ")
+		b.WriteString(attr.Key)
+		b.WriteString(`="`)
+		b.WriteString(html.EscapeString(attr.Val))
+		b.WriteString(`"`)
+	}
+	if e.SelfClosing {
+		b.WriteString(" /")
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// setAttr sets an attribute, keeping its place if the element already has it
+func (e *Element) setAttr(key, val string) {
+	for i := range e.Attrs {
+		if e.Attrs[i].Key == key {
+			e.Attrs[i].Val = val
+			return
+		}
+	}
+	e.Attrs = append(e.Attrs, html.Attribute{Key: key, Val: val})
+}
+
+// removeAttr removes an attribute if the element has it
+func (e *Element) removeAttr(key string) {
+	for i := range e.Attrs {
+		if e.Attrs[i].Key == key {
+			e.Attrs = append(e.Attrs[:i], e.Attrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// ElementHook rewrites the start tags of the elements it names as a page
+// streams through, without the page being held in memory
+type ElementHook interface {
+	// Elements lists the lower-case tag names the hook handles; "*" is every tag
+	Elements() []string
+	// RewriteElement edits el in place and reports whether it changed it, or
+	// returns replacement HTML for the start tag
+	RewriteElement(pageURL string, el *Element) (replacement string, changed bool, err error)
+}
+
+// PageHook is implemented by plugins that may also transform whole pages
+// through Process; plugins without it always do. Pages only stream when no
+// plugin transforms whole pages.
+type PageHook interface {
+	TransformsPages() bool
+}
+
+// elementHooks returns the plugins' element hooks by the tag they handle
+func (m *Manager) elementHooks() map[string][]HTMLPlugin {
+	hooks := make(map[string][]HTMLPlugin)
+	for _, plugin := range m.plugins {
+		hook, ok := plugin.(ElementHook)
+		if !ok {
+			continue
+		}
+		for _, tag := range hook.Elements() {
+			hooks[tag] = append(hooks[tag], plugin)
+		}
+	}
+	return hooks
+}
+
+// styleHooks returns the plugins' body hooks for CSS, which also rewrite
+// the contents of <style> elements
+func (m *Manager) styleHooks() []HTMLPlugin {
+	var hooks []HTMLPlugin
+	for _, plugin := range m.plugins {
+		if hook, ok := plugin.(BodyHook); ok && hook.TransformsBody("text/css") {
+			hooks = append(hooks, plugin)
+		}
+	}
+	return hooks
+}
+
+// transformsPages reports whether some plugin needs whole pages of contentType
+func (m *Manager) transformsPages(contentType string) bool {
+	for _, plugin := range m.plugins {
+		if hook, ok := plugin.(PageHook); !ok || hook.TransformsPages() {
+			return true
+		}
+		if hook, ok := plugin.(BodyHook); ok && hook.TransformsBody(contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteElements copies the HTML in r to w, running the element hooks on the
+// start tags they handle and the CSS body hooks on <style> elements. Once
+// more than limit bytes have been read (when limit >= 0) the rest of the page
+// is copied untouched.
+func (m *Manager) rewriteElements(pageURL string, r io.Reader, w io.Writer, limit int64) error {
+	hooks := m.elementHooks()
+	styles := m.styleHooks()
+	if len(hooks) == 0 && len(styles) == 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	counter := &countingReader{r: r}
+	z := html.NewTokenizer(counter)
+	inStyle := false // the last token opened a <style> element
+	baseURI, baseSeen := pageURL, false
+	for {
+		if limit >= 0 && counter.n > limit {
+			// Too big to rewrite: pass the rest through
+			if _, err := w.Write(z.Buffered()); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+		if tt == html.TextToken && inStyle {
+			if _, err := io.WriteString(w, m.rewriteStyle(baseURI, string(z.Raw()), styles)); err != nil {
+				return err
+			}
+			inStyle = false
+			continue
+		}
+		inStyle = false
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			if _, err := w.Write(z.Raw()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// TagName lower-cases the token in place, so keep the raw tag first
+		raw := string(z.Raw())
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		inStyle = tag == "style" && tt == html.StartTagToken && len(styles) > 0
+		plugins := hooks[tag]
+		if all := hooks["*"]; len(all) > 0 {
+			plugins = append(append([]HTMLPlugin(nil), plugins...), all...)
+		}
+		isBase := tag == "base" && !baseSeen
+		if len(plugins) == 0 && !isBase {
+			if _, err := io.WriteString(w, raw); err != nil {
+				return err
+			}
+			continue
+		}
+
+		el := &Element{Tag: tag, SelfClosing: tt == html.SelfClosingTagToken, BaseURI: baseURI}
+		for hasAttr {
+			var key, val []byte
+			key, val, hasAttr = z.TagAttr()
+			el.Attrs = append(el.Attrs, html.Attribute{Key: string(key), Val: string(val)})
+		}
+		if isBase {
+			// Only the first <base href> counts, resolved against the page URL
+			for _, attr := range el.Attrs {
+				if attr.Key == "href" {
+					baseSeen = true
+					baseURI = resolveReference(pageURL, attr.Val)
+					break
+				}
+			}
+		}
+		if len(plugins) == 0 {
+			if _, err := io.WriteString(w, raw); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.WriteString(w, m.rewriteElement(pageURL, el, raw, plugins)); err != nil {
+			return err
+		}
+	}
+}
+
+// resolveReference resolves ref against base, or returns base if either is invalid
+func resolveReference(base, ref string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	resolved, err := baseURL.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return base
+	}
+	return resolved.String()
+}
+
+// rewriteElement runs the hooks on one start tag and returns the HTML to send for it
+func (m *Manager) rewriteElement(pageURL string, el *Element, raw string, plugins []HTMLPlugin) string {
+	changed := false
+	for _, plugin := range plugins {
+		replacement, pluginChanged, err := plugin.(ElementHook).RewriteElement(pageURL, el)
+		if err != nil {
+			log.Printf("Plugin %s failed on <%s> in %s: %v", plugin.Name(), el.Tag, pageURL, err)
+			continue
+		}
+		if replacement != "" {
+			return replacement
+		}
+		changed = changed || pluginChanged
+	}
+	if !changed {
+		return raw
+	}
+	return el.String()
+}
+
+// rewriteStyle runs the CSS body hooks on the contents of a <style> element
+func (m *Manager) rewriteStyle(pageURL, css string, plugins []HTMLPlugin) string {
+	for _, plugin := range plugins {
+		modified, changed, err := plugin.(BodyHook).TransformBody(pageURL, "text/css", []byte(css))
+		if err != nil {
+			log.Printf("Plugin %s failed on <style> in %s: %v", plugin.Name(), pageURL, err)
+			continue
+		}
+		if changed {
+			css = string(modified)
+		}
+	}
+	return css
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,213 @@
+package htmlplugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const elementsPlugin = `
+export const elements = ["a", "img"];
+
+export function transformElement(element: PageElement, page: Page) {
+  if (element.tag === "img") {
+    return "<picture>";
+  }
+  if (element.attributes.href === undefined) {
+    return undefined;
+  }
+  return { attributes: { href: element.attributes.href.toUpperCase(), target: null, "data-page": page.url } };
+}
+`
+
+func loadElementsPlugin(t *testing.T) *Manager {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := writeScriptPlugin(t, dir, "elements", elementsPlugin, "")
+	plugin, err := LoadScriptPlugin(path, filepath.Join(dir, "configs", "elements", "config.toml"), nil, nil)
+	if err != nil {
+		t.Fatalf("failed to load plugin: %v", err)
+	}
+	return &Manager{plugins: []HTMLPlugin{plugin}, maxBodySize: defaultMaxBodySize}
+}
+
+func htmlResponse(t *testing.T, encoding string, body []byte) *http.Response {
+	t.Helper()
+
+	encoded, err := encodeAll(encoding, body)
+	if err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+	header := http.Header{"Content-Type": []string{"text/html"}}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	reqURL, _ := url.Parse("https://example.com/page")
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(encoded)),
+		ContentLength: int64(len(encoded)),
+		Request:       &http.Request{Method: http.MethodGet, URL: reqURL},
+	}
+}
+
+func readResponse(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	body, err := decodeBody(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	return string(data)
+}
+
+func TestManager_StreamsElements(t *testing.T) {
+	mgr := loadElementsPlugin(t)
+
+	page := `<!DOCTYPE html><HTML><!-- <a href="x"> --><A HREF='/one' target=_blank>one</A>` +
+		`<script>var s = '<a href="/two">';</script><p class=x>text &amp; more</p><img src="a.png"/><a name=top></a>`
+	want := `<!DOCTYPE html><HTML><!-- <a href="x"> --><a href="/ONE" data-page="https://example.com/page">one</A>` +
+		`<script>var s = '<a href="/two">';</script><p class=x>text &amp; more</p><picture><a name=top></a>`
+
+	for _, encoding := range []string{"", "gzip", "br", "deflate"} {
+		t.Run(fmt.Sprintf("encoding %q", encoding), func(t *testing.T) {
+			resp := htmlResponse(t, encoding, []byte(page))
+			if err := mgr.ModifyResponse(resp); err != nil {
+				t.Fatalf("modify response failed: %v", err)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if got := readResponse(t, resp); got != want {
+				t.Fatalf("body = %s\nwant   %s", got, want)
+			}
+		})
+	}
+
+	// Apply runs the same element hooks on whole pages
+	got, changed, err := mgr.Apply("https://example.com/page", page)
+	if err != nil || !changed || got != want {
+		t.Fatalf("Apply = %s, %v, %v", got, changed, err)
+	}
+}
+
+func TestManager_ModifyResponseSizeCap(t *testing.T) {
+	mgr := loadElementsPlugin(t)
+	mgr.ConfigureMaxBodySize(1024)
+
+	padding := strings.Repeat("<p>padding</p>", 1000)
+	page := `<a href="/first">` + padding + `<a href="/last">`
+
+	t.Run("known length", func(t *testing.T) {
+		resp := htmlResponse(t, "", []byte(page))
+		if err := mgr.ModifyResponse(resp); err != nil {
+			t.Fatalf("modify response failed: %v", err)
+		}
+		if got := readResponse(t, resp); got != page {
+			t.Fatalf("page over the cap should pass through untouched")
+		}
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		resp := htmlResponse(t, "gzip", []byte(page))
+		resp.ContentLength = -1
+		if err := mgr.ModifyResponse(resp); err != nil {
+			t.Fatalf("modify response failed: %v", err)
+		}
+		got := readResponse(t, resp)
+		if !strings.HasPrefix(got, `<a href="/FIRST" data-page=`) {
+			t.Fatalf("element before the cap should be rewritten, got %.60s", got)
+		}
+		if !strings.HasSuffix(got, padding+`<a href="/last">`) {
+			t.Fatalf("rest of the page past the cap should pass through untouched")
+		}
+	})
+
+	t.Run("whole page", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeScriptPlugin(t, dir, "pages", `export function transform(html: string) { return html.replace("first", "changed"); }`, "")
+		plugin, err := LoadScriptPlugin(path, "", nil, nil)
+		if err != nil {
+			t.Fatalf("failed to load plugin: %v", err)
+		}
+		pages := &Manager{plugins: []HTMLPlugin{plugin}}
+		pages.ConfigureMaxBodySize(1024)
+
+		resp := htmlResponse(t, "", []byte(page))
+		resp.ContentLength = -1
+		if err := pages.ModifyResponse(resp); err != nil {
+			t.Fatalf("modify response failed: %v", err)
+		}
+		if got := readResponse(t, resp); got != page {
+			t.Fatalf("page over the cap should pass through untouched")
+		}
+
+		small := htmlResponse(t, "br", []byte(`<a href="/first">`))
+		if err := pages.ModifyResponse(small); err != nil {
+			t.Fatalf("modify response failed: %v", err)
+		}
+		if got := readResponse(t, small); got != `<a href="/changed">` {
+			t.Fatalf("body = %q", got)
+		}
+		if small.Header.Get("Content-Length") != fmt.Sprint(small.ContentLength) {
+			t.Fatalf("Content-Length %q does not match %d", small.Header.Get("Content-Length"), small.ContentLength)
+		}
+	})
+}
+
+func TestManager_ModifyResponseUnknownEncoding(t *testing.T) {
+	mgr := loadElementsPlugin(t)
+
+	resp := htmlResponse(t, "", []byte(`<a href="/x">`))
+	resp.Header.Set("Content-Encoding", "zstd")
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if string(data) != `<a href="/x">` {
+		t.Fatalf("body in an unknown encoding should pass through, got %q", data)
+	}
+}
+
+func TestManager_RestrictAcceptEncoding(t *testing.T) {
+	mgr := &Manager{plugins: []HTMLPlugin{&ScriptPlugin{}}}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "gzip, deflate, br, zstd", want: "gzip, deflate, br"},
+		{accept: "br;q=1.0, zstd;q=0.9", want: "br;q=1.0"},
+		{accept: "zstd", want: ""},
+		{accept: "", want: ""},
+	}
+	for _, tc := range tests {
+		header := http.Header{}
+		if tc.accept != "" {
+			header.Set("Accept-Encoding", tc.accept)
+		}
+		mgr.RestrictAcceptEncoding(header)
+		if got := header.Get("Accept-Encoding"); got != tc.want {
+			t.Errorf("RestrictAcceptEncoding(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+
+	// Without plugins nothing is decoded, so the client's codings stand
+	var none *Manager
+	header := http.Header{"Accept-Encoding": []string{"zstd"}}
+	none.RestrictAcceptEncoding(header)
+	if got := header.Get("Accept-Encoding"); got != "zstd" {
+		t.Fatalf("Accept-Encoding = %q without plugins", got)
+	}
+}
@@ -0,0 +1,743 @@
+package htmlplugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mitmcdn/src/cache"
+	"mitmcdn/src/download"
+
+	"github.com/dop251/goja"
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	defaultScriptTimeout   = 500 * time.Millisecond
+	scriptCallStackSize    = 4096
+	scriptMaxValueLength   = 64 * 1024 * 1024 // characters or elements built by one builtin call
+	scriptDownloadPriority = 90
+)
+
+var errScriptTimeout = errors.New("time limit exceeded")
+
+// ScriptPlugin runs a TypeScript plugin. The source is transpiled with
+// esbuild and evaluated in a goja runtime that has no file or network
+// access; the global mitmcdn object is its only way out. Each call into the
+// plugin is stopped once it runs longer than the time limit. Memory is not
+// limited: goja cannot account for it, so plugins are trusted code.
+type ScriptPlugin struct {
+	name          string
+	timeout       time.Duration
+	cacheManager  *cache.Manager
+	downloadSched *download.Scheduler
+
+	mu sync.Mutex // a goja runtime is not safe for concurrent use
+	vm *goja.Runtime
+
+	// The plugin's exports; any of them may be missing
+	transform     goja.Callable // transform(html, page)
+	onRequest     goja.Callable // onRequest(request)
+	onResponse    goja.Callable // onResponse(response)
+	transformBody goja.Callable // transformBody(body, response), for contentTypes
+	shouldCache   goja.Callable // shouldCache(request)
+	contentTypes  []string
+
+	transformElement goja.Callable // transformElement(element, page), for elements
+	elements         []string
+
+	urlPathOnly    bool     // only run on requests through the URL-path reverse proxy
+	embedProviders []string // providers served on /cache/<provider>/<id>/
+}
+
+// scriptSettings are the keys of a plugin's config.toml read by mitmcdn
+// itself rather than by the plugin
+type scriptSettings struct {
+	Timeout      string   `toml:"timeout"` // per call, e.g. "500ms"
+	YTDLPCommand []string `toml:"yt_dlp_command"`
+}
+
+// LoadScriptPlugin loads the plugin at sourcePath with the config at
+// configPath, which may be missing. The plugin's name is its file name
+// without the .ts extension.
+func LoadScriptPlugin(sourcePath, configPath string, cacheMgr *cache.Manager, sched *download.Scheduler) (*ScriptPlugin, error) {
+	source, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugin: %w", err)
+	}
+
+	cfg := map[string]interface{}{}
+	var settings scriptSettings
+	data, err := os.ReadFile(configPath)
+	switch {
+	case err == nil:
+		if err := toml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %w", err)
+		}
+		if err := toml.Unmarshal(data, &settings); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	p := &ScriptPlugin{
+		name:          strings.TrimSuffix(baseName(sourcePath), ".ts"),
+		timeout:       defaultScriptTimeout,
+		cacheManager:  cacheMgr,
+		downloadSched: sched,
+	}
+	if settings.Timeout != "" {
+		if p.timeout, err = time.ParseDuration(settings.Timeout); err != nil || p.timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", settings.Timeout)
+		}
+	}
+	if _, ok := cfg["memory_limit"]; ok {
+		log.Printf("Plugin %s: memory_limit is not supported and ignored; calls are only bounded by timeout", p.name)
+	}
+	if _, ok := cfg["yt_dlp_command"]; ok {
+		if len(settings.YTDLPCommand) == 0 {
+			return nil, fmt.Errorf("yt_dlp_command cannot be empty")
+		}
+		if sched != nil {
+			sched.ConfigureYTDLPCommand(settings.YTDLPCommand)
+		}
+	}
+
+	code, err := transpile(sourcePath, string(source))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.load(code, cfg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// transpile turns TypeScript into a CommonJS script goja can run
+func transpile(sourcePath, source string) (string, error) {
+	result := api.Transform(source, api.TransformOptions{
+		Loader:     api.LoaderTS,
+		Format:     api.FormatCommonJS,
+		Target:     api.ES2017,
+		Sourcefile: sourcePath,
+	})
+	if len(result.Errors) > 0 {
+		messages := make([]string, 0, len(result.Errors))
+		for _, msg := range result.Errors {
+			if msg.Location != nil {
+				messages = append(messages, fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column, msg.Text))
+			} else {
+				messages = append(messages, msg.Text)
+			}
+		}
+		return "", fmt.Errorf("failed to transpile: %s", strings.Join(messages, "; "))
+	}
+	return string(result.Code), nil
+}
+
+// load evaluates the plugin module and looks up its hooks
+func (p *ScriptPlugin) load(code string, cfg map[string]interface{}) error {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(scriptCallStackSize)
+	p.vm = vm
+	p.capBuiltins()
+
+	host, err := p.hostAPI(cfg)
+	if err != nil {
+		return err
+	}
+	module := vm.NewObject()
+	exports := vm.NewObject()
+	module.Set("exports", exports)
+	vm.Set("module", module)
+	vm.Set("exports", exports)
+	vm.Set("mitmcdn", host)
+
+	if _, err := p.call(func() (goja.Value, error) {
+		return vm.RunScript(p.name+".js", code)
+	}); err != nil {
+		return fmt.Errorf("failed to evaluate: %w", err)
+	}
+
+	exported := module.Get("exports").ToObject(vm)
+	hooks := map[string]*goja.Callable{
+		"transform":     &p.transform,
+		"onRequest":     &p.onRequest,
+		"onResponse":    &p.onResponse,
+		"transformBody": &p.transformBody,
+		"shouldCache":   &p.shouldCache,
+
+		"transformElement": &p.transformElement,
+	}
+	found := false
+	for name, hook := range hooks {
+		if fn, ok := goja.AssertFunction(exported.Get(name)); ok {
+			*hook = fn
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("plugin exports none of transform, transformElement, onRequest, onResponse, transformBody or shouldCache")
+	}
+
+	if p.transformBody != nil {
+		var types []interface{}
+		if value := exported.Get("contentTypes"); value != nil {
+			types, _ = value.Export().([]interface{})
+		}
+		if len(types) == 0 {
+			return fmt.Errorf("transformBody requires a contentTypes export listing the content types it handles")
+		}
+		for _, t := range types {
+			p.contentTypes = append(p.contentTypes, strings.ToLower(fmt.Sprint(t)))
+		}
+	}
+
+	if value := exported.Get("urlPathOnly"); value != nil {
+		p.urlPathOnly = value.ToBoolean()
+	}
+
+	if value := exported.Get("embedProviders"); value != nil {
+		names, _ := value.Export().([]interface{})
+		for _, name := range names {
+			p.embedProviders = append(p.embedProviders, fmt.Sprint(name))
+		}
+	}
+
+	if p.transformElement != nil {
+		var tags []interface{}
+		if value := exported.Get("elements"); value != nil {
+			tags, _ = value.Export().([]interface{})
+		}
+		if len(tags) == 0 {
+			return fmt.Errorf("transformElement requires an elements export listing the tags it handles")
+		}
+		for _, t := range tags {
+			p.elements = append(p.elements, strings.ToLower(fmt.Sprint(t)))
+		}
+	}
+	return nil
+}
+
+// hostAPI builds the global mitmcdn object:
+//
+//	mitmcdn.config                   the plugin's config.toml
+//	mitmcdn.cacheStatus(url)         "complete", "downloading", "pending", "failed" or "" when not cached
+//	mitmcdn.download(url, options?)  starts caching url unless it is cached or downloading, returning its status;
+//	                                 options are filename, priority, fetchURL (the URL downloaded, if not url)
+//	                                 and downloader (the backend to use, if not the one fetchURL routes to)
+//	mitmcdn.embedURL(provider, id)   the URL a video served on /cache/<provider>/<id>/ is cached under
+//	mitmcdn.resolveURL(ref, base)    ref resolved against base, or "" when either is invalid
+//	mitmcdn.hash(text)               a short hex digest of text, for IDs made from URLs
+//	mitmcdn.log(...args)             writes to the server log
+func (p *ScriptPlugin) hostAPI(cfg map[string]interface{}) (*goja.Object, error) {
+	vm := p.vm
+	host := vm.NewObject()
+
+	// Round-trip through JSON so the config is made of plain JS objects and arrays
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	configValue, err := parse(goja.Undefined(), vm.ToValue(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	host.Set("config", configValue)
+
+	host.Set("cacheStatus", func(call goja.FunctionCall) goja.Value {
+		url := call.Argument(0).String()
+		file, err := p.cacheManager.FindFile(url, "full_url", cache.RequestKey{})
+		if err != nil {
+			panic(vm.NewGoError(err))
+		}
+		if file == nil {
+			return vm.ToValue("")
+		}
+		return vm.ToValue(file.DownloadStatus)
+	})
+
+	host.Set("download", func(call goja.FunctionCall) goja.Value {
+		url := call.Argument(0).String()
+		var options downloadOptions
+		if arg := call.Argument(1); !goja.IsUndefined(arg) && !goja.IsNull(arg) {
+			encoded, err := json.Marshal(arg.Export())
+			if err == nil {
+				err = json.Unmarshal(encoded, &options)
+			}
+			if err != nil {
+				panic(vm.NewTypeError("invalid download options: %v", err))
+			}
+		}
+		status, err := p.download(url, options)
+		if err != nil {
+			panic(vm.NewGoError(err))
+		}
+		return vm.ToValue(status)
+	})
+
+	host.Set("embedURL", func(provider, id string) string {
+		return download.EmbedCacheURL(provider, id)
+	})
+
+	host.Set("resolveURL", func(ref, base string) string {
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return ""
+		}
+		resolved, err := baseURL.Parse(ref)
+		if err != nil {
+			return ""
+		}
+		return resolved.String()
+	})
+
+	host.Set("hash", func(text string) string {
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:8])
+	})
+
+	host.Set("log", func(call goja.FunctionCall) goja.Value {
+		parts := make([]string, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			parts[i] = arg.String()
+		}
+		log.Printf("[plugin %s] %s", p.name, strings.Join(parts, " "))
+		return goja.Undefined()
+	})
+
+	return host, nil
+}
+
+// downloadOptions are the options of mitmcdn.download
+type downloadOptions struct {
+	Filename   string `json:"filename"`
+	Priority   int    `json:"priority"`
+	FetchURL   string `json:"fetchURL"`
+	Downloader string `json:"downloader"`
+}
+
+// download starts caching url for the plugin
+func (p *ScriptPlugin) download(url string, options downloadOptions) (string, error) {
+	if strings.TrimSpace(url) == "" {
+		return "", fmt.Errorf("download url cannot be empty")
+	}
+	filename := options.Filename
+	if filename == "" {
+		filename = baseName(url)
+	}
+	fetchURL := options.FetchURL
+	if fetchURL == "" {
+		fetchURL = url
+	}
+	priority := options.Priority
+	if priority == 0 {
+		priority = scriptDownloadPriority
+	}
+
+	file, err := p.cacheManager.GetOrCreateFile(url, "", filename, "full_url")
+	if err != nil {
+		return "", fmt.Errorf("failed to get cache entry for %s: %w", url, err)
+	}
+	if file.DownloadStatus == "complete" || file.DownloadStatus == "downloading" {
+		return file.DownloadStatus, nil
+	}
+	if options.Downloader != "" {
+		err = p.downloadSched.StartDownloadWith(file, fetchURL, options.Downloader, priority)
+	} else {
+		err = p.downloadSched.StartDownload(file, fetchURL, "", priority)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to start download for %s: %w", url, err)
+	}
+	return "downloading", nil
+}
+
+// call runs fn in the plugin's runtime under its time limit
+func (p *ScriptPlugin) call(fn func() (goja.Value, error)) (goja.Value, error) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			p.vm.Interrupt(errScriptTimeout)
+		}
+	}()
+
+	value, err := fn()
+	close(done)
+	wg.Wait()
+	p.vm.ClearInterrupt()
+
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		if cause, ok := interrupted.Value().(error); ok {
+			return nil, cause
+		}
+	}
+	return value, err
+}
+
+// capBuiltins makes the builtins that build a whole string or array in one
+// uninterruptible step throw a RangeError for results longer than
+// scriptMaxValueLength, as engines cap string length, so one step cannot
+// allocate gigabytes before the time limit is checked
+func (p *ScriptPlugin) capBuiltins() {
+	vm := p.vm
+	capped := func(class, method string, length func(call goja.FunctionCall) float64) {
+		proto := vm.Get(class).ToObject(vm).Get("prototype").ToObject(vm)
+		original, _ := goja.AssertFunction(proto.Get(method))
+		proto.Set(method, func(call goja.FunctionCall) goja.Value {
+			if length(call) > scriptMaxValueLength {
+				rangeError, err := vm.New(vm.Get("RangeError"), vm.ToValue("Invalid "+strings.ToLower(class)+" length"))
+				if err != nil {
+					panic(err)
+				}
+				panic(rangeError)
+			}
+			result, err := original(call.This, call.Arguments...)
+			if err != nil {
+				panic(err)
+			}
+			return result
+		})
+	}
+
+	capped("String", "repeat", func(call goja.FunctionCall) float64 {
+		return p.length(call.This) * call.Argument(0).ToFloat()
+	})
+	targetLength := func(call goja.FunctionCall) float64 {
+		return call.Argument(0).ToFloat()
+	}
+	capped("String", "padStart", targetLength)
+	capped("String", "padEnd", targetLength)
+	capped("Array", "fill", func(call goja.FunctionCall) float64 {
+		return p.length(call.This)
+	})
+}
+
+// length is the length property of v, or 0 when it has none
+func (p *ScriptPlugin) length(v goja.Value) float64 {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return 0
+	}
+	length := v.ToObject(p.vm).Get("length")
+	if length == nil {
+		return 0
+	}
+	return length.ToFloat()
+}
+
+func (p *ScriptPlugin) Name() string {
+	return p.name
+}
+
+// Process calls the plugin's transform(html, page) export. It may return the
+// new HTML as a string or as the html property of an object, or nothing to
+// leave the page unchanged.
+func (p *ScriptPlugin) Process(pageURL, html string) (string, bool, error) {
+	if p.transform == nil {
+		return html, false, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vm := p.vm
+	page := vm.NewObject()
+	page.Set("url", pageURL)
+	result, err := p.call(func() (goja.Value, error) {
+		return p.transform(goja.Undefined(), vm.ToValue(html), page)
+	})
+	if err != nil {
+		return html, false, err
+	}
+	modified, ok, err := p.resultString(result, "html")
+	if err != nil || !ok {
+		return html, false, err
+	}
+	return modified, modified != html, nil
+}
+
+// EmbedProviders returns the provider names the plugin exports as embedProviders
+func (p *ScriptPlugin) EmbedProviders() []string {
+	return p.embedProviders
+}
+
+// URLPathOnly reports whether the plugin exports urlPathOnly = true
+func (p *ScriptPlugin) URLPathOnly() bool {
+	return p.urlPathOnly
+}
+
+// TransformsPages reports whether the plugin exports transform, which needs
+// whole pages rather than streamed elements
+func (p *ScriptPlugin) TransformsPages() bool {
+	return p.transform != nil
+}
+
+// Elements returns the plugin's elements export
+func (p *ScriptPlugin) Elements() []string {
+	if p.transformElement == nil {
+		return nil
+	}
+	return p.elements
+}
+
+// RewriteElement calls transformElement({tag, attributes, baseURI}, page) on a start
+// tag. It may return a string of HTML replacing the tag, an object with tag
+// or attributes to change it (an attribute set to null is removed), or
+// nothing to leave it unchanged.
+func (p *ScriptPlugin) RewriteElement(pageURL string, el *Element) (string, bool, error) {
+	if p.transformElement == nil {
+		return "", false, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vm := p.vm
+	attributes := vm.NewObject()
+	for _, attr := range el.Attrs {
+		attributes.Set(attr.Key, attr.Val)
+	}
+	element := vm.NewObject()
+	element.Set("tag", el.Tag)
+	element.Set("attributes", attributes)
+	element.Set("baseURI", el.BaseURI)
+	page := vm.NewObject()
+	page.Set("url", pageURL)
+	result, err := p.call(func() (goja.Value, error) {
+		return p.transformElement(goja.Undefined(), element, page)
+	})
+	if err != nil || result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+		return "", false, err
+	}
+	if replacement, ok := result.Export().(string); ok {
+		return replacement, false, nil
+	}
+
+	before := el.String()
+	changes := result.ToObject(vm)
+	if tag := changes.Get("tag"); tag != nil && !goja.IsUndefined(tag) && !goja.IsNull(tag) {
+		el.Tag = strings.ToLower(tag.String())
+	}
+	if value := changes.Get("attributes"); value != nil && !goja.IsUndefined(value) && !goja.IsNull(value) {
+		changed := value.ToObject(vm)
+		for _, key := range changed.Keys() {
+			if v := changed.Get(key); goja.IsUndefined(v) || goja.IsNull(v) {
+				el.removeAttr(key)
+			} else {
+				el.setAttr(key, v.String())
+			}
+		}
+	}
+	return "", el.String() != before, nil
+}
+
+// RewriteRequest calls onRequest({method, url, headers}) on an upstream
+// request. It may return {url, headers} to change the URL or headers; a
+// header set to null is removed.
+func (p *ScriptPlugin) RewriteRequest(req *http.Request) error {
+	if p.onRequest == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	request := p.vm.NewObject()
+	request.Set("method", req.Method)
+	request.Set("url", req.URL.String())
+	request.Set("headers", p.headersObject(req.Header))
+	result, err := p.call(func() (goja.Value, error) {
+		return p.onRequest(goja.Undefined(), request)
+	})
+	if err != nil || result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+		return err
+	}
+
+	changes, ok := result.Export().(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("onRequest must return an object with url or headers")
+	}
+	if rawURL, ok := changes["url"].(string); ok && rawURL != req.URL.String() {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("onRequest returned an invalid url %q", rawURL)
+		}
+		req.URL = u
+		req.Host = u.Host
+	}
+	return applyHeaderChanges(req.Header, changes["headers"])
+}
+
+// InspectResponse calls onResponse({url, status, headers}) before a response
+// header is sent. It may return {headers} to change it like onRequest.
+func (p *ScriptPlugin) InspectResponse(rawURL string, status int, header http.Header) error {
+	if p.onResponse == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	response := p.vm.NewObject()
+	response.Set("url", rawURL)
+	response.Set("status", status)
+	response.Set("headers", p.headersObject(header))
+	result, err := p.call(func() (goja.Value, error) {
+		return p.onResponse(goja.Undefined(), response)
+	})
+	if err != nil || result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+		return err
+	}
+
+	changes, ok := result.Export().(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("onResponse must return an object with headers")
+	}
+	return applyHeaderChanges(header, changes["headers"])
+}
+
+// ShouldCache calls shouldCache({method, url, headers}), which returns true
+// or false to override the CDN rules, or nothing to leave them be
+func (p *ScriptPlugin) ShouldCache(req *http.Request, rawURL string) (bool, bool, error) {
+	if p.shouldCache == nil {
+		return false, false, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	request := p.vm.NewObject()
+	request.Set("method", req.Method)
+	request.Set("url", rawURL)
+	request.Set("headers", p.headersObject(req.Header))
+	result, err := p.call(func() (goja.Value, error) {
+		return p.shouldCache(goja.Undefined(), request)
+	})
+	if err != nil || result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+		return false, false, err
+	}
+	cache, ok := result.Export().(bool)
+	if !ok {
+		return false, false, fmt.Errorf("shouldCache must return a boolean")
+	}
+	return cache, true, nil
+}
+
+// TransformsBody reports whether contentType is listed in the plugin's
+// contentTypes export, either exactly or as type/* for its whole type
+func (p *ScriptPlugin) TransformsBody(contentType string) bool {
+	if p.transformBody == nil {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, accepted := range p.contentTypes {
+		if accepted == mediaType || (strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransformBody calls transformBody(body, {url, contentType}), which returns
+// the new body as a string or as the body property of an object, or nothing
+// to leave it unchanged
+func (p *ScriptPlugin) TransformBody(rawURL, contentType string, body []byte) ([]byte, bool, error) {
+	if p.transformBody == nil {
+		return body, false, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	response := p.vm.NewObject()
+	response.Set("url", rawURL)
+	response.Set("contentType", contentType)
+	result, err := p.call(func() (goja.Value, error) {
+		return p.transformBody(goja.Undefined(), p.vm.ToValue(string(body)), response)
+	})
+	if err != nil {
+		return body, false, err
+	}
+	modified, ok, err := p.resultString(result, "body")
+	if err != nil || !ok || modified == string(body) {
+		return body, false, err
+	}
+	return []byte(modified), true, nil
+}
+
+// resultString reads a hook's result given either as a string or as the
+// named property of an object; ok is false when the hook returned nothing
+func (p *ScriptPlugin) resultString(result goja.Value, property string) (string, bool, error) {
+	if result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+		return "", false, nil
+	}
+	if s, ok := result.Export().(string); ok {
+		return s, true, nil
+	}
+	value := result.ToObject(p.vm).Get(property)
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return "", false, fmt.Errorf("expected a string or an object with a %s property", property)
+	}
+	return value.String(), true, nil
+}
+
+// headersObject exposes a header to the plugin as {Name: "value"}, with
+// repeated headers joined by ", "
+func (p *ScriptPlugin) headersObject(header http.Header) *goja.Object {
+	obj := p.vm.NewObject()
+	for name, values := range header {
+		obj.Set(name, strings.Join(values, ", "))
+	}
+	return obj
+}
+
+// applyHeaderChanges applies a hook's {Name: "value" | null} to header
+func applyHeaderChanges(header http.Header, changes interface{}) error {
+	if changes == nil {
+		return nil
+	}
+	values, ok := changes.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("headers must be an object")
+	}
+	for name, value := range values {
+		if value == nil {
+			header.Del(name)
+		} else {
+			header.Set(name, fmt.Sprint(value))
+		}
+	}
+	return nil
+}
+
+// baseName returns the last element of a slash-separated path or URL
+func baseName(path string) string {
+	if i := strings.LastIndexAny(path, "/\\"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
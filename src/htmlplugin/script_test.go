@@ -0,0 +1,337 @@
+package htmlplugin
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeScriptPlugin(t *testing.T, dir, name, source, config string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "plugins", name+".ts")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create plugins dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("failed to write plugin: %v", err)
+	}
+	if config != "" {
+		cfgPath := filepath.Join(dir, "configs", name, "config.toml")
+		if err := os.MkdirAll(filepath.Dir(cfgPath), 0755); err != nil {
+			t.Fatalf("failed to create configs dir: %v", err)
+		}
+		if err := os.WriteFile(cfgPath, []byte(config), 0644); err != nil {
+			t.Fatalf("failed to write plugin config: %v", err)
+		}
+	}
+	return path
+}
+
+func TestManager_LoadsAnyScriptPlugin(t *testing.T) {
+	cacheMgr, sched, db := setupPluginTestEnv(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("banner-bytes"))
+	}))
+	defer server.Close()
+	origin := server.URL
+	dir := t.TempDir()
+	writeScriptPlugin(t, dir, "banner", `
+interface Config { banner: string; tags: string[] }
+const config = mitmcdn.config as Config;
+
+export function transform(html: string, page: Page) {
+  const status = mitmcdn.cacheStatus(config.banner);
+  if (status === "") {
+    mitmcdn.download(config.banner, { filename: "banner.png", priority: 50 });
+  }
+  return { html: html.replace("</body>", `+"`"+`<p data-tags="${config.tags.join(",")}" data-status="${status}">${page.url}</p></body>`+"`"+`) };
+}
+`, `banner = "`+origin+`/banner.png"
+tags = ["a", "b"]
+`)
+	// Type declarations are not plugins
+	writeScriptPlugin(t, dir, "types.d", "declare const x: number;\n", "")
+
+	mgr, err := NewManager(filepath.Join(dir, "plugins"), filepath.Join(dir, "configs"), cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	if len(mgr.plugins) != 1 || mgr.plugins[0].Name() != "banner" {
+		t.Fatalf("expected only the banner plugin, got %d plugins", len(mgr.plugins))
+	}
+
+	modified, changed, err := mgr.Apply("https://site.example/page", "<body></body>")
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if !changed || modified != `<body><p data-tags="a,b" data-status="">https://site.example/page</p></body>` {
+		t.Fatalf("unexpected output (changed=%v): %s", changed, modified)
+	}
+
+	file := waitForStatusByURL(t, db, origin+"/banner.png", "complete")
+	if file.Filename != "banner.png" {
+		t.Fatalf("filename = %q, want banner.png", file.Filename)
+	}
+
+	modified, _, err = mgr.Apply("https://site.example/page", "<body></body>")
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if !strings.Contains(modified, `data-status="complete"`) {
+		t.Fatalf("expected cached banner status, got: %s", modified)
+	}
+}
+
+func TestScriptPlugin_ReturnValues(t *testing.T) {
+	cacheMgr, sched, _ := setupPluginTestEnv(t)
+	dir := t.TempDir()
+
+	path := writeScriptPlugin(t, dir, "returns", `
+export function transform(html: string): any {
+  switch (html) {
+    case "string": return "replaced";
+    case "object": return { html: "replaced" };
+    case "same": return html;
+    case "bad": return 42;
+  }
+  return undefined;
+}
+`, "")
+	plugin, err := LoadScriptPlugin(path, filepath.Join(dir, "configs", "returns", "config.toml"), cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to load plugin: %v", err)
+	}
+
+	tests := []struct {
+		html    string
+		want    string
+		changed bool
+		wantErr bool
+	}{
+		{html: "string", want: "replaced", changed: true},
+		{html: "object", want: "replaced", changed: true},
+		{html: "same", want: "same"},
+		{html: "nothing", want: "nothing"},
+		{html: "bad", want: "bad", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, changed, err := plugin.Process("https://site.example/", tc.html)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: err = %v, wantErr %v", tc.html, err, tc.wantErr)
+		}
+		if got != tc.want || changed != tc.changed {
+			t.Fatalf("%s: got (%q, %v), want (%q, %v)", tc.html, got, changed, tc.want, tc.changed)
+		}
+	}
+}
+
+func TestScriptPlugin_Limits(t *testing.T) {
+	cacheMgr, sched, _ := setupPluginTestEnv(t)
+	dir := t.TempDir()
+
+	path := writeScriptPlugin(t, dir, "limits", `
+export function transform(html: string) {
+  if (html === "loop") {
+    for (;;) {}
+  }
+  if (html === "huge") {
+    return "x".repeat(2 ** 30);
+  }
+  if (html === "caught") {
+    try {
+      new Array(1 << 30).fill(0);
+    } catch (e) {}
+    return "survived";
+  }
+  return html.toUpperCase();
+}
+`, "timeout = \"200ms\"\n")
+	cfgPath := filepath.Join(dir, "configs", "limits", "config.toml")
+
+	plugin, err := LoadScriptPlugin(path, cfgPath, cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to load plugin: %v", err)
+	}
+
+	if _, _, err := plugin.Process("https://site.example/", "loop"); !errors.Is(err, errScriptTimeout) {
+		t.Fatalf("expected time limit error, got %v", err)
+	}
+	// Builtins building one huge value throw instead of allocating it
+	if _, _, err := plugin.Process("https://site.example/", "huge"); err == nil || !strings.Contains(err.Error(), "Invalid string length") {
+		t.Fatalf("expected a RangeError, got %v", err)
+	}
+	if got, _, err := plugin.Process("https://site.example/", "caught"); err != nil || got != "survived" {
+		t.Fatalf("got (%q, %v), want the plugin to catch the RangeError", got, err)
+	}
+
+	// The runtime stays usable after an interrupted call
+	got, changed, err := plugin.Process("https://site.example/", "ok")
+	if err != nil || !changed || got != "OK" {
+		t.Fatalf("got (%q, %v, %v) after interrupted calls", got, changed, err)
+	}
+
+	mgr := &Manager{plugins: []HTMLPlugin{plugin}}
+	reqURL, _ := url.Parse("https://site.example/")
+	resp := &http.Response{
+		Header:  http.Header{"Content-Type": []string{"text/html"}},
+		Body:    io.NopCloser(strings.NewReader("loop")),
+		Request: &http.Request{URL: reqURL},
+	}
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "loop" {
+		t.Fatalf("a failing plugin should leave the page unchanged, got %q", body)
+	}
+}
+
+func TestLoadScriptPlugin_Errors(t *testing.T) {
+	cacheMgr, sched, _ := setupPluginTestEnv(t)
+
+	tests := []struct {
+		name   string
+		source string
+		config string
+	}{
+		{name: "syntax error", source: "export function transform(html: string {\n"},
+		{name: "no hooks", source: "export const answer = 42;\n"},
+		{name: "body hook without content types", source: "export function transformBody(body: string) { return body; }\n"},
+		{name: "module throws", source: "throw new Error(\"bad config\");\nexport function transform(html: string) { return html; }\n"},
+		{name: "module loops", source: "for (;;) {}\nexport function transform(html: string) { return html; }\n", config: "timeout = \"50ms\"\n"},
+		{name: "invalid timeout", source: "export function transform(html: string) { return html; }\n", config: "timeout = \"soon\"\n"},
+		{name: "invalid config", source: "export function transform(html: string) { return html; }\n", config: "timeout = \n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeScriptPlugin(t, dir, "broken", tc.source, tc.config)
+			if _, err := LoadScriptPlugin(path, filepath.Join(dir, "configs", "broken", "config.toml"), cacheMgr, sched); err == nil {
+				t.Fatalf("expected load error")
+			}
+		})
+	}
+}
+
+func TestScriptPlugin_Hooks(t *testing.T) {
+	cacheMgr, sched, _ := setupPluginTestEnv(t)
+	dir := t.TempDir()
+
+	path := writeScriptPlugin(t, dir, "hooks", `
+export const contentTypes = ["application/json", "text/*"];
+
+export function onRequest(request: PluginRequest): RequestChanges | undefined {
+  if (request.method !== "GET") {
+    return undefined;
+  }
+  return {
+    url: request.url.replace("http://", "https://"),
+    headers: { "User-Agent": "plugin/" + request.headers["User-Agent"], "Cookie": null },
+  };
+}
+
+export function onResponse(response: PluginResponse) {
+  if (response.headers["Content-Type"] === "application/json") {
+    return { headers: { "Cache-Control": "no-store", "X-Status": String(response.status) } };
+  }
+}
+
+export function shouldCache(request: PluginRequest): any {
+  if (request.url.endsWith(".mp4")) return true;
+  if (request.url.endsWith(".m3u8")) return false;
+  if (request.url.endsWith(".bad")) return "yes";
+  return undefined;
+}
+
+export function transformBody(body: string, response: BodyInfo) {
+  if (response.contentType.startsWith("text/css")) {
+    return { body: body.replace("red", "blue") };
+  }
+  return body.toUpperCase();
+}
+`, "")
+	plugin, err := LoadScriptPlugin(path, filepath.Join(dir, "configs", "hooks", "config.toml"), cacheMgr, sched)
+	if err != nil {
+		t.Fatalf("failed to load plugin: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://cdn.example/a.js", nil)
+	req.Header.Set("User-Agent", "client")
+	req.Header.Set("Cookie", "session=1")
+	if err := plugin.RewriteRequest(req); err != nil {
+		t.Fatalf("RewriteRequest: %v", err)
+	}
+	if req.URL.String() != "https://cdn.example/a.js" || req.Host != "cdn.example" {
+		t.Fatalf("request URL = %s, host %s", req.URL, req.Host)
+	}
+	if req.Header.Get("User-Agent") != "plugin/client" || req.Header.Get("Cookie") != "" {
+		t.Fatalf("request headers = %v", req.Header)
+	}
+	post, _ := http.NewRequest(http.MethodPost, "http://cdn.example/a.js", nil)
+	if err := plugin.RewriteRequest(post); err != nil || post.URL.String() != "http://cdn.example/a.js" {
+		t.Fatalf("POST rewritten to %s: %v", post.URL, err)
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if err := plugin.InspectResponse("https://cdn.example/a.json", 200, header); err != nil {
+		t.Fatalf("InspectResponse: %v", err)
+	}
+	if header.Get("Cache-Control") != "no-store" || header.Get("X-Status") != "200" {
+		t.Fatalf("response headers = %v", header)
+	}
+
+	for _, tc := range []struct {
+		url            string
+		cache, decided bool
+		wantErr        bool
+	}{
+		{url: "https://cdn.example/v.mp4", cache: true, decided: true},
+		{url: "https://cdn.example/v.m3u8", decided: true},
+		{url: "https://cdn.example/page"},
+		{url: "https://cdn.example/x.bad", wantErr: true},
+	} {
+		cache, decided, err := plugin.ShouldCache(req, tc.url)
+		if cache != tc.cache || decided != tc.decided || (err != nil) != tc.wantErr {
+			t.Fatalf("ShouldCache(%s) = %v, %v, %v", tc.url, cache, decided, err)
+		}
+	}
+
+	for contentType, want := range map[string]bool{
+		"application/json":          true,
+		"application/json; charset": false,
+		"text/css; charset=utf-8":   true,
+		"text/html":                 true,
+		"application/javascript":    false,
+	} {
+		if got := plugin.TransformsBody(contentType); got != want {
+			t.Fatalf("TransformsBody(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+	body, changed, err := plugin.TransformBody("https://cdn.example/a.css", "text/css", []byte("a { color: red }"))
+	if err != nil || !changed || string(body) != "a { color: blue }" {
+		t.Fatalf("TransformBody = %q, %v, %v", body, changed, err)
+	}
+
+	mgr := &Manager{plugins: []HTMLPlugin{plugin}}
+	reqURL, _ := url.Parse("https://cdn.example/a.json")
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"a":1}`)),
+		Request:    &http.Request{URL: reqURL},
+	}
+	if err := mgr.ModifyResponse(resp); err != nil {
+		t.Fatalf("modify response failed: %v", err)
+	}
+	if got, _ := io.ReadAll(resp.Body); string(got) != `{"A":1}` || resp.Header.Get("Content-Length") != "7" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("response = %q, headers %v", got, resp.Header)
+	}
+}
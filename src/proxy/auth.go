@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mitmcdn/src/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// proxyUser is an authenticated proxy account with its policy and counters
+type proxyUser struct {
+	name         string
+	passwordHash []byte
+	allowedRules map[string]bool // nil allows every CDN rule
+	limiter      *bandwidthLimiter
+	priority     int
+
+	requests  atomic.Int64
+	cacheHits atomic.Int64
+	bytesSent atomic.Int64
+	tunnels   atomic.Int64
+}
+
+// UserStatus is a per-user summary for the status API
+type UserStatus struct {
+	Username  string `json:"username"`
+	Requests  int64  `json:"requests"`
+	CacheHits int64  `json:"cache_hits"`
+	BytesSent int64  `json:"bytes_sent"`
+	Tunnels   int64  `json:"tunnels"`
+}
+
+// userStore holds the configured proxy users. A nil store disables authentication.
+type userStore struct {
+	users    map[string]*proxyUser
+	verified sync.Map // username + sha256(password) -> struct{}, avoids a bcrypt check per request
+}
+
+func newUserStore(users []config.UserConfig) (*userStore, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	store := &userStore{users: make(map[string]*proxyUser, len(users))}
+	for _, u := range users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("user without username")
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("user %s: invalid bcrypt password_hash: %w", u.Username, err)
+		}
+
+		user := &proxyUser{
+			name:         u.Username,
+			passwordHash: []byte(u.PasswordHash),
+			priority:     u.Priority,
+		}
+		if user.priority == 0 {
+			user.priority = 100
+		}
+		if len(u.AllowedRules) > 0 {
+			user.allowedRules = make(map[string]bool, len(u.AllowedRules))
+			for _, domain := range u.AllowedRules {
+				user.allowedRules[strings.ToLower(domain)] = true
+			}
+		}
+		if u.BandwidthLimit != "" {
+			rate, err := config.ParseSize(u.BandwidthLimit)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: invalid bandwidth_limit: %w", u.Username, err)
+			}
+			user.limiter = newBandwidthLimiter(rate)
+		}
+		store.users[u.Username] = user
+	}
+	return store, nil
+}
+
+// authenticate returns the user for valid credentials, or nil
+func (s *userStore) authenticate(username, password string) *proxyUser {
+	user, ok := s.users[username]
+	if !ok {
+		return nil
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	key := username + "\x00" + string(digest[:])
+	if _, ok := s.verified.Load(key); ok {
+		return user
+	}
+	if bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)) != nil {
+		return nil
+	}
+	s.verified.Store(key, struct{}{})
+	return user
+}
+
+// lookup returns an already-authenticated user by name
+func (s *userStore) lookup(username string) *proxyUser {
+	if s == nil {
+		return nil
+	}
+	return s.users[username]
+}
+
+// Valid implements socks5.CredentialStore for RFC 1929 authentication
+func (s *userStore) Valid(username, password, _ string) bool {
+	return s.authenticate(username, password) != nil
+}
+
+// authenticateHTTP checks the Proxy-Authorization Basic credentials of a request
+func (s *userStore) authenticateHTTP(r *http.Request) *proxyUser {
+	scheme, encoded, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil
+	}
+	return s.authenticate(username, password)
+}
+
+// Status returns per-user counters sorted by username
+func (s *userStore) Status() []UserStatus {
+	if s == nil {
+		return nil
+	}
+
+	status := make([]UserStatus, 0, len(s.users))
+	for _, user := range s.users {
+		status = append(status, UserStatus{
+			Username:  user.name,
+			Requests:  user.requests.Load(),
+			CacheHits: user.cacheHits.Load(),
+			BytesSent: user.bytesSent.Load(),
+			Tunnels:   user.tunnels.Load(),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Username < status[j].Username })
+	return status
+}
+
+type proxyUserKey struct{}
+
+// withProxyUser attaches the authenticated user to a request context
+func withProxyUser(ctx context.Context, user *proxyUser) context.Context {
+	if user == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyUserKey{}, user)
+}
+
+// proxyUserFrom returns the authenticated user of a request context, or nil
+func proxyUserFrom(ctx context.Context) *proxyUser {
+	user, _ := ctx.Value(proxyUserKey{}).(*proxyUser)
+	return user
+}
+
+// Name returns the username, or "" for anonymous clients
+func (u *proxyUser) Name() string {
+	if u == nil {
+		return ""
+	}
+	return u.name
+}
+
+// allowsRule reports whether the user's traffic may be cached under a CDN rule
+func (u *proxyUser) allowsRule(rule config.CDNRule) bool {
+	if u == nil || u.allowedRules == nil {
+		return true
+	}
+	return u.allowedRules[strings.ToLower(rule.Domain)]
+}
+
+// ruleFilter returns allowsRule as a RuleMatcher filter, nil when every rule is allowed
+func (u *proxyUser) ruleFilter() func(*config.CDNRule) bool {
+	if u == nil || u.allowedRules == nil {
+		return nil
+	}
+	return func(rule *config.CDNRule) bool { return u.allowsRule(*rule) }
+}
+
+// downloadPriority returns the scheduler priority for the user's cache misses
+func (u *proxyUser) downloadPriority() int {
+	if u == nil {
+		return 100
+	}
+	return u.priority
+}
+
+// limitWriter applies the user's bandwidth cap and byte accounting to w
+func (u *proxyUser) limitWriter(w io.Writer) io.Writer {
+	if u == nil {
+		return w
+	}
+	return &limitedWriter{w: w, user: u}
+}
+
+// limitResponseWriter applies the user's bandwidth cap and byte accounting to w
+func (u *proxyUser) limitResponseWriter(w http.ResponseWriter) http.ResponseWriter {
+	if u == nil {
+		return w
+	}
+	return &limitedResponseWriter{ResponseWriter: w, limited: limitedWriter{w: w, user: u}}
+}
+
+// bandwidthLimiter is a token bucket shared by all connections of one user
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// chunkSize bounds a single write so one connection cannot hold the bucket for long
+func (l *bandwidthLimiter) chunkSize() int {
+	return max(1024, int(l.rate/10))
+}
+
+// wait blocks until n bytes may be sent
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// limitedWriter throttles and counts bytes written to a user
+type limitedWriter struct {
+	w    io.Writer
+	user *proxyUser
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.user.limiter == nil {
+		n, err := l.w.Write(b)
+		l.user.bytesSent.Add(int64(n))
+		return n, err
+	}
+
+	written := 0
+	chunk := l.user.limiter.chunkSize()
+	for written < len(b) {
+		end := min(len(b), written+chunk)
+		l.user.limiter.wait(end - written)
+		n, err := l.w.Write(b[written:end])
+		written += n
+		l.user.bytesSent.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite forwards half-closes so throttled tunnels keep working
+func (l *limitedWriter) CloseWrite() error {
+	if cw, ok := l.w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// limitedResponseWriter throttles and counts a response body
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	limited limitedWriter
+}
+
+func (w *limitedResponseWriter) Write(b []byte) (int, error) {
+	return w.limited.Write(b)
+}
+
+func (w *limitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *limitedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijacking not supported")
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/proxy"
+)
+
+func hashPasswordForTest(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	return string(hash)
+}
+
+func sendConnectWithAuth(t *testing.T, proxyAddr, target, username, password string) (net.Conn, *http.Response) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", target, target, credentials)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	return conn, resp
+}
+
+func TestHTTPProxyRequiresAuthentication(t *testing.T) {
+	echoAddr := startHalfCloseEchoServer(t)
+	server, proxyAddr := startUnifiedServerForTest(t, &config.Config{
+		ProxyMode: "all",
+		Users:     []config.UserConfig{{Username: "alice", PasswordHash: hashPasswordForTest(t, "secret")}},
+	})
+
+	conn, _, resp := sendConnect(t, proxyAddr, echoAddr)
+	conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("unauthenticated CONNECT status = %d, want 407", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="mitmcdn"` {
+		t.Errorf("Proxy-Authenticate = %q", got)
+	}
+
+	conn, resp = sendConnectWithAuth(t, proxyAddr, echoAddr, "alice", "wrong")
+	conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("wrong password CONNECT status = %d, want 407", resp.StatusCode)
+	}
+
+	conn, resp = sendConnectWithAuth(t, proxyAddr, echoAddr, "alice", "secret")
+	conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && server.mitmProxy.UserStatus()[0].Tunnels == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := server.mitmProxy.UserStatus(); len(status) != 1 || status[0].Username != "alice" || status[0].Tunnels != 1 {
+		t.Errorf("unexpected user status: %+v", status)
+	}
+}
+
+func TestURLPathProxyRequiresAuthentication(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("Proxy-Authorization reached the origin")
+		}
+		_, _ = w.Write([]byte("origin-body"))
+	}))
+	defer origin.Close()
+
+	server, proxyAddr := startUnifiedServerForTest(t, &config.Config{
+		ProxyMode: "all",
+		Users:     []config.UserConfig{{Username: "alice", PasswordHash: hashPasswordForTest(t, "secret")}},
+	})
+	target := "http://" + proxyAddr + "/" + origin.URL + "/file.txt"
+
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("unauthenticated URL path status = %d, want 407", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "origin-body" {
+		t.Fatalf("authenticated URL path response = %d %q", resp.StatusCode, body)
+	}
+	if status := server.mitmProxy.UserStatus(); status[0].Requests != 1 || status[0].BytesSent == 0 {
+		t.Errorf("unexpected user status: %+v", status)
+	}
+}
+
+func TestSOCKS5ProxyAuthenticatesAndAttributesUsers(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("attributed-body"))
+	}))
+	defer origin.Close()
+
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatalf("failed to parse origin URL: %v", err)
+	}
+
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{
+		Domain:        originURL.Hostname(),
+		MatchPattern:  ".*",
+		DedupStrategy: "full_url",
+	}})
+	mitm.users, err = newUserStore([]config.UserConfig{{Username: "bob", PasswordHash: hashPasswordForTest(t, "hunter2")}})
+	if err != nil {
+		t.Fatalf("newUserStore() error = %v", err)
+	}
+
+	socksProxy, err := NewSOCKS5Proxy(mitm.config, mitm.cacheManager, mitm.downloadSched, mitm)
+	if err != nil {
+		t.Fatalf("failed to create SOCKS5 proxy: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go socksProxy.Serve(listener)
+
+	targetURL := origin.URL + "/files/attributed.bin"
+
+	client := newSOCKS5HTTPClientWithAuth(t, listener.Addr().String(), &proxy.Auth{User: "bob", Password: "wrong"})
+	if resp, err := client.Get(targetURL); err == nil {
+		resp.Body.Close()
+		t.Fatal("request with wrong SOCKS5 password should fail")
+	}
+
+	client = newSOCKS5HTTPClientWithAuth(t, listener.Addr().String(), &proxy.Auth{User: "bob", Password: "hunter2"})
+	resp, err := client.Get(targetURL)
+	if err != nil {
+		t.Fatalf("authenticated SOCKS5 request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "attributed-body" {
+		t.Fatalf("body = %q", body)
+	}
+
+	file, ok := waitForCachedFileByURL(t, db, targetURL, 5*time.Second)
+	if !ok {
+		t.Fatalf("expected cached file record for %s", targetURL)
+	}
+	if file.RequestedBy != "bob" {
+		t.Errorf("RequestedBy = %q, want bob", file.RequestedBy)
+	}
+	if status := mitm.UserStatus(); status[0].Requests != 1 || status[0].BytesSent == 0 {
+		t.Errorf("unexpected user status: %+v", status)
+	}
+}
+
+func TestUserAllowedRules(t *testing.T) {
+	cfg := &config.Config{CDNRules: []config.CDNRule{
+		{Domain: "video.example.com", MatchPattern: ".*"},
+		{Domain: "img.example.com", MatchPattern: ".*"},
+	}}
+	rules, err := cfg.RuleMatcher()
+	if err != nil {
+		t.Fatalf("RuleMatcher() error = %v", err)
+	}
+	p := &MITMProxy{config: cfg, rules: rules}
+	user := &proxyUser{name: "carol", allowedRules: map[string]bool{"img.example.com": true}}
+
+	if p.shouldInterceptFor("video.example.com", user) {
+		t.Error("user without the video rule should not be intercepted")
+	}
+	if !p.shouldInterceptFor("img.example.com", user) || !p.shouldInterceptFor("video.example.com", nil) {
+		t.Error("allowed rules and anonymous clients should be intercepted")
+	}
+	if rule := p.findMatchingRuleFor("https://video.example.com/a.mp4", user); rule != nil {
+		t.Errorf("findMatchingRuleFor() = %v, want nil", rule.Domain)
+	}
+}
+
+func TestBandwidthLimitedWriter(t *testing.T) {
+	user := &proxyUser{name: "dave", limiter: newBandwidthLimiter(20000)}
+	w := user.limitWriter(io.Discard)
+
+	// The bucket starts full, so the second 10000 bytes must wait about half a second
+	start := time.Now()
+	n, err := w.Write(make([]byte, 30000))
+	elapsed := time.Since(start)
+	if err != nil || n != 30000 {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("30000 bytes at 20000 B/s took %v, want at least 400ms", elapsed)
+	}
+	if got := user.bytesSent.Load(); got != 30000 {
+		t.Errorf("bytesSent = %d, want 30000", got)
+	}
+}
+
+func TestNewUserStoreRejectsInvalidHash(t *testing.T) {
+	if _, err := newUserStore([]config.UserConfig{{Username: "eve", PasswordHash: "plaintext"}}); err == nil {
+		t.Fatal("newUserStore() should reject a non-bcrypt password_hash")
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"mitmcdn/src/download"
+)
+
+var hlsCachePathRegex = regexp.MustCompile(`^/cache/hls/([0-9a-f]{64})/(index\.m3u8|video\.ts|player|seg/([0-9a-f]{64})[^/]*)$`)
+
+//go:generate curl -sSfL -o assets/hls.min.js https://cdn.jsdelivr.net/npm/hls.js@1.5.20/dist/hls.min.js
+//go:generate curl -sSfL -o assets/hls.js-LICENSE https://cdn.jsdelivr.net/npm/hls.js@1.5.20/LICENSE
+
+// playerAssets holds hls.js for the player page, served on hlsScriptPath
+//
+//go:embed assets
+var playerAssets embed.FS
+
+const hlsScriptPath = "/cache/hls/hls.min.js"
+
+// handleCacheHLS serves offline copies of cached HLS streams: the playlist
+// rewritten to local URLs, its segments, the rendition joined into one
+// MPEG-TS file, and a player page.
+func (s *UnifiedServer) handleCacheHLS(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if urlPath == hlsScriptPath {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeFileFS(w, r, playerAssets, "assets/hls.min.js")
+		return
+	}
+	m := hlsCachePathRegex.FindStringSubmatch(urlPath)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	packager := download.NewHLSPackager(s.db)
+
+	if m[3] != "" {
+		segment, err := packager.FindSegment(m[3])
+		if err != nil {
+			http.Error(w, "Segment not cached", http.StatusNotFound)
+			return
+		}
+		if s.downloadSched != nil {
+			s.downloadSched.ServeFile(segment, w, r)
+		} else {
+			http.ServeFile(w, r, segment.SavedPath)
+		}
+		return
+	}
+
+	file, err := packager.FindPlaylist(m[1])
+	if err != nil {
+		http.Error(w, "Playlist not cached", http.StatusNotFound)
+		return
+	}
+
+	switch m[2] {
+	case "index.m3u8":
+		playlist, err := packager.LocalPlaylist(file, "/cache/hls")
+		if err != nil {
+			writePackagingError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Content-Length", strconv.Itoa(len(playlist)))
+		w.Write(playlist)
+	case "video.ts":
+		export, err := packager.PrepareTS(file)
+		if err != nil {
+			writePackagingError(w, err)
+			return
+		}
+		name := strings.TrimSuffix(path.Base(file.Filename), path.Ext(file.Filename))
+		if name == "" || name == "." || name == "/" {
+			name = "video"
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name+".ts"))
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := export.WriteTo(w); err != nil {
+			logErrorWithStack(err, "Failed to write MPEG-TS for %s", file.OriginalURL)
+		}
+	case "player":
+		s.serveHLSPlayer(w, file.FileHash, file.OriginalURL)
+	}
+}
+
+// writePackagingError reports why a cached stream cannot be packaged yet
+func writePackagingError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, download.ErrIncomplete):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, download.ErrNotTransportStream):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveHLSPlayer returns a player page for a cached HLS stream. Browsers
+// without native HLS support load the hls.js bundled with the server; when
+// the build has none, or it fails to load, the page says so.
+func (s *UnifiedServer) serveHLSPlayer(w http.ResponseWriter, fileHash, originalURL string) {
+	playlistSrc := fmt.Sprintf("/cache/hls/%s/index.m3u8", fileHash)
+	videoSrc := fmt.Sprintf("/cache/hls/%s/video.ts", fileHash)
+	_, err := fs.Stat(playerAssets, "assets/hls.min.js")
+	bundled := err == nil
+
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>%s - Cached Stream</title>
+<style>*{margin:0;padding:0;box-sizing:border-box}html,body{width:100%%;height:100%%;background:#000;overflow:hidden}
+video{width:100%%;height:100%%;object-fit:contain}
+a{position:fixed;top:8px;right:12px;color:#ccc;font:13px sans-serif}
+#notice{position:fixed;left:0;right:0;top:40%%;padding:0 16px;color:#ccc;font:15px sans-serif;text-align:center}</style></head>
+<body><video id="video" controls autoplay></video><a href="%s">Download .ts</a><p id="notice" hidden></p>
+<script>
+var video = document.getElementById('video');
+var src = '%s';
+function notice(text) {
+  var p = document.getElementById('notice');
+  p.textContent = text + ' Download the .ts file to play it instead.';
+  p.hidden = false;
+}
+if (video.canPlayType('application/vnd.apple.mpegurl')) {
+  video.src = src;
+} else if (!%t) {
+  notice('This browser cannot play HLS natively and this mitmcdn build does not bundle hls.js (run "go generate ./src/proxy" before building).');
+} else {
+  var script = document.createElement('script');
+  script.src = '%s';
+  script.onload = function () {
+    if (!window.Hls || !Hls.isSupported()) {
+      notice('This browser supports neither native HLS nor hls.js.');
+      return;
+    }
+    var hls = new Hls();
+    hls.loadSource(src);
+    hls.attachMedia(video);
+  };
+  script.onerror = function () {
+    notice('Failed to load hls.js from this server.');
+  };
+  document.head.appendChild(script);
+}
+</script></body></html>`,
+		html.EscapeString(originalURL), videoSrc, playlistSrc, bundled, hlsScriptPath)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(page))
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHLSPlayerLoadsBundledScript(t *testing.T) {
+	server := &UnifiedServer{}
+
+	w := httptest.NewRecorder()
+	server.serveHLSPlayer(w, strings.Repeat("a", 64), "https://cdn.example/live.m3u8")
+	page := w.Body.String()
+	if !strings.Contains(page, "'"+hlsScriptPath+"'") {
+		t.Errorf("player page does not load %s:\n%s", hlsScriptPath, page)
+	}
+	if strings.Contains(strings.ReplaceAll(page, "https://cdn.example/live.m3u8", ""), "://") {
+		t.Errorf("player page loads resources from another host:\n%s", page)
+	}
+
+	// The script is served from the binary; without a vendored copy the
+	// player only plays natively and tells other browsers why it cannot
+	w = httptest.NewRecorder()
+	server.handleCacheHLS(w, httptest.NewRequest(http.MethodGet, hlsScriptPath, nil), hlsScriptPath)
+	bundled, err := fs.ReadFile(playerAssets, "assets/hls.min.js")
+	switch {
+	case err == nil:
+		if w.Code != http.StatusOK || w.Body.String() != string(bundled) {
+			t.Errorf("%s = %d with %d bytes, want the bundled hls.js", hlsScriptPath, w.Code, w.Body.Len())
+		}
+		if !strings.Contains(page, "} else if (!true) {") {
+			t.Error("player page does not know hls.js is bundled")
+		}
+	case w.Code != http.StatusNotFound:
+		t.Errorf("%s = %d without a bundled hls.js, want 404", hlsScriptPath, w.Code)
+	case !strings.Contains(page, "} else if (!false) {") || !strings.Contains(page, "does not bundle hls.js"):
+		t.Errorf("player page does not report the missing hls.js:\n%s", page)
+	}
+	if !strings.Contains(page, "script.onerror") {
+		t.Error("player page ignores a failure to load hls.js")
+	}
+}
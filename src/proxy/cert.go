@@ -1,17 +1,27 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 const (
@@ -20,27 +30,58 @@ const (
 	keyFile  = "mitmproxy-ca-key.pem"
 )
 
-// publicKey returns the public key for a private key
-func publicKey(priv any) any {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
+// CertificateAuthority is the CA used to sign per-host MITM certificates.
+// Cert may be a self-signed root or an intermediate issued by another CA;
+// in the latter case Chain holds the DER certificates sent after each leaf.
+type CertificateAuthority struct {
+	Cert     *x509.Certificate
+	Key      crypto.Signer
+	Chain    [][]byte
+	CertPath string
+	KeyPath  string
+}
+
+// DefaultCAPaths returns the mitmproxy-compatible CA location in the user's home directory
+func DefaultCAPaths() (string, string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(homeDir, certDir, certFile), filepath.Join(homeDir, certDir, keyFile), nil
+}
+
+// resolveCAPaths fills in the default location for empty paths
+func resolveCAPaths(certPath, keyPath string) (string, string, error) {
+	if certPath != "" && keyPath != "" {
+		return certPath, keyPath, nil
 	}
+	defaultCert, defaultKey, err := DefaultCAPaths()
+	if err != nil {
+		return "", "", err
+	}
+	if certPath == "" {
+		certPath = defaultCert
+	}
+	if keyPath == "" {
+		keyPath = defaultKey
+	}
+	return certPath, keyPath, nil
 }
 
 // generateRootCA generates a root CA certificate for MITM
-func generateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+func generateRootCA() (*x509.Certificate, crypto.Signer, error) {
+	return generateRootCAWithKeyType("rsa")
+}
+
+// generateRootCAWithKeyType generates a root CA with an RSA or ECDSA key
+func generateRootCAWithKeyType(keyType string) (*x509.Certificate, crypto.Signer, error) {
 	// Create private key
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	key, err := generatePrivateKey(keyType)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Generate random serial number
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := randomSerialNumber()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -49,6 +90,7 @@ func generateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
+			CommonName:    "MitmCDN Root CA",
 			Organization:  []string{"MitmCDN Proxy"},
 			Country:       []string{"US"},
 			Province:      []string{""},
@@ -67,7 +109,7 @@ func generateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 	}
 
 	// Create certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(key), key)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -80,104 +122,274 @@ func generateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 	return cert, key, nil
 }
 
-// loadOrCreateRootCA loads existing root CA or creates a new one
-func loadOrCreateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, nil, err
+func generatePrivateKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "", "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa", "ec":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
 	}
+}
 
-	certPath := filepath.Join(homeDir, certDir, certFile)
-	keyPath := filepath.Join(homeDir, certDir, keyFile)
+func randomSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
 
-	// Try to load existing CA
-	if certData, err := os.ReadFile(certPath); err == nil {
-		if keyData, err := os.ReadFile(keyPath); err == nil {
-			certBlock, _ := pem.Decode(certData)
-			keyBlock, _ := pem.Decode(keyData)
-
-			if certBlock != nil && keyBlock != nil {
-				cert, err := x509.ParseCertificate(certBlock.Bytes)
-				if err == nil {
-					// Try PKCS#8 format first (more standard, supports multiple key types)
-					privKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
-					if err == nil {
-						if rsaKey, ok := privKey.(*rsa.PrivateKey); ok {
-							return cert, rsaKey, nil
-						}
-					}
-					// Fallback to PKCS#1 format for backward compatibility
-					key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-					if err == nil {
-						return cert, key, nil
-					}
-				}
+// parsePrivateKeyPEM parses the first private key in PEM data.
+// PKCS#1 RSA, SEC1 EC and PKCS#8 (RSA, ECDSA, Ed25519) keys are supported.
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found in PEM data")
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
 			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported PKCS#8 key type %T", key)
+			}
+			return signer, nil
 		}
+		// Skip EC PARAMETERS and other non-key blocks
 	}
+}
 
-	// Generate new CA
-	cert, key, err := generateRootCA()
+// parseCertificatesPEM parses every CERTIFICATE block in PEM data
+func parseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	return certs, nil
+}
+
+// LoadCA loads a CA from PEM files. The certificate file may contain the
+// signing certificate followed by its issuers (e.g. a corporate intermediate
+// and root); the key must belong to the first certificate.
+func LoadCA(certPath, keyPath string) (*CertificateAuthority, error) {
+	certData, err := os.ReadFile(certPath)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
 	}
 
-	// Save CA certificate and key
-	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
-		return nil, nil, err
+	certs, err := parseCertificatesPEM(certData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate %s: %w", certPath, err)
+	}
+	key, err := parsePrivateKeyPEM(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key %s: %w", keyPath, err)
+	}
+
+	ca, err := newCertificateAuthority(certs, key)
+	if err != nil {
+		return nil, err
+	}
+	ca.CertPath = certPath
+	ca.KeyPath = keyPath
+	return ca, nil
+}
+
+func newCertificateAuthority(certs []*x509.Certificate, key crypto.Signer) (*CertificateAuthority, error) {
+	caCert := certs[0]
+	if !caCert.IsCA {
+		return nil, errors.New("certificate is not a CA certificate")
+	}
+	if !publicKeysEqual(caCert.PublicKey, key.Public()) {
+		return nil, errors.New("private key does not match CA certificate")
+	}
+
+	ca := &CertificateAuthority{Cert: caCert, Key: key}
+	if !ca.IsRoot() {
+		// Intermediate CA: clients need the intermediate (and any issuers
+		// shipped alongside it) to build a path to their trusted root.
+		for _, cert := range certs {
+			ca.Chain = append(ca.Chain, cert.Raw)
+		}
+	}
+	return ca, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	type equaler interface {
+		Equal(crypto.PublicKey) bool
+	}
+	if k, ok := a.(equaler); ok {
+		return k.Equal(b)
+	}
+	return false
+}
+
+// LoadOrCreateCA loads the CA at the given paths or generates a new root CA there.
+// Empty paths fall back to DefaultCAPaths.
+func LoadOrCreateCA(certPath, keyPath string) (*CertificateAuthority, error) {
+	certPath, keyPath, err := resolveCAPaths(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to load existing CA
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return LoadCA(certPath, keyPath)
+	}
+
+	ca, err := CreateCA(certPath, keyPath, "rsa")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Root CA certificate generated at: %s\n", certPath)
+	fmt.Printf("Please install this certificate in your system/browser to trust MITM connections.\n")
+
+	return ca, nil
+}
+
+// CreateCA generates a new root CA and writes it to the given paths, overwriting existing files
+func CreateCA(certPath, keyPath, keyType string) (*CertificateAuthority, error) {
+	cert, key, err := generateRootCAWithKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CertificateAuthority{Cert: cert, Key: key, CertPath: certPath, KeyPath: keyPath}
+	if err := ca.save(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// save writes the CA certificate and key as PEM files
+func (ca *CertificateAuthority) save() error {
+	for _, path := range []string{ca.CertPath, ca.KeyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
 	}
 
 	// Save certificate
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: cert.Raw,
-	})
-	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
-		return nil, nil, err
+	if err := os.WriteFile(ca.CertPath, ca.CertPEM(), 0644); err != nil {
+		return err
 	}
 
 	// Save private key (using PKCS#8 format, more standard and supports multiple key types)
-	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(ca.Key)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 	keyPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "PRIVATE KEY",
 		Bytes: keyBytes,
 	})
-	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
-		return nil, nil, err
+	return os.WriteFile(ca.KeyPath, keyPEM, 0600)
+}
+
+// IsRoot reports whether the CA certificate is self-signed
+func (ca *CertificateAuthority) IsRoot() bool {
+	return bytes.Equal(ca.Cert.RawIssuer, ca.Cert.RawSubject) && ca.Cert.CheckSignatureFrom(ca.Cert) == nil
+}
+
+// CertPEM returns the CA certificate (and its issuers, for an intermediate) in PEM format
+func (ca *CertificateAuthority) CertPEM() []byte {
+	chain := ca.Chain
+	if len(chain) == 0 {
+		chain = [][]byte{ca.Cert.Raw}
 	}
+	var buf bytes.Buffer
+	for _, der := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return buf.Bytes()
+}
 
-	fmt.Printf("Root CA certificate generated at: %s\n", certPath)
-	fmt.Printf("Please install this certificate in your system/browser to trust MITM connections.\n")
+// CertDER returns the CA certificate in DER format
+func (ca *CertificateAuthority) CertDER() []byte {
+	return ca.Cert.Raw
+}
 
-	return cert, key, nil
+// PKCS12 returns the CA certificate, its chain and private key as a PKCS#12 bundle
+func (ca *CertificateAuthority) PKCS12(password string) ([]byte, error) {
+	var issuers []*x509.Certificate
+	for _, der := range ca.Chain[min(1, len(ca.Chain)):] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, cert)
+	}
+	return pkcs12.Modern.Encode(ca.Key, ca.Cert, issuers, password)
 }
 
-// GenerateCertificate generates a certificate for a specific host signed by the root CA
-// This is the public API for certificate generation
-func GenerateCertificate(host string) (*tls.Certificate, error) {
-	return generateCertificate(host)
+// TrustAnchor returns the certificate clients should install: the CA itself
+// for a root, or the top-most issuer shipped in the chain for an intermediate
+func (ca *CertificateAuthority) TrustAnchor() *x509.Certificate {
+	if len(ca.Chain) > 1 {
+		if cert, err := x509.ParseCertificate(ca.Chain[len(ca.Chain)-1]); err == nil {
+			return cert
+		}
+	}
+	return ca.Cert
 }
 
-// generateCertificate generates a certificate for a specific host signed by the root CA
-func generateCertificate(host string) (*tls.Certificate, error) {
-	// Load or create root CA
-	caCert, caKey, err := loadOrCreateRootCA()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load root CA: %w", err)
+// Fingerprint returns the colon-separated SHA-256 fingerprint of the CA certificate
+func (ca *CertificateAuthority) Fingerprint() string {
+	return certFingerprint(ca.Cert)
+}
+
+// certFingerprint returns the colon-separated SHA-256 fingerprint of a certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	parts := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		parts = append(parts, hexSum[i:i+2])
 	}
+	return strings.Join(parts, ":")
+}
 
+// IssueCertificate generates a certificate for a specific host signed by the CA
+func (ca *CertificateAuthority) IssueCertificate(host string) (*tls.Certificate, error) {
 	// Create private key for this host
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate random serial number
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := randomSerialNumber()
 	if err != nil {
 		return nil, err
 	}
@@ -197,17 +409,47 @@ func generateCertificate(host string) (*tls.Certificate, error) {
 		DNSNames:              []string{host},
 	}
 
+	// Leaf certificates must not outlive the CA that signs them
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+
 	// Create certificate signed by CA
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, caCert, publicKey(key), caKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, ca.Cert, &key.PublicKey, ca.Key)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create TLS certificate
+	// Create TLS certificate, followed by the intermediate chain if any
 	tlsCert := tls.Certificate{
-		Certificate: [][]byte{certDER},
+		Certificate: append([][]byte{certDER}, ca.Chain...),
 		PrivateKey:  key,
 	}
 
 	return &tlsCert, nil
 }
+
+// loadOrCreateRootCA loads existing root CA from the default location or creates a new one
+func loadOrCreateRootCA() (*x509.Certificate, crypto.Signer, error) {
+	ca, err := LoadOrCreateCA("", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca.Cert, ca.Key, nil
+}
+
+// GenerateCertificate generates a certificate for a specific host signed by the root CA
+// This is the public API for certificate generation
+func GenerateCertificate(host string) (*tls.Certificate, error) {
+	return generateCertificate(host)
+}
+
+// generateCertificate generates a certificate for a specific host signed by the default CA
+func generateCertificate(host string) (*tls.Certificate, error) {
+	// Load or create root CA
+	ca, err := LoadOrCreateCA("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root CA: %w", err)
+	}
+	return ca.IssueCertificate(host)
+}
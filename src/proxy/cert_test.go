@@ -1,10 +1,18 @@
 package proxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestGenerateRootCA(t *testing.T) {
@@ -163,3 +171,160 @@ func TestGenerateCertificateMultipleHosts(t *testing.T) {
 		}
 	}
 }
+
+func writeTestCA(t *testing.T, dir string, certs []*x509.Certificate, keyPEM []byte) (string, string) {
+	t.Helper()
+
+	certPath := filepath.Join(dir, "ca-cert.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	var certPEM []byte
+	for _, cert := range certs {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatalf("failed to write CA cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write CA key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestLoadCAKeyFormats(t *testing.T) {
+	rsaCert, rsaKey, err := generateRootCAWithKeyType("rsa")
+	if err != nil {
+		t.Fatalf("failed to generate RSA CA: %v", err)
+	}
+	ecCert, ecKey, err := generateRootCAWithKeyType("ecdsa")
+	if err != nil {
+		t.Fatalf("failed to generate ECDSA CA: %v", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatalf("failed to marshal PKCS#8 key: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("failed to marshal EC key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		keyPEM []byte
+	}{
+		{"pkcs1", rsaCert, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey))})},
+		{"pkcs8", rsaCert, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})},
+		{"ec", ecCert, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPath, keyPath := writeTestCA(t, t.TempDir(), []*x509.Certificate{tt.cert}, tt.keyPEM)
+
+			ca, err := LoadCA(certPath, keyPath)
+			if err != nil {
+				t.Fatalf("LoadCA() error = %v", err)
+			}
+			if !ca.IsRoot() {
+				t.Error("self-signed CA should be reported as root")
+			}
+
+			leaf, err := ca.IssueCertificate("cdn.example.com")
+			if err != nil {
+				t.Fatalf("IssueCertificate() error = %v", err)
+			}
+			if len(leaf.Certificate) != 1 {
+				t.Errorf("root CA leaf chain length = %d, want 1", len(leaf.Certificate))
+			}
+		})
+	}
+}
+
+func TestLoadCARejectsMismatchedKey(t *testing.T) {
+	cert, _, err := generateRootCA()
+	if err != nil {
+		t.Fatalf("generateRootCA() error = %v", err)
+	}
+	_, otherKey, err := generateRootCA()
+	if err != nil {
+		t.Fatalf("generateRootCA() error = %v", err)
+	}
+	keyBytes, _ := x509.MarshalPKCS8PrivateKey(otherKey)
+
+	certPath, keyPath := writeTestCA(t, t.TempDir(), []*x509.Certificate{cert}, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}))
+	if _, err := LoadCA(certPath, keyPath); err == nil {
+		t.Fatal("LoadCA() should fail when the key does not match the certificate")
+	}
+}
+
+func TestIntermediateCAServesFullChain(t *testing.T) {
+	// Corporate root allowed to issue intermediates
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Corp Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, _ := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	root, _ := x509.ParseCertificate(rootDER)
+
+	interKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	interTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Corp MITM Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(2, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	interDER, _ := x509.CreateCertificate(rand.Reader, interTemplate, root, interKey.Public(), rootKey)
+	inter, _ := x509.ParseCertificate(interDER)
+
+	sec1, _ := x509.MarshalECPrivateKey(interKey)
+	certPath, keyPath := writeTestCA(t, t.TempDir(), []*x509.Certificate{inter}, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+
+	ca, err := LoadCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("LoadCA() error = %v", err)
+	}
+	if ca.IsRoot() {
+		t.Fatal("intermediate CA should not be reported as root")
+	}
+
+	leaf, err := ca.IssueCertificate("cdn.example.com")
+	if err != nil {
+		t.Fatalf("IssueCertificate() error = %v", err)
+	}
+	if len(leaf.Certificate) != 2 {
+		t.Fatalf("leaf chain length = %d, want 2 (leaf + intermediate)", len(leaf.Certificate))
+	}
+
+	// A client trusting only the corporate root must be able to verify the served chain
+	parsedLeaf, _ := x509.ParseCertificate(leaf.Certificate[0])
+	if parsedLeaf.NotAfter.After(inter.NotAfter) {
+		t.Error("leaf certificate should not outlive the intermediate")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, der := range leaf.Certificate[1:] {
+		cert, _ := x509.ParseCertificate(der)
+		intermediates.AddCert(cert)
+	}
+	if _, err := parsedLeaf.Verify(x509.VerifyOptions{DNSName: "cdn.example.com", Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Fatalf("served chain does not verify against corporate root: %v", err)
+	}
+
+	if _, err := ca.PKCS12("secret"); err != nil {
+		t.Errorf("PKCS12() error = %v", err)
+	}
+}
@@ -0,0 +1,548 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/resolver"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsUpstreamTimeout = 5 * time.Second
+
+// DNSServer answers CDN rule domains with the mitmcdn address and forwards
+// everything else to an upstream resolver, caching the forwarded answers
+type DNSServer struct {
+	config   *config.Config
+	rules    *config.RuleMatcher
+	upstream resolver.Transport
+	answerV4 []net.IP
+	answerV6 []net.IP
+	ttl      uint32
+
+	cacheMu   sync.Mutex
+	cache     map[dnsCacheKey]dnsCacheEntry
+	cacheSize int
+
+	logMu    sync.Mutex
+	queryLog []DNSQuery
+	logSize  int
+
+	queries   atomic.Int64
+	local     atomic.Int64
+	cacheHits atomic.Int64
+	forwarded atomic.Int64
+	failed    atomic.Int64
+
+	listenMu    sync.Mutex // guards the sockets, which Shutdown may close from another goroutine
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	closed      bool
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	response []byte
+	stored   time.Time
+	expires  time.Time
+}
+
+// dnsMinUDPSize is the UDP payload every client accepts, used when a query
+// does not advertise a larger one with EDNS
+const dnsMinUDPSize = 512
+
+// DNSQuery is one entry of the query log
+type DNSQuery struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Result string    `json:"result"` // local, cached, forwarded or failed
+}
+
+// DNSStatus summarises the DNS server for the status API
+type DNSStatus struct {
+	Queries       int64      `json:"queries"`
+	Local         int64      `json:"local"`
+	CacheHits     int64      `json:"cache_hits"`
+	Forwarded     int64      `json:"forwarded"`
+	Failed        int64      `json:"failed"`
+	RecentQueries []DNSQuery `json:"recent_queries"`
+}
+
+// NewDNSServer creates the DNS server from cfg.DNS
+func NewDNSServer(cfg *config.Config) (*DNSServer, error) {
+	// dns.upstream overrides the server only; TLS and timeout settings come from [resolver]
+	upstreamCfg := cfg.Resolver
+	if cfg.DNS.Upstream != "" {
+		upstreamCfg.Upstream = cfg.DNS.Upstream
+	}
+	if upstreamCfg.Upstream == "" {
+		return nil, errors.New("dns upstream is required (set dns.upstream or resolver.upstream)")
+	}
+	upstream, err := resolver.NewTransport(upstreamCfg)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := cfg.RuleMatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	answers := cfg.DNS.AnswerAddresses
+	if len(answers) == 0 {
+		if host, _, err := net.SplitHostPort(cfg.ListenAddress); err == nil {
+			if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+				answers = []string{host}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, errors.New("dns answer_addresses is required when listen_address does not name a specific IP")
+	}
+
+	s := &DNSServer{
+		config:    cfg,
+		rules:     rules,
+		upstream:  upstream,
+		ttl:       uint32(cfg.DNS.TTL),
+		cache:     make(map[dnsCacheKey]dnsCacheEntry),
+		cacheSize: cfg.DNS.CacheSize,
+		logSize:   cfg.DNS.QueryLogSize,
+	}
+	if s.ttl == 0 {
+		s.ttl = 60
+	}
+	for _, addr := range answers {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns answer address %q", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			s.answerV4 = append(s.answerV4, ip4)
+		} else {
+			s.answerV6 = append(s.answerV6, ip)
+		}
+	}
+	return s, nil
+}
+
+// ListenAndServe serves DNS over UDP and TCP on addr until Shutdown is called
+func (s *DNSServer) ListenAndServe(addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds the UDP and TCP sockets on addr, so that binding errors are
+// reported before serving starts in the background
+func (s *DNSServer) Listen(addr string) error {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	}
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen on TCP %s: %w", addr, err)
+	}
+
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	if s.closed || s.udpConn != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		if s.closed {
+			return errors.New("dns server shut down")
+		}
+		return errors.New("dns server already listening")
+	}
+	s.udpConn = udpConn
+	s.tcpListener = tcpListener
+	return nil
+}
+
+// Serve answers queries on the sockets bound by Listen until Shutdown is called
+func (s *DNSServer) Serve() error {
+	s.listenMu.Lock()
+	udpConn, tcpListener := s.udpConn, s.tcpListener
+	s.listenMu.Unlock()
+	if udpConn == nil {
+		return errors.New("dns server is not listening")
+	}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.serveUDP(udpConn) }()
+	go func() { errCh <- s.serveTCP(tcpListener) }()
+	err := <-errCh
+	s.Shutdown()
+	return err
+}
+
+// Shutdown closes the DNS listeners; a later Listen fails
+func (s *DNSServer) Shutdown() {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	s.closed = true
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+}
+
+func (s *DNSServer) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response := s.handleQuery(query, addr, "udp"); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers length-prefixed queries until the client goes idle
+func (s *DNSServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		query, err := resolver.ReadStreamMessage(conn)
+		if err != nil {
+			return
+		}
+		response := s.handleQuery(query, conn.RemoteAddr(), "tcp")
+		if response == nil {
+			return
+		}
+		if err := resolver.WriteStreamMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// handleQuery returns the response for one DNS message, or nil to drop it
+func (s *DNSServer) handleQuery(query []byte, client net.Addr, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	s.queries.Add(1)
+
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	key := dnsCacheKey{name: name, qtype: question.Type, class: question.Class}
+
+	var response []byte
+	result := "local"
+	if question.Class == dnsmessage.ClassINET && s.isCDNName(name) {
+		response, err = s.localAnswer(header, question)
+		s.local.Add(1)
+	} else if cached := s.cachedResponse(key, header.ID); cached != nil {
+		// The cached answer may have come over TCP
+		if network == "udp" {
+			cached = truncateDNSResponse(cached, dnsUDPSize(parser))
+		}
+		response, result = cached, "cached"
+		s.cacheHits.Add(1)
+	} else {
+		response, err = s.forward(query, network)
+		result = "forwarded"
+		if err == nil {
+			s.forwarded.Add(1)
+			s.storeResponse(key, response)
+		}
+	}
+	if err != nil {
+		s.failed.Add(1)
+		result = "failed"
+		response = dnsErrorResponse(header, question, dnsmessage.RCodeServerFailure)
+	}
+
+	s.logQuery(DNSQuery{
+		Time:   time.Now(),
+		Client: client.String(),
+		Name:   name,
+		Type:   strings.TrimPrefix(question.Type.String(), "Type"),
+		Result: result,
+	})
+	return response
+}
+
+// isCDNName reports whether name matches a CDN rule host. The port is not
+// known yet, so rules restricted to a port match too.
+func (s *DNSServer) isCDNName(name string) bool {
+	return s.rules.MatchHost(name, nil) != nil
+}
+
+// localAnswer points A/AAAA queries for CDN names at mitmcdn. Other types,
+// notably HTTPS/SVCB, get an empty answer so clients cannot learn ALPN (h3)
+// or address hints that would bypass the proxy.
+func (s *DNSServer) localAnswer(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range s.answerV4 {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip)
+			if err := builder.AResource(rh, a); err != nil {
+				return nil, err
+			}
+		}
+	case dnsmessage.TypeAAAA:
+		for _, ip := range s.answerV6 {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			if err := builder.AAAAResource(rh, aaaa); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return builder.Finish()
+}
+
+func dnsErrorResponse(header dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.StartQuestions()
+	builder.Question(question)
+	msg, _ := builder.Finish()
+	return msg
+}
+
+// forward sends the query to the upstream resolver over the client's transport
+func (s *DNSServer) forward(query []byte, network string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsUpstreamTimeout)
+	defer cancel()
+	return s.upstream.Exchange(ctx, network, query)
+}
+
+// cachedResponse returns a cached response rewritten for the query ID, with
+// its TTLs counting down from when it was stored, or nil
+func (s *DNSServer) cachedResponse(key dnsCacheKey, id uint16) []byte {
+	s.cacheMu.Lock()
+	entry, ok := s.cache[key]
+	now := time.Now()
+	if ok && now.After(entry.expires) {
+		delete(s.cache, key)
+		ok = false
+	}
+	s.cacheMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(entry.response); err != nil {
+		return nil
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dnsmessage.TypeOPT {
+				continue // its TTL field holds EDNS flags
+			}
+			section[i].Header.TTL -= min(elapsed, section[i].Header.TTL)
+		}
+	}
+	msg.Header.ID = id
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// dnsUDPSize returns the largest UDP response the client of a query accepts.
+// parser must be positioned after the query's question.
+func dnsUDPSize(parser dnsmessage.Parser) int {
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return dnsMinUDPSize
+	}
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return dnsMinUDPSize
+		}
+		if header.Type == dnsmessage.TypeOPT {
+			return max(int(header.Class), dnsMinUDPSize)
+		}
+		if parser.SkipAdditional() != nil {
+			return dnsMinUDPSize
+		}
+	}
+}
+
+// truncateDNSResponse returns response cut down to its header, question and
+// EDNS record with TC set when it is larger than size, so the client retries
+// over TCP
+func truncateDNSResponse(response []byte, size int) []byte {
+	if len(response) <= size {
+		return response
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+	var opt []dnsmessage.Resource
+	for _, additional := range msg.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, additional)
+		}
+	}
+	msg.Header.Truncated = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, opt
+	truncated, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	return truncated
+}
+
+// storeResponse caches a successful, untruncated upstream response for its lowest TTL
+func (s *DNSServer) storeResponse(key dnsCacheKey, response []byte) {
+	if s.cacheSize <= 0 {
+		return
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil || header.Truncated || header.RCode != dnsmessage.RCodeSuccess {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil || len(answers) == 0 {
+		return
+	}
+	ttl := answers[0].Header.TTL
+	for _, answer := range answers[1:] {
+		ttl = min(ttl, answer.Header.TTL)
+	}
+	if ttl == 0 {
+		return
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if len(s.cache) >= s.cacheSize {
+		now := time.Now()
+		for k, entry := range s.cache {
+			if now.After(entry.expires) {
+				delete(s.cache, k)
+			}
+		}
+		// Still full: drop an arbitrary entry
+		for k := range s.cache {
+			if len(s.cache) < s.cacheSize {
+				break
+			}
+			delete(s.cache, k)
+		}
+	}
+	now := time.Now()
+	s.cache[key] = dnsCacheEntry{
+		response: append([]byte(nil), response...),
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (s *DNSServer) logQuery(q DNSQuery) {
+	if s.config.DNS.LogQueries {
+		log.Printf("DNS %s %s from %s: %s", q.Type, q.Name, q.Client, q.Result)
+	}
+	if s.logSize <= 0 {
+		return
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.queryLog = append(s.queryLog, q)
+	if len(s.queryLog) > s.logSize {
+		s.queryLog = s.queryLog[len(s.queryLog)-s.logSize:]
+	}
+}
+
+// Status returns counters and the most recent queries, newest first
+func (s *DNSServer) Status() *DNSStatus {
+	if s == nil {
+		return nil
+	}
+
+	s.logMu.Lock()
+	recent := make([]DNSQuery, len(s.queryLog))
+	for i, q := range s.queryLog {
+		recent[len(s.queryLog)-1-i] = q
+	}
+	s.logMu.Unlock()
+
+	return &DNSStatus{
+		Queries:       s.queries.Load(),
+		Local:         s.local.Load(),
+		CacheHits:     s.cacheHits.Load(),
+		Forwarded:     s.forwarded.Load(),
+		Failed:        s.failed.Load(),
+		RecentQueries: recent,
+	}
+}
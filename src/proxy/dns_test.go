@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/resolver"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startFakeUpstreamDNS answers A queries with 198.51.100.7 and counts requests
+func startFakeUpstreamDNS(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var count atomic.Int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			count.Add(1)
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+			builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true})
+			builder.StartQuestions()
+			builder.Question(question)
+			builder.StartAnswers()
+			builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 300},
+				dnsmessage.AResource{A: [4]byte{198, 51, 100, 7}})
+			msg, _ := builder.Finish()
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &count
+}
+
+func buildDNSQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("failed to build query: %v", err)
+	}
+	return msg
+}
+
+func parseDNSAnswers(t *testing.T, response []byte) (dnsmessage.Header, []dnsmessage.Resource) {
+	t.Helper()
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		t.Fatalf("failed to skip questions: %v", err)
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		t.Fatalf("failed to parse answers: %v", err)
+	}
+	return header, answers
+}
+
+func newDNSServerForTest(t *testing.T, upstream string) *DNSServer {
+	t.Helper()
+
+	server, err := NewDNSServer(&config.Config{
+		CDNRules: []config.CDNRule{{Domain: ".cdn.example.com"}},
+		DNS: config.DNSConfig{
+			AnswerAddresses: []string{"192.0.2.1", "2001:db8::1"},
+			Upstream:        upstream,
+			TTL:             30,
+			CacheSize:       10,
+			QueryLogSize:    10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewDNSServer() error = %v", err)
+	}
+	return server
+}
+
+func TestDNSServerAnswersCDNNames(t *testing.T) {
+	server := newDNSServerForTest(t, "127.0.0.1:1")
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	header, answers := parseDNSAnswers(t, server.handleQuery(buildDNSQuery(t, 1, "img.cdn.example.com.", dnsmessage.TypeA), client, "udp"))
+	if header.ID != 1 || !header.Authoritative || len(answers) != 1 {
+		t.Fatalf("unexpected A response: %+v %v", header, answers)
+	}
+	if a := answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "192.0.2.1" || answers[0].Header.TTL != 30 {
+		t.Errorf("A answer = %v ttl %d, want 192.0.2.1 ttl 30", net.IP(a.A[:]), answers[0].Header.TTL)
+	}
+
+	_, answers = parseDNSAnswers(t, server.handleQuery(buildDNSQuery(t, 2, "cdn.example.com.", dnsmessage.TypeAAAA), client, "udp"))
+	if len(answers) != 1 || net.IP(answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]).String() != "2001:db8::1" {
+		t.Errorf("unexpected AAAA answers: %v", answers)
+	}
+
+	// HTTPS records would advertise h3 and origin address hints, so they are answered empty
+	header, answers = parseDNSAnswers(t, server.handleQuery(buildDNSQuery(t, 3, "cdn.example.com.", dnsmessage.Type(65)), client, "udp"))
+	if header.RCode != dnsmessage.RCodeSuccess || len(answers) != 0 {
+		t.Errorf("HTTPS response = %v with %d answers, want NOERROR/NODATA", header.RCode, len(answers))
+	}
+
+	if status := server.Status(); status.Local != 3 || len(status.RecentQueries) != 3 || status.RecentQueries[0].Type != "HTTPS" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestDNSServerForwardsAndCaches(t *testing.T) {
+	upstream, count := startFakeUpstreamDNS(t)
+	server := newDNSServerForTest(t, upstream)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	for i, id := range []uint16{10, 11} {
+		header, answers := parseDNSAnswers(t, server.handleQuery(buildDNSQuery(t, id, "other.example.org.", dnsmessage.TypeA), client, "udp"))
+		if header.ID != id {
+			t.Errorf("query %d: response ID = %d, want %d", i, header.ID, id)
+		}
+		if len(answers) != 1 || net.IP(answers[0].Body.(*dnsmessage.AResource).A[:]).String() != "198.51.100.7" {
+			t.Errorf("query %d: unexpected answers %v", i, answers)
+		}
+	}
+
+	if got := count.Load(); got != 1 {
+		t.Errorf("upstream queried %d times, want 1 (second answer from cache)", got)
+	}
+	status := server.Status()
+	if status.Forwarded != 1 || status.CacheHits != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestDNSServerCachedTTLAndTruncation(t *testing.T) {
+	server := newDNSServerForTest(t, "127.0.0.1:1")
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	// An upstream answer fetched over TCP, too large for a plain UDP response
+	name := dnsmessage.MustNewName("big.example.org.")
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	builder.StartAnswers()
+	for i := 0; i < 60; i++ {
+		builder.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 300},
+			dnsmessage.AResource{A: [4]byte{198, 51, 100, byte(i)}})
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("failed to build response: %v", err)
+	}
+	key := dnsCacheKey{name: "big.example.org", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	server.storeResponse(key, response)
+	entry := server.cache[key]
+	entry.stored = entry.stored.Add(-100 * time.Second)
+	server.cache[key] = entry
+
+	// TTLs count down from when the answer was cached
+	header, answers := parseDNSAnswers(t, server.handleQuery(buildDNSQuery(t, 7, "big.example.org.", dnsmessage.TypeA), client, "tcp"))
+	if header.ID != 7 || len(answers) != 60 {
+		t.Fatalf("TCP response %+v with %d answers", header, len(answers))
+	}
+	for _, answer := range answers {
+		if answer.Header.TTL < 199 || answer.Header.TTL > 200 {
+			t.Fatalf("cached TTL = %d, want about 200", answer.Header.TTL)
+		}
+	}
+
+	// Over UDP the response is cut to fit 512 bytes, asking for a TCP retry
+	udpResponse := server.handleQuery(buildDNSQuery(t, 8, "big.example.org.", dnsmessage.TypeA), client, "udp")
+	header, answers = parseDNSAnswers(t, udpResponse)
+	if len(udpResponse) > dnsMinUDPSize || !header.Truncated || header.ID != 8 || len(answers) != 0 {
+		t.Errorf("UDP response of %d bytes: %+v with %d answers, want a truncated one", len(udpResponse), header, len(answers))
+	}
+
+	// A client advertising a larger EDNS buffer gets the whole answer
+	builder = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 9, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	builder.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+	builder.OPTResource(opt, dnsmessage.OPTResource{})
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("failed to build query: %v", err)
+	}
+	header, answers = parseDNSAnswers(t, server.handleQuery(query, client, "udp"))
+	if header.Truncated || len(answers) != 60 {
+		t.Errorf("EDNS UDP response %+v with %d answers, want all of them", header, len(answers))
+	}
+}
+
+func TestDNSServerTCP(t *testing.T) {
+	server := newDNSServerForTest(t, "127.0.0.1:1")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.serveTCPConn(serverConn)
+
+	if err := resolver.WriteStreamMessage(clientConn, buildDNSQuery(t, 7, "cdn.example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	response, err := resolver.ReadStreamMessage(clientConn)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if header, answers := parseDNSAnswers(t, response); header.ID != 7 || len(answers) != 1 {
+		t.Fatalf("unexpected TCP response: %+v %v", header, answers)
+	}
+}
+
+func TestDNSServerShutdown(t *testing.T) {
+	server := newDNSServerForTest(t, "127.0.0.1:1")
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	server.Shutdown()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve() did not return after Shutdown()")
+	}
+
+	// A server shut down before it binds does not leave sockets behind
+	early := newDNSServerForTest(t, "127.0.0.1:1")
+	early.Shutdown()
+	if err := early.Listen("127.0.0.1:0"); err == nil {
+		t.Fatal("Listen() after Shutdown() should fail")
+	}
+}
+
+func TestNewDNSServerRequiresAnswerAddress(t *testing.T) {
+	_, err := NewDNSServer(&config.Config{
+		ListenAddress: "0.0.0.0:8081",
+		DNS:           config.DNSConfig{Upstream: "1.1.1.1"},
+	})
+	if err == nil {
+		t.Fatal("NewDNSServer() should require answer_addresses for a wildcard listen address")
+	}
+}
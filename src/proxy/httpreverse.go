@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -35,6 +37,15 @@ func NewHTTPReverseProxy(cfg *config.Config, cacheMgr *cache.Manager, sched *dow
 
 // ServeHTTP handles requests in URL path format: /https://origin.cdn.com/file.exe
 func (p *HTTPReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Plugins limited to this mode, such as link rewriting, apply from here on
+	r = r.WithContext(htmlplugin.WithURLPath(r.Context()))
+
+	user := proxyUserFrom(r.Context())
+	if user != nil {
+		user.requests.Add(1)
+		w = user.limitResponseWriter(w)
+	}
+
 	// Extract target URL from path
 	// Path format: /https://origin.cdn.com/file.exe or /http://...
 	path := strings.TrimPrefix(r.URL.Path, "/")
@@ -77,57 +88,91 @@ func (p *HTTPReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if this matches any CDN rule
-	rule := p.findMatchingRule(targetURL.String(), targetURL.Host)
+	// Hosts that are not intercepted are subject to the tunnel ACL, as they
+	// are through the forward proxy
+	if !p.mitmProxy.shouldInterceptFor(httpTargetAddress(targetURL), user) && !p.mitmProxy.allowDestination(w, targetURL) {
+		return
+	}
+
+	// Check if this matches any CDN rule or a plugin caches it
+	rule := p.mitmProxy.cacheRuleFor(r, targetURL.String(), user)
 	if rule == nil {
 		// Not a CDN file, forward to upstream
 		p.forwardRequest(w, r, targetURL)
 		return
 	}
 
-	// Extract cookie from request
-	cookie := r.Header.Get("Cookie")
+	// Only GET is cached; HEAD is answered from the cache when it can be
+	if r.Method != http.MethodGet {
+		if r.Method != http.MethodHead || !p.mitmProxy.serveCachedHead(w, r, targetURL.String(), rule) {
+			rule.RequestHeaders.Apply(r.Header)
+			p.forwardRequest(w, r, targetURL)
+		}
+		return
+	}
 
 	// Extract filename
 	filename := p.extractFilename(targetURL.Path)
 
-	// Get or create file entry
-	file, err := p.cacheManager.GetOrCreateFile(
+	// Get or create the file entry for this request's variant
+	file, err := p.cacheManager.GetOrCreateFileForRequest(
 		targetURL.String(),
-		cookie,
 		filename,
 		rule.DedupStrategy,
+		requestKey(r, rule),
 	)
+	if errors.Is(err, cache.ErrVaryAll) {
+		p.forwardRequest(w, r, targetURL)
+		return
+	}
 	if err != nil {
 		logErrorWithStack(err, "Failed to get or create file: %s", targetURL.String())
 		http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	if user != nil {
+		if err := p.cacheManager.SetRequestedBy(file, user.name); err != nil {
+			log.Printf("Failed to attribute %s to %s: %v", file.OriginalURL, user.name, err)
+		}
+	}
+
+	w, finish := p.mitmProxy.pluginResponses(w, r, targetURL.String())
+	defer finish()
+
+	// Playlists are revalidated with the origin and drive segment prefetching
+	if download.IsPlaylistPath(targetURL.Path) {
+		if err := p.downloadSched.ServePlaylist(file, w, r); err != nil {
+			logErrorWithStack(err, "Failed to serve playlist: %s", targetURL.String())
+		}
+		return
+	}
+
+	// Byte ranges of entries not cached yet are fetched and cached on their own
+	if served, err := p.downloadSched.ServeRange(file, w, r); served {
+		if err != nil {
+			logErrorWithStack(err, "Failed to serve range: %s", targetURL.String())
+		}
+		return
+	}
+
 	// Check if file is complete
 	if file.DownloadStatus == "complete" {
 		// Serve from cache
-		http.ServeFile(w, r, file.SavedPath)
+		if user != nil {
+			user.cacheHits.Add(1)
+		}
+		p.downloadSched.ServeFile(file, w, r)
 		return
 	}
 
 	// Stream file (will trigger download if needed)
-	if err := p.downloadSched.StreamFile(file, w, r); err != nil {
+	if err := p.downloadSched.StreamFileWithPriority(file, w, r, user.downloadPriority()); err != nil {
 		logErrorWithStack(err, "Failed to stream file: %s", targetURL.String())
 		// Error already sent to client by StreamFile
 	}
 }
 
-// findMatchingRule finds matching CDN rule
-func (p *HTTPReverseProxy) findMatchingRule(urlStr, host string) *config.CDNRule {
-	for _, rule := range p.config.CDNRules {
-		if cache.MatchCDNRule(urlStr, rule.Domain, rule.MatchPattern) {
-			return &rule
-		}
-	}
-	return nil
-}
-
 // extractFilename extracts filename from URL path
 func (p *HTTPReverseProxy) extractFilename(path string) string {
 	parts := strings.Split(path, "/")
@@ -199,7 +244,8 @@ func (p *HTTPReverseProxy) forwardRequest(w http.ResponseWriter, r *http.Request
 			req.URL.RawQuery = targetURL.RawQuery // Preserve query parameters from target URL
 			req.URL.Fragment = targetURL.Fragment
 			req.Host = targetURL.Host
-			req.Header.Del("Accept-Encoding")
+			p.htmlPlugins.ForRequest(req).RestrictAcceptEncoding(req.Header)
+			p.htmlPlugins.RewriteRequest(req)
 		},
 		ModifyResponse: func(resp *http.Response) error {
 			if p.htmlPlugins == nil {
@@ -213,18 +259,9 @@ func (p *HTTPReverseProxy) forwardRequest(w http.ResponseWriter, r *http.Request
 			if p.serveFromAssets(w, r) {
 				return
 			}
-			http.Error(w, err.Error(), http.StatusBadGateway)
+			forwardError(w, err)
 		},
-	}
-
-	// Configure upstream proxy if needed
-	if p.config.UpstreamProxy != "" {
-		proxyURL, err := url.Parse(p.config.UpstreamProxy)
-		if err == nil {
-			proxy.Transport = &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
-			}
-		}
+		Transport: p.mitmProxy.forwardTransport(targetURL, proxyUserFrom(r.Context())),
 	}
 
 	proxy.ServeHTTP(w, r)
@@ -2,43 +2,119 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"mitmcdn/src/cache"
 	"mitmcdn/src/config"
 	"mitmcdn/src/download"
 	"mitmcdn/src/htmlplugin"
+	"mitmcdn/src/resolver"
 )
 
 type MITMProxy struct {
-	config        *config.Config
-	cacheManager  *cache.Manager
-	downloadSched *download.Scheduler
-	htmlPlugins   *htmlplugin.Manager
-	certCache     sync.Map // host -> *tls.Certificate
+	config          *config.Config
+	cacheManager    *cache.Manager
+	downloadSched   *download.Scheduler
+	htmlPlugins     *htmlplugin.Manager
+	certCache       sync.Map // host -> *tls.Certificate
+	caMu            sync.Mutex
+	ca              *CertificateAuthority
+	tunnel          *tunnelDialer // nil if the tunnel config is invalid
+	tunnelErr       error
+	resolver        *resolver.Resolver // nil uses the system resolver
+	resolverErr     error
+	originTransport *http.Transport // set when a custom resolver is configured
+	tunnelTransport *http.Transport // forwards to hosts that are not intercepted through the tunnel ACL
+	users           *userStore      // nil disables proxy authentication
+	usersErr        error
+	rules           *config.RuleMatcher // nil if a CDN rule is invalid
+	rulesErr        error
 }
 
 func NewMITMProxy(cfg *config.Config, cacheMgr *cache.Manager, sched *download.Scheduler, htmlPlugins *htmlplugin.Manager) *MITMProxy {
-	return &MITMProxy{
+	res, resolverErr := resolver.NewResolver(cfg.Resolver)
+	if resolverErr != nil {
+		log.Printf("Origin resolver disabled: %v", resolverErr)
+	}
+
+	tunnel, err := newTunnelDialer(cfg.Tunnel, res)
+	if err != nil {
+		log.Printf("Direct tunnels disabled: %v", err)
+	}
+
+	users, usersErr := newUserStore(cfg.Users)
+	if usersErr != nil {
+		log.Printf("Proxy users invalid: %v", usersErr)
+	}
+
+	rules, rulesErr := cfg.RuleMatcher()
+	if rulesErr != nil {
+		log.Printf("CDN rules invalid: %v", rulesErr)
+	}
+
+	p := &MITMProxy{
 		config:        cfg,
 		cacheManager:  cacheMgr,
 		downloadSched: sched,
 		htmlPlugins:   htmlPlugins,
+		tunnel:        tunnel,
+		tunnelErr:     err,
+		resolver:      res,
+		resolverErr:   resolverErr,
+		users:         users,
+		usersErr:      usersErr,
+		rules:         rules,
+		rulesErr:      rulesErr,
+	}
+	if res != nil {
+		p.originTransport = http.DefaultTransport.(*http.Transport).Clone()
+		p.originTransport.DialContext = res.DialFunc(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	}
+	if tunnel != nil {
+		p.tunnelTransport = http.DefaultTransport.(*http.Transport).Clone()
+		p.tunnelTransport.DialContext = func(ctx context.Context, _, address string) (net.Conn, error) {
+			return tunnel.Dial(ctx, address)
+		}
+	}
+	return p
+}
+
+// TunnelStats returns byte and connection counters for non-intercepted tunnels
+func (p *MITMProxy) TunnelStats() *TunnelStats {
+	if p.tunnel == nil {
+		return nil
 	}
+	return p.tunnel.stats
+}
+
+// UserStatus returns per-user counters, or nil when authentication is disabled
+func (p *MITMProxy) UserStatus() []UserStatus {
+	return p.users.Status()
 }
 
 // HandleHTTP handles HTTP CONNECT requests (HTTPS tunneling)
 func (p *MITMProxy) HandleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect || r.URL.IsAbs() {
+		if r = p.authorize(w, r); r == nil {
+			return
+		}
+	}
+
 	if r.Method == http.MethodConnect {
 		p.handleHTTPS(w, r)
 	} else {
@@ -46,6 +122,31 @@ func (p *MITMProxy) HandleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// tunnelsWithoutAuth reports whether connections that cannot carry proxy
+// credentials, made through the TLS front or redirected transparently, may be
+// tunnelled. With users configured they may only when [tunnel] allow limits
+// where they go.
+func (p *MITMProxy) tunnelsWithoutAuth() bool {
+	return p.users == nil || (p.tunnel != nil && len(p.tunnel.acl.allow) > 0)
+}
+
+// authorize checks the Proxy-Authorization credentials of a proxied request
+// when users are configured and attaches the user to its context. Without
+// valid credentials it answers 407 and returns nil.
+func (p *MITMProxy) authorize(w http.ResponseWriter, r *http.Request) *http.Request {
+	if p.users == nil {
+		return r
+	}
+	user := p.users.authenticateHTTP(r)
+	if user == nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="mitmcdn"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return nil
+	}
+	r.Header.Del("Proxy-Authorization")
+	return r.WithContext(withProxyUser(r.Context(), user))
+}
+
 // handleHTTPS handles HTTPS CONNECT requests
 func (p *MITMProxy) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 	// Extract target host
@@ -55,7 +156,8 @@ func (p *MITMProxy) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if this is a CDN we should intercept
-	if !p.shouldIntercept(r.Host) {
+	user := proxyUserFrom(r.Context())
+	if !p.shouldInterceptFor(r.Host, user) {
 		// Forward to upstream proxy or direct connection
 		p.forwardConnect(w, r, host)
 		return
@@ -91,11 +193,11 @@ func (p *MITMProxy) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 	tlsConn := tls.Server(clientConn, tlsConfig)
 
 	// Handle TLS connection
-	go p.handleTLSConnection(tlsConn, r.Host)
+	go p.handleTLSConnection(tlsConn, r.Host, user)
 }
 
 // handleTLSConnection handles the TLS connection after handshake
-func (p *MITMProxy) handleTLSConnection(conn *tls.Conn, host string) {
+func (p *MITMProxy) handleTLSConnection(conn *tls.Conn, host string, user *proxyUser) {
 	defer conn.Close()
 
 	// Read HTTP request from TLS connection
@@ -103,6 +205,7 @@ func (p *MITMProxy) handleTLSConnection(conn *tls.Conn, host string) {
 	if err != nil {
 		return
 	}
+	req = req.WithContext(withProxyUser(req.Context(), user))
 
 	// Reconstruct URL
 	req.URL.Scheme = "https"
@@ -194,29 +297,86 @@ func (w *tlsResponseWriter) Close() error {
 	return nil
 }
 
+// serveMITMConnection serves HTTP requests from an already-terminated client
+// connection to host:port through the interception pipeline. Requests carry
+// ctx, which holds the authenticated user if there is one.
+func (p *MITMProxy) serveMITMConnection(ctx context.Context, conn net.Conn, scheme, host string, port int) error {
+	br := bufio.NewReader(conn)
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if isIgnorableProxyError(err) {
+				return nil
+			}
+			return err
+		}
+
+		req = req.WithContext(ctx)
+		normalizeSOCKS5Request(req, scheme, host, port)
+
+		w := &tlsResponseWriter{
+			conn:   conn,
+			header: make(http.Header),
+			writer: bufio.NewWriter(conn),
+		}
+
+		p.processRequestWithWriter(req, w)
+
+		if req.Body != nil {
+			req.Body.Close()
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+		w.Flush()
+
+		if req.Close || strings.EqualFold(req.Header.Get("Connection"), "close") || req.ProtoMajor < 1 || (req.ProtoMajor == 1 && req.ProtoMinor == 0) {
+			return nil
+		}
+	}
+}
+
 // processRequestWithWriter processes a request with a proper ResponseWriter
 func (p *MITMProxy) processRequestWithWriter(r *http.Request, w http.ResponseWriter) {
-	// Check CDN rules
-	rule := p.findMatchingRule(r.URL.String(), r.Host)
+	user := proxyUserFrom(r.Context())
+	if user != nil {
+		user.requests.Add(1)
+		w = user.limitResponseWriter(w)
+	}
+
+	// Check CDN rules and plugins
+	rule := p.cacheRuleFor(r, r.URL.String(), user)
 	if rule == nil {
 		// Not a CDN file, forward normally
 		p.forwardHTTP(w, r)
 		return
 	}
 
-	// Extract cookie
-	cookie := r.Header.Get("Cookie")
+	// Only GET is cached; HEAD is answered from the cache when it can be
+	if r.Method != http.MethodGet {
+		if r.Method != http.MethodHead || !p.serveCachedHead(w, r, r.URL.String(), rule) {
+			rule.RequestHeaders.Apply(r.Header)
+			p.forwardHTTP(w, r)
+		}
+		return
+	}
 
 	// Extract filename
 	filename := p.extractFilename(r.URL.Path)
 
-	// Get or create file entry
-	file, err := p.cacheManager.GetOrCreateFile(
+	// Get or create the file entry for this request's variant
+	file, err := p.cacheManager.GetOrCreateFileForRequest(
 		r.URL.String(),
-		cookie,
 		filename,
 		rule.DedupStrategy,
+		requestKey(r, rule),
 	)
+	if errors.Is(err, cache.ErrVaryAll) {
+		p.forwardHTTP(w, r)
+		return
+	}
 	if err != nil {
 		// Log error with stack trace and forward
 		logErrorWithStack(err, "Failed to get or create file: %s", r.URL.String())
@@ -224,15 +384,43 @@ func (p *MITMProxy) processRequestWithWriter(r *http.Request, w http.ResponseWri
 		return
 	}
 
+	if user != nil {
+		if err := p.cacheManager.SetRequestedBy(file, user.name); err != nil {
+			log.Printf("Failed to attribute %s to %s: %v", file.OriginalURL, user.name, err)
+		}
+	}
+
+	w, finish := p.pluginResponses(w, r, r.URL.String())
+	defer finish()
+
+	// Playlists are revalidated with the origin and drive segment prefetching
+	if download.IsPlaylistPath(r.URL.Path) {
+		if err := p.downloadSched.ServePlaylist(file, w, r); err != nil {
+			logErrorWithStack(err, "Failed to serve playlist: %s", r.URL.String())
+		}
+		return
+	}
+
+	// Byte ranges of entries not cached yet are fetched and cached on their own
+	if served, err := p.downloadSched.ServeRange(file, w, r); served {
+		if err != nil {
+			logErrorWithStack(err, "Failed to serve range: %s", r.URL.String())
+		}
+		return
+	}
+
 	// Check if file is complete
 	if file.DownloadStatus == "complete" {
 		// Serve from cache
-		http.ServeFile(w, r, file.SavedPath)
+		if user != nil {
+			user.cacheHits.Add(1)
+		}
+		p.downloadSched.ServeFile(file, w, r)
 		return
 	}
 
 	// Stream file (will trigger download if needed)
-	if err := p.downloadSched.StreamFile(file, w, r); err != nil {
+	if err := p.downloadSched.StreamFileWithPriority(file, w, r, user.downloadPriority()); err != nil {
 		logErrorWithStack(err, "Failed to stream file: %s", r.URL.String())
 		// Error already sent to client by StreamFile
 	}
@@ -251,9 +439,11 @@ func (p *MITMProxy) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !p.shouldIntercept(r.Host) {
-		// Forward to upstream
-		p.forwardHTTP(w, r)
+	if !p.shouldInterceptFor(httpTargetAddress(r.URL), proxyUserFrom(r.Context())) {
+		// Forward to upstream, subject to the tunnel ACL
+		if p.allowDestination(w, r.URL) {
+			p.forwardHTTP(w, r)
+		}
 		return
 	}
 
@@ -261,70 +451,53 @@ func (p *MITMProxy) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 	p.processRequestWithWriter(r, w)
 }
 
-// processRequest processes intercepted requests
-func (p *MITMProxy) processRequest(r *http.Request, w io.Writer) {
-	// Check CDN rules
-	rule := p.findMatchingRule(r.URL.String(), r.Host)
-	if rule == nil {
-		// Not a CDN file, forward normally
-		p.forwardHTTP(w.(http.ResponseWriter), r)
-		return
+// serveCachedHead answers a HEAD for a CDN URL from the cached file or its
+// in-progress download, without creating an entry or starting a download.
+// It returns false when the cache knows nothing yet.
+func (p *MITMProxy) serveCachedHead(w http.ResponseWriter, r *http.Request, rawURL string, rule *config.CDNRule) bool {
+	file, err := p.cacheManager.FindFile(rawURL, rule.DedupStrategy, requestKey(r, rule))
+	if errors.Is(err, cache.ErrVaryAll) {
+		return false
 	}
-
-	// Extract cookie
-	cookie := r.Header.Get("Cookie")
-
-	// Extract filename
-	filename := p.extractFilename(r.URL.Path)
-
-	// Get or create file entry
-	file, err := p.cacheManager.GetOrCreateFile(
-		r.URL.String(),
-		cookie,
-		filename,
-		rule.DedupStrategy,
-	)
 	if err != nil {
-		// Log error with stack trace and forward
-		logErrorWithStack(err, "Failed to get or create file: %s", r.URL.String())
-		p.forwardHTTP(w.(http.ResponseWriter), r)
-		return
+		logErrorWithStack(err, "Failed to look up file: %s", rawURL)
+		return false
 	}
-
-	// Check if file is complete
-	if file.DownloadStatus == "complete" {
-		// Serve from cache
-		http.ServeFile(w.(http.ResponseWriter), r, file.SavedPath)
-		return
+	if file == nil {
+		return false
 	}
+	w, finish := p.pluginResponses(w, r, rawURL)
+	defer finish()
+	return p.downloadSched.ServeHead(file, w, r)
+}
 
-	// Stream file (will trigger download if needed)
-	if httpWriter, ok := w.(http.ResponseWriter); ok {
-		if err := p.downloadSched.StreamFile(file, httpWriter, r); err != nil {
-			logErrorWithStack(err, "Failed to stream file: %s", r.URL.String())
-			// Error already sent to client by StreamFile
-		}
+// requestKey is the part of r that selects its cache entry under rule
+func requestKey(r *http.Request, rule *config.CDNRule) cache.RequestKey {
+	return cache.RequestKey{
+		Cookie:  r.Header.Get("Cookie"),
+		Key:     rule.CacheKey(r.Header),
+		Headers: rule.UpstreamHeaders(r.Header),
 	}
 }
 
-// shouldIntercept checks if host should be intercepted
+// shouldIntercept checks if host ("host" or "host:port") matches a CDN rule
 func (p *MITMProxy) shouldIntercept(host string) bool {
-	for _, rule := range p.config.CDNRules {
-		if strings.Contains(host, rule.Domain) {
-			return true
-		}
-	}
-	return false
+	return p.rules.MatchHost(host, nil) != nil
+}
+
+// shouldInterceptFor is shouldIntercept restricted to the CDN rules a user may use
+func (p *MITMProxy) shouldInterceptFor(host string, user *proxyUser) bool {
+	return p.rules.MatchHost(host, user.ruleFilter()) != nil
 }
 
 // findMatchingRule finds matching CDN rule
-func (p *MITMProxy) findMatchingRule(urlStr, host string) *config.CDNRule {
-	for _, rule := range p.config.CDNRules {
-		if cache.MatchCDNRule(urlStr, rule.Domain, rule.MatchPattern) {
-			return &rule
-		}
-	}
-	return nil
+func (p *MITMProxy) findMatchingRule(urlStr string) *config.CDNRule {
+	return p.findMatchingRuleFor(urlStr, nil)
+}
+
+// findMatchingRuleFor finds the matching CDN rule among those a user may use
+func (p *MITMProxy) findMatchingRuleFor(urlStr string, user *proxyUser) *config.CDNRule {
+	return p.rules.MatchURL(urlStr, user.ruleFilter())
 }
 
 // extractFilename extracts filename from URL path
@@ -344,9 +517,12 @@ func (p *MITMProxy) getCertificate(host string) (*tls.Certificate, error) {
 		return cert.(*tls.Certificate), nil
 	}
 
-	// Generate new certificate (simplified - in production use proper CA)
-	// TODO: Implement proper certificate generation with CA
-	cert, err := generateCertificate(host)
+	ca, err := p.certificateAuthority()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root CA: %w", err)
+	}
+
+	cert, err := ca.IssueCertificate(host)
 	if err != nil {
 		return nil, err
 	}
@@ -355,32 +531,99 @@ func (p *MITMProxy) getCertificate(host string) (*tls.Certificate, error) {
 	return cert, nil
 }
 
-// generateCertificate is now implemented in cert.go
+// certificateAuthority loads the configured CA on first use
+func (p *MITMProxy) certificateAuthority() (*CertificateAuthority, error) {
+	p.caMu.Lock()
+	defer p.caMu.Unlock()
 
-// forwardConnect forwards CONNECT request to upstream
-func (p *MITMProxy) forwardConnect(w http.ResponseWriter, r *http.Request, target string) {
-	if p.config.UpstreamProxy == "" {
-		http.Error(w, "No upstream proxy configured", http.StatusBadGateway)
-		return
+	if p.ca != nil {
+		return p.ca, nil
 	}
 
-	// Parse upstream proxy
-	proxyURL, err := url.Parse(p.config.UpstreamProxy)
+	ca, err := LoadOrCreateCA(p.config.CA.CertPath, p.config.CA.KeyPath)
 	if err != nil {
-		http.Error(w, "Invalid upstream proxy", http.StatusInternalServerError)
+		return nil, err
+	}
+	p.ca = ca
+	return ca, nil
+}
+
+// allowDestination checks a request for a host that is not intercepted
+// against the tunnel ACL, answering it when the destination is refused. The
+// addresses the host resolves to are checked again when forwarding dials them.
+func (p *MITMProxy) allowDestination(w http.ResponseWriter, target *url.URL) bool {
+	if p.tunnel == nil {
+		http.Error(w, fmt.Sprintf("Tunnelling disabled: %v", p.tunnelErr), http.StatusInternalServerError)
+		return false
+	}
+	if !p.tunnel.allowedAddress(httpTargetAddress(target)) {
+		p.tunnel.stats.denied.Add(1)
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// forwardTransport returns the transport forwarding a request for target:
+// the upstream proxy when one is configured, otherwise the tunnel for hosts
+// that are not intercepted, so the ACL covers the addresses they resolve to
+func (p *MITMProxy) forwardTransport(target *url.URL, user *proxyUser) http.RoundTripper {
+	if p.config.UpstreamProxy != "" {
+		proxyURL, err := url.Parse(p.config.UpstreamProxy)
+		if err != nil {
+			return nil
+		}
+		return &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	}
+	if p.tunnelTransport != nil && !p.shouldInterceptFor(httpTargetAddress(target), user) {
+		return p.tunnelTransport
+	}
+	if p.originTransport != nil {
+		return p.originTransport
+	}
+	return nil
+}
+
+// forwardError answers a request the forwarding reverse proxy failed to complete
+func forwardError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDestinationDenied) {
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
 		return
 	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
 
-	// Connect to upstream proxy
-	conn, err := net.Dial("tcp", proxyURL.Host)
+// forwardConnect tunnels a non-intercepted CONNECT request, either directly
+// or through the configured upstream proxy
+func (p *MITMProxy) forwardConnect(w http.ResponseWriter, r *http.Request, target string) {
+	if p.tunnel == nil {
+		http.Error(w, fmt.Sprintf("Tunnelling disabled: %v", p.tunnelErr), http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		targetConn net.Conn
+		err        error
+	)
+	if p.config.UpstreamProxy != "" {
+		targetConn, err = p.dialUpstreamConnect(r, target)
+	} else {
+		targetConn, err = p.tunnel.Dial(r.Context(), target)
+	}
 	if err != nil {
+		if errors.Is(err, errDestinationDenied) {
+			http.Error(w, "Destination not allowed", http.StatusForbidden)
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	defer conn.Close()
-
-	// Send CONNECT request to upstream
-	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	defer targetConn.Close()
 
 	// Hijack client connection
 	hijacker, ok := w.(http.Hijacker)
@@ -389,7 +632,7 @@ func (p *MITMProxy) forwardConnect(w http.ResponseWriter, r *http.Request, targe
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, clientBuf, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
@@ -397,11 +640,88 @@ func (p *MITMProxy) forwardConnect(w http.ResponseWriter, r *http.Request, targe
 	defer clientConn.Close()
 
 	// Send 200 to client
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// Read through the hijacked buffer so bytes the client sent early are not lost
+	var clientReader io.Reader = clientConn
+	if clientBuf != nil && clientBuf.Reader != nil {
+		clientReader = clientBuf.Reader
+	}
+
+	user := proxyUserFrom(r.Context())
+	if user != nil {
+		user.tunnels.Add(1)
+	}
+	// An IP-literal CONNECT may still be for a CDN host; look for its SNI or Host header
+	var relayErr error
+	if host, portStr, err := net.SplitHostPort(target); err == nil && p.sniffsIPLiteral(host) {
+		port, _ := strconv.Atoi(portStr)
+		relayErr = p.relaySniffed(r.Context(), clientConn, clientReader, targetConn, port, user)
+	} else {
+		relayErr = p.tunnel.Relay(user.limitWriter(clientConn), clientReader, targetConn)
+	}
+	if relayErr != nil {
+		log.Printf("Tunnel to %s ended with error: %v", target, relayErr)
+	}
+}
+
+// dialUpstreamConnect opens a CONNECT tunnel to target through the upstream proxy
+func (p *MITMProxy) dialUpstreamConnect(r *http.Request, target string) (net.Conn, error) {
+	if !p.tunnel.allowedAddress(target) {
+		p.tunnel.stats.denied.Add(1)
+		return nil, fmt.Errorf("%w: %s", errDestinationDenied, target)
+	}
+
+	// Parse upstream proxy
+	proxyURL, err := url.Parse(p.config.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+	}
+
+	// Connect to upstream proxy
+	dialer := &net.Dialer{Timeout: p.tunnel.connectTimeout}
+	conn, err := dialer.DialContext(r.Context(), "tcp", proxyURL.Host)
+	if err != nil {
+		p.tunnel.stats.failed.Add(1)
+		return nil, err
+	}
+
+	// Send CONNECT request to upstream and wait for its answer
+	conn.SetDeadline(time.Now().Add(p.tunnel.connectTimeout))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		p.tunnel.stats.failed.Add(1)
+		return nil, fmt.Errorf("upstream proxy CONNECT failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		p.tunnel.stats.failed.Add(1)
+		return nil, fmt.Errorf("upstream proxy refused CONNECT: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
 
-	// Relay data
-	go io.Copy(conn, clientConn)
-	io.Copy(clientConn, conn)
+	if br.Buffered() > 0 {
+		return &socksBufferedConn{Conn: conn, reader: io.MultiReader(br, conn)}, nil
+	}
+	return conn, nil
+}
+
+// httpTargetAddress returns host:port for a proxied request URL
+func httpTargetAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
 }
 
 // serveFromAssets tries to serve file from assets directory
@@ -450,7 +770,8 @@ func (p *MITMProxy) forwardHTTP(w http.ResponseWriter, r *http.Request) {
 			if req.URL.Scheme == "" {
 				req.URL.Scheme = "https"
 			}
-			req.Header.Del("Accept-Encoding")
+			p.htmlPlugins.ForRequest(req).RestrictAcceptEncoding(req.Header)
+			p.htmlPlugins.RewriteRequest(req)
 		},
 		ModifyResponse: func(resp *http.Response) error {
 			if p.htmlPlugins == nil {
@@ -464,18 +785,9 @@ func (p *MITMProxy) forwardHTTP(w http.ResponseWriter, r *http.Request) {
 			if p.serveFromAssets(w, r) {
 				return
 			}
-			http.Error(w, err.Error(), http.StatusBadGateway)
+			forwardError(w, err)
 		},
-	}
-
-	// Configure upstream proxy if needed
-	if p.config.UpstreamProxy != "" {
-		proxyURL, err := url.Parse(p.config.UpstreamProxy)
-		if err == nil {
-			proxy.Transport = &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
-			}
-		}
+		Transport: p.forwardTransport(r.URL, proxyUserFrom(r.Context())),
 	}
 
 	proxy.ServeHTTP(w, r)
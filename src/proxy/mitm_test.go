@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/database"
+)
+
+func TestCachedURLMethodHandling(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("ETag", `"abc"`)
+		w.Write([]byte("archive-body"))
+	}))
+	defer origin.Close()
+	originMethods := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(methods, ",")
+	}
+
+	originURL, _ := url.Parse(origin.URL)
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{Domain: originURL.Hostname(), DedupStrategy: "full_url"}})
+	target := origin.URL + "/pkg.zip"
+	serve := func(method string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		mitm.processRequestWithWriter(r, w)
+		return w
+	}
+	countFiles := func() int64 {
+		var count int64
+		db.Model(&database.File{}).Count(&count)
+		return count
+	}
+
+	// Unknown file: HEAD and POST go upstream and nothing is cached
+	if w := serve(http.MethodHead, nil); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("HEAD = %d with %d body bytes", w.Code, w.Body.Len())
+	}
+	if w := serve(http.MethodPost, nil); w.Code != http.StatusOK || w.Body.String() != "archive-body" {
+		t.Fatalf("POST = %d %q", w.Code, w.Body.String())
+	}
+	if got := originMethods(); got != "HEAD,POST" {
+		t.Fatalf("origin saw %s, want HEAD,POST", got)
+	}
+	if n := countFiles(); n != 0 {
+		t.Fatalf("HEAD and POST created %d cache entries", n)
+	}
+
+	if w := serve(http.MethodGet, nil); w.Body.String() != "archive-body" {
+		t.Fatalf("GET body = %q", w.Body.String())
+	}
+	file, ok := waitForCachedFileByURL(t, db, target, 5*time.Second)
+	if !ok {
+		t.Fatal("GET should create a cache entry")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for file.DownloadStatus != "complete" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		db.First(file, file.ID)
+	}
+
+	// Known file: HEAD and conditional GET are answered without the origin
+	w := serve(http.MethodHead, nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Length") != "12" || w.Body.Len() != 0 {
+		t.Errorf("cached HEAD = %d, headers %v, %d body bytes", w.Code, w.Header(), w.Body.Len())
+	}
+	if w := serve(http.MethodGet, http.Header{"If-None-Match": {`"abc"`}}); w.Code != http.StatusNotModified {
+		t.Errorf("conditional GET = %d, want 304", w.Code)
+	}
+	if got := originMethods(); got != "HEAD,POST,GET" {
+		t.Errorf("origin saw %s, want HEAD,POST,GET", got)
+	}
+}
+
+func TestCachedURLVariants(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.Header.Get("Accept-Language"))
+		mu.Unlock()
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello-" + r.Header.Get("Accept-Language")))
+	}))
+	defer origin.Close()
+
+	originURL, _ := url.Parse(origin.URL)
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{
+		Domain:          originURL.Hostname(),
+		DedupStrategy:   "full_url",
+		CacheKeyCookies: []string{"session"},
+	}})
+	target := origin.URL + "/greeting.txt"
+	get := func(language, cookie string) string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept-Language", language)
+		r.Header.Set("Cookie", cookie)
+		w := httptest.NewRecorder()
+		mitm.processRequestWithWriter(r, w)
+		return w.Body.String()
+	}
+	waitComplete := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		var count int64
+		for time.Now().Before(deadline) {
+			db.Model(&database.File{}).Where("download_status = ?", "complete").Count(&count)
+			if count == want {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("%d complete entries, want %d", count, want)
+	}
+
+	if body := get("en", "session=1; tracking=a"); body != "hello-en" {
+		t.Fatalf("first English body = %q", body)
+	}
+	waitComplete(1)
+	if body := get("de", "session=1; tracking=b"); body != "hello-de" {
+		t.Fatalf("German body = %q", body)
+	}
+	waitComplete(2)
+
+	// Cached variants are served without the origin, whatever the other cookies
+	if body := get("en", "tracking=c; session=1"); body != "hello-en" {
+		t.Errorf("cached English body = %q", body)
+	}
+	if body := get("de", "session=1"); body != "hello-de" {
+		t.Errorf("cached German body = %q", body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(fetched, ",") != "en,de" {
+		t.Errorf("origin fetched %q, want en,de", fetched)
+	}
+}
@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mitmcdn/src/config"
+)
+
+const (
+	// onboardingHost is the magic hostname that serves the onboarding page
+	// when requested through the proxy (http://mitm.cdn/)
+	onboardingHost = "mitm.cdn"
+	// onboardingPrefix is the reserved path that serves the onboarding page
+	// when the server is addressed directly (http://server:8081/mitmcdn/)
+	onboardingPrefix = "/mitmcdn"
+)
+
+// OnboardingHandler serves the CA distribution and client setup page
+type OnboardingHandler struct {
+	config    *config.Config
+	mitmProxy *MITMProxy
+}
+
+// NewOnboardingHandler creates a new onboarding handler
+func NewOnboardingHandler(cfg *config.Config, mitm *MITMProxy) *OnboardingHandler {
+	return &OnboardingHandler{
+		config:    cfg,
+		mitmProxy: mitm,
+	}
+}
+
+// isOnboardingRequest reports whether the request targets the magic host or reserved path
+func isOnboardingRequest(r *http.Request) bool {
+	if isOnboardingHost(r) {
+		return true
+	}
+	// Only claim the reserved path for requests addressed to this server,
+	// not for absolute-form proxy requests to other sites
+	if r.URL.Host != "" {
+		return false
+	}
+	return r.URL.Path == onboardingPrefix || strings.HasPrefix(r.URL.Path, onboardingPrefix+"/")
+}
+
+// isOnboardingHost reports whether the request was addressed to the magic host
+func isOnboardingHost(r *http.Request) bool {
+	return strings.EqualFold(hostWithoutPort(r.Host), onboardingHost)
+}
+
+// hostWithoutPort strips an optional port from a host[:port] string
+func hostWithoutPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// ServeHTTP dispatches onboarding page and download requests
+func (h *OnboardingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca, err := h.mitmProxy.certificateAuthority()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("CA not available: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	// The magic host serves the same files at its root
+	path := r.URL.Path
+	if path == onboardingPrefix || strings.HasPrefix(path, onboardingPrefix+"/") {
+		path = path[len(onboardingPrefix):]
+	}
+	switch path {
+	case "", "/":
+		h.servePage(w, r, ca)
+	case "/mitmcdn-ca.pem":
+		anchor := ca.TrustAnchor()
+		writeDownload(w, "application/x-pem-file", "mitmcdn-ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: anchor.Raw}))
+	case "/mitmcdn-ca.cer":
+		writeDownload(w, "application/x-x509-ca-cert", "mitmcdn-ca.cer", ca.TrustAnchor().Raw)
+	case "/mitmcdn-ca.mobileconfig":
+		writeDownload(w, "application/x-apple-aspen-config", "mitmcdn-ca.mobileconfig", buildMobileConfig(ca))
+	case "/proxy.pac", "/wpad.dat":
+		servePAC(w, r, h.config)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeDownload(w http.ResponseWriter, contentType, filename string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writeBody(w, data)
+}
+
+func writeBody(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// buildMobileConfig wraps the CA certificate in an Apple configuration profile
+// so iOS and macOS can install it with a single tap
+func buildMobileConfig(ca *CertificateAuthority) []byte {
+	anchor := ca.TrustAnchor()
+	sum := sha256.Sum256(anchor.Raw)
+	// Derive stable UUIDs from the fingerprint so re-downloads replace the same profile
+	payloadUUID := formatUUID(sum[:16])
+	profileUUID := formatUUID(sum[16:])
+
+	profile := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>mitmcdn-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDescription</key>
+			<string>Adds the MitmCDN root certificate</string>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>com.mitmcdn.ca.%s</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>MitmCDN CA</string>
+	<key>PayloadIdentifier</key>
+	<string>com.mitmcdn.profile.%s</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`,
+		base64.StdEncoding.EncodeToString(anchor.Raw),
+		template.HTMLEscapeString(anchor.Subject.CommonName),
+		payloadUUID, payloadUUID, profileUUID, profileUUID)
+
+	return []byte(profile)
+}
+
+// formatUUID formats 16 bytes as an RFC 4122 version 4 style UUID string
+func formatUUID(b []byte) string {
+	u := make([]byte, 16)
+	copy(u, b)
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]))
+}
+
+// onboardingOS describes install instructions for one client platform
+type onboardingOS struct {
+	ID       string
+	Name     string
+	Download string
+	Steps    []string
+	Detected bool
+}
+
+// detectClientOS guesses the client platform from the User-Agent
+func detectClientOS(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"):
+		return "ios"
+	case strings.Contains(ua, "android"):
+		return "android"
+	case strings.Contains(ua, "windows"):
+		return "windows"
+	case strings.Contains(ua, "mac os"), strings.Contains(ua, "macintosh"):
+		return "macos"
+	case strings.Contains(ua, "linux"), strings.Contains(ua, "x11"):
+		return "linux"
+	}
+	return ""
+}
+
+// installInstructions builds per-OS steps, with the detected OS first
+func installInstructions(base, pac, proxyAddr, userAgent string) []onboardingOS {
+	pemURL := base + "/mitmcdn-ca.pem"
+	der := base + "/mitmcdn-ca.cer"
+	mobileconfig := base + "/mitmcdn-ca.mobileconfig"
+
+	all := []onboardingOS{
+		{
+			ID: "windows", Name: "Windows", Download: der,
+			Steps: []string{
+				"Download the certificate and open it, then choose Install Certificate.",
+				"Select Local Machine, then place it in Trusted Root Certification Authorities.",
+				"Or from an elevated prompt: certutil -addstore -f Root mitmcdn-ca.cer",
+				"Set the proxy auto-config URL to " + pac + " under Settings > Network > Proxy.",
+			},
+		},
+		{
+			ID: "macos", Name: "macOS", Download: mobileconfig,
+			Steps: []string{
+				"Download the profile and install it from System Settings > Privacy & Security > Profiles.",
+				"Or in Terminal: sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain mitmcdn-ca.pem",
+				"Set the automatic proxy configuration URL to " + pac + " under Network > Details > Proxies.",
+			},
+		},
+		{
+			ID: "ios", Name: "iOS / iPadOS", Download: mobileconfig,
+			Steps: []string{
+				"Open this page in Safari and download the profile.",
+				"Install it from Settings > General > VPN & Device Management.",
+				"Enable full trust in Settings > General > About > Certificate Trust Settings.",
+				"Set Wi-Fi > Configure Proxy > Automatic with URL " + pac + ".",
+			},
+		},
+		{
+			ID: "android", Name: "Android", Download: der,
+			Steps: []string{
+				"Download the certificate.",
+				"Install it from Settings > Security > Encryption & credentials > Install a certificate > CA certificate.",
+				"Note: apps targeting Android 7+ only trust user CAs if they opt in; browsers such as Firefox can be configured to use them.",
+				"Set the Wi-Fi proxy to Auto-config with URL " + pac + ", or Manual with " + proxyAddr + ".",
+			},
+		},
+		{
+			ID: "linux", Name: "Linux", Download: pemURL,
+			Steps: []string{
+				"Debian/Ubuntu: sudo cp mitmcdn-ca.pem /usr/local/share/ca-certificates/mitmcdn.crt && sudo update-ca-certificates",
+				"Fedora/RHEL: sudo cp mitmcdn-ca.pem /etc/pki/ca-trust/source/anchors/ && sudo update-ca-trust",
+				"Firefox uses its own store: Settings > Privacy & Security > Certificates > Import.",
+				"Export http_proxy/https_proxy=http://" + proxyAddr + " or point your desktop proxy settings at " + pac + ".",
+			},
+		},
+	}
+
+	detected := detectClientOS(userAgent)
+	ordered := make([]onboardingOS, 0, len(all))
+	for _, platform := range all {
+		if platform.ID == detected {
+			platform.Detected = true
+			ordered = append([]onboardingOS{platform}, ordered...)
+			continue
+		}
+		ordered = append(ordered, platform)
+	}
+	return ordered
+}
+
+// onboardingPage is the data rendered into the onboarding template
+type onboardingPage struct {
+	Subject     string
+	Fingerprint string
+	NotAfter    time.Time
+	DaysLeft    int
+	Base        string
+	PACURL      string
+	ProxyAddr   string
+	Domains     []string
+	Platforms   []onboardingOS
+}
+
+func (h *OnboardingHandler) servePage(w http.ResponseWriter, r *http.Request, ca *CertificateAuthority) {
+	base := "http://" + r.Host + onboardingPrefix
+	if isOnboardingHost(r) {
+		base = "http://" + onboardingHost
+	}
+
+	anchor := ca.TrustAnchor()
+	proxyAddr := pacProxyAddress(h.config, r)
+	// The PAC file must be reachable before the proxy is configured,
+	// so always point at the server address rather than the magic host
+	pacURL := "http://" + proxyAddr + "/proxy.pac"
+	data := onboardingPage{
+		Subject:     anchor.Subject.String(),
+		Fingerprint: certFingerprint(anchor),
+		NotAfter:    anchor.NotAfter,
+		DaysLeft:    int(time.Until(anchor.NotAfter).Hours() / 24),
+		Base:        base,
+		PACURL:      pacURL,
+		ProxyAddr:   proxyAddr,
+		Domains:     pacDomains(h.config),
+		Platforms:   installInstructions(base, pacURL, proxyAddr, r.UserAgent()),
+	}
+
+	tmpl := `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>MitmCDN Setup</title>
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            padding: 20px;
+        }
+        .container { max-width: 900px; margin: 0 auto; }
+        .card {
+            background: white;
+            border-radius: 10px;
+            padding: 30px;
+            margin-bottom: 20px;
+            box-shadow: 0 4px 6px rgba(0,0,0,0.1);
+        }
+        h1, h2 { color: #333; margin-bottom: 10px; }
+        h2 { font-size: 18px; }
+        .meta { color: #666; font-size: 14px; line-height: 1.8; }
+        code { background: #f8f9fa; padding: 2px 4px; border-radius: 4px; word-break: break-all; }
+        .downloads a {
+            display: inline-block;
+            background: #667eea;
+            color: white;
+            text-decoration: none;
+            padding: 10px 20px;
+            border-radius: 5px;
+            margin: 10px 10px 0 0;
+            font-size: 14px;
+        }
+        .downloads a:hover { background: #5568d3; }
+        .detected { border-left: 4px solid #667eea; }
+        ol { margin-left: 20px; color: #333; line-height: 1.8; }
+        .badge { background: #d4edda; color: #155724; padding: 2px 8px; border-radius: 4px; font-size: 12px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="card">
+            <h1>MitmCDN Client Setup</h1>
+            <div class="meta">
+                <strong>CA:</strong> {{.Subject}}<br>
+                <strong>SHA-256:</strong> <code>{{.Fingerprint}}</code><br>
+                <strong>Expires:</strong> {{.NotAfter.Format "2006-01-02"}} ({{.DaysLeft}} days)<br>
+                <strong>Proxy:</strong> <code>{{.ProxyAddr}}</code>
+            </div>
+            <div class="downloads">
+                <a href="{{.Base}}/mitmcdn-ca.pem">PEM</a>
+                <a href="{{.Base}}/mitmcdn-ca.cer">DER</a>
+                <a href="{{.Base}}/mitmcdn-ca.mobileconfig">Apple profile</a>
+                <a href="{{.PACURL}}">PAC file</a>
+            </div>
+        </div>
+        {{range .Platforms}}
+        <div class="card{{if .Detected}} detected{{end}}" id="{{.ID}}">
+            <h2>{{.Name}} {{if .Detected}}<span class="badge">your device</span>{{end}}</h2>
+            <p class="meta"><a href="{{.Download}}">Download certificate</a></p>
+            <ol>
+                {{range .Steps}}<li>{{.}}</li>{{end}}
+            </ol>
+        </div>
+        {{end}}
+        <div class="card">
+            <h2>Proxied domains</h2>
+            <p class="meta">The PAC file routes only these domains through MitmCDN:</p>
+            <ol>
+                {{range .Domains}}<li><code>{{.}}</code></li>{{else}}<li>No CDN rules configured</li>{{end}}
+            </ol>
+        </div>
+    </div>
+</body>
+</html>`
+
+	t, err := template.New("onboarding").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, "Template execution error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeBody(w, []byte(buf.String()))
+}
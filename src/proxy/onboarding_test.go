@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mitmcdn/src/config"
+)
+
+func setupOnboardingServer(t *testing.T) (*UnifiedServer, *CertificateAuthority) {
+	t.Helper()
+
+	caDir := t.TempDir()
+	cfg := &config.Config{
+		ListenAddress: "0.0.0.0:8081",
+		ProxyMode:     "all",
+		CA: config.CAConfig{
+			CertPath: filepath.Join(caDir, "ca-cert.pem"),
+			KeyPath:  filepath.Join(caDir, "ca-key.pem"),
+		},
+		CDNRules: []config.CDNRule{
+			{Domain: "cdn.example.com", DedupStrategy: "full_url"},
+			{Domain: "video.example.net", DedupStrategy: "full_url"},
+		},
+	}
+
+	server, err := NewUnifiedServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewUnifiedServer() error = %v", err)
+	}
+	ca, err := server.mitmProxy.certificateAuthority()
+	if err != nil {
+		t.Fatalf("certificateAuthority() error = %v", err)
+	}
+	return server, ca
+}
+
+func TestOnboardingPageOnMagicHost(t *testing.T) {
+	server, ca := setupOnboardingServer(t)
+
+	// Absolute-form proxy request for the magic host
+	req := httptest.NewRequest("GET", "http://mitm.cdn/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, ca.Fingerprint()) {
+		t.Error("page should show the CA fingerprint")
+	}
+	if !strings.Contains(body, ca.Cert.NotAfter.Format("2006-01-02")) {
+		t.Error("page should show the CA expiry")
+	}
+	if strings.Index(body, "iOS / iPadOS") > strings.Index(body, "Windows") {
+		t.Error("detected OS instructions should be listed first")
+	}
+	if !strings.Contains(body, "http://mitm.cdn/mitmcdn-ca.mobileconfig") {
+		t.Error("page should link downloads on the magic host")
+	}
+}
+
+func TestOnboardingDownloads(t *testing.T) {
+	server, ca := setupOnboardingServer(t)
+
+	tests := []struct {
+		file        string
+		contentType string
+		check       func(t *testing.T, body []byte)
+	}{
+		{"mitmcdn-ca.pem", "application/x-pem-file", func(t *testing.T, body []byte) {
+			if !strings.Contains(string(body), "BEGIN CERTIFICATE") {
+				t.Error("PEM download should contain a certificate block")
+			}
+		}},
+		{"mitmcdn-ca.cer", "application/x-x509-ca-cert", func(t *testing.T, body []byte) {
+			cert, err := x509.ParseCertificate(body)
+			if err != nil {
+				t.Fatalf("DER download should parse: %v", err)
+			}
+			if !cert.Equal(ca.Cert) {
+				t.Error("DER download should be the CA certificate")
+			}
+		}},
+		{"mitmcdn-ca.mobileconfig", "application/x-apple-aspen-config", func(t *testing.T, body []byte) {
+			if !strings.Contains(string(body), "com.apple.security.root") {
+				t.Error("profile should contain a root certificate payload")
+			}
+		}},
+		{"proxy.pac", "application/x-ns-proxy-autoconfig", func(t *testing.T, body []byte) {
+			pac := string(body)
+			if !strings.Contains(pac, `dnsDomainIs(host, ".cdn.example.com")`) {
+				t.Errorf("PAC should route CDN domains through the proxy:\n%s", pac)
+			}
+			if !strings.Contains(pac, "PROXY 192.168.1.10:8081") {
+				t.Errorf("PAC should use the address the client reached us on:\n%s", pac)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/mitmcdn/"+tt.file, nil)
+			req.Host = "192.168.1.10:8081"
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			body, _ := io.ReadAll(w.Body)
+			tt.check(t, body)
+		})
+	}
+
+	// The page on the magic host links the CA downloads at its root
+	for _, tt := range tests[:3] {
+		t.Run("mitm.cdn/"+tt.file, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://mitm.cdn/"+tt.file, nil)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			body, _ := io.ReadAll(w.Body)
+			tt.check(t, body)
+		})
+	}
+}
+
+func TestOnboardingIgnoresProxiedReservedPath(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://other.example.com/mitmcdn/", nil)
+	if isOnboardingRequest(req) {
+		t.Error("reserved path on another host should be proxied, not served locally")
+	}
+}
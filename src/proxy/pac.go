@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"mitmcdn/src/config"
+)
+
+// normalizePACDomains lowercases, trims and de-duplicates domains in a stable order.
+// A leading "." is dropped: ".example.com" means the domain and its
+// subdomains, as it does in CDN rules and the tunnel ACL.
+func normalizePACDomains(domains []string) []string {
+	seen := make(map[string]struct{})
+	result := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		domain = strings.TrimPrefix(domain, ".")
+		if domain == "" || domain == "*." {
+			continue
+		}
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		result = append(result, domain)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// pacDomains returns the domains routed through the proxy: every CDN rule
+// domain plus any extra domains from the PAC config
+func pacDomains(cfg *config.Config) []string {
+	domains := make([]string, 0, len(cfg.CDNRules)+len(cfg.PAC.ExtraDomains))
+	for _, rule := range cfg.CDNRules {
+		if domain := pacRuleDomain(rule.Domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	domains = append(domains, cfg.PAC.ExtraDomains...)
+	return normalizePACDomains(domains)
+}
+
+// pacRuleDomain returns a PAC domain covering every host a CDN rule matches.
+// Ports are dropped and globs widen to their fixed suffix; host regexes cannot
+// be expressed and return "", so they need pac.extra_domains.
+func pacRuleDomain(domain string) string {
+	domain = strings.TrimSpace(domain)
+	if strings.HasPrefix(domain, "~") {
+		return ""
+	}
+	domain, exact := strings.CutPrefix(domain, "=")
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	if exact {
+		return "=" + domain
+	}
+	if i := strings.LastIndex(domain, "*"); i >= 0 {
+		if !strings.HasPrefix(domain[i+1:], ".") {
+			return ""
+		}
+		return "*" + domain[i+1:]
+	}
+	return strings.TrimPrefix(domain, ".")
+}
+
+// pacCondition returns the JavaScript test for a domain pattern.
+// "example.com" matches the domain and its subdomains, "*.example.com" only
+// subdomains and "=example.com" only the domain itself.
+func pacCondition(domain string) string {
+	if host, ok := strings.CutPrefix(domain, "="); ok {
+		return fmt.Sprintf("host == %q", host)
+	}
+	if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+		return fmt.Sprintf("dnsDomainIs(host, %q)", "."+suffix)
+	}
+	return fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain)
+}
+
+// pacProxyResult builds the FindProxyForURL return value for proxied hosts
+func pacProxyResult(pac config.PACConfig, proxyAddr string) string {
+	proxyTypes := pac.ProxyTypes
+	if len(proxyTypes) == 0 {
+		proxyTypes = []string{"PROXY"}
+	}
+
+	entries := make([]string, 0, len(proxyTypes)+1)
+	for _, proxyType := range proxyTypes {
+		entries = append(entries, proxyType+" "+proxyAddr)
+	}
+	if pac.FallbackDirect {
+		entries = append(entries, "DIRECT")
+	}
+	return strings.Join(entries, "; ")
+}
+
+// generatePAC builds a proxy auto-config script that sends the CDN rule
+// domains (and their subdomains) through proxyAddr and everything else DIRECT
+func generatePAC(cfg *config.Config, proxyAddr string) string {
+	var b strings.Builder
+	b.WriteString("// Generated by MitmCDN\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+
+	excluded := normalizePACDomains(cfg.PAC.ExcludeDomains)
+	for _, domain := range excluded {
+		fmt.Fprintf(&b, "  if (%s) return \"DIRECT\";\n", pacCondition(domain))
+	}
+
+	result := pacProxyResult(cfg.PAC, proxyAddr)
+	for _, domain := range pacDomains(cfg) {
+		fmt.Fprintf(&b, "  if (%s) return %q;\n", pacCondition(domain), result)
+	}
+
+	b.WriteString("  return \"DIRECT\";\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// isPACRequest reports whether the request asks for the PAC or WPAD file on this server
+func isPACRequest(r *http.Request) bool {
+	if r.URL.Host != "" {
+		return false
+	}
+	return r.URL.Path == "/proxy.pac" || r.URL.Path == "/wpad.dat"
+}
+
+// pacProxyAddress returns the proxy address advertised in the PAC file.
+// The configured listen address is often 0.0.0.0, so unless an explicit
+// address is configured, prefer the host the client used to reach us.
+func pacProxyAddress(cfg *config.Config, r *http.Request) string {
+	if cfg.PAC.ProxyAddress != "" {
+		return cfg.PAC.ProxyAddress
+	}
+
+	_, listenPort, err := net.SplitHostPort(cfg.ListenAddress)
+	if err != nil {
+		return cfg.ListenAddress
+	}
+
+	host := hostWithoutPort(r.Host)
+	if host == "" || isOnboardingHost(r) || strings.HasPrefix(strings.ToLower(host), "wpad") {
+		// Proxied magic host or WPAD alias: use the local address the client connected to
+		host = ""
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			host = hostWithoutPort(addr.String())
+		}
+	}
+	if host == "" {
+		host = hostWithoutPort(cfg.ListenAddress)
+	}
+	return net.JoinHostPort(host, listenPort)
+}
+
+// servePAC writes the generated PAC file
+func servePAC(w http.ResponseWriter, r *http.Request, cfg *config.Config) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeBody(w, []byte(generatePAC(cfg, pacProxyAddress(cfg, r))))
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mitmcdn/src/config"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	cfg := &config.Config{
+		ListenAddress: "0.0.0.0:8081",
+		PAC: config.PACConfig{
+			ProxyTypes:     []string{"PROXY", "SOCKS5"},
+			ExtraDomains:   []string{"*.media.example.org", "CDN.example.com", ".static.example.org"},
+			ExcludeDomains: []string{"login.cdn.example.com", ".ads.example.com"},
+			FallbackDirect: true,
+		},
+		CDNRules: []config.CDNRule{
+			{Domain: "cdn.example.com"},
+			{Domain: "video.example.net"},
+			{Domain: "=origin.example.net:8443"},
+		},
+	}
+
+	pac := generatePAC(cfg, "10.0.0.2:8081")
+
+	wantLines := []string{
+		`if (host == "login.cdn.example.com" || dnsDomainIs(host, ".login.cdn.example.com")) return "DIRECT";`,
+		// A leading "." covers the domain itself, as in CDN rules
+		`if (host == "ads.example.com" || dnsDomainIs(host, ".ads.example.com")) return "DIRECT";`,
+		`if (host == "static.example.org" || dnsDomainIs(host, ".static.example.org")) return "PROXY 10.0.0.2:8081; SOCKS5 10.0.0.2:8081; DIRECT";`,
+		`if (dnsDomainIs(host, ".media.example.org")) return "PROXY 10.0.0.2:8081; SOCKS5 10.0.0.2:8081; DIRECT";`,
+		`if (host == "video.example.net" || dnsDomainIs(host, ".video.example.net")) return "PROXY 10.0.0.2:8081; SOCKS5 10.0.0.2:8081; DIRECT";`,
+		`if (host == "origin.example.net") return "PROXY 10.0.0.2:8081; SOCKS5 10.0.0.2:8081; DIRECT";`,
+		`return "DIRECT";`,
+	}
+	for _, line := range wantLines {
+		if !strings.Contains(pac, line) {
+			t.Errorf("PAC missing line %q:\n%s", line, pac)
+		}
+	}
+
+	// Exclusions must be evaluated before the proxied domains
+	if strings.Index(pac, "login.cdn.example.com") > strings.Index(pac, `host == "cdn.example.com"`) {
+		t.Error("exclusions should precede proxied domains")
+	}
+	// Duplicate domains (case-insensitive) are emitted once
+	if strings.Count(pac, `host == "cdn.example.com"`) != 1 {
+		t.Errorf("duplicate domain emitted more than once:\n%s", pac)
+	}
+}
+
+func TestPACRuleDomain(t *testing.T) {
+	tests := map[string]string{
+		"cdn.example.com":       "cdn.example.com",
+		".example.com":          "example.com",
+		"*.example.com":         "*.example.com",
+		"img-*.example.com":     "*.example.com",
+		"cdn.example.com:8443":  "cdn.example.com",
+		"=cdn.example.com:8443": "=cdn.example.com",
+		`~^edge\.example\.com$`: "",
+	}
+	for domain, want := range tests {
+		if got := pacRuleDomain(domain); got != want {
+			t.Errorf("pacRuleDomain(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestServePACAndWPAD(t *testing.T) {
+	cfg := &config.Config{
+		ListenAddress: "0.0.0.0:8081",
+		CDNRules:      []config.CDNRule{{Domain: "cdn.example.com"}},
+	}
+	server, err := NewUnifiedServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewUnifiedServer() error = %v", err)
+	}
+
+	for _, path := range []string{"/proxy.pac", "/wpad.dat"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "192.168.1.10:8081"
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", path, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/x-ns-proxy-autoconfig" {
+			t.Errorf("%s: Content-Type = %q", path, got)
+		}
+		if !strings.Contains(w.Body.String(), `return "PROXY 192.168.1.10:8081";`) {
+			t.Errorf("%s: unexpected PAC body:\n%s", path, w.Body.String())
+		}
+	}
+
+	// An explicit proxy address overrides the request host
+	cfg.PAC.ProxyAddress = "proxy.lan:3128"
+	req := httptest.NewRequest("GET", "/wpad.dat", nil)
+	req.Host = "wpad.lan"
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "PROXY proxy.lan:3128") {
+		t.Errorf("configured proxy_address not used:\n%s", w.Body.String())
+	}
+}
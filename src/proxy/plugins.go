@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/htmlplugin"
+)
+
+// pluginCacheRule is the rule requests are cached under when a plugin opts
+// them into caching without a matching CDN rule
+var pluginCacheRule = config.CDNRule{DedupStrategy: "full_url"}
+
+// cacheRuleFor returns the CDN rule r is cached under, or nil to forward it
+// uncached. Plugins may override the rules' decision either way.
+func (p *MITMProxy) cacheRuleFor(r *http.Request, rawURL string, user *proxyUser) *config.CDNRule {
+	rule := p.findMatchingRuleFor(rawURL, user)
+	cache, decided := p.htmlPlugins.ShouldCache(r, rawURL)
+	switch {
+	case !decided:
+		return rule
+	case !cache:
+		return nil
+	case rule == nil:
+		fallback := pluginCacheRule
+		return &fallback
+	}
+	return rule
+}
+
+// pluginResponses wraps w so the plugins' response and body hooks run on a
+// response served from the cache; forwarded responses get them through
+// Manager.ModifyResponse instead. The returned function must be called once
+// the response is complete.
+func (p *MITMProxy) pluginResponses(w http.ResponseWriter, r *http.Request, rawURL string) (http.ResponseWriter, func()) {
+	if p.htmlPlugins == nil {
+		return w, func() {}
+	}
+	pw := &pluginResponseWriter{ResponseWriter: w, plugins: p.htmlPlugins.ForRequest(r), rawURL: rawURL, method: r.Method}
+	return pw, pw.finish
+}
+
+// pluginResponseWriter runs the response hooks when the header is written.
+// Complete responses of a content type a plugin transforms are held back
+// until finish, up to the plugins' MaxBodySize, and sent transformed.
+type pluginResponseWriter struct {
+	http.ResponseWriter
+	plugins     *htmlplugin.Manager
+	rawURL      string
+	method      string
+	wroteHeader bool
+	status      int
+	body        *bytes.Buffer // held back body, nil when passing through
+}
+
+func (w *pluginResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if status == http.StatusOK && w.method != http.MethodHead && header.Get("Content-Encoding") == "" && w.plugins.TransformsBody(header.Get("Content-Type")) {
+		if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err != nil || size <= w.plugins.MaxBodySize() {
+			w.status = status
+			w.body = &bytes.Buffer{}
+			return
+		}
+	}
+	w.plugins.InspectResponse(w.rawURL, status, header)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pluginResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	if int64(w.body.Len()+len(b)) > w.plugins.MaxBodySize() {
+		// Too big to transform after all: send it as it is
+		if err := w.send(w.body.Bytes()); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+// finish transforms and sends a held back body
+func (w *pluginResponseWriter) finish() {
+	if w.body == nil {
+		return
+	}
+	body := w.body.Bytes()
+	modified, changed, err := w.plugins.TransformBody(w.rawURL, w.Header().Get("Content-Type"), body)
+	if err != nil {
+		log.Printf("Plugins failed for %s: %v", w.rawURL, err)
+	}
+	if err == nil && changed {
+		body = modified
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.send(body)
+}
+
+// send writes the held back header and body and stops holding back
+func (w *pluginResponseWriter) send(body []byte) error {
+	w.body = nil
+	w.plugins.InspectResponse(w.rawURL, w.status, w.Header())
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+func (w *pluginResponseWriter) Flush() {
+	if w.body != nil {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *pluginResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijacking not supported")
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/database"
+	"mitmcdn/src/htmlplugin"
+)
+
+const hooksPlugin = `
+export const contentTypes = ["application/json"];
+
+export function onRequest(request: PluginRequest) {
+  return { headers: { "X-Plugin": "1", "X-Drop": null } };
+}
+
+export function onResponse(response: PluginResponse) {
+  return { headers: { "X-Seen": String(response.status) } };
+}
+
+export function shouldCache(request: PluginRequest) {
+  if (request.url.includes("/live/")) {
+    return false;
+  }
+  if (request.url.includes("/extra/")) {
+    return true;
+  }
+  return undefined;
+}
+
+export function transformBody(body: string, response: BodyInfo) {
+  return body.replace("origin", "plugin");
+}
+`
+
+func TestPluginHooks(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path] = r.Header.Get("X-Plugin") + "|" + r.Header.Get("X-Drop")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"from":"origin"}`))
+	}))
+	defer origin.Close()
+	originRequest := func(path string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[path]
+	}
+
+	originURL, _ := url.Parse(origin.URL)
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{Domain: originURL.Hostname(), MatchPattern: `^/cdn/`, DedupStrategy: "full_url"}})
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "plugins"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plugins", "hooks.ts"), []byte(hooksPlugin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := htmlplugin.NewManager(filepath.Join(dir, "plugins"), filepath.Join(dir, "configs"), mitm.cacheManager, mitm.downloadSched)
+	if err != nil {
+		t.Fatalf("failed to load plugins: %v", err)
+	}
+	mitm.htmlPlugins = plugins
+	mitm.downloadSched.ConfigureRequestHook(plugins.RewriteRequest)
+	reverse := NewHTTPReverseProxy(&config.Config{}, mitm.cacheManager, mitm.downloadSched, mitm, plugins)
+
+	serve := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-Drop", "yes")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	mitmHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { mitm.processRequestWithWriter(r, w) })
+	waitComplete := func(rawURL string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			var file database.File
+			if db.Where("original_url = ?", rawURL).First(&file).Error == nil && file.DownloadStatus == "complete" {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("%s was not cached", rawURL)
+	}
+	cached := func(rawURL string) bool {
+		var count int64
+		db.Model(&database.File{}).Where("original_url = ?", rawURL).Count(&count)
+		return count > 0
+	}
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		target  string
+		path    string
+		cached  bool
+	}{
+		{name: "cached by rule", handler: mitmHandler, target: origin.URL + "/cdn/data.json", path: "/cdn/data.json", cached: true},
+		{name: "uncached by plugin", handler: mitmHandler, target: origin.URL + "/cdn/live/data.json", path: "/cdn/live/data.json"},
+		{name: "forwarded", handler: mitmHandler, target: origin.URL + "/api/data.json", path: "/api/data.json"},
+		{name: "cached by plugin in URL path mode", handler: reverse, target: "/" + origin.URL + "/extra/data.json", path: "/extra/data.json", cached: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rawURL := origin.URL + tc.path
+			for i := 0; i < 2; i++ {
+				w := serve(tc.handler, tc.target)
+				if got := w.Body.String(); got != `{"from":"plugin"}` {
+					t.Fatalf("request %d: body = %q", i, got)
+				}
+				if got := w.Header().Get("X-Seen"); got != "200" {
+					t.Fatalf("request %d: response hook header = %q", i, got)
+				}
+				if got := w.Header().Get("Content-Length"); got != "" && got != "17" {
+					t.Fatalf("request %d: Content-Length = %s", i, got)
+				}
+				if tc.cached {
+					waitComplete(rawURL)
+				}
+			}
+			if got := originRequest(tc.path); got != "1|" {
+				t.Fatalf("origin saw X-Plugin|X-Drop = %q, want 1|", got)
+			}
+			if got := cached(rawURL); got != tc.cached {
+				t.Fatalf("cached = %v, want %v", got, tc.cached)
+			}
+		})
+	}
+
+	// The cache keeps the origin's body; plugins only change what clients see
+	var file database.File
+	db.Where("original_url = ?", origin.URL+"/cdn/data.json").First(&file)
+	if data, err := os.ReadFile(file.SavedPath); err != nil || !strings.Contains(string(data), "origin") {
+		t.Fatalf("cached body = %q, %v", data, err)
+	}
+}
+
+func TestLinkRewritePlugin(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<a href="/next">next</a><img src="http://cdn.example/i.png"><a href="more">more</a>`))
+	}))
+	defer origin.Close()
+
+	mitm, _ := newMITMProxyForTest(t, nil)
+
+	dir := t.TempDir()
+	source, err := os.ReadFile(filepath.Join("..", "..", "plugins", "link_rewrite.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "plugins"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plugins", "link_rewrite.ts"), source, 0644); err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := htmlplugin.NewManager(filepath.Join(dir, "plugins"), filepath.Join(dir, "configs"), mitm.cacheManager, mitm.downloadSched)
+	if err != nil {
+		t.Fatalf("failed to load plugins: %v", err)
+	}
+	mitm.htmlPlugins = plugins
+	reverse := NewHTTPReverseProxy(&config.Config{}, mitm.cacheManager, mitm.downloadSched, mitm, plugins)
+	mitmHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { mitm.processRequestWithWriter(r, w) })
+
+	serve := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := serve(reverse, "/"+origin.URL+"/page")
+	want := `<a href="/` + origin.URL + `/next">next</a><img src="/http://cdn.example/i.png"><a href="more">more</a>`
+	if got := w.Body.String(); got != want {
+		t.Fatalf("page through the URL path proxy = %s\nwant %s", got, want)
+	}
+	w = serve(reverse, "/"+origin.URL+"/old")
+	if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != "/"+origin.URL+"/page" {
+		t.Fatalf("redirect through the URL path proxy = %d %q", w.Code, got)
+	}
+
+	// Pages fetched through the forward proxy already use origin URLs
+	w = serve(mitmHandler, origin.URL+"/page")
+	if got := w.Body.String(); got != `<a href="/next">next</a><img src="http://cdn.example/i.png"><a href="more">more</a>` {
+		t.Fatalf("page through the proxy was rewritten: %s", got)
+	}
+	w = serve(mitmHandler, origin.URL+"/old")
+	if got := w.Header().Get("Location"); got != "/page" {
+		t.Fatalf("redirect through the proxy = %q", got)
+	}
+}
+
+func TestCachePathsServedOnlyToLocalRequests(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin:" + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	mitm, db := newMITMProxyForTest(t, nil)
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "plugins"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	embeds := `export const elements = ["iframe"];
+export const embedProviders = ["clips"];
+export function transformElement() { return undefined; }
+`
+	if err := os.WriteFile(filepath.Join(dir, "plugins", "embeds.ts"), []byte(embeds), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := htmlplugin.NewManager(filepath.Join(dir, "plugins"), filepath.Join(dir, "configs"), mitm.cacheManager, mitm.downloadSched)
+	if err != nil {
+		t.Fatalf("failed to load plugins: %v", err)
+	}
+	mitm.htmlPlugins = plugins
+	server := &UnifiedServer{config: mitm.config, db: db, mitmProxy: mitm, downloadSched: mitm.downloadSched}
+
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		// Forward-proxy requests for /cache/ paths on other sites reach them
+		{target: origin.URL + "/cache/images/logo.png", status: http.StatusOK, body: "origin:/cache/images/logo.png"},
+		{target: origin.URL + "/cache/clips/abc123/player", status: http.StatusOK, body: "origin:/cache/clips/abc123/player"},
+		{target: origin.URL + "/cache/hls/abc123/index.m3u8", status: http.StatusOK, body: "origin:/cache/hls/abc123/index.m3u8"},
+		// Requests addressed to the server are answered for configured providers only
+		{target: "/cache/clips/abc123/player", status: http.StatusNotFound, body: "Video not cached\n"},
+		{target: "/cache/images/logo.png", status: http.StatusNotFound, body: "Not Found\n"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("GET %s = %d %q, want %d %q", tc.target, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errClientHelloPeeked aborts the probe handshake once the ClientHello has been seen
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// recordingConn feeds a probe TLS handshake while discarding anything it writes
+type recordingConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// peekClientHello reads the TLS ClientHello from conn and returns its SNI
+// (empty when the client sent none) along with a connection that replays
+// every consumed byte, so the handshake can be terminated or spliced later
+func peekClientHello(conn net.Conn) (string, *peekConn, error) {
+	var consumed bytes.Buffer
+	var serverName string
+	probe := tls.Server(&recordingConn{Conn: conn, reader: io.TeeReader(conn, &consumed)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloPeeked
+		},
+	})
+
+	err := probe.Handshake()
+	replay := &peekConn{Conn: conn, buffer: consumed.Bytes()}
+	if !errors.Is(err, errClientHelloPeeked) {
+		if err == nil {
+			err = errors.New("unexpected TLS handshake completion")
+		}
+		return "", replay, err
+	}
+	return serverName, replay, nil
+}
+
+// serveTLSFront routes a TLS connection made directly to the listener by its SNI.
+// With DNS for a CDN hostname pointed at mitmcdn, the CDN SNI is served as a
+// MITM'd request for that origin; local names keep the normal TLS handling and
+// any other SNI is tunnelled to its origin untouched, if tunnelling is allowed.
+func (s *UnifiedServer) serveTLSFront(conn net.Conn) {
+	serverName, replay, err := peekClientHello(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	switch {
+	case s.isLocalServerName(serverName):
+		s.serveLocalTLS(replay)
+	case s.mitmProxy.shouldIntercept(net.JoinHostPort(serverName, strconv.Itoa(s.sniOriginPort()))):
+		defer replay.Close()
+		if err := s.mitmProxy.interceptConnection(context.Background(), replay, serverName, true, s.sniOriginPort()); err != nil && !isIgnorableProxyError(err) {
+			log.Printf("TLS front: intercepted connection to %s failed: %v", serverName, err)
+		}
+	default:
+		defer replay.Close()
+		s.tunnelTLSFront(replay, serverName)
+	}
+}
+
+// isLocalServerName reports whether an SNI addresses mitmcdn itself
+func (s *UnifiedServer) isLocalServerName(serverName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" || serverName == "localhost" || serverName == onboardingHost || net.ParseIP(serverName) != nil {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(s.config.ListenAddress); err == nil && strings.EqualFold(host, serverName) {
+		return true
+	}
+	for _, name := range s.config.SNIRouting.LocalNames {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if serverName == name || strings.HasSuffix(serverName, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniOriginPort returns the port origins are reached on for SNI-routed connections
+func (s *UnifiedServer) sniOriginPort() int {
+	if s.config.SNIRouting.OriginPort == 0 {
+		return 443
+	}
+	return s.config.SNIRouting.OriginPort
+}
+
+// tunnelTLSFront splices a TLS connection to serverName's origin. Such
+// connections carry no credentials, so with users configured they are only
+// tunnelled when [tunnel] allow bounds their destinations.
+func (s *UnifiedServer) tunnelTLSFront(conn *peekConn, serverName string) {
+	tunnel := s.mitmProxy.tunnel
+	if tunnel == nil {
+		return
+	}
+	if !s.mitmProxy.tunnelsWithoutAuth() {
+		tunnel.stats.denied.Add(1)
+		log.Printf("TLS front: refusing to tunnel %s without proxy authentication", serverName)
+		return
+	}
+
+	target := net.JoinHostPort(serverName, strconv.Itoa(s.sniOriginPort()))
+	targetConn, err := tunnel.Dial(context.Background(), target)
+	if err != nil {
+		log.Printf("TLS front: failed to connect to %s: %v", target, err)
+		return
+	}
+	defer targetConn.Close()
+
+	tunnel.Relay(conn, conn, targetConn)
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+
+	"gorm.io/gorm"
+)
+
+// startTLSFrontForTest runs a unified server with SNI routing enabled that
+// resolves the given names to the local origin
+func startTLSFrontForTest(t *testing.T, origin *httptest.Server, names ...string) (*gorm.DB, string) {
+	t.Helper()
+	return startTLSFrontWithConfig(t, origin, nil, names...)
+}
+
+// startTLSFrontWithConfig is startTLSFrontForTest with configure applied to
+// the server config first
+func startTLSFrontWithConfig(t *testing.T, origin *httptest.Server, configure func(*config.Config), names ...string) (*gorm.DB, string) {
+	t.Helper()
+
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{
+		Domain:        "cdn.test",
+		MatchPattern:  ".*",
+		DedupStrategy: "full_url",
+	}})
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	originPort, _ := strconv.Atoi(port)
+	hosts := make(map[string]string)
+	for _, name := range names {
+		hosts[name] = "127.0.0.1"
+	}
+
+	caDir := t.TempDir()
+	cfg := mitm.config
+	cfg.CA = config.CAConfig{
+		CertPath: filepath.Join(caDir, "ca-cert.pem"),
+		KeyPath:  filepath.Join(caDir, "ca-key.pem"),
+	}
+	cfg.Resolver = config.ResolverConfig{Hosts: hosts}
+	cfg.SNIRouting = config.SNIRoutingConfig{Enabled: true, OriginPort: originPort}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	server, err := NewUnifiedServer(cfg, mitm.cacheManager, mitm.downloadSched, nil, nil)
+	if err != nil {
+		t.Fatalf("NewUnifiedServer() error = %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	return db, listener.Addr().String()
+}
+
+func getViaTLSFront(t *testing.T, frontAddr, serverName, path string) (*http.Response, *tls.Conn) {
+	t.Helper()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", frontAddr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, serverName)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, conn
+}
+
+func TestTLSFrontServesCDNHostname(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("tls-front-body"))
+	}))
+	defer origin.Close()
+
+	db, frontAddr := startTLSFrontForTest(t, origin, "cdn.test")
+
+	resp, conn := getViaTLSFront(t, frontAddr, "cdn.test", "/assets/front.bin")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if issuer := conn.ConnectionState().PeerCertificates[0].Issuer.CommonName; issuer != "MitmCDN Root CA" {
+		t.Fatalf("leaf issuer = %q, want the MITM CA", issuer)
+	}
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	targetURL := "https://cdn.test:" + port + "/assets/front.bin"
+	if _, ok := waitForCachedFileByURL(t, db, targetURL, 5*time.Second); !ok {
+		t.Fatalf("expected cached file record for %s", targetURL)
+	}
+}
+
+func TestTLSFrontTunnelsOtherHostnames(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin-direct"))
+	}))
+	defer origin.Close()
+
+	_, frontAddr := startTLSFrontForTest(t, origin, "other.test")
+
+	resp, conn := getViaTLSFront(t, frontAddr, "other.test", "/")
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "origin-direct" {
+		t.Fatalf("body = %q, want origin response", body)
+	}
+	if issuer := conn.ConnectionState().PeerCertificates[0].Issuer.CommonName; issuer == "MitmCDN Root CA" {
+		t.Fatal("non-CDN SNI should be tunnelled, not intercepted")
+	}
+}
+
+func TestTLSFrontRequiresTunnelAllowWithUsers(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin-direct"))
+	}))
+	defer origin.Close()
+	users := []config.UserConfig{{Username: "alice", PasswordHash: hashPasswordForTest(t, "secret")}}
+
+	// Without credentials, an unbounded tunnel would be an open proxy
+	_, frontAddr := startTLSFrontWithConfig(t, origin, func(cfg *config.Config) {
+		cfg.Users = users
+	}, "other.test", "cdn.test")
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", frontAddr, &tls.Config{
+		ServerName:         "other.test",
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS front tunnelled another hostname without authentication")
+	}
+	// CDN hostnames are still served
+	if resp, _ := getViaTLSFront(t, frontAddr, "cdn.test", "/assets/front.bin"); resp.StatusCode != http.StatusOK {
+		t.Errorf("CDN hostname status = %d, want 200", resp.StatusCode)
+	}
+
+	// An allow list bounds where such connections go
+	_, frontAddr = startTLSFrontWithConfig(t, origin, func(cfg *config.Config) {
+		cfg.Users = users
+		cfg.Tunnel.Allow = []string{"other.test", "127.0.0.1"}
+	}, "other.test")
+	resp, _ := getViaTLSFront(t, frontAddr, "other.test", "/")
+	if body, _ := io.ReadAll(resp.Body); string(body) != "origin-direct" {
+		t.Fatalf("body = %q, want origin response", body)
+	}
+}
@@ -1,7 +1,6 @@
 package proxy
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -16,6 +15,7 @@ import (
 	"mitmcdn/src/cache"
 	"mitmcdn/src/config"
 	"mitmcdn/src/download"
+	"mitmcdn/src/resolver"
 
 	"github.com/things-go/go-socks5"
 	"github.com/things-go/go-socks5/statute"
@@ -27,6 +27,7 @@ type SOCKS5Proxy struct {
 	downloadSched *download.Scheduler
 	mitmProxy     *MITMProxy
 	server        *socks5.Server
+	sessions      *SessionStats // UDP ASSOCIATE and BIND
 }
 
 func NewSOCKS5Proxy(cfg *config.Config, cacheMgr *cache.Manager, sched *download.Scheduler, mitm *MITMProxy) (*SOCKS5Proxy, error) {
@@ -35,17 +36,27 @@ func NewSOCKS5Proxy(cfg *config.Config, cacheMgr *cache.Manager, sched *download
 		cacheManager:  cacheMgr,
 		downloadSched: sched,
 		mitmProxy:     mitm,
+		sessions:      newSessionStats(),
 	}
 
 	// Create custom resolver that checks CDN rules
-	resolver := &CDNResolver{
+	cdnResolver := &CDNResolver{
 		config: cfg,
+		mitm:   mitm,
 	}
 
-	server := socks5.NewServer(
-		socks5.WithResolver(resolver),
+	opts := []socks5.Option{
+		socks5.WithResolver(cdnResolver),
 		socks5.WithConnectHandle(proxy.handleConnect),
-	)
+		socks5.WithAssociateHandle(proxy.handleAssociate),
+		socks5.WithBindHandle(proxy.handleBind),
+	}
+	// Require RFC 1929 username/password authentication when users are configured
+	if mitm != nil && mitm.users != nil {
+		opts = append(opts, socks5.WithCredential(mitm.users))
+	}
+
+	server := socks5.NewServer(opts...)
 
 	proxy.server = server
 	return proxy, nil
@@ -55,6 +66,14 @@ func (p *SOCKS5Proxy) ListenAndServe(addr string) error {
 	return p.server.ListenAndServe("tcp", addr)
 }
 
+// SessionStats returns counters for UDP associations and BINDs
+func (p *SOCKS5Proxy) SessionStats() *SessionStats {
+	if p == nil {
+		return nil
+	}
+	return p.sessions
+}
+
 // Serve serves connections from the given listener
 func (p *SOCKS5Proxy) Serve(listener net.Listener) error {
 	for {
@@ -69,9 +88,12 @@ func (p *SOCKS5Proxy) Serve(listener net.Listener) error {
 	}
 }
 
-// CDNResolver resolves addresses, checking if they match CDN rules
+// CDNResolver resolves SOCKS5 destination names through the configured
+// [resolver] rather than the system one. CDN rule hosts are not resolved at
+// all: they are intercepted and fetched by name.
 type CDNResolver struct {
 	config *config.Config
+	mitm   *MITMProxy
 }
 
 func (r *CDNResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
@@ -79,7 +101,15 @@ func (r *CDNResolver) Resolve(ctx context.Context, name string) (context.Context
 		return ctx, nil, fmt.Errorf("resolver config is nil")
 	}
 
-	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	var res *resolver.Resolver
+	if r.mitm != nil {
+		if r.mitm.shouldIntercept(name) {
+			return ctx, nil, nil
+		}
+		res = r.mitm.resolver
+	}
+
+	ips, err := res.LookupIP(ctx, name)
 	if err != nil {
 		return ctx, nil, err
 	}
@@ -87,7 +117,9 @@ func (r *CDNResolver) Resolve(ctx context.Context, name string) (context.Context
 		return ctx, nil, fmt.Errorf("no IPs found for %s", name)
 	}
 
-	return ctx, ips[0].IP, nil
+	// Tunnels dial the name again and race every address; this one is only
+	// used for BIND peer checks and logging
+	return ctx, ips[0], nil
 }
 
 // socksBufferedConn ensures we consume already-buffered data in request.Reader
@@ -110,14 +142,33 @@ func (p *SOCKS5Proxy) handleConnect(ctx context.Context, writer io.Writer, reque
 		return err
 	}
 
-	if p.mitmProxy != nil && p.mitmProxy.shouldIntercept(host) {
-		return p.handleInterceptedConnection(writer, request, host, port)
+	user := p.requestUser(request)
+	ctx = withProxyUser(ctx, user)
+
+	if p.mitmProxy != nil && p.mitmProxy.shouldInterceptFor(net.JoinHostPort(host, strconv.Itoa(port)), user) {
+		return p.handleInterceptedConnection(ctx, writer, request, host, port)
 	}
 
 	return p.forwardConnect(ctx, writer, request)
 }
 
-func (p *SOCKS5Proxy) handleInterceptedConnection(writer io.Writer, request *socks5.Request, host string, port int) error {
+// requestUser returns the user a SOCKS5 connection authenticated as, or nil
+func (p *SOCKS5Proxy) requestUser(request *socks5.Request) *proxyUser {
+	if p.mitmProxy == nil || request.AuthContext == nil {
+		return nil
+	}
+	return p.mitmProxy.users.lookup(request.AuthContext.Payload["username"])
+}
+
+// tunnelDialer returns the dialer for non-intercepted traffic, or nil if tunnelling is disabled
+func (p *SOCKS5Proxy) tunnelDialer() *tunnelDialer {
+	if p.mitmProxy == nil {
+		return nil
+	}
+	return p.mitmProxy.tunnel
+}
+
+func (p *SOCKS5Proxy) handleInterceptedConnection(ctx context.Context, writer io.Writer, request *socks5.Request, host string, port int) error {
 	clientConn, ok := writer.(net.Conn)
 	if !ok {
 		return fmt.Errorf("writer does not implement net.Conn")
@@ -157,44 +208,7 @@ func (p *SOCKS5Proxy) handleInterceptedConnection(writer io.Writer, request *soc
 		streamConn = tlsConn
 	}
 
-	return p.handleMITMConnection(streamConn, scheme, host, port)
-}
-
-func (p *SOCKS5Proxy) handleMITMConnection(conn net.Conn, scheme, host string, port int) error {
-	br := bufio.NewReader(conn)
-
-	for {
-		req, err := http.ReadRequest(br)
-		if err != nil {
-			if isIgnorableProxyError(err) {
-				return nil
-			}
-			return err
-		}
-
-		normalizeSOCKS5Request(req, scheme, host, port)
-
-		w := &tlsResponseWriter{
-			conn:   conn,
-			header: make(http.Header),
-			writer: bufio.NewWriter(conn),
-		}
-
-		p.mitmProxy.processRequestWithWriter(req, w)
-
-		if req.Body != nil {
-			req.Body.Close()
-		}
-
-		if err := w.Close(); err != nil {
-			return err
-		}
-		w.Flush()
-
-		if req.Close || strings.EqualFold(req.Header.Get("Connection"), "close") || req.ProtoMajor < 1 || (req.ProtoMajor == 1 && req.ProtoMinor == 0) {
-			return nil
-		}
-	}
+	return p.mitmProxy.serveMITMConnection(ctx, streamConn, scheme, host, port)
 }
 
 func normalizeSOCKS5Request(req *http.Request, scheme, host string, port int) {
@@ -266,7 +280,21 @@ func extractSOCKS5Target(request *socks5.Request) (string, int, error) {
 }
 
 func (p *SOCKS5Proxy) forwardConnect(ctx context.Context, writer io.Writer, request *socks5.Request) error {
-	targetConn, err := (&net.Dialer{}).DialContext(ctx, "tcp", request.DestAddr.String())
+	tunnel := p.tunnelDialer()
+	if tunnel == nil {
+		if sendErr := socks5.SendReply(writer, statute.RepServerFailure, nil); sendErr != nil {
+			return fmt.Errorf("failed to send reply: %w", sendErr)
+		}
+		return fmt.Errorf("tunnelling disabled")
+	}
+
+	// Dial by name when the client supplied one so the ACL sees the hostname
+	target := request.DestAddr.String()
+	if host, port, err := extractSOCKS5Target(request); err == nil {
+		target = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	targetConn, err := tunnel.Dial(ctx, target)
 	if err != nil {
 		reply := mapDialErrorToReply(err)
 		if sendErr := socks5.SendReply(writer, reply, nil); sendErr != nil {
@@ -280,21 +308,23 @@ func (p *SOCKS5Proxy) forwardConnect(ctx context.Context, writer io.Writer, requ
 		return fmt.Errorf("failed to send success reply: %w", err)
 	}
 
-	errCh := make(chan error, 2)
-	go func() { errCh <- proxyConn(targetConn, request.Reader) }()
-	go func() { errCh <- proxyConn(writer, targetConn) }()
-
-	for i := 0; i < 2; i++ {
-		err := <-errCh
-		if err != nil && !isIgnorableProxyError(err) {
-			return err
+	user := proxyUserFrom(ctx)
+	if user != nil {
+		user.tunnels.Add(1)
+	}
+	// An IP-literal request may still be for a CDN host; look for its SNI or Host header
+	if host, port, err := extractSOCKS5Target(request); err == nil && p.mitmProxy.sniffsIPLiteral(host) {
+		if clientConn, ok := writer.(net.Conn); ok {
+			return p.mitmProxy.relaySniffed(ctx, clientConn, request.Reader, targetConn, port, user)
 		}
 	}
-
-	return nil
+	return tunnel.Relay(user.limitWriter(writer), request.Reader, targetConn)
 }
 
 func mapDialErrorToReply(err error) uint8 {
+	if errors.Is(err, errDestinationDenied) {
+		return statute.RepRuleFailure
+	}
 	msg := err.Error()
 	if strings.Contains(msg, "refused") {
 		return statute.RepConnectionRefused
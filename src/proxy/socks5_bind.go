@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// handleBind serves a SOCKS5 BIND request, used by protocols such as active
+// FTP where the destination connects back to the client. One inbound
+// connection is accepted within bind_idle_timeout and relayed to the client.
+func (p *SOCKS5Proxy) handleBind(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	tunnel := p.tunnelDialer()
+	if tunnel == nil {
+		if err := socks5.SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("tunnelling disabled")
+	}
+
+	dst := *request.RawDestAddr
+	if !tunnel.allowedAddress(addrSpecHostPort(dst)) {
+		tunnel.stats.denied.Add(1)
+		if err := socks5.SendReply(writer, statute.RepRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("%w: %s", errDestinationDenied, addrSpecHostPort(dst))
+	}
+
+	user := p.requestUser(request)
+	if p.config.UpstreamProxy != "" {
+		upstream, ok := socks5Upstream(p.config.UpstreamProxy)
+		if !ok {
+			if err := socks5.SendReply(writer, statute.RepCommandNotSupported, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return fmt.Errorf("BIND requires a socks5 upstream_proxy")
+		}
+		return p.bindUpstream(ctx, writer, request, upstream, tunnel, user)
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP(request.LocalAddr)})
+	if err != nil {
+		if sendErr := socks5.SendReply(writer, statute.RepServerFailure, nil); sendErr != nil {
+			return fmt.Errorf("failed to send reply: %w", sendErr)
+		}
+		return fmt.Errorf("failed to listen for BIND: %w", err)
+	}
+	defer listener.Close()
+
+	session := p.sessions.start("bind", addrString(request.RemoteAddr), user.Name(), listener.Addr().String())
+	defer p.sessions.end(session)
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, listener.Addr()); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	// Wait for the single inbound connection
+	listener.SetDeadline(time.Now().Add(tunnel.bindIdleTimeout))
+	var expected net.IP
+	if request.DestAddr != nil && request.DestAddr.IP != nil && !request.DestAddr.IP.IsUnspecified() {
+		expected = request.DestAddr.IP
+	}
+
+	var peer *net.TCPConn
+	for peer == nil {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			reply := statute.RepServerFailure
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				reply = statute.RepTTLExpired
+			}
+			if sendErr := socks5.SendReply(writer, reply, nil); sendErr != nil {
+				return fmt.Errorf("failed to send reply: %w", sendErr)
+			}
+			return fmt.Errorf("BIND accept failed: %w", err)
+		}
+
+		// Only the host named in the request, and only permitted addresses, may connect
+		peerAddr := conn.RemoteAddr().(*net.TCPAddr)
+		if (expected != nil && !expected.Equal(peerAddr.IP)) || !tunnel.acl.allowed("", peerAddr.IP, peerAddr.Port) {
+			session.dropped.Add(1)
+			conn.Close()
+			continue
+		}
+		peer = conn
+	}
+	listener.Close()
+	defer peer.Close()
+
+	session.peer.Store(peer.RemoteAddr().String())
+	if err := socks5.SendReply(writer, statute.RepSuccess, peer.RemoteAddr()); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	return relaySession(session, writer, request.Reader, &idleConn{Conn: peer, session: session, timeout: tunnel.bindIdleTimeout}, user)
+}
+
+// bindUpstream forwards a BIND request to a SOCKS5 upstream proxy and relays
+// its two replies and the resulting connection
+func (p *SOCKS5Proxy) bindUpstream(ctx context.Context, writer io.Writer, request *socks5.Request, upstream *url.URL, tunnel *tunnelDialer, user *proxyUser) error {
+	control, first, err := dialSOCKS5Upstream(ctx, upstream, tunnel.connectTimeout, statute.CommandBind, *request.RawDestAddr)
+	if err != nil {
+		reply := mapDialErrorToReply(err)
+		if first.Response != statute.RepSuccess && first.Version == statute.VersionSocks5 {
+			reply = first.Response
+		}
+		if sendErr := socks5.SendReply(writer, reply, nil); sendErr != nil {
+			return fmt.Errorf("failed to send reply: %w", sendErr)
+		}
+		return fmt.Errorf("upstream BIND failed: %w", err)
+	}
+	defer control.Close()
+
+	bindAddr := upstreamBindAddress(first.BndAddr, control)
+	session := p.sessions.start("bind", addrString(request.RemoteAddr), user.Name(), addrSpecHostPort(bindAddr))
+	defer p.sessions.end(session)
+
+	if err := sendSOCKS5Reply(writer, statute.RepSuccess, bindAddr); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	control.SetReadDeadline(time.Now().Add(tunnel.bindIdleTimeout))
+	second, err := statute.ParseReply(control)
+	if err != nil || second.Response != statute.RepSuccess {
+		reply := statute.RepTTLExpired
+		if err == nil {
+			reply = second.Response
+			err = fmt.Errorf("upstream SOCKS5 proxy refused BIND: reply %d", second.Response)
+		}
+		if sendErr := socks5.SendReply(writer, reply, nil); sendErr != nil {
+			return fmt.Errorf("failed to send reply: %w", sendErr)
+		}
+		return err
+	}
+	control.SetReadDeadline(time.Time{})
+
+	session.peer.Store(addrSpecHostPort(second.BndAddr))
+	if err := sendSOCKS5Reply(writer, statute.RepSuccess, second.BndAddr); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	return relaySession(session, writer, request.Reader, &idleConn{Conn: control, session: session, timeout: tunnel.bindIdleTimeout}, user)
+}
+
+// relaySession copies a BIND connection in both directions with per-session
+// accounting. An error in either direction, such as the idle timeout, ends both.
+func relaySession(session *socks5Session, client io.Writer, clientReader io.Reader, target net.Conn, user *proxyUser) error {
+	errCh := make(chan error, 2)
+	go func() { errCh <- relayCounted(target, clientReader, &session.bytesUp) }()
+	go func() { errCh <- relayCounted(user.limitWriter(client), target, &session.bytesDown) }()
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil && !isIgnorableProxyError(err) && firstErr == nil {
+			firstErr = err
+			target.Close()
+			if closer, ok := client.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(firstErr, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return firstErr
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// exerciseBind connects a peer to a BIND address and checks data flows both ways
+func exerciseBind(t *testing.T, control net.Conn, bind statute.AddrSpec) {
+	t.Helper()
+
+	peer, err := net.DialTimeout("tcp", addrSpecHostPort(bind), 2*time.Second)
+	if err != nil {
+		t.Fatalf("peer failed to connect to BIND address: %v", err)
+	}
+	defer peer.Close()
+
+	control.SetReadDeadline(time.Now().Add(3 * time.Second))
+	second, err := statute.ParseReply(control)
+	if err != nil || second.Response != statute.RepSuccess {
+		t.Fatalf("second BIND reply = %+v, %v", second, err)
+	}
+	if second.BndAddr.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("second reply names %s, want peer %s", addrSpecHostPort(second.BndAddr), peer.LocalAddr())
+	}
+
+	peer.Write([]byte("from-peer"))
+	buf := make([]byte, len("from-peer"))
+	if _, err := io.ReadFull(control, buf); err != nil || string(buf) != "from-peer" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+
+	control.Write([]byte("from-client"))
+	peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf = make([]byte, len("from-client"))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "from-client" {
+		t.Fatalf("peer read %q, %v", buf, err)
+	}
+}
+
+func TestSOCKS5BindDirect(t *testing.T) {
+	mitm, _ := newMITMProxyForTest(t, nil)
+	socksProxy, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	control, first := sendSOCKS5Command(t, proxyAddr, statute.CommandBind, "127.0.0.1:0")
+	exerciseBind(t, control, first.BndAddr)
+
+	status := socksProxy.SessionStats().Snapshot()
+	if status.ActiveBind != 1 || len(status.Sessions) != 1 {
+		t.Fatalf("unexpected session status: %+v", status)
+	}
+	if session := status.Sessions[0]; session.Peer == "" || session.BytesUp != int64(len("from-client")) || session.BytesDown != int64(len("from-peer")) {
+		t.Errorf("unexpected session counters: %+v", session)
+	}
+}
+
+func TestSOCKS5BindTimeout(t *testing.T) {
+	mitm, _ := newMITMProxyForTest(t, nil)
+	mitm.tunnel.bindIdleTimeout = 200 * time.Millisecond
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	control, _ := sendSOCKS5Command(t, proxyAddr, statute.CommandBind, "127.0.0.1:0")
+
+	control.SetReadDeadline(time.Now().Add(3 * time.Second))
+	second, err := statute.ParseReply(control)
+	if err != nil {
+		t.Fatalf("failed to read second reply: %v", err)
+	}
+	if second.Response != statute.RepTTLExpired {
+		t.Errorf("second reply = %d, want TTL expired", second.Response)
+	}
+}
+
+func TestSOCKS5BindRejectsUnexpectedPeer(t *testing.T) {
+	mitm, _ := newMITMProxyForTest(t, nil)
+	mitm.tunnel.bindIdleTimeout = 500 * time.Millisecond
+	socksProxy, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	// Only 192.0.2.1 may connect back, so the loopback peer is turned away
+	control, first := sendSOCKS5Command(t, proxyAddr, statute.CommandBind, "192.0.2.1:0")
+	peer, err := net.DialTimeout("tcp", addrSpecHostPort(first.BndAddr), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer peer.Close()
+
+	control.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if second, err := statute.ParseReply(control); err != nil || second.Response != statute.RepTTLExpired {
+		t.Fatalf("second reply = %+v, %v; want TTL expired", second, err)
+	}
+	if total := socksProxy.SessionStats().Snapshot().TotalBind; total != 1 {
+		t.Errorf("TotalBind = %d, want 1", total)
+	}
+}
+
+func TestSOCKS5BindThroughUpstream(t *testing.T) {
+	upstreamMITM, _ := newMITMProxyForTest(t, nil)
+	upstreamProxy, upstreamAddr := startSOCKS5ForTest(t, upstreamMITM)
+
+	mitm, _ := newMITMProxyForTest(t, nil)
+	mitm.config.UpstreamProxy = "socks5://" + upstreamAddr
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	control, first := sendSOCKS5Command(t, proxyAddr, statute.CommandBind, "127.0.0.1:0")
+	exerciseBind(t, control, first.BndAddr)
+
+	if status := upstreamProxy.SessionStats().Snapshot(); status.ActiveBind != 1 {
+		t.Errorf("upstream should hold the BIND: %+v", status)
+	}
+}
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// socks5Session is one SOCKS5 UDP ASSOCIATE or BIND in progress
+type socks5Session struct {
+	id          uint64
+	command     string // "udp_associate" or "bind"
+	client      string
+	user        string
+	bindAddress string
+	started     time.Time
+
+	peer        atomic.Value // string, the BIND peer once connected
+	lastActive  atomic.Int64 // unix nanoseconds
+	bytesUp     atomic.Int64 // client -> destination
+	bytesDown   atomic.Int64 // destination -> client
+	packetsUp   atomic.Int64
+	packetsDown atomic.Int64
+	dropped     atomic.Int64 // datagrams denied, malformed or fragmented
+}
+
+// touch records activity for the idle timeout
+func (s *socks5Session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the session has seen no traffic
+func (s *socks5Session) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// SessionStatus is a snapshot of one SOCKS5 UDP association or BIND
+type SessionStatus struct {
+	ID          uint64    `json:"id"`
+	Command     string    `json:"command"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	BindAddress string    `json:"bind_address"`
+	Peer        string    `json:"peer,omitempty"`
+	Started     time.Time `json:"started"`
+	LastActive  time.Time `json:"last_active"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+	PacketsUp   int64     `json:"packets_up"`
+	PacketsDown int64     `json:"packets_down"`
+	Dropped     int64     `json:"dropped"`
+}
+
+// SessionsStatus summarises SOCKS5 UDP associations and BINDs for the status API
+type SessionsStatus struct {
+	ActiveUDP  int             `json:"active_udp"`
+	TotalUDP   int64           `json:"total_udp"`
+	ActiveBind int             `json:"active_bind"`
+	TotalBind  int64           `json:"total_bind"`
+	Sessions   []SessionStatus `json:"sessions"`
+}
+
+// SessionStats tracks active SOCKS5 UDP associations and BINDs
+type SessionStats struct {
+	mu        sync.Mutex
+	nextID    uint64
+	active    map[uint64]*socks5Session
+	totalUDP  atomic.Int64
+	totalBind atomic.Int64
+}
+
+func newSessionStats() *SessionStats {
+	return &SessionStats{active: make(map[uint64]*socks5Session)}
+}
+
+// start registers a new session; the caller must end it
+func (s *SessionStats) start(command, client, user, bindAddress string) *socks5Session {
+	session := &socks5Session{
+		command:     command,
+		client:      client,
+		user:        user,
+		bindAddress: bindAddress,
+		started:     time.Now(),
+	}
+	session.touch()
+
+	if command == "bind" {
+		s.totalBind.Add(1)
+	} else {
+		s.totalUDP.Add(1)
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	session.id = s.nextID
+	s.active[session.id] = session
+	s.mu.Unlock()
+	return session
+}
+
+// end removes a finished session
+func (s *SessionStats) end(session *socks5Session) {
+	s.mu.Lock()
+	delete(s.active, session.id)
+	s.mu.Unlock()
+}
+
+// Snapshot returns the active sessions ordered by start time
+func (s *SessionStats) Snapshot() SessionsStatus {
+	if s == nil {
+		return SessionsStatus{}
+	}
+
+	status := SessionsStatus{
+		TotalUDP:  s.totalUDP.Load(),
+		TotalBind: s.totalBind.Load(),
+	}
+	s.mu.Lock()
+	for _, session := range s.active {
+		peer, _ := session.peer.Load().(string)
+		status.Sessions = append(status.Sessions, SessionStatus{
+			ID:          session.id,
+			Command:     session.command,
+			Client:      session.client,
+			User:        session.user,
+			BindAddress: session.bindAddress,
+			Peer:        peer,
+			Started:     session.started,
+			LastActive:  time.Unix(0, session.lastActive.Load()),
+			BytesUp:     session.bytesUp.Load(),
+			BytesDown:   session.bytesDown.Load(),
+			PacketsUp:   session.packetsUp.Load(),
+			PacketsDown: session.packetsDown.Load(),
+			Dropped:     session.dropped.Load(),
+		})
+		if session.command == "bind" {
+			status.ActiveBind++
+		} else {
+			status.ActiveUDP++
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(status.Sessions, func(i, j int) bool { return status.Sessions[i].ID < status.Sessions[j].ID })
+	return status
+}
+
+// idleConn fails reads once neither direction of a session has seen traffic for timeout
+type idleConn struct {
+	net.Conn
+	session *socks5Session
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.session.touch()
+		}
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() && c.session.idleFor() < c.timeout {
+			// The other direction was active, keep waiting
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.session.touch()
+	}
+	return n, err
+}
+
+// socks5Upstream returns the upstream_proxy URL when it is a SOCKS5 proxy
+func socks5Upstream(upstream string) (*url.URL, bool) {
+	if upstream == "" {
+		return nil, false
+	}
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") {
+		return nil, false
+	}
+	return u, true
+}
+
+// dialSOCKS5Upstream negotiates with a SOCKS5 upstream proxy and sends command
+// for dst, returning the control connection and the upstream's first reply
+func dialSOCKS5Upstream(ctx context.Context, upstream *url.URL, timeout time.Duration, command byte, dst statute.AddrSpec) (net.Conn, statute.Reply, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", upstream.Host)
+	if err != nil {
+		return nil, statute.Reply{}, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	reply, err := negotiateSOCKS5(conn, upstream.User, command, dst)
+	if err != nil {
+		conn.Close()
+		return nil, reply, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reply, nil
+}
+
+// negotiateSOCKS5 performs the client side of the SOCKS5 handshake and request
+func negotiateSOCKS5(conn net.Conn, user *url.Userinfo, command byte, dst statute.AddrSpec) (statute.Reply, error) {
+	methods := []byte{statute.MethodNoAuth}
+	if user != nil {
+		methods = []byte{statute.MethodUserPassAuth}
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, methods).Bytes()); err != nil {
+		return statute.Reply{}, err
+	}
+	method, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return statute.Reply{}, fmt.Errorf("upstream SOCKS5 handshake failed: %w", err)
+	}
+
+	switch method.Method {
+	case statute.MethodNoAuth:
+	case statute.MethodUserPassAuth:
+		if user == nil {
+			return statute.Reply{}, fmt.Errorf("upstream SOCKS5 proxy requires credentials")
+		}
+		password, _ := user.Password()
+		if _, err := conn.Write(statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(user.Username()), []byte(password)).Bytes()); err != nil {
+			return statute.Reply{}, err
+		}
+		authReply, err := statute.ParseUserPassReply(conn)
+		if err != nil {
+			return statute.Reply{}, fmt.Errorf("upstream SOCKS5 authentication failed: %w", err)
+		}
+		if authReply.Status != statute.AuthSuccess {
+			return statute.Reply{}, statute.ErrUserAuthFailed
+		}
+	default:
+		return statute.Reply{}, statute.ErrNoSupportedAuth
+	}
+
+	request := statute.Request{Version: statute.VersionSocks5, Command: command, DstAddr: dst}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return statute.Reply{}, err
+	}
+	reply, err := statute.ParseReply(conn)
+	if err != nil {
+		return reply, fmt.Errorf("upstream SOCKS5 request failed: %w", err)
+	}
+	if reply.Response != statute.RepSuccess {
+		return reply, fmt.Errorf("upstream SOCKS5 proxy refused request: reply %d", reply.Response)
+	}
+	return reply, nil
+}
+
+// addrSpecFromAddr converts a TCP or UDP address to a SOCKS5 address
+func addrSpecFromAddr(addr net.Addr) statute.AddrSpec {
+	spec, err := statute.ParseAddrSpec(addr.String())
+	if err != nil {
+		return statute.AddrSpec{AddrType: statute.ATYPIPv4, IP: net.IPv4zero}
+	}
+	if ip4 := spec.IP.To4(); ip4 != nil {
+		spec.IP = ip4
+	}
+	return spec
+}
+
+// sendSOCKS5Reply writes a reply carrying an arbitrary SOCKS5 address
+func sendSOCKS5Reply(w io.Writer, rep byte, addr statute.AddrSpec) error {
+	_, err := w.Write(statute.Reply{Version: statute.VersionSocks5, Response: rep, BndAddr: addr}.Bytes())
+	return err
+}
+
+// addrSpecHostPort returns host:port for ACL checks, preferring the name
+func addrSpecHostPort(spec statute.AddrSpec) string {
+	host := spec.FQDN
+	if host == "" {
+		host = spec.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(spec.Port))
+}
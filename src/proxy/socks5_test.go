@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -19,6 +21,7 @@ import (
 	"mitmcdn/src/database"
 	"mitmcdn/src/download"
 
+	"github.com/things-go/go-socks5/statute"
 	"golang.org/x/net/proxy"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -125,43 +128,84 @@ func TestSOCKS5ProxyMITMCachesHTTPSRequests(t *testing.T) {
 	}
 }
 
-func setupSOCKS5ProxyForTest(t *testing.T, rules []config.CDNRule) (string, *gorm.DB, func()) {
-	t.Helper()
+func TestSOCKS5InterceptsIPLiteralBySNI(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte("ip-literal-body"))
+	}))
+	defer origin.Close()
 
-	dbPath := filepath.Join(t.TempDir(), "proxy-test.db")
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
-	if err != nil {
-		t.Fatalf("failed to open sqlite database: %v", err)
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{
+		Domain:        "localhost",
+		MatchPattern:  ".*",
+		DedupStrategy: "full_url",
+	}})
+	caDir := t.TempDir()
+	mitm.config.CA = config.CAConfig{
+		CertPath: filepath.Join(caDir, "ca-cert.pem"),
+		KeyPath:  filepath.Join(caDir, "ca-key.pem"),
 	}
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
 
-	if err := db.AutoMigrate(&database.File{}, &database.Log{}); err != nil {
-		t.Fatalf("failed to migrate database: %v", err)
-	}
+	// The client resolved the name itself and only sends the IP
+	originAddr := origin.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(originAddr)
+	conn, _ := sendSOCKS5Command(t, proxyAddr, statute.CommandConnect, originAddr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "GET /assets/ip-literal.bin HTTP/1.1\r\nHost: localhost:%s\r\nConnection: close\r\n\r\n", port)
 
-	cacheDir := filepath.Join(t.TempDir(), "cache")
-	cacheMgr, err := cache.NewManager(db, cacheDir, 50*1024*1024, 200*1024*1024, time.Hour)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
 	if err != nil {
-		t.Fatalf("failed to create cache manager: %v", err)
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if issuer := tlsConn.ConnectionState().PeerCertificates[0].Issuer.CommonName; issuer != "MitmCDN Root CA" {
+		t.Fatalf("leaf issuer = %q, want the MITM CA", issuer)
 	}
 
-	downloadClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-		Timeout: 15 * time.Second,
+	targetURL := "https://localhost:" + port + "/assets/ip-literal.bin"
+	if _, ok := waitForCachedFileByURL(t, db, targetURL, 5*time.Second); !ok {
+		t.Fatalf("expected cached file record for %s", targetURL)
 	}
+}
 
-	sched, err := download.NewSchedulerWithClient(cacheMgr, db, "", downloadClient)
+func TestSOCKS5IPLiteralServerSpeaksFirst(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("failed to create scheduler: %v", err)
+		t.Fatalf("failed to listen: %v", err)
 	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 ready\r\n"))
+			conn.Close()
+		}
+	}()
 
-	cfg := &config.Config{
-		CDNRules: rules,
+	mitm, _ := newMITMProxyForTest(t, []config.CDNRule{{Domain: "cdn.example.com", MatchPattern: ".*"}})
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	conn, _ := sendSOCKS5Command(t, proxyAddr, statute.CommandConnect, listener.Addr().String())
+	// The banner must arrive without waiting out the SNI peek
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || banner != "220 ready\r\n" {
+		t.Fatalf("banner = %q, %v", banner, err)
 	}
+}
 
-	mitm := NewMITMProxy(cfg, cacheMgr, sched, nil)
-	socksProxy, err := NewSOCKS5Proxy(cfg, cacheMgr, sched, mitm)
+func setupSOCKS5ProxyForTest(t *testing.T, rules []config.CDNRule) (string, *gorm.DB, func()) {
+	t.Helper()
+
+	mitm, db := newMITMProxyForTest(t, rules)
+	socksProxy, err := NewSOCKS5Proxy(mitm.config, mitm.cacheManager, mitm.downloadSched, mitm)
 	if err != nil {
 		t.Fatalf("failed to create SOCKS5 proxy: %v", err)
 	}
@@ -189,10 +233,54 @@ func setupSOCKS5ProxyForTest(t *testing.T, rules []config.CDNRule) (string, *gor
 	return listener.Addr().String(), db, cleanup
 }
 
+// newMITMProxyForTest builds a MITMProxy backed by a temporary database and cache
+func newMITMProxyForTest(t *testing.T, rules []config.CDNRule) (*MITMProxy, *gorm.DB) {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "proxy-test.db")
+	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite database: %v", err)
+	}
+
+	if err := db.AutoMigrate(&database.File{}, &database.Log{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	cacheMgr, err := cache.NewManager(db, cacheDir, 50*1024*1024, 200*1024*1024, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache manager: %v", err)
+	}
+
+	downloadClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 15 * time.Second,
+	}
+
+	sched, err := download.NewSchedulerWithClient(cacheMgr, db, "", downloadClient)
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %v", err)
+	}
+
+	cfg := &config.Config{
+		CDNRules: rules,
+	}
+
+	return NewMITMProxy(cfg, cacheMgr, sched, nil), db
+}
+
 func newSOCKS5HTTPClient(t *testing.T, proxyAddr string) *http.Client {
 	t.Helper()
+	return newSOCKS5HTTPClientWithAuth(t, proxyAddr, nil)
+}
+
+func newSOCKS5HTTPClientWithAuth(t *testing.T, proxyAddr string, auth *proxy.Auth) *http.Client {
+	t.Helper()
 
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
 	if err != nil {
 		t.Fatalf("failed to create SOCKS5 dialer: %v", err)
 	}
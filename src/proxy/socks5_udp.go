@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// maxUDPDatagram bounds a SOCKS5 UDP datagram including its header
+const maxUDPDatagram = 65535
+
+// udpOutbound sends client datagrams towards their destinations and returns replies
+type udpOutbound interface {
+	WriteTo(ctx context.Context, data []byte, dst statute.AddrSpec) error
+	ReadFrom(buf []byte) (int, statute.AddrSpec, error)
+	Close() error
+}
+
+// handleAssociate relays UDP for a SOCKS5 UDP ASSOCIATE request, directly or
+// through a SOCKS5 upstream proxy. The association ends when the TCP control
+// connection closes or no datagram has passed for udp_idle_timeout.
+func (p *SOCKS5Proxy) handleAssociate(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	tunnel := p.tunnelDialer()
+	if tunnel == nil {
+		if err := socks5.SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("tunnelling disabled")
+	}
+
+	var (
+		outbound udpOutbound
+		err      error
+	)
+	if p.config.UpstreamProxy != "" {
+		upstream, ok := socks5Upstream(p.config.UpstreamProxy)
+		if !ok {
+			if sendErr := socks5.SendReply(writer, statute.RepCommandNotSupported, nil); sendErr != nil {
+				return fmt.Errorf("failed to send reply: %w", sendErr)
+			}
+			return fmt.Errorf("UDP ASSOCIATE requires a socks5 upstream_proxy")
+		}
+		outbound, err = newUpstreamUDP(ctx, upstream, tunnel.connectTimeout)
+	} else {
+		outbound, err = newDirectUDP(tunnel)
+	}
+	if err != nil {
+		if sendErr := socks5.SendReply(writer, mapDialErrorToReply(err), nil); sendErr != nil {
+			return fmt.Errorf("failed to send reply: %w", sendErr)
+		}
+		return fmt.Errorf("UDP ASSOCIATE failed: %w", err)
+	}
+	defer outbound.Close()
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP(request.LocalAddr)})
+	if err != nil {
+		if sendErr := socks5.SendReply(writer, statute.RepServerFailure, nil); sendErr != nil {
+			return fmt.Errorf("failed to send reply: %w", sendErr)
+		}
+		return fmt.Errorf("failed to listen for UDP: %w", err)
+	}
+	defer relay.Close()
+
+	user := p.requestUser(request)
+	session := p.sessions.start("udp_associate", addrString(request.RemoteAddr), user.Name(), relay.LocalAddr().String())
+	defer p.sessions.end(session)
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, relay.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	// The association lives as long as the TCP control connection
+	go func() {
+		io.Copy(io.Discard, request.Reader)
+		relay.Close()
+		outbound.Close()
+	}()
+
+	association := &udpAssociation{
+		relay:    relay,
+		outbound: outbound,
+		session:  session,
+		tunnel:   tunnel,
+		user:     user,
+		clientIP: remoteIP(request.RemoteAddr),
+	}
+	if request.DestAddr != nil {
+		association.clientPort = request.DestAddr.Port
+	}
+	go association.relayReplies()
+	return association.relayRequests(ctx)
+}
+
+// udpAssociation relays datagrams between one SOCKS5 client and its destinations
+type udpAssociation struct {
+	relay      *net.UDPConn
+	outbound   udpOutbound
+	session    *socks5Session
+	tunnel     *tunnelDialer
+	user       *proxyUser
+	clientIP   net.IP // only datagrams from the control connection's host are accepted
+	clientPort int    // port announced in the request, 0 if unknown
+	client     atomic.Pointer[net.UDPAddr]
+}
+
+// relayRequests forwards datagrams from the client until the association ends
+func (a *udpAssociation) relayRequests(ctx context.Context) error {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		a.relay.SetReadDeadline(time.Now().Add(a.tunnel.udpIdleTimeout))
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if a.session.idleFor() < a.tunnel.udpIdleTimeout {
+					continue
+				}
+				return nil
+			}
+			if isIgnorableProxyError(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !a.acceptClient(src) {
+			a.session.dropped.Add(1)
+			continue
+		}
+
+		datagram, err := statute.ParseDatagram(buf[:n])
+		if err != nil || datagram.Frag != 0 {
+			// Fragmentation is optional in RFC 1928 and not supported
+			a.session.dropped.Add(1)
+			continue
+		}
+		if !a.tunnel.allowedAddress(addrSpecHostPort(datagram.DstAddr)) {
+			a.session.dropped.Add(1)
+			a.tunnel.stats.denied.Add(1)
+			continue
+		}
+		if err := a.outbound.WriteTo(ctx, datagram.Data, datagram.DstAddr); err != nil {
+			if errors.Is(err, errDestinationDenied) {
+				a.tunnel.stats.denied.Add(1)
+			}
+			a.session.dropped.Add(1)
+			continue
+		}
+
+		a.session.touch()
+		a.session.packetsUp.Add(1)
+		a.session.bytesUp.Add(int64(len(datagram.Data)))
+	}
+}
+
+// acceptClient checks a datagram source against the control connection and
+// pins the association to the first accepted source address
+func (a *udpAssociation) acceptClient(src *net.UDPAddr) bool {
+	if client := a.client.Load(); client != nil {
+		return client.IP.Equal(src.IP) && client.Port == src.Port
+	}
+	if a.clientIP != nil && !a.clientIP.Equal(src.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != src.Port {
+		return false
+	}
+	a.client.Store(src)
+	return true
+}
+
+// relayReplies returns datagrams from destinations to the client
+func (a *udpAssociation) relayReplies() {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, src, err := a.outbound.ReadFrom(buf)
+		if err != nil {
+			if !isIgnorableProxyError(err) {
+				log.Printf("SOCKS5 UDP association %d: %v", a.session.id, err)
+			}
+			a.relay.Close()
+			return
+		}
+		client := a.client.Load()
+		if client == nil {
+			continue
+		}
+
+		datagram := statute.Datagram{DstAddr: src, Data: buf[:n]}
+		if _, err := a.relay.WriteToUDP(datagram.Bytes(), client); err != nil {
+			a.session.dropped.Add(1)
+			continue
+		}
+
+		a.session.touch()
+		a.session.packetsDown.Add(1)
+		a.session.bytesDown.Add(int64(n))
+		if a.user != nil {
+			a.user.bytesSent.Add(int64(n))
+		}
+	}
+}
+
+// directUDP sends datagrams from a local socket, accepting replies only from
+// addresses the client has sent to
+type directUDP struct {
+	conn   *net.UDPConn
+	tunnel *tunnelDialer
+	mu     sync.Mutex
+	sent   map[string]bool
+}
+
+func newDirectUDP(tunnel *tunnelDialer) (*directUDP, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &directUDP{conn: conn, tunnel: tunnel, sent: make(map[string]bool)}, nil
+}
+
+func (u *directUDP) WriteTo(ctx context.Context, data []byte, dst statute.AddrSpec) error {
+	ip := dst.IP
+	if dst.FQDN != "" {
+		ips, err := u.tunnel.resolver.LookupIP(ctx, dst.FQDN)
+		if err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("no addresses for %s", dst.FQDN)
+		}
+		ip = ips[0]
+	}
+	// Re-check the resolved address so a permitted name cannot reach a denied network
+	if !u.tunnel.acl.allowed("", ip, dst.Port) {
+		return fmt.Errorf("%w: %s", errDestinationDenied, addrSpecHostPort(dst))
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: dst.Port}
+	u.mu.Lock()
+	u.sent[addr.String()] = true
+	u.mu.Unlock()
+
+	_, err := u.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (u *directUDP) ReadFrom(buf []byte) (int, statute.AddrSpec, error) {
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, statute.AddrSpec{}, err
+		}
+		u.mu.Lock()
+		known := u.sent[addr.String()]
+		u.mu.Unlock()
+		if known {
+			return n, addrSpecFromAddr(addr), nil
+		}
+	}
+}
+
+func (u *directUDP) Close() error {
+	return u.conn.Close()
+}
+
+// upstreamUDP relays datagrams through a SOCKS5 upstream's UDP ASSOCIATE
+type upstreamUDP struct {
+	control net.Conn
+	conn    *net.UDPConn
+}
+
+func newUpstreamUDP(ctx context.Context, upstream *url.URL, timeout time.Duration) (*upstreamUDP, error) {
+	control, reply, err := dialSOCKS5Upstream(ctx, upstream, timeout, statute.CommandAssociate,
+		statute.AddrSpec{AddrType: statute.ATYPIPv4, IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", addrSpecHostPort(upstreamBindAddress(reply.BndAddr, control)))
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	// The upstream ends the association by closing the control connection
+	go func() {
+		io.Copy(io.Discard, control)
+		conn.Close()
+	}()
+	return &upstreamUDP{control: control, conn: conn}, nil
+}
+
+func (u *upstreamUDP) WriteTo(_ context.Context, data []byte, dst statute.AddrSpec) error {
+	datagram := statute.Datagram{DstAddr: dst, Data: data}
+	_, err := u.conn.Write(datagram.Bytes())
+	return err
+}
+
+func (u *upstreamUDP) ReadFrom(buf []byte) (int, statute.AddrSpec, error) {
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			return 0, statute.AddrSpec{}, err
+		}
+		datagram, err := statute.ParseDatagram(buf[:n])
+		if err != nil || datagram.Frag != 0 {
+			continue
+		}
+		return copy(buf, datagram.Data), datagram.DstAddr, nil
+	}
+}
+
+func (u *upstreamUDP) Close() error {
+	u.control.Close()
+	return u.conn.Close()
+}
+
+// upstreamBindAddress replaces an unspecified address in an upstream reply
+// with the address the upstream was reached on
+func upstreamBindAddress(bind statute.AddrSpec, control net.Conn) statute.AddrSpec {
+	if bind.FQDN == "" && (bind.IP == nil || bind.IP.IsUnspecified()) {
+		bind.IP = remoteIP(control.RemoteAddr())
+		bind.AddrType = statute.ATYPIPv6
+		if ip4 := bind.IP.To4(); ip4 != nil {
+			bind.IP, bind.AddrType = ip4, statute.ATYPIPv4
+		}
+	}
+	return bind
+}
+
+// localIP returns the IP of a listener-side address, or nil
+func localIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+// remoteIP returns the IP of a TCP peer address, or nil
+func remoteIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// addrString formats a possibly nil address
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
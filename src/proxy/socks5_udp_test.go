@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// startUDPEchoServer answers every datagram with its upper-cased payload
+func startUDPEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// startSOCKS5ForTest serves a SOCKS5 proxy backed by mitm on a loopback port
+func startSOCKS5ForTest(t *testing.T, mitm *MITMProxy) (*SOCKS5Proxy, string) {
+	t.Helper()
+
+	socksProxy, err := NewSOCKS5Proxy(mitm.config, mitm.cacheManager, mitm.downloadSched, mitm)
+	if err != nil {
+		t.Fatalf("failed to create SOCKS5 proxy: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go socksProxy.Serve(listener)
+	return socksProxy, listener.Addr().String()
+}
+
+// sendSOCKS5Command opens a control connection and returns the first reply
+func sendSOCKS5Command(t *testing.T, proxyAddr string, command byte, dst string) (net.Conn, statute.Reply) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	spec, err := statute.ParseAddrSpec(dst)
+	if err != nil {
+		t.Fatalf("invalid destination %s: %v", dst, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := negotiateSOCKS5(conn, nil, command, spec)
+	if err != nil {
+		t.Fatalf("SOCKS5 command failed: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reply
+}
+
+// exchangeUDP sends payload to dst through a SOCKS5 UDP relay and returns the reply datagram
+func exchangeUDP(t *testing.T, client *net.UDPConn, relay statute.AddrSpec, dst *net.UDPAddr, payload string) (statute.Datagram, error) {
+	t.Helper()
+
+	datagram, err := statute.NewDatagram(dst.String(), []byte(payload))
+	if err != nil {
+		t.Fatalf("failed to build datagram: %v", err)
+	}
+	relayAddr := &net.UDPAddr{IP: relay.IP, Port: relay.Port}
+	if _, err := client.WriteToUDP(datagram.Bytes(), relayAddr); err != nil {
+		t.Fatalf("failed to send datagram: %v", err)
+	}
+
+	buf := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		return statute.Datagram{}, err
+	}
+	return statute.ParseDatagram(buf[:n])
+}
+
+func newUDPClientForTest(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSOCKS5UDPAssociateDirect(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	mitm, _ := newMITMProxyForTest(t, nil)
+	socksProxy, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	control, reply := sendSOCKS5Command(t, proxyAddr, statute.CommandAssociate, "0.0.0.0:0")
+	client := newUDPClientForTest(t)
+
+	for _, payload := range []string{"ping", "pong"} {
+		response, err := exchangeUDP(t, client, reply.BndAddr, echo, payload)
+		if err != nil {
+			t.Fatalf("no UDP reply for %q: %v", payload, err)
+		}
+		if string(response.Data) != strings.ToUpper(payload) || response.DstAddr.Port != echo.Port {
+			t.Fatalf("reply = %q from %v, want %q from %v", response.Data, response.DstAddr.String(), strings.ToUpper(payload), echo)
+		}
+	}
+
+	status := socksProxy.SessionStats().Snapshot()
+	if status.ActiveUDP != 1 || len(status.Sessions) != 1 {
+		t.Fatalf("unexpected session status: %+v", status)
+	}
+	if session := status.Sessions[0]; session.PacketsUp != 2 || session.PacketsDown != 2 || session.BytesUp != 8 || session.BytesDown != 8 {
+		t.Errorf("unexpected session counters: %+v", session)
+	}
+
+	// Closing the control connection ends the association
+	control.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && socksProxy.SessionStats().Snapshot().ActiveUDP != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := socksProxy.SessionStats().Snapshot(); status.ActiveUDP != 0 || status.TotalUDP != 1 {
+		t.Errorf("association should have ended: %+v", status)
+	}
+}
+
+func TestSOCKS5UDPAssociateDeniedDestination(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	mitm, _ := newMITMProxyForTest(t, nil)
+	var err error
+	mitm.tunnel, err = newTunnelDialer(config.TunnelConfig{Deny: []string{"127.0.0.0/8"}}, nil)
+	if err != nil {
+		t.Fatalf("newTunnelDialer() error = %v", err)
+	}
+	socksProxy, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	_, reply := sendSOCKS5Command(t, proxyAddr, statute.CommandAssociate, "0.0.0.0:0")
+	client := newUDPClientForTest(t)
+
+	if _, err := exchangeUDP(t, client, reply.BndAddr, echo, "ping"); err == nil {
+		t.Fatal("datagram to a denied destination should not be relayed")
+	}
+	if status := socksProxy.SessionStats().Snapshot(); len(status.Sessions) != 1 || status.Sessions[0].Dropped != 1 {
+		t.Errorf("unexpected session status: %+v", status)
+	}
+}
+
+func TestSOCKS5UDPAssociateIdleTimeout(t *testing.T) {
+	mitm, _ := newMITMProxyForTest(t, nil)
+	mitm.tunnel.udpIdleTimeout = 200 * time.Millisecond
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	control, _ := sendSOCKS5Command(t, proxyAddr, statute.CommandAssociate, "0.0.0.0:0")
+
+	// The server closes the control connection once the association is idle
+	control.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if _, err := control.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the control connection to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle association closed after %v", elapsed)
+	}
+}
+
+func TestSOCKS5UDPAssociateThroughUpstream(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	upstreamMITM, _ := newMITMProxyForTest(t, nil)
+	upstreamProxy, upstreamAddr := startSOCKS5ForTest(t, upstreamMITM)
+
+	mitm, _ := newMITMProxyForTest(t, nil)
+	mitm.config.UpstreamProxy = "socks5://" + upstreamAddr
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	_, reply := sendSOCKS5Command(t, proxyAddr, statute.CommandAssociate, "0.0.0.0:0")
+	client := newUDPClientForTest(t)
+
+	response, err := exchangeUDP(t, client, reply.BndAddr, echo, "chained")
+	if err != nil {
+		t.Fatalf("no UDP reply through upstream: %v", err)
+	}
+	if string(response.Data) != "CHAINED" {
+		t.Fatalf("reply = %q, want CHAINED", response.Data)
+	}
+	if status := upstreamProxy.SessionStats().Snapshot(); status.ActiveUDP != 1 {
+		t.Errorf("upstream should relay the association: %+v", status)
+	}
+}
+
+func TestSOCKS5UDPAssociateRejectsHTTPUpstream(t *testing.T) {
+	mitm, _ := newMITMProxyForTest(t, nil)
+	mitm.config.UpstreamProxy = "http://127.0.0.1:1"
+	_, proxyAddr := startSOCKS5ForTest(t, mitm)
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reply, err := negotiateSOCKS5(conn, nil, statute.CommandAssociate, statute.AddrSpec{AddrType: statute.ATYPIPv4, IP: net.IPv4zero})
+	if err == nil || reply.Response != statute.RepCommandNotSupported {
+		t.Fatalf("reply = %d, %v; want command not supported", reply.Response, err)
+	}
+}
@@ -21,6 +21,10 @@ type StatusHandler struct {
 	db            *gorm.DB
 	cacheManager  *cache.Manager
 	downloadSched *download.Scheduler
+	tunnelStats   *TunnelStats
+	dnsServer     *DNSServer
+	users         *userStore
+	socks5Stats   *SessionStats
 	startTime     time.Time
 	version       string
 }
@@ -57,6 +61,10 @@ type StatusResponse struct {
 	UptimeSeconds float64               `json:"uptime_seconds"`
 	Cache        CacheStatus            `json:"cache"`
 	Downloads    DownloadStatus         `json:"downloads"`
+	Tunnels      TunnelStatus           `json:"tunnels"`
+	SOCKS5       SessionsStatus         `json:"socks5_sessions"`
+	DNS          *DNSStatus             `json:"dns,omitempty"`
+	Users        []UserStatus           `json:"users,omitempty"`
 	Files        []FileInfo             `json:"files"`
 }
 
@@ -92,6 +100,10 @@ type FileInfo struct {
 	Progress       float64   `json:"progress"`
 	CreatedAt      time.Time `json:"created_at"`
 	LastAccessed   time.Time `json:"last_accessed"`
+	RequestedBy    string    `json:"requested_by,omitempty"`
+	Kind           string    `json:"kind,omitempty"`
+	Segments       int64     `json:"segments,omitempty"`
+	SegmentsComplete int64   `json:"segments_complete,omitempty"`
 }
 
 // HandleAPIStatus handles /api/status JSON endpoint
@@ -276,7 +288,52 @@ func (h *StatusHandler) HandleStatusPage(w http.ResponseWriter, r *http.Request)
                 <div class="value">{{.Downloads.TotalDownloadedHuman}}</div>
                 <div class="label">{{.Downloads.FailedTasks}} failed</div>
             </div>
+            <div class="stat-card">
+                <h3>Direct Tunnels</h3>
+                <div class="value">{{.Tunnels.ActiveTunnels}}</div>
+                <div class="label">{{.Tunnels.TotalTunnels}} total, {{bytes .Tunnels.BytesUp}} up / {{bytes .Tunnels.BytesDown}} down, {{.Tunnels.Denied}} denied</div>
+            </div>
+            <div class="stat-card">
+                <h3>SOCKS5 UDP / BIND</h3>
+                <div class="value">{{.SOCKS5.ActiveUDP}} / {{.SOCKS5.ActiveBind}}</div>
+                <div class="label">{{.SOCKS5.TotalUDP}} associations, {{.SOCKS5.TotalBind}} binds total</div>
+            </div>
+            {{if .DNS}}
+            <div class="stat-card">
+                <h3>DNS Queries</h3>
+                <div class="value">{{.DNS.Queries}}</div>
+                <div class="label">{{.DNS.Local}} answered locally, {{.DNS.CacheHits}} cached, {{.DNS.Forwarded}} forwarded, {{.DNS.Failed}} failed</div>
+            </div>
+            {{end}}
+        </div>
+
+        {{if .Users}}
+        <div class="files-section">
+            <h2>👤 Users</h2>
+            <table>
+                <thead>
+                    <tr>
+                        <th>Username</th>
+                        <th>Requests</th>
+                        <th>Cache Hits</th>
+                        <th>Sent</th>
+                        <th>Tunnels</th>
+                    </tr>
+                </thead>
+                <tbody>
+                    {{range .Users}}
+                    <tr>
+                        <td><strong>{{.Username}}</strong></td>
+                        <td>{{.Requests}}</td>
+                        <td>{{.CacheHits}}</td>
+                        <td>{{bytes .BytesSent}}</td>
+                        <td>{{.Tunnels}}</td>
+                    </tr>
+                    {{end}}
+                </tbody>
+            </table>
         </div>
+        {{end}}
 
         <div class="files-section">
             <h2>📁 Cached Files</h2>
@@ -293,14 +350,14 @@ func (h *StatusHandler) HandleStatusPage(w http.ResponseWriter, r *http.Request)
                 <tbody>
                     {{range .Files}}
                     <tr>
-                        <td><strong>{{.Filename}}</strong><br><small style="color:#666;">{{.URL}}</small></td>
+                        <td><strong>{{.Filename}}</strong><br><small style="color:#666;">{{.URL}}</small>{{if .RequestedBy}}<br><small style="color:#666;">requested by {{.RequestedBy}}</small>{{end}}</td>
                         <td>{{.SizeHuman}}</td>
                         <td><span class="status-badge status-{{.Status}}">{{.Status}}</span></td>
                         <td>
                             <div class="progress-bar">
                                 <div class="progress-fill" style="width: {{.Progress}}%"></div>
                             </div>
-                            <small>{{.DownloadedHuman}} / {{.SizeHuman}}</small>
+                            <small>{{.DownloadedHuman}} / {{.SizeHuman}}</small>{{if .Segments}}<br><small>{{.Kind}}: {{.SegmentsComplete}}/{{.Segments}} segments</small>{{end}}{{if eq .Kind "hls"}}<br><small><a href="/cache/hls/{{.Hash}}/player">play</a> · <a href="/cache/hls/{{.Hash}}/index.m3u8">m3u8</a> · <a href="/cache/hls/{{.Hash}}/video.ts">.ts</a></small>{{end}}
                         </td>
                         <td>{{.LastAccessed.Format "2006-01-02 15:04:05"}}</td>
                     </tr>
@@ -317,7 +374,7 @@ func (h *StatusHandler) HandleStatusPage(w http.ResponseWriter, r *http.Request)
 </body>
 </html>`
 
-	t, err := template.New("status").Parse(tmpl)
+	t, err := template.New("status").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(tmpl)
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 		return
@@ -355,6 +412,10 @@ func (h *StatusHandler) getStatus() StatusResponse {
 		UptimeSeconds: uptime.Seconds(),
 		Cache:         cacheStats,
 		Downloads:     downloadStats,
+		Tunnels:       h.tunnelStats.Snapshot(),
+		SOCKS5:        h.socks5Stats.Snapshot(),
+		DNS:           h.dnsServer.Status(),
+		Users:         h.users.Status(),
 		Files:         files,
 	}
 }
@@ -419,12 +480,31 @@ func (h *StatusHandler) getDownloadStats() DownloadStatus {
 // getFileList gets list of files with details
 func (h *StatusHandler) getFileList() []FileInfo {
 	var dbFiles []database.File
-	h.db.Order("last_accessed_at DESC").Limit(50).Find(&dbFiles)
+	// Segments and media playlists are listed under their root playlist
+	h.db.Where("parent_hash = '' OR parent_hash IS NULL").Order("last_accessed_at DESC").Limit(50).Find(&dbFiles)
 	
 	files := make([]FileInfo, 0, len(dbFiles))
 	for _, file := range dbFiles {
+		info := FileInfo{Kind: file.Kind}
+		if file.Kind != "" {
+			if group, err := h.cacheManager.PrefetchProgress(file.FileHash); err == nil && group.Segments > 0 {
+				file.FileSize, file.DownloadedBytes = group.Size, group.Downloaded
+				info.Segments, info.SegmentsComplete = group.Segments, group.Complete
+				switch {
+				case group.Complete == group.Segments:
+					file.DownloadStatus = "complete"
+				case group.Complete+group.Failed == group.Segments:
+					file.DownloadStatus = "failed"
+				default:
+					file.DownloadStatus = "downloading"
+				}
+			}
+		}
+
 		progress := 0.0
-		if file.FileSize > 0 {
+		if info.Segments > 0 {
+			progress = float64(info.SegmentsComplete) / float64(info.Segments) * 100
+		} else if file.FileSize > 0 {
 			progress = float64(file.DownloadedBytes) / float64(file.FileSize) * 100
 		}
 		
@@ -440,6 +520,10 @@ func (h *StatusHandler) getFileList() []FileInfo {
 			Progress:        progress,
 			CreatedAt:       file.CreatedAt,
 			LastAccessed:    file.LastAccessedAt,
+			RequestedBy:     file.RequestedBy,
+			Kind:            info.Kind,
+			Segments:        info.Segments,
+			SegmentsComplete: info.SegmentsComplete,
 		})
 	}
 	
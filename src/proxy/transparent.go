@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errTransparentUnsupported is returned when transparent mode is requested on a platform without SO_ORIGINAL_DST
+var errTransparentUnsupported = errors.New("transparent proxy mode is only supported on Linux")
+
+// transparentPeekTimeout bounds how long a redirected client may take to send
+// its first bytes; server-speaks-first protocols are spliced once it expires
+const transparentPeekTimeout = 3 * time.Second
+
+// handleTransparentConnection handles a connection redirected by iptables/nftables.
+// Connections addressed to the listener itself get the normal protocol detection.
+func (s *UnifiedServer) handleTransparentConnection(conn net.Conn) {
+	dst, err := originalDestination(conn)
+	if err != nil {
+		log.Printf("Transparent proxy: failed to get original destination: %v", err)
+		conn.Close()
+		return
+	}
+
+	if s.isListenerAddress(dst) {
+		s.handleConnection(conn)
+		return
+	}
+
+	s.serveTransparent(conn, dst)
+}
+
+// isListenerAddress reports whether dst is this server rather than a redirected destination
+func (s *UnifiedServer) isListenerAddress(dst *net.TCPAddr) bool {
+	if s.listener == nil {
+		return false
+	}
+	listenAddr, ok := s.listener.Addr().(*net.TCPAddr)
+	if !ok || dst.Port != listenAddr.Port {
+		return false
+	}
+	if !listenAddr.IP.IsUnspecified() {
+		return dst.IP.Equal(listenAddr.IP)
+	}
+	return isLocalIP(dst.IP)
+}
+
+// isLocalIP reports whether ip is one of this host's addresses, which a
+// listener on the unspecified address accepts connections to
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Transparent proxy: failed to list interface addresses: %v", err)
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTransparent routes a redirected connection to its original destination dst.
+// The hostname comes from the TLS SNI or the HTTP Host header; intercepted hosts go
+// through the MITM pipeline and everything else is spliced to dst unchanged,
+// unless users are configured and [tunnel] allow does not bound the splicing.
+func (s *UnifiedServer) serveTransparent(conn net.Conn, dst *net.TCPAddr) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	host, tlsDetected, replay := sniffTransparentHost(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if host != "" && s.mitmProxy.shouldIntercept(net.JoinHostPort(host, strconv.Itoa(dst.Port))) {
+		if err := s.mitmProxy.interceptConnection(context.Background(), replay, host, tlsDetected, dst.Port); err != nil && !isIgnorableProxyError(err) {
+			log.Printf("Transparent proxy: intercepted connection to %s failed: %v", host, err)
+		}
+		return
+	}
+
+	tunnel := s.mitmProxy.tunnel
+	if tunnel == nil {
+		return
+	}
+	if !s.mitmProxy.tunnelsWithoutAuth() {
+		tunnel.stats.denied.Add(1)
+		log.Printf("Transparent proxy: refusing to splice %s without proxy authentication", dst)
+		return
+	}
+	if host != "" && !tunnel.allowedAddress(net.JoinHostPort(host, strconv.Itoa(dst.Port))) {
+		tunnel.stats.denied.Add(1)
+		return
+	}
+
+	targetConn, err := tunnel.Dial(context.Background(), dst.String())
+	if err != nil {
+		log.Printf("Transparent proxy: failed to connect to %s: %v", dst, err)
+		return
+	}
+	defer targetConn.Close()
+
+	tunnel.Relay(replay, replay, targetConn)
+}
+
+// sniffTransparentHost peeks at the first bytes of a redirected connection and
+// extracts the requested hostname. The returned connection replays everything
+// that was read, so it can still be spliced when no hostname is found.
+func sniffTransparentHost(conn net.Conn) (string, bool, *peekConn) {
+	first := make([]byte, 1)
+	if n, _ := conn.Read(first); n == 0 {
+		return "", false, &peekConn{Conn: conn}
+	}
+	prefixed := &peekConn{Conn: conn, buffer: first}
+
+	if first[0] == 0x16 { // TLS handshake record type
+		serverName, replay, err := peekClientHello(prefixed)
+		if err != nil {
+			return "", true, replay
+		}
+		return serverName, true, replay
+	}
+
+	var consumed bytes.Buffer
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(prefixed, &consumed)))
+	replay := &peekConn{Conn: prefixed, buffer: consumed.Bytes()}
+	if err != nil {
+		return "", false, replay
+	}
+	return hostWithoutPort(req.Host), false, replay
+}
+
+// interceptConnection terminates TLS if needed and serves the connection
+// through the MITM pipeline as host:port
+func (p *MITMProxy) interceptConnection(ctx context.Context, conn net.Conn, host string, tlsDetected bool, port int) error {
+	if !tlsDetected {
+		return p.serveMITMConnection(ctx, conn, "http", host, port)
+	}
+
+	cert, err := p.getCertificate(host)
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return p.serveMITMConnection(ctx, tlsConn, "https", host, port)
+}
+
+// sniffsIPLiteral reports whether a tunnel to host should peek for the real
+// hostname: host is an IP address and there are CDN rules it could match
+func (p *MITMProxy) sniffsIPLiteral(host string) bool {
+	return p.rules.Len() > 0 && net.ParseIP(strings.Trim(host, "[]")) != nil
+}
+
+// relaySniffed relays a tunnel whose destination was given as an IP address.
+// The client's first bytes are peeked for a TLS SNI or HTTP Host header and,
+// when that hostname matches a CDN rule, the connection is intercepted as that
+// host and target is dropped. The peek ends early if the origin speaks first.
+func (p *MITMProxy) relaySniffed(ctx context.Context, client net.Conn, clientReader io.Reader, target net.Conn, port int, user *proxyUser) error {
+	originFirst := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := target.Read(buf)
+		if n > 0 {
+			client.SetReadDeadline(time.Now())
+		}
+		originFirst <- buf[:n]
+	}()
+
+	client.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	host, tlsDetected, replay := sniffTransparentHost(&socksBufferedConn{Conn: client, reader: clientReader})
+
+	// Stop the origin read and keep whatever it returned for the relay
+	target.SetReadDeadline(time.Now())
+	prefix := <-originFirst
+	target.SetReadDeadline(time.Time{})
+	client.SetReadDeadline(time.Time{})
+
+	if host != "" && p.shouldInterceptFor(net.JoinHostPort(host, strconv.Itoa(port)), user) {
+		target.Close()
+		return p.interceptConnection(ctx, replay, host, tlsDetected, port)
+	}
+	if host != "" && !p.tunnel.allowedAddress(net.JoinHostPort(host, strconv.Itoa(port))) {
+		p.tunnel.stats.denied.Add(1)
+		return fmt.Errorf("%w: %s", errDestinationDenied, host)
+	}
+	return p.tunnel.Relay(user.limitWriter(client), replay, &peekConn{Conn: target, buffer: prefix})
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+)
+
+// transparentSupported reports whether this platform can run proxy_mode = "transparent"
+const transparentSupported = true
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	ip6tSOOriginalDst = 80 // IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT from linux/in6.h
+)
+
+// originalDestination returns the address a redirected client originally dialled.
+// REDIRECT/DNAT connections are looked up in conntrack via SO_ORIGINAL_DST; TPROXY
+// connections keep the original destination as their local address.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	local, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %v", tcpConn.LocalAddr())
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in fits in the 20 bytes of an ipv6_mreq
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			raw := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+				Port: int(binary.BigEndian.Uint16(raw[2:4])),
+			}
+			return
+		}
+
+		// sockaddr_in6 fits in an ip6_mtuinfo
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSOOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		dst = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		// No conntrack entry: either TPROXY or a direct connection to the listener
+		return local, nil
+	}
+	return dst, nil
+}
+
+// listenTransparent opens the listener for transparent mode, enabling
+// IP_TRANSPARENT when permitted so TPROXY rules can deliver to it
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if sockErr == nil && network != "tcp4" {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				log.Printf("Transparent proxy: IP_TRANSPARENT unavailable (%v); TPROXY rules will not work, REDIRECT still does", sockErr)
+			}
+			return nil
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
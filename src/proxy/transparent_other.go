@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// transparentSupported reports whether this platform can run proxy_mode = "transparent"
+const transparentSupported = false
+
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+)
+
+// dialTransparentForTest returns a client connection whose server side is
+// handled by serveTransparent as if it had been redirected from dst
+func dialTransparentForTest(t *testing.T, server *UnifiedServer, dst string) net.Conn {
+	t.Helper()
+
+	dstAddr, err := net.ResolveTCPAddr("tcp", dst)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", dst, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.serveTransparent(conn, dstAddr)
+	}()
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func TestTransparentSplicesUnknownProtocol(t *testing.T) {
+	echoAddr := startHalfCloseEchoServer(t)
+	server, _ := startUnifiedServerForTest(t, &config.Config{ProxyMode: "transparent"})
+
+	conn := dialTransparentForTest(t, server, echoAddr)
+	conn.Write([]byte("hello transparent"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(reply) != "HELLO TRANSPARENT" {
+		t.Fatalf("reply = %q, want %q", reply, "HELLO TRANSPARENT")
+	}
+}
+
+func TestTransparentSplicesUnmatchedTLS(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin-tls"))
+	}))
+	defer origin.Close()
+
+	server, _ := startUnifiedServerForTest(t, &config.Config{
+		ProxyMode: "transparent",
+		CDNRules:  []config.CDNRule{{Domain: "cdn.example.com"}},
+	})
+
+	conn := dialTransparentForTest(t, server, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "other.example.org", InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: other.example.org\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "origin-tls" {
+		t.Fatalf("body = %q, want origin response", body)
+	}
+	if issuer := tlsConn.ConnectionState().PeerCertificates[0].Issuer.CommonName; issuer == "MitmCDN Root CA" {
+		t.Fatal("unmatched TLS should not be intercepted")
+	}
+}
+
+func TestTransparentRequiresTunnelAllowWithUsers(t *testing.T) {
+	echoAddr := startHalfCloseEchoServer(t)
+	users := []config.UserConfig{{Username: "alice", PasswordHash: hashPasswordForTest(t, "secret")}}
+
+	for _, allow := range [][]string{nil, {"127.0.0.1"}} {
+		server, _ := startUnifiedServerForTest(t, &config.Config{ProxyMode: "transparent", Users: users, Tunnel: config.TunnelConfig{Allow: allow}})
+
+		conn := dialTransparentForTest(t, server, echoAddr)
+		conn.Write([]byte("hello transparent"))
+		conn.(*net.TCPConn).CloseWrite()
+		reply, _ := io.ReadAll(conn)
+
+		want := ""
+		if allow != nil {
+			want = "HELLO TRANSPARENT"
+		}
+		if string(reply) != want {
+			t.Errorf("allow %v: reply = %q, want %q", allow, reply, want)
+		}
+	}
+}
+
+func TestTransparentInterceptsByHostHeader(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("transparent-http-body"))
+	}))
+	defer origin.Close()
+
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatalf("failed to parse origin URL: %v", err)
+	}
+
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{
+		Domain:        originURL.Hostname(),
+		MatchPattern:  ".*",
+		DedupStrategy: "full_url",
+	}})
+	server := &UnifiedServer{config: mitm.config, mitmProxy: mitm}
+
+	conn := dialTransparentForTest(t, server, originURL.Host)
+	fmt.Fprintf(conn, "GET /assets/transparent.bin HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", originURL.Host)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	targetURL := origin.URL + "/assets/transparent.bin"
+	if _, ok := waitForCachedFileByURL(t, db, targetURL, 5*time.Second); !ok {
+		t.Fatalf("expected cached file record for %s", targetURL)
+	}
+}
+
+func TestTransparentInterceptsBySNI(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("transparent-https-body"))
+	}))
+	defer origin.Close()
+
+	mitm, db := newMITMProxyForTest(t, []config.CDNRule{{
+		Domain:        "localhost",
+		MatchPattern:  ".*",
+		DedupStrategy: "full_url",
+	}})
+	caDir := t.TempDir()
+	mitm.config.CA = config.CAConfig{
+		CertPath: filepath.Join(caDir, "ca-cert.pem"),
+		KeyPath:  filepath.Join(caDir, "ca-key.pem"),
+	}
+	server := &UnifiedServer{config: mitm.config, mitmProxy: mitm}
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	conn := dialTransparentForTest(t, server, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "GET /assets/transparent.bin HTTP/1.1\r\nHost: localhost:%s\r\nConnection: close\r\n\r\n", port)
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if issuer := tlsConn.ConnectionState().PeerCertificates[0].Issuer.CommonName; issuer != "MitmCDN Root CA" {
+		t.Fatalf("leaf issuer = %q, want the MITM CA", issuer)
+	}
+
+	targetURL := "https://localhost:" + port + "/assets/transparent.bin"
+	if _, ok := waitForCachedFileByURL(t, db, targetURL, 5*time.Second); !ok {
+		t.Fatalf("expected cached file record for %s", targetURL)
+	}
+}
+
+func TestIsListenerAddress(t *testing.T) {
+	listen := func(addr string) *UnifiedServer {
+		t.Helper()
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return &UnifiedServer{listener: listener}
+	}
+	port := func(server *UnifiedServer) int {
+		return server.listener.Addr().(*net.TCPAddr).Port
+	}
+
+	loopback := listen("127.0.0.1:0")
+	wildcard := listen("0.0.0.0:0")
+	tests := []struct {
+		server *UnifiedServer
+		dst    *net.TCPAddr
+		want   bool
+	}{
+		{loopback, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port(loopback)}, true},
+		{loopback, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port(loopback) + 1}, false},
+		// A remote host serving on the same port is a redirected destination
+		{loopback, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: port(loopback)}, false},
+		{wildcard, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port(wildcard)}, true},
+		{wildcard, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: port(wildcard)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.server.isListenerAddress(tt.dst); got != tt.want {
+			t.Errorf("isListenerAddress(%s) on %s = %v, want %v", tt.dst, tt.server.listener.Addr(), got, tt.want)
+		}
+	}
+
+	// Any address of a local interface reaches a listener on 0.0.0.0
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			dst := &net.TCPAddr{IP: ipNet.IP, Port: port(wildcard)}
+			if !wildcard.isListenerAddress(dst) {
+				t.Errorf("isListenerAddress(%s) = false for a local interface address", dst)
+			}
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"mitmcdn/src/config"
+	"mitmcdn/src/resolver"
+)
+
+// errDestinationDenied is returned when a tunnel destination is blocked by the ACL
+var errDestinationDenied = errors.New("destination not allowed")
+
+// destinationRule is one compiled allow/deny entry
+type destinationRule struct {
+	host     string     // exact host, or suffix when wildcard is set
+	wildcard bool       // "*.example.com": subdomains only
+	network  *net.IPNet // CIDR or single IP
+	port     int        // 0 matches any port
+}
+
+// parseDestinationRule parses "host", "*.host", "1.2.3.4", "10.0.0.0/8" with an optional ":port"
+func parseDestinationRule(entry string) (destinationRule, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return destinationRule{}, errors.New("empty destination rule")
+	}
+
+	var rule destinationRule
+	if host, port, err := net.SplitHostPort(entry); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return destinationRule{}, fmt.Errorf("invalid port in destination rule %q", entry)
+		}
+		entry = host
+		rule.port = p
+	}
+
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		rule.network = network
+		return rule, nil
+	}
+	if ip := net.ParseIP(strings.Trim(entry, "[]")); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return rule, nil
+	}
+
+	if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+		rule.host = suffix
+		rule.wildcard = true
+	} else {
+		rule.host = strings.TrimPrefix(entry, ".")
+	}
+	return rule, nil
+}
+
+// matchHost reports whether a hostname matches a name-based rule
+func (r destinationRule) matchHost(host string, port int) bool {
+	if r.network != nil || (r.port != 0 && r.port != port) {
+		return false
+	}
+	if r.wildcard {
+		return strings.HasSuffix(host, "."+r.host)
+	}
+	return host == r.host || strings.HasSuffix(host, "."+r.host)
+}
+
+// matchIP reports whether an address matches an IP/CIDR rule
+func (r destinationRule) matchIP(ip net.IP, port int) bool {
+	if r.network == nil || (r.port != 0 && r.port != port) {
+		return false
+	}
+	return r.network.Contains(ip)
+}
+
+// destinationACL decides which destinations may be tunnelled
+type destinationACL struct {
+	allow []destinationRule
+	deny  []destinationRule
+}
+
+func newDestinationACL(allow, deny []string) (*destinationACL, error) {
+	acl := &destinationACL{}
+	for _, entry := range allow {
+		rule, err := parseDestinationRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		acl.allow = append(acl.allow, rule)
+	}
+	for _, entry := range deny {
+		rule, err := parseDestinationRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		acl.deny = append(acl.deny, rule)
+	}
+	return acl, nil
+}
+
+func matchAny(rules []destinationRule, host string, ip net.IP, port int) bool {
+	for _, rule := range rules {
+		if host != "" && rule.matchHost(host, port) {
+			return true
+		}
+		if ip != nil && rule.matchIP(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks a destination. host may be empty when only the resolved IP is
+// known, and ip may be nil before resolution; IP-literal hosts are checked as IPs.
+func (a *destinationACL) allowed(host string, ip net.IP, port int) bool {
+	if a == nil {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if literal := net.ParseIP(strings.Trim(host, "[]")); literal != nil {
+		host, ip = "", literal
+	}
+
+	if matchAny(a.deny, host, ip, port) {
+		return false
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	return matchAny(a.allow, host, ip, port)
+}
+
+// TunnelStats tracks connections passed through without interception
+type TunnelStats struct {
+	active    atomic.Int64
+	total     atomic.Int64
+	denied    atomic.Int64
+	failed    atomic.Int64
+	bytesUp   atomic.Int64 // client -> destination
+	bytesDown atomic.Int64 // destination -> client
+}
+
+// TunnelStatus is a point-in-time copy of TunnelStats for the status API
+type TunnelStatus struct {
+	ActiveTunnels int64 `json:"active_tunnels"`
+	TotalTunnels  int64 `json:"total_tunnels"`
+	Denied        int64 `json:"denied"`
+	Failed        int64 `json:"failed"`
+	BytesUp       int64 `json:"bytes_up"`
+	BytesDown     int64 `json:"bytes_down"`
+}
+
+// Snapshot returns the current counters
+func (s *TunnelStats) Snapshot() TunnelStatus {
+	if s == nil {
+		return TunnelStatus{}
+	}
+	return TunnelStatus{
+		ActiveTunnels: s.active.Load(),
+		TotalTunnels:  s.total.Load(),
+		Denied:        s.denied.Load(),
+		Failed:        s.failed.Load(),
+		BytesUp:       s.bytesUp.Load(),
+		BytesDown:     s.bytesDown.Load(),
+	}
+}
+
+// tunnelDialer dials non-intercepted destinations directly, enforcing the ACL
+// against both the requested hostname and every address it resolves to
+type tunnelDialer struct {
+	acl             *destinationACL
+	connectTimeout  time.Duration
+	udpIdleTimeout  time.Duration // SOCKS5 UDP ASSOCIATE
+	bindIdleTimeout time.Duration // SOCKS5 BIND
+	resolver        *resolver.Resolver
+	stats           *TunnelStats
+}
+
+func newTunnelDialer(cfg config.TunnelConfig, res *resolver.Resolver) (*tunnelDialer, error) {
+	acl, err := newDestinationACL(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel rule: %w", err)
+	}
+
+	timeout := 10 * time.Second
+	if cfg.ConnectTimeout != "" {
+		timeout, err = time.ParseDuration(cfg.ConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel connect_timeout: %w", err)
+		}
+	}
+	udpIdle := 2 * time.Minute
+	if cfg.UDPIdleTimeout != "" {
+		udpIdle, err = time.ParseDuration(cfg.UDPIdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel udp_idle_timeout: %w", err)
+		}
+	}
+	bindIdle := 2 * time.Minute
+	if cfg.BindIdleTimeout != "" {
+		bindIdle, err = time.ParseDuration(cfg.BindIdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel bind_idle_timeout: %w", err)
+		}
+	}
+
+	return &tunnelDialer{
+		acl:             acl,
+		connectTimeout:  timeout,
+		udpIdleTimeout:  udpIdle,
+		bindIdleTimeout: bindIdle,
+		resolver:        res,
+		stats:           &TunnelStats{},
+	}, nil
+}
+
+// allowedAddress checks a host:port destination against the ACL before resolution
+func (d *tunnelDialer) allowedAddress(address string) bool {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+	return d.acl.allowed(host, nil, port)
+}
+
+// Dial connects to address ("host:port") within the connect timeout
+func (d *tunnelDialer) Dial(ctx context.Context, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	if !d.acl.allowed(host, nil, port) {
+		d.stats.denied.Add(1)
+		return nil, fmt.Errorf("%w: %s", errDestinationDenied, address)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: d.connectTimeout,
+		// Re-check the resolved address so a permitted name cannot be used to reach a denied network
+		Control: func(network, resolved string, _ syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return err
+			}
+			if !d.acl.allowed("", net.ParseIP(ipStr), port) {
+				return fmt.Errorf("%w: %s resolves to %s", errDestinationDenied, host, ipStr)
+			}
+			return nil
+		},
+	}
+
+	conn, err := d.resolver.DialContext(ctx, dialer, "tcp", address)
+	if err != nil {
+		if errors.Is(err, errDestinationDenied) {
+			d.stats.denied.Add(1)
+		} else {
+			d.stats.failed.Add(1)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Relay copies data in both directions until both sides are done, half-closing
+// each direction as its source reaches EOF so request/response protocols that
+// rely on shutdown(SHUT_WR) keep working. When a direction fails instead, both
+// connections are closed. clientReader may wrap client to
+// replay bytes that were buffered before the tunnel was established.
+func (d *tunnelDialer) Relay(client io.Writer, clientReader io.Reader, target net.Conn) error {
+	d.stats.active.Add(1)
+	d.stats.total.Add(1)
+	defer d.stats.active.Add(-1)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- relayCounted(target, clientReader, &d.stats.bytesUp) }()
+	go func() { errCh <- relayCounted(client, target, &d.stats.bytesDown) }()
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		err := <-errCh
+		if err != nil && i == 0 {
+			// One direction failed rather than reaching EOF: stop the other,
+			// which could wait forever on a peer keeping its half open
+			target.Close()
+			closeRelayClient(client, clientReader)
+		}
+		if err != nil && !isIgnorableProxyError(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// closeRelayClient closes the client side of a relay, looking through the
+// bandwidth limiter callers may wrap around the connection
+func closeRelayClient(client io.Writer, clientReader io.Reader) {
+	if limited, ok := client.(*limitedWriter); ok {
+		client = limited.w
+	}
+	for _, side := range []interface{}{client, clientReader} {
+		if closer, ok := side.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// countingWriter adds every written byte to a shared counter
+type countingWriter struct {
+	w       io.Writer
+	counter *atomic.Int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+// relayCounted copies src to dst, counts bytes and half-closes dst when src is exhausted
+func relayCounted(dst io.Writer, src io.Reader, counter *atomic.Int64) error {
+	return proxyConn(&halfCloser{Writer: &countingWriter{w: dst, counter: counter}, dst: dst}, src)
+}
+
+// halfCloser forwards CloseWrite to the underlying destination
+type halfCloser struct {
+	io.Writer
+	dst io.Writer
+}
+
+func (h *halfCloser) CloseWrite() error {
+	if cw, ok := h.dst.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
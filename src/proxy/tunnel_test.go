@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+)
+
+func TestDestinationACL(t *testing.T) {
+	acl, err := newDestinationACL(
+		[]string{"example.com", "*.cdn.net", "10.0.0.0/8", "api.internal:443"},
+		[]string{"blocked.example.com", "10.1.0.0/16", "example.com:25"},
+	)
+	if err != nil {
+		t.Fatalf("newDestinationACL() error = %v", err)
+	}
+
+	tests := []struct {
+		host string
+		ip   string
+		port int
+		want bool
+	}{
+		{"example.com", "", 443, true},
+		{"www.example.com", "", 443, true},
+		{"evilexample.com", "", 443, false},
+		{"blocked.example.com", "", 443, false},
+		{"example.com", "", 25, false},
+		{"cdn.net", "", 443, false}, // wildcard matches subdomains only
+		{"img.cdn.net", "", 443, true},
+		{"api.internal", "", 443, true},
+		{"api.internal", "", 80, false},
+		{"10.2.3.4", "", 22, true},
+		{"10.1.2.3", "", 22, false},
+		{"", "10.1.2.3", 443, false}, // resolved address checked against CIDRs
+		{"192.168.1.1", "", 80, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s:%d", tt.host, tt.ip, tt.port), func(t *testing.T) {
+			if got := acl.allowed(tt.host, net.ParseIP(tt.ip), tt.port); got != tt.want {
+				t.Errorf("allowed(%q, %q, %d) = %v, want %v", tt.host, tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newDestinationACL([]string{"example.com:99999"}, nil); err == nil {
+		t.Error("invalid port should be rejected")
+	}
+}
+
+// startHalfCloseEchoServer accepts one connection, reads until the client
+// half-closes, then replies with the upper-cased payload and closes
+func startHalfCloseEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				conn.Write([]byte(strings.ToUpper(string(data))))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func startUnifiedServerForTest(t *testing.T, cfg *config.Config) (*UnifiedServer, string) {
+	t.Helper()
+
+	server, err := NewUnifiedServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewUnifiedServer() error = %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func sendConnect(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	return conn, br, resp
+}
+
+func TestForwardConnectDirectTunnel(t *testing.T) {
+	echoAddr := startHalfCloseEchoServer(t)
+	server, proxyAddr := startUnifiedServerForTest(t, &config.Config{ProxyMode: "all"})
+
+	conn, br, resp := sendConnect(t, proxyAddr, echoAddr)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("hello tunnel")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// The echo server only answers after seeing EOF, so this requires half-close propagation
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(reply) != "HELLO TUNNEL" {
+		t.Fatalf("reply = %q, want %q", reply, "HELLO TUNNEL")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && server.mitmProxy.TunnelStats().Snapshot().ActiveTunnels != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := server.mitmProxy.TunnelStats().Snapshot()
+	if stats.TotalTunnels != 1 || stats.BytesUp != int64(len("hello tunnel")) || stats.BytesDown != int64(len("HELLO TUNNEL")) {
+		t.Errorf("unexpected tunnel stats: %+v", stats)
+	}
+}
+
+func TestForwardConnectDeniedDestination(t *testing.T) {
+	echoAddr := startHalfCloseEchoServer(t)
+	server, proxyAddr := startUnifiedServerForTest(t, &config.Config{
+		ProxyMode: "all",
+		Tunnel:    config.TunnelConfig{Allow: []string{"*.example.com"}},
+	})
+
+	conn, _, resp := sendConnect(t, proxyAddr, echoAddr)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("CONNECT status = %d, want 403", resp.StatusCode)
+	}
+	if denied := server.mitmProxy.TunnelStats().Snapshot().Denied; denied != 1 {
+		t.Errorf("Denied = %d, want 1", denied)
+	}
+}
+
+func TestNewUnifiedServerRejectsInvalidTunnelRule(t *testing.T) {
+	_, err := NewUnifiedServer(&config.Config{Tunnel: config.TunnelConfig{Deny: []string{"host:0"}}}, nil, nil, nil, nil)
+	if err == nil {
+		t.Fatal("NewUnifiedServer() should reject invalid tunnel rules")
+	}
+}
+
+func TestForwardedRequestsDeniedDestination(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+
+	_, proxyAddr := startUnifiedServerForTest(t, &config.Config{
+		ProxyMode: "all",
+		Tunnel:    config.TunnelConfig{Deny: []string{"127.0.0.0/8", "::1/128"}},
+	})
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	forwardClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// localhost passes the check on the name and is refused once resolved
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		target := "http://" + net.JoinHostPort(host, port) + "/file"
+		for name, get := range map[string]func() (*http.Response, error){
+			"URL path": func() (*http.Response, error) { return http.Get("http://" + proxyAddr + "/" + target) },
+			"forward":  func() (*http.Response, error) { return forwardClient.Get(target) },
+		} {
+			resp, err := get()
+			if err != nil {
+				t.Fatalf("%s request for %s failed: %v", name, target, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden || string(body) != "Destination not allowed\n" {
+				t.Errorf("%s request for %s = %d %q, want 403", name, target, resp.StatusCode, body)
+			}
+		}
+	}
+	if hits.Load() != 0 {
+		t.Errorf("origin reached %d times", hits.Load())
+	}
+}
+
+func TestForwardedRequestsWithTunnellingDisabled(t *testing.T) {
+	mitm := NewMITMProxy(&config.Config{}, nil, nil, nil)
+	mitm.tunnel, mitm.tunnelErr = nil, errors.New("invalid tunnel rule")
+
+	w := httptest.NewRecorder()
+	mitm.HandleHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/file", nil))
+	if !strings.HasPrefix(w.Body.String(), "Tunnelling disabled") {
+		t.Fatalf("response = %d %q, want tunnelling disabled", w.Code, w.Body.String())
+	}
+}
+
+// failingWriter fails every write, like a client that reset its connection
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestRelayClosesBothSidesOnError(t *testing.T) {
+	tunnel, err := newTunnelDialer(config.TunnelConfig{}, nil)
+	if err != nil {
+		t.Fatalf("newTunnelDialer() error = %v", err)
+	}
+
+	// The target sends data and then keeps its connection open
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("response"))
+		io.Copy(io.Discard, conn)
+	}()
+	target, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer target.Close()
+
+	// The client never sends EOF, so only closing it ends the upload
+	clientReader, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- tunnel.Relay(failingWriter{}, clientReader, target) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Relay() = nil, want the write error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay() kept waiting after the download to the client failed")
+	}
+	if active := tunnel.stats.active.Load(); active != 0 {
+		t.Errorf("%d tunnels still counted as active", active)
+	}
+}
@@ -7,13 +7,18 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"html"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"mitmcdn/src/cache"
 	"mitmcdn/src/config"
@@ -34,12 +39,43 @@ type UnifiedServer struct {
 	reverseProxy  *HTTPReverseProxy
 	socks5Proxy   *SOCKS5Proxy
 	statusHandler *StatusHandler
+	onboarding    *OnboardingHandler
+	dnsServer     *DNSServer // nil unless [dns] is enabled
 	listener      net.Listener
 }
 
 // NewUnifiedServer creates a unified server that can handle multiple protocols
 func NewUnifiedServer(cfg *config.Config, cacheMgr *cache.Manager, sched *download.Scheduler, htmlPlugins *htmlplugin.Manager, db *gorm.DB) (*UnifiedServer, error) {
 	mitmProxy := NewMITMProxy(cfg, cacheMgr, sched, htmlPlugins)
+	if mitmProxy.tunnelErr != nil {
+		return nil, fmt.Errorf("invalid tunnel configuration: %w", mitmProxy.tunnelErr)
+	}
+	if mitmProxy.resolverErr != nil {
+		return nil, fmt.Errorf("invalid resolver configuration: %w", mitmProxy.resolverErr)
+	}
+	if mitmProxy.usersErr != nil {
+		return nil, fmt.Errorf("invalid users configuration: %w", mitmProxy.usersErr)
+	}
+	if mitmProxy.rulesErr != nil {
+		return nil, fmt.Errorf("invalid CDN rules: %w", mitmProxy.rulesErr)
+	}
+	if sched != nil {
+		sched.ConfigureRules(mitmProxy.rules)
+		sched.ConfigureStreaming(cfg.Streaming)
+		if err := sched.ConfigureDownloaders(cfg.Downloaders); err != nil {
+			return nil, fmt.Errorf("invalid downloaders: %w", err)
+		}
+		if htmlPlugins != nil {
+			sched.ConfigureRequestHook(htmlPlugins.RewriteRequest)
+		}
+	}
+	if sched != nil && mitmProxy.resolver != nil {
+		// Downloads must reach the real origin even when DNS points at us
+		sched.ConfigureDialContext(mitmProxy.resolver.DialFunc(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}))
+	}
+	if cfg.ProxyMode == "transparent" && !transparentSupported {
+		return nil, errTransparentUnsupported
+	}
 	reverseProxy := NewHTTPReverseProxy(cfg, cacheMgr, sched, mitmProxy, htmlPlugins)
 
 	var socks5Proxy *SOCKS5Proxy
@@ -51,10 +87,22 @@ func NewUnifiedServer(cfg *config.Config, cacheMgr *cache.Manager, sched *downlo
 		}
 	}
 
+	var dnsServer *DNSServer
+	if cfg.DNS.Enabled {
+		dnsServer, err = NewDNSServer(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DNS server: %w", err)
+		}
+	}
+
 	// Create status handler
 	var statusHandler *StatusHandler
 	if db != nil {
 		statusHandler = NewStatusHandler(db, cacheMgr, sched)
+		statusHandler.tunnelStats = mitmProxy.TunnelStats()
+		statusHandler.dnsServer = dnsServer
+		statusHandler.users = mitmProxy.users
+		statusHandler.socks5Stats = socks5Proxy.SessionStats()
 	}
 
 	return &UnifiedServer{
@@ -66,6 +114,8 @@ func NewUnifiedServer(cfg *config.Config, cacheMgr *cache.Manager, sched *downlo
 		reverseProxy:  reverseProxy,
 		socks5Proxy:   socks5Proxy,
 		statusHandler: statusHandler,
+		onboarding:    NewOnboardingHandler(cfg, mitmProxy),
+		dnsServer:     dnsServer,
 	}, nil
 }
 
@@ -73,6 +123,18 @@ func NewUnifiedServer(cfg *config.Config, cacheMgr *cache.Manager, sched *downlo
 func (s *UnifiedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
+	// Handle CA distribution and client onboarding (http://mitm.cdn/ or /mitmcdn/)
+	if isOnboardingRequest(r) {
+		s.onboarding.ServeHTTP(w, r)
+		return
+	}
+
+	// Handle proxy auto-config (PAC / WPAD)
+	if isPACRequest(r) {
+		servePAC(w, r, s.config)
+		return
+	}
+
 	// Handle status endpoints
 	if path == "/api/status" || path == "/api/status/" {
 		if s.statusHandler != nil {
@@ -92,16 +154,29 @@ func (s *UnifiedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Handle cached YouTube video endpoints
-	if strings.HasPrefix(path, "/cache/yt/") {
-		s.handleCacheYT(w, r, path)
-		return
+	// Cached video endpoints are only served to requests addressed to this
+	// server; proxied requests for /cache/ paths on other sites go through
+	if r.URL.Host == "" {
+		// Handle offline copies of cached HLS streams
+		if strings.HasPrefix(path, "/cache/hls/") {
+			s.handleCacheHLS(w, r, path)
+			return
+		}
+
+		// Handle cached embedded video endpoints (YouTube, Vimeo, ...)
+		if provider, ok := embedProvider(path); ok && s.mitmProxy.htmlPlugins.ServesEmbed(provider) {
+			s.handleCacheEmbed(w, r, path)
+			return
+		}
 	}
 
 	// Check if this is a reverse proxy request (URL path mode)
 	// Format: /https://target.com/file or /http://target.com/file
 	if strings.HasPrefix(path, "/http://") || strings.HasPrefix(path, "/https://") {
-		// This is a reverse proxy request
+		// This is a reverse proxy request, as much a proxy request as any other
+		if r = s.mitmProxy.authorize(w, r); r == nil {
+			return
+		}
 		s.reverseProxy.ServeHTTP(w, r)
 		return
 	}
@@ -178,20 +253,10 @@ func (s *UnifiedServer) handleConnection(conn net.Conn) {
 	case "http", "https":
 		// Handle HTTP/HTTPS (proxy or reverse proxy)
 		if protocol == "https" {
-			// For HTTPS, we need to do TLS handshake first
-			cert, err := GenerateCertificate("localhost")
-			if err == nil {
-				tlsConfig := &tls.Config{
-					Certificates: []tls.Certificate{*cert},
-					GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-						return GenerateCertificate(clientHello.ServerName)
-					},
-				}
-				// Wrap connection with TLS
-				tlsConn := tls.Server(peekConn, tlsConfig)
-				s.handleHTTPConnection(tlsConn)
+			if s.config.SNIRouting.Enabled {
+				s.serveTLSFront(peekConn)
 			} else {
-				conn.Close()
+				s.serveLocalTLS(peekConn)
 			}
 		} else {
 			s.handleHTTPConnection(peekConn)
@@ -201,6 +266,29 @@ func (s *UnifiedServer) handleConnection(conn net.Conn) {
 	}
 }
 
+// serveLocalTLS terminates TLS with a generated certificate for the requested
+// name and serves the connection as proxy or reverse-proxy traffic
+func (s *UnifiedServer) serveLocalTLS(conn net.Conn) {
+	cert, err := s.mitmProxy.getCertificate("localhost")
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if clientHello.ServerName == "" {
+				return cert, nil
+			}
+			return s.mitmProxy.getCertificate(clientHello.ServerName)
+		},
+	}
+	// Wrap connection with TLS
+	tlsConn := tls.Server(conn, tlsConfig)
+	s.handleHTTPConnection(tlsConn)
+}
+
 // peekConn wraps a connection to allow peeking without consuming
 type peekConn struct {
 	net.Conn
@@ -210,19 +298,27 @@ type peekConn struct {
 
 func (p *peekConn) Read(b []byte) (int, error) {
 	if !p.peeked && len(p.buffer) > 0 {
-		// Return peeked data first
+		// Return peeked data first, across as many reads as it takes
 		n := copy(b, p.buffer)
 		if n < len(p.buffer) {
 			p.buffer = p.buffer[n:]
 		} else {
 			p.buffer = nil
+			p.peeked = true
 		}
-		p.peeked = true
 		return n, nil
 	}
 	return p.Conn.Read(b)
 }
 
+// CloseWrite half-closes the underlying connection when supported
+func (p *peekConn) CloseWrite() error {
+	if cw, ok := p.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 // handleHTTPConnection handles HTTP connection with keep-alive support
 func (s *UnifiedServer) handleHTTPConnection(conn net.Conn) {
 	br := bufio.NewReader(conn)
@@ -233,6 +329,7 @@ func (s *UnifiedServer) handleHTTPConnection(conn net.Conn) {
 			conn.Close()
 			return
 		}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, conn.LocalAddr()))
 
 		w := &responseWriter{
 			conn:   conn,
@@ -346,13 +443,36 @@ func (w *responseWriter) Close() error {
 // ListenAndServe starts the unified server on the specified address
 // It handles HTTP Proxy, HTTP Reverse Proxy, HTTPS Server, and SOCKS5 on the same port
 func (s *UnifiedServer) ListenAndServe(addr string) error {
+	// Transparent mode accepts connections redirected by iptables/nftables
+	transparent := s.config.ProxyMode == "transparent"
+
 	// Create listener
-	listener, err := net.Listen("tcp", addr)
+	var listener net.Listener
+	var err error
+	if transparent {
+		listener, err = listenTransparent(addr)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 	s.listener = listener
 
+	if s.dnsServer != nil {
+		// Bind before serving in the background, so Shutdown sees the sockets
+		log.Printf("Starting DNS server on %s", s.config.DNS.ListenAddress)
+		if err := s.dnsServer.Listen(s.config.DNS.ListenAddress); err != nil {
+			listener.Close()
+			return err
+		}
+		go func() {
+			if err := s.dnsServer.Serve(); err != nil {
+				log.Printf("DNS server stopped: %v", err)
+			}
+		}()
+	}
+
 	// Start accepting connections with protocol detection
 	for {
 		conn, err := listener.Accept()
@@ -360,32 +480,53 @@ func (s *UnifiedServer) ListenAndServe(addr string) error {
 			return err
 		}
 
-		go s.handleConnection(conn)
+		if transparent {
+			go s.handleTransparentConnection(conn)
+		} else {
+			go s.handleConnection(conn)
+		}
 	}
 }
 
 // Shutdown gracefully shuts down the server
 func (s *UnifiedServer) Shutdown(ctx context.Context) error {
+	if s.dnsServer != nil {
+		s.dnsServer.Shutdown()
+	}
 	if s.listener != nil {
 		return s.listener.Close()
 	}
 	return nil
 }
 
-var ytVideoIDRegex = regexp.MustCompile(`^/cache/yt/([A-Za-z0-9_-]{6,})/(player|video)$`)
+var embedPathRegex = regexp.MustCompile(`^/cache/([a-z0-9_-]+)/([A-Za-z0-9_-]+)/(player|video|thumbnail|subtitles/([A-Za-z0-9_.@-]+))$`)
 
-// handleCacheYT serves cached YouTube video files and an embedded player page.
-func (s *UnifiedServer) handleCacheYT(w http.ResponseWriter, r *http.Request, path string) {
-	m := ytVideoIDRegex.FindStringSubmatch(path)
+// embedProvider returns the <provider> of a /cache/<provider>/... path
+func embedProvider(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, "/cache/")
+	if !ok {
+		return "", false
+	}
+	provider, _, ok := strings.Cut(rest, "/")
+	return provider, ok && provider != ""
+}
+
+// handleCacheEmbed serves videos cached by embed plugins under
+// /cache/<provider>/<id>/: the video file, its thumbnail and subtitles, and
+// an embedded player page.
+func (s *UnifiedServer) handleCacheEmbed(w http.ResponseWriter, r *http.Request, path string) {
+	m := embedPathRegex.FindStringSubmatch(path)
 	if m == nil {
 		http.NotFound(w, r)
 		return
 	}
-	videoID := m[1]
-	action := m[2]
+	provider := m[1]
+	videoID := m[2]
+	action := m[3]
+	prefix := fmt.Sprintf("/cache/%s/%s", provider, videoID)
 
 	// Look up the cache entry for this video.
-	cacheURL := fmt.Sprintf("yt-dlp://%s", videoID)
+	cacheURL := download.EmbedCacheURL(provider, videoID)
 	hashBytes := sha256.Sum256([]byte(cacheURL))
 	fileHash := hex.EncodeToString(hashBytes[:])
 
@@ -395,11 +536,36 @@ func (s *UnifiedServer) handleCacheYT(w http.ResponseWriter, r *http.Request, pa
 		return
 	}
 
-	switch action {
-	case "video":
+	meta, err := download.ReadMediaMetadata(&file)
+	if err != nil {
+		log.Printf("Ignoring invalid metadata for %s: %v", cacheURL, err)
+	}
+	if meta == nil {
+		meta = &download.MediaMetadata{}
+	}
+
+	switch {
+	case action == "video":
 		s.serveCachedVideo(w, r, &file)
-	case "player":
-		s.serveVideoPlayer(w, r, videoID, &file)
+	case action == "player":
+		s.serveVideoPlayer(w, r, prefix, videoID, &file, meta)
+	case action == "thumbnail":
+		if meta.Thumbnail == "" {
+			http.Error(w, "Thumbnail not cached", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, meta.Thumbnail)
+	default:
+		for _, subtitle := range meta.Subtitles {
+			if subtitle.Lang == m[4] {
+				if strings.EqualFold(filepath.Ext(subtitle.Path), ".vtt") {
+					w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+				}
+				http.ServeFile(w, r, subtitle.Path)
+				return
+			}
+		}
+		http.Error(w, "Subtitle not cached", http.StatusNotFound)
 	}
 }
 
@@ -465,9 +631,10 @@ func (s *UnifiedServer) serveCachedVideo(w http.ResponseWriter, r *http.Request,
 	io.CopyN(w, f, length)
 }
 
-// serveVideoPlayer returns a minimal HTML5 video player page.
-func (s *UnifiedServer) serveVideoPlayer(w http.ResponseWriter, r *http.Request, videoID string, file *database.File) {
-	videoSrc := fmt.Sprintf("/cache/yt/%s/video", videoID)
+// serveVideoPlayer returns a minimal HTML5 video player page, with the
+// video's title, thumbnail and WebVTT subtitles when yt-dlp saved them.
+func (s *UnifiedServer) serveVideoPlayer(w http.ResponseWriter, r *http.Request, prefix, videoID string, file *database.File, meta *download.MediaMetadata) {
+	videoSrc := prefix + "/video"
 
 	var statusNote string
 	switch file.DownloadStatus {
@@ -484,16 +651,37 @@ func (s *UnifiedServer) serveVideoPlayer(w http.ResponseWriter, r *http.Request,
 		ct = "video/mp4"
 	}
 
-	html := fmt.Sprintf(`<!DOCTYPE html>
+	title := videoID
+	if meta.Title != "" {
+		title = meta.Title
+	}
+	var poster string
+	if meta.Thumbnail != "" {
+		poster = fmt.Sprintf(` poster="%s/thumbnail"`, prefix)
+	}
+	var tracks strings.Builder
+	for _, subtitle := range meta.Subtitles {
+		if !strings.EqualFold(filepath.Ext(subtitle.Path), ".vtt") {
+			continue // browsers only load WebVTT tracks
+		}
+		label := subtitle.Name
+		if label == "" {
+			label = subtitle.Lang
+		}
+		fmt.Fprintf(&tracks, `<track kind="subtitles" src="%s/subtitles/%s" srclang="%s" label="%s">`,
+			prefix, url.PathEscape(subtitle.Lang), html.EscapeString(subtitle.Lang), html.EscapeString(label))
+	}
+
+	page := fmt.Sprintf(`<!DOCTYPE html>
 <html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
 <title>%s - Cached Video</title>
 <style>*{margin:0;padding:0;box-sizing:border-box}html,body{width:100%%;height:100%%;background:#000;overflow:hidden}
 video{width:100%%;height:100%%;object-fit:contain}</style></head>
-<body>%s<video controls autoplay><source src="%s" type="%s">Your browser does not support the video tag.</video></body></html>`,
-		videoID, statusNote, videoSrc, ct)
+<body>%s<video controls autoplay%s><source src="%s" type="%s">%sYour browser does not support the video tag.</video></body></html>`,
+		html.EscapeString(title), statusNote, poster, videoSrc, ct, tracks.String())
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Content-Length", strconv.Itoa(len(html)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(page)))
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(html))
+	w.Write([]byte(page))
 }
@@ -0,0 +1,205 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"mitmcdn/src/config"
+)
+
+// Resolver resolves origin hostnames, consulting static host overrides first
+// and then the configured upstream DNS server (or the system resolver)
+type Resolver struct {
+	hosts         map[string]net.IP
+	resolver      *net.Resolver
+	transport     Transport // nil when the system resolver is used
+	fallbackDelay time.Duration
+}
+
+// NewResolver creates a resolver from the [resolver] config section.
+// It returns nil for an empty section; a nil Resolver uses the system resolver.
+func NewResolver(cfg config.ResolverConfig) (*Resolver, error) {
+	if cfg.Upstream == "" && len(cfg.Hosts) == 0 {
+		return nil, nil
+	}
+
+	r := &Resolver{
+		hosts:         make(map[string]net.IP, len(cfg.Hosts)),
+		resolver:      net.DefaultResolver,
+		fallbackDelay: 300 * time.Millisecond,
+	}
+	if cfg.FallbackDelay != "" {
+		delay, err := time.ParseDuration(cfg.FallbackDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver fallback_delay: %w", err)
+		}
+		r.fallbackDelay = delay
+	}
+
+	for host, addr := range cfg.Hosts {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q for host %s", addr, host)
+		}
+		r.hosts[normalizeHost(host)] = ip
+	}
+
+	if cfg.Upstream != "" {
+		transport, err := NewTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.transport = transport
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return &exchangeConn{ctx: ctx, network: network, transport: transport}, nil
+			},
+		}
+	}
+
+	return r, nil
+}
+
+// Exchange sends a raw DNS query to the configured upstream
+func (r *Resolver) Exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	if r == nil || r.transport == nil {
+		return nil, errors.New("no upstream DNS server configured")
+	}
+	return r.transport.Exchange(ctx, network, query)
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
+
+// LookupIP returns the addresses for host. IP literals are returned as-is.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r == nil {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	if ip, ok := r.hosts[normalizeHost(host)]; ok {
+		return []net.IP{ip}, nil
+	}
+	return r.resolver.LookupIP(ctx, "ip", host)
+}
+
+// DialContext resolves the host in address and dials its addresses with
+// dialer, racing them happy-eyeballs style (RFC 8305): address families are
+// interleaved and the next address is tried after the fallback delay or as
+// soon as the previous attempt fails. A nil Resolver dials through the system
+// resolver.
+func (r *Resolver) DialContext(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	if r == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return dialParallel(ctx, dialer, network, interleaveFamilies(ips), port, r.fallbackDelay)
+}
+
+// interleaveFamilies reorders ips to alternate address families, starting with
+// the family of the first (preferred) address
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var primary, secondary []net.IP
+	firstIsV4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIsV4 {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			ordered = append(ordered, primary[i])
+		}
+		if i < len(secondary) {
+			ordered = append(ordered, secondary[i])
+		}
+	}
+	return ordered
+}
+
+// dialParallel starts a connection attempt to each IP in turn, fallbackDelay
+// apart, and returns the first that succeeds; the others are cancelled
+func dialParallel(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string, fallbackDelay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(ips))
+	dial := func(ip net.IP) {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		results <- dialResult{conn, err}
+	}
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	go dial(ips[0])
+	started, pending := 1, 1
+	var errs []error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Late winners are closed once the remaining attempts report back
+				go func(remaining int) {
+					for i := 0; i < remaining; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			errs = append(errs, result.err)
+			if started < len(ips) && ctx.Err() == nil {
+				go dial(ips[started])
+				started++
+				pending++
+				timer.Reset(fallbackDelay)
+			}
+		case <-timer.C:
+			if started < len(ips) {
+				go dial(ips[started])
+				started++
+				pending++
+				timer.Reset(fallbackDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// DialFunc returns a DialContext function suitable for http.Transport
+func (r *Resolver) DialFunc(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return r.DialContext(ctx, dialer, network, address)
+	}
+}
@@ -0,0 +1,286 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mitmcdn/src/config"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSResponse answers an A query with ip, or returns nil for a malformed query
+func fakeDNSResponse(query []byte, ip net.IP) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	if question.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, a)
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// startFakeDNSServer answers every A query with ip over UDP
+func startFakeDNSServer(t *testing.T, ip net.IP) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if msg := fakeDNSResponse(buf[:n], ip); msg != nil {
+				conn.WriteTo(msg, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// writeServerCA saves the certificate of a TLS test server for ca_cert_path
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	return path
+}
+
+// lookupExpecting resolves name through r and checks ip is among the answers
+func lookupExpecting(t *testing.T, r *Resolver, name string, ip net.IP) {
+	t.Helper()
+
+	ips, err := r.LookupIP(context.Background(), name)
+	if err != nil {
+		t.Fatalf("LookupIP() error = %v", err)
+	}
+	for _, got := range ips {
+		if got.Equal(ip) {
+			return
+		}
+	}
+	t.Fatalf("LookupIP() = %v, want %v from upstream", ips, ip)
+}
+
+func TestNewResolverEmptyConfig(t *testing.T) {
+	r, err := NewResolver(config.ResolverConfig{})
+	if err != nil || r != nil {
+		t.Fatalf("NewResolver(empty) = %v, %v; want nil, nil", r, err)
+	}
+
+	ips, err := r.LookupIP(context.Background(), "127.0.0.1")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("nil resolver LookupIP(literal) = %v, %v", ips, err)
+	}
+}
+
+func TestResolverStaticHosts(t *testing.T) {
+	r, err := NewResolver(config.ResolverConfig{Hosts: map[string]string{"CDN.Example.com": "203.0.113.10"}})
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+
+	ips, err := r.LookupIP(context.Background(), "cdn.example.com.")
+	if err != nil {
+		t.Fatalf("LookupIP() error = %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("203.0.113.10")) {
+		t.Fatalf("LookupIP() = %v, want 203.0.113.10", ips)
+	}
+
+	if _, err := NewResolver(config.ResolverConfig{Hosts: map[string]string{"cdn.example.com": "not-an-ip"}}); err == nil {
+		t.Error("invalid static host IP should be rejected")
+	}
+}
+
+func TestResolverUpstream(t *testing.T) {
+	upstream := startFakeDNSServer(t, net.ParseIP("198.51.100.7"))
+	r, err := NewResolver(config.ResolverConfig{Upstream: upstream})
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	lookupExpecting(t, r, "origin.example.net", net.ParseIP("198.51.100.7"))
+}
+
+func TestResolverDNSOverTLS(t *testing.T) {
+	// Borrow the test server's certificate for a raw DoT listener
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	var connections atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := ReadStreamMessage(conn)
+					if err != nil {
+						return
+					}
+					if WriteStreamMessage(conn, fakeDNSResponse(query, net.ParseIP("198.51.100.8"))) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	r, err := NewResolver(config.ResolverConfig{
+		Upstream:   "tls://" + listener.Addr().String(),
+		CACertPath: writeServerCA(t, certServer),
+	})
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	lookupExpecting(t, r, "origin.example.net", net.ParseIP("198.51.100.8"))
+	lookupExpecting(t, r, "other.example.net", net.ParseIP("198.51.100.8"))
+	// A and AAAA are queried in parallel, so at most two connections are needed
+	if n := connections.Load(); n > 2 {
+		t.Errorf("DoT connections = %d, want idle connections reused", n)
+	}
+
+	// Without the CA the server certificate is rejected
+	untrusted, err := NewResolver(config.ResolverConfig{Upstream: "tls://" + listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	if _, err := untrusted.LookupIP(context.Background(), "origin.example.net"); err == nil {
+		t.Error("lookup through an untrusted DoT server should fail")
+	}
+}
+
+func TestResolverDNSOverHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if len(query) < 2 || query[0] != 0 || query[1] != 0 {
+			http.Error(w, "query ID should be 0", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(fakeDNSResponse(query, net.ParseIP("198.51.100.9")))
+	}))
+	defer server.Close()
+
+	r, err := NewResolver(config.ResolverConfig{
+		Upstream:   server.URL,
+		CACertPath: writeServerCA(t, server),
+	})
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	lookupExpecting(t, r, "origin.example.net", net.ParseIP("198.51.100.9"))
+}
+
+func TestNewTransportRejectsUnknownScheme(t *testing.T) {
+	if _, err := NewTransport(config.ResolverConfig{Upstream: "quic://1.1.1.1"}); err == nil {
+		t.Error("unsupported scheme should be rejected")
+	}
+	if _, err := NewTransport(config.ResolverConfig{Upstream: "https://"}); err == nil {
+		t.Error("DoH upstream without a host should be rejected")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3"),
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+
+	got := interleaveFamilies(ips)
+	for i, ip := range got {
+		if ip.String() != want[i] {
+			t.Fatalf("interleaveFamilies() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestResolverDialFallsBackAcrossAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// 127.0.0.2 refuses the port; 192.0.2.1 (TEST-NET-1) never answers
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+	start := time.Now()
+	conn, err := dialParallel(context.Background(), &net.Dialer{Timeout: 5 * time.Second}, "tcp", ips, port, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("dialParallel() error = %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != listener.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, listener.Addr())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fallback took %v", elapsed)
+	}
+
+	if _, err := dialParallel(context.Background(), &net.Dialer{Timeout: time.Second}, "tcp", ips[1:2], port, 50*time.Millisecond); err == nil {
+		t.Error("dialing only a refusing address should fail")
+	}
+}
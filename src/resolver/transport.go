@@ -0,0 +1,426 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mitmcdn/src/config"
+)
+
+// maxMessageSize bounds a DNS message read from an upstream
+const maxMessageSize = 65535
+
+// Transport sends one DNS message to an upstream server and returns the response
+type Transport interface {
+	// Exchange sends query and returns the response. network is "udp" or
+	// "tcp" and only matters for plain DNS; DoT and DoH use their own transport.
+	Exchange(ctx context.Context, network string, query []byte) ([]byte, error)
+}
+
+// NewTransport creates the transport for cfg.Upstream:
+//
+//	1.1.1.1, 1.1.1.1:53, udp://1.1.1.1  plain DNS over the caller's network
+//	tcp://1.1.1.1                       plain DNS, always over TCP
+//	tls://1.1.1.1, tls://dns.example    DNS over TLS (RFC 7858), port 853
+//	https://1.1.1.1/dns-query           DNS over HTTPS (RFC 8484)
+//
+// Upstream hostnames are resolved through cfg.Hosts, then the system resolver.
+func NewTransport(cfg config.ResolverConfig) (Transport, error) {
+	if cfg.Upstream == "" {
+		return nil, errors.New("no upstream DNS server configured")
+	}
+	timeout := 5 * time.Second
+	if cfg.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid resolver timeout: %w", err)
+		}
+	}
+
+	scheme, rest := "", cfg.Upstream
+	if i := strings.Index(cfg.Upstream, "://"); i >= 0 {
+		scheme, rest = strings.ToLower(cfg.Upstream[:i]), cfg.Upstream[i+3:]
+	}
+
+	switch scheme {
+	case "", "udp", "tcp":
+		addr, err := withDefaultPort(rest, "53")
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream DNS server %q: %w", cfg.Upstream, err)
+		}
+		return &plainTransport{addr: addr, tcpOnly: scheme == "tcp", timeout: timeout}, nil
+
+	case "tls":
+		addr, err := withDefaultPort(rest, "853")
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream DNS server %q: %w", cfg.Upstream, err)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig, err := upstreamTLSConfig(cfg, host)
+		if err != nil {
+			return nil, err
+		}
+		return &dotTransport{
+			addr:      addr,
+			dial:      bootstrapDialer(cfg.Hosts, timeout),
+			tlsConfig: tlsConfig,
+			timeout:   timeout,
+		}, nil
+
+	case "https":
+		u, err := url.Parse(cfg.Upstream)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream DNS server %q", cfg.Upstream)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		tlsConfig, err := upstreamTLSConfig(cfg, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		return &dohTransport{
+			url: u.String(),
+			client: &http.Client{
+				Timeout: timeout,
+				Transport: &http.Transport{
+					DialContext:         bootstrapDialer(cfg.Hosts, timeout),
+					TLSClientConfig:     tlsConfig,
+					ForceAttemptHTTP2:   true,
+					MaxIdleConnsPerHost: 4,
+					IdleConnTimeout:     90 * time.Second,
+				},
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream DNS scheme %q", scheme)
+}
+
+func withDefaultPort(addr, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && host == "" {
+		err = errors.New("missing host")
+	}
+	return addr, err
+}
+
+// upstreamTLSConfig verifies the upstream as cfg.ServerName (or host), trusting
+// the system roots plus cfg.CACertPath
+func upstreamTLSConfig(cfg config.ResolverConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName, MinVersion: tls.VersionTLS12}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if cfg.CACertPath != "" {
+		pemData, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read resolver ca_cert_path: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// bootstrapDialer dials an upstream DNS server, looking its name up in hosts
+// before falling back to the system resolver
+func bootstrapDialer(hosts map[string]string, timeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(address); err == nil {
+			for name, ip := range hosts {
+				if normalizeHost(name) == normalizeHost(host) {
+					address = net.JoinHostPort(strings.TrimSpace(ip), port)
+					break
+				}
+			}
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// ReadStreamMessage reads one length-prefixed DNS message (RFC 1035 4.2.2)
+func ReadStreamMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteStreamMessage writes msg with its two-byte length prefix
+func WriteStreamMessage(w io.Writer, msg []byte) error {
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	_, err := w.Write(framed)
+	return err
+}
+
+// plainTransport speaks unencrypted DNS over UDP or TCP
+type plainTransport struct {
+	addr    string
+	tcpOnly bool
+	timeout time.Duration
+}
+
+func (t *plainTransport) Exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	if t.tcpOnly {
+		network = "tcp"
+	}
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, network, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(exchangeDeadline(ctx, t.timeout))
+
+	if network == "tcp" {
+		if err := WriteStreamMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return ReadStreamMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams that do not answer this query
+		if n >= 2 && len(query) >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// maxIdleDoTConns bounds the DoT connections kept open for reuse
+const maxIdleDoTConns = 4
+
+// dotTransport speaks DNS over TLS, reusing idle connections
+type dotTransport struct {
+	addr      string
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	idle []*tls.Conn
+}
+
+func (t *dotTransport) Exchange(ctx context.Context, _ string, query []byte) ([]byte, error) {
+	var conn *tls.Conn
+	t.mu.Lock()
+	if n := len(t.idle); n > 0 {
+		conn, t.idle = t.idle[n-1], t.idle[:n-1]
+	}
+	t.mu.Unlock()
+
+	if conn != nil {
+		if response, err := t.exchangeOn(ctx, conn, query); err == nil {
+			return response, nil
+		}
+		// The server may have closed the idle connection; retry on a fresh one
+	}
+
+	rawConn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn = tls.Client(rawConn, t.tlsConfig)
+	conn.SetDeadline(exchangeDeadline(ctx, t.timeout))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("DoT handshake with %s failed: %w", t.addr, err)
+	}
+	return t.exchangeOn(ctx, conn, query)
+}
+
+// exchangeOn sends query on conn and returns conn to the idle pool on success
+func (t *dotTransport) exchangeOn(ctx context.Context, conn *tls.Conn, query []byte) ([]byte, error) {
+	conn.SetDeadline(exchangeDeadline(ctx, t.timeout))
+	if err := WriteStreamMessage(conn, query); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response, err := ReadStreamMessage(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	t.mu.Lock()
+	if len(t.idle) < maxIdleDoTConns {
+		t.idle, conn = append(t.idle, conn), nil
+	}
+	t.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return response, nil
+}
+
+// dohTransport speaks DNS over HTTPS using POST with application/dns-message
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *dohTransport) Exchange(ctx context.Context, _ string, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("DNS query too short")
+	}
+	// RFC 8484 asks for ID 0 so responses are cacheable; the caller's ID is restored below
+	body := append([]byte(nil), query...)
+	body[0], body[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 2 || len(response) > maxMessageSize {
+		return nil, fmt.Errorf("invalid DoH response of %d bytes", len(response))
+	}
+	response[0], response[1] = query[0], query[1]
+	return response, nil
+}
+
+// exchangeDeadline returns the earlier of the context deadline and now+timeout
+func exchangeDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// exchangeConn lets net.Resolver use a Transport: it is a stream connection
+// that collects the length-prefixed query written by the resolver and answers
+// it on Read. The network the resolver asked for is passed to the transport,
+// so truncated UDP answers are still retried over TCP.
+type exchangeConn struct {
+	ctx       context.Context
+	network   string
+	transport Transport
+
+	mu       sync.Mutex
+	query    bytes.Buffer
+	response bytes.Reader
+	deadline time.Time
+	closed   bool
+}
+
+func (c *exchangeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.query.Write(b)
+}
+
+func (c *exchangeConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	if c.response.Len() == 0 {
+		query, err := ReadStreamMessage(&c.query)
+		if err != nil {
+			return 0, err
+		}
+		ctx := c.ctx
+		if !c.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+			defer cancel()
+		}
+		response, err := c.transport.Exchange(ctx, c.network, query)
+		if err != nil {
+			return 0, err
+		}
+		var framed bytes.Buffer
+		WriteStreamMessage(&framed, response)
+		c.response.Reset(framed.Bytes())
+	}
+	return c.response.Read(b)
+}
+
+func (c *exchangeConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *exchangeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *exchangeConn) SetReadDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *exchangeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *exchangeConn) LocalAddr() net.Addr { return exchangeAddr(c.network) }
+
+func (c *exchangeConn) RemoteAddr() net.Addr { return exchangeAddr(c.network) }
+
+// exchangeAddr is the placeholder address of an exchangeConn
+type exchangeAddr string
+
+func (a exchangeAddr) Network() string { return string(a) }
+
+func (a exchangeAddr) String() string { return "dns-transport" }